@@ -15,10 +15,12 @@ func (v *Var) stmt()    {}
 func (v *Var) Pos() int { return v.Line }
 
 type Function struct {
-	Line   int
-	Name   *token.Token
-	Params []*token.Token
-	Body   *Block
+	Line     int
+	Name     *token.Token
+	Params   []*token.Token
+	Defaults []Expr       // can be nil; otherwise one per param, nil for params without a default
+	Rest     *token.Token // can be nil; collects the extra arguments
+	Body     *Block
 }
 
 func (f *Function) node()    {}
@@ -30,8 +32,42 @@ type Class struct {
 	Name       *token.Token
 	Methods    []*Function
 	SuperClass *Variable
+	Statics    []*Function // can be nil; called on the class, without this
+	Getters    []*Function // can be nil; called when the property is read, no params
+	Setters    []*Function // can be nil; called when the property is set, one param
+	Traits     []*Variable // can be nil; traits after with, in declaration order
 }
 
 func (c *Class) node()    {}
 func (c *Class) stmt()    {}
 func (c *Class) Pos() int { return c.Line }
+
+// Trait is a set of methods that classes gain by listing it after with
+type Trait struct {
+	Line    int
+	Name    *token.Token
+	Methods []*Function
+}
+
+func (t *Trait) node()    {}
+func (t *Trait) stmt()    {}
+func (t *Trait) Pos() int { return t.Line }
+
+type Import struct {
+	Line int
+	Path string
+	Name *token.Token
+}
+
+func (i *Import) node()    {}
+func (i *Import) stmt()    {}
+func (i *Import) Pos() int { return i.Line }
+
+type Export struct {
+	Line        int
+	Declaration Stmt
+}
+
+func (e *Export) node()    {}
+func (e *Export) stmt()    {}
+func (e *Export) Pos() int { return e.Line }
@@ -65,6 +65,16 @@ func (g *Get) node()    {}
 func (g *Get) expr()    {}
 func (g *Get) Pos() int { return g.Line }
 
+type Index struct {
+	Line   int
+	Object Expr
+	Index  Expr
+}
+
+func (i *Index) node()    {}
+func (i *Index) expr()    {}
+func (i *Index) Pos() int { return i.Line }
+
 type Call struct {
 	Line      int
 	Callee    Expr
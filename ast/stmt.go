@@ -1,5 +1,7 @@
 package ast
 
+import "stmt/token"
+
 type Print struct {
 	Line       int
 	Expression Expr
@@ -72,3 +74,24 @@ type ExpressionStatement struct {
 func (e *ExpressionStatement) node()    {}
 func (e *ExpressionStatement) stmt()    {}
 func (e *ExpressionStatement) Pos() int { return e.Line }
+
+type Throw struct {
+	Line       int
+	Expression Expr
+}
+
+func (t *Throw) node()    {}
+func (t *Throw) stmt()    {}
+func (t *Throw) Pos() int { return t.Line }
+
+type Try struct {
+	Line        int
+	Body        *Block
+	CatchName   *token.Token // can be nil when there is no catch clause
+	CatchBody   *Block       // can be nil
+	FinallyBody *Block       // can be nil
+}
+
+func (t *Try) node()    {}
+func (t *Try) stmt()    {}
+func (t *Try) Pos() int { return t.Line }
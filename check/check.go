@@ -0,0 +1,326 @@
+package check
+
+import (
+	"errors"
+	"fmt"
+	"stmt/ast"
+	"stmt/token"
+	"strings"
+)
+
+var (
+	ErrReturnAtTopLevel       = errors.New("can't return from top-level code")
+	ErrThisOutsideClass       = errors.New("can't use 'this' outside of a class")
+	ErrSuperOutsideClass      = errors.New("can't use 'super' outside of a class")
+	ErrSuperWithoutSuperclass = errors.New("can't use 'super' in a class with no superclass")
+	ErrBreakOutsideLoop       = errors.New("can't use 'break' outside of a loop")
+	ErrContinueOutsideLoop    = errors.New("can't use 'continue' outside of a loop")
+	ErrInheritFromSelf        = errors.New("a class can't inherit from itself")
+	ErrExportNotTopLevel      = errors.New("export must be at the top level of a module")
+	ErrReturnFromInit         = errors.New("can't return a value from an initializer")
+	ErrThisInStatic           = errors.New("can't use 'this' in a static method")
+	ErrSuperInStatic          = errors.New("can't use 'super' in a static method")
+	ErrSuperInTrait           = errors.New("can't use 'super' in a trait")
+	ErrAmbiguousTraitMethod   = errors.New("method is provided by more than one trait")
+	ErrPrivateOutsideClass    = errors.New("can't use a private name outside of a class")
+	ErrUndeclaredPrivate      = errors.New("private name is not declared in the enclosing class")
+)
+
+// Error 是一条带行号的语义错误
+type Error struct {
+	Err  error
+	Line int
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Errors 是一次检查发现的全部错误，按出现的顺序排列
+type Errors []*Error
+
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+func (e Errors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
+
+// classKind 表示当前代码所在的类
+type classKind int
+
+const (
+	classNone classKind = iota
+	classPlain
+	classSub   // 有父类的类
+	classTrait // trait 的方法有 this，但没有父类
+)
+
+type checker struct {
+	errs      Errors
+	functions int // 所在函数的嵌套层数
+	loops     int // 所在函数中循环的嵌套层数
+	blocks    int // 顶层之下代码块的嵌套层数
+	class     classKind
+	init      bool                  // 是否位于类的 init 方法中，不包括其中声明的函数
+	static    bool                  // 是否位于类的 static 方法中，包括其中声明的函数
+	traits    map[string]*ast.Trait // 已声明的 trait，用于检查类组合的 trait 之间的方法冲突
+	privates  *privates             // 所在的类体中的私有名字，不在类中时为 nil
+}
+
+// privates 记录一个类体中声明和使用的私有名字。私有方法和被赋值的私有字段是声明，
+// 读取私有属性是使用，类体结束时每个使用的名字都必须在这个类体中声明过
+type privates struct {
+	declared map[string]bool
+	used     []*token.Token
+}
+
+// private 判断属性名 name 是否是私有名字，是时记录它。类体中的私有名字已被解析器改写为 类名@编号#name，
+// 仍以 # 开头的私有名字不在类中
+func (c *checker) private(name *token.Token, declare bool) {
+	if name.TokenType != token.PRIVATE_IDENTIFIER {
+		return
+	}
+	if strings.HasPrefix(name.Lexeme, "#") || c.privates == nil {
+		c.report(ErrPrivateOutsideClass, name.Line)
+		return
+	}
+	if declare {
+		c.privates.declared[name.Lexeme] = true
+		return
+	}
+	c.privates.used = append(c.privates.used, name)
+}
+
+// Check 在执行前遍历一次语法树，返回发现的全部语义错误，没有错误时返回 nil。
+// 返回的错误类型为 Errors，可以用 errors.Is 判断是否包含某个错误。
+func Check(nodes []ast.Node) error {
+	c := &checker{
+		traits: map[string]*ast.Trait{},
+	}
+	for _, node := range nodes {
+		c.check(node)
+	}
+	if len(c.errs) == 0 {
+		return nil
+	}
+	return c.errs
+}
+
+func (c *checker) report(err error, line int) {
+	c.errs = append(c.errs, &Error{
+		Err:  err,
+		Line: line,
+	})
+}
+
+// function 检查函数体，函数体中不能 break 或 continue 外层的循环。init 表示函数是类的 init 方法
+func (c *checker) function(function *ast.Function, init bool) {
+	loops, init_ := c.loops, c.init
+	c.functions++
+	c.loops, c.init = 0, init
+	for _, default_ := range function.Defaults {
+		c.check(default_)
+	}
+	c.check(function.Body)
+	c.functions--
+	c.loops, c.init = loops, init_
+}
+
+// conflicts 报告类组合的多个 trait 都提供、而类自身没有定义的方法，这样的方法来源有歧义。
+// 只检查之前声明过的 trait，其他 trait 在运行时按 with 之后的顺序组合，后面的覆盖前面的
+func (c *checker) conflicts(class *ast.Class) {
+	own := map[string]bool{}
+	for _, method := range class.Methods {
+		own[method.Name.Lexeme] = true
+	}
+	provided := map[string]string{} // 方法名到最先提供它的 trait
+	for _, variable := range class.Traits {
+		trait, ok := c.traits[variable.Name.Lexeme]
+		if !ok {
+			continue
+		}
+		for _, method := range trait.Methods {
+			name := method.Name.Lexeme
+			if own[name] {
+				continue
+			}
+			if first, ok := provided[name]; ok {
+				err := fmt.Errorf("%w: %s is provided by both %s and %s", ErrAmbiguousTraitMethod, name, first, trait.Name.Lexeme)
+				c.report(err, variable.Name.Line)
+				// 同一个方法只报告一次
+				own[name] = true
+				continue
+			}
+			provided[name] = trait.Name.Lexeme
+		}
+	}
+}
+
+func (c *checker) check(node ast.Node) {
+	switch _node := node.(type) {
+	case nil:
+	case *ast.Return:
+		if c.functions == 0 {
+			c.report(ErrReturnAtTopLevel, _node.Line)
+		}
+		if c.init && _node.Expression != nil {
+			c.report(ErrReturnFromInit, _node.Line)
+		}
+		c.check(_node.Expression)
+	case *ast.Break:
+		if c.loops == 0 {
+			c.report(ErrBreakOutsideLoop, _node.Line)
+		}
+	case *ast.Continue:
+		if c.loops == 0 {
+			c.report(ErrContinueOutsideLoop, _node.Line)
+		}
+	case *ast.This:
+		switch {
+		case c.class == classNone:
+			c.report(ErrThisOutsideClass, _node.Line)
+		case c.static:
+			c.report(ErrThisInStatic, _node.Line)
+		}
+	case *ast.Super:
+		switch {
+		case c.class == classNone:
+			c.report(ErrSuperOutsideClass, _node.Line)
+		case c.static:
+			c.report(ErrSuperInStatic, _node.Line)
+		case c.class == classTrait:
+			c.report(ErrSuperInTrait, _node.Line)
+		case c.class == classPlain:
+			c.report(ErrSuperWithoutSuperclass, _node.Line)
+		}
+	case *ast.While:
+		c.check(_node.Condition)
+		c.loops++
+		c.check(_node.Body)
+		c.loops--
+	case *ast.Function:
+		c.function(_node, false)
+	case *ast.Class:
+		class, static, privates_ := c.class, c.static, c.privates
+		c.class, c.static = classPlain, false
+		c.privates = &privates{
+			declared: map[string]bool{},
+		}
+		for _, methods := range [][]*ast.Function{_node.Methods, _node.Statics} {
+			for _, method := range methods {
+				c.private(method.Name, true)
+			}
+		}
+		if _node.SuperClass != nil {
+			c.class = classSub
+			if _node.SuperClass.Name.Lexeme == _node.Name.Lexeme {
+				c.report(ErrInheritFromSelf, _node.SuperClass.Name.Line)
+			}
+		}
+		c.conflicts(_node)
+		for _, method := range _node.Methods {
+			c.function(method, method.Name.Lexeme == "init")
+		}
+		for _, accessors := range [][]*ast.Function{_node.Getters, _node.Setters} {
+			for _, accessor := range accessors {
+				c.function(accessor, false)
+			}
+		}
+		c.static = true
+		for _, method := range _node.Statics {
+			c.function(method, false)
+		}
+		for _, name := range c.privates.used {
+			if !c.privates.declared[name.Lexeme] {
+				c.report(ErrUndeclaredPrivate, name.Line)
+			}
+		}
+		c.class, c.static, c.privates = class, static, privates_
+	case *ast.Trait:
+		c.traits[_node.Name.Lexeme] = _node
+		class, static := c.class, c.static
+		c.class, c.static = classTrait, false
+		privates_ := c.privates
+		c.privates = nil
+		for _, method := range _node.Methods {
+			c.private(method.Name, true)
+			c.function(method, method.Name.Lexeme == "init")
+		}
+		c.privates = privates_
+		c.class, c.static = class, static
+	case *ast.Block:
+		c.blocks++
+		for _, declaration := range _node.Declarations {
+			c.check(declaration)
+		}
+		c.blocks--
+	case *ast.If:
+		c.check(_node.Condition)
+		c.check(_node.ThenBranch)
+		if _node.ElseBranch != nil {
+			c.check(_node.ElseBranch)
+		}
+	case *ast.Try:
+		c.check(_node.Body)
+		if _node.CatchBody != nil {
+			c.check(_node.CatchBody)
+		}
+		if _node.FinallyBody != nil {
+			c.check(_node.FinallyBody)
+		}
+	case *ast.Export:
+		if c.functions > 0 || c.blocks > 0 {
+			c.report(ErrExportNotTopLevel, _node.Line)
+		}
+		c.check(_node.Declaration)
+	case *ast.Var:
+		c.check(_node.Initializer)
+	case *ast.Print:
+		c.check(_node.Expression)
+	case *ast.ExpressionStatement:
+		c.check(_node.Expression)
+	case *ast.Throw:
+		c.check(_node.Expression)
+	case *ast.Assign:
+		c.check(_node.Value)
+	case *ast.Set:
+		c.private(_node.Name, true)
+		c.check(_node.Object)
+		c.check(_node.Value)
+	case *ast.Get:
+		c.private(_node.Name, false)
+		c.check(_node.Object)
+	case *ast.Index:
+		c.check(_node.Object)
+		c.check(_node.Index)
+	case *ast.Call:
+		c.check(_node.Callee)
+		for _, argument := range _node.Arguments {
+			c.check(argument)
+		}
+	case *ast.Binary:
+		c.check(_node.Left)
+		c.check(_node.Right)
+	case *ast.Logical:
+		c.check(_node.Left)
+		c.check(_node.Right)
+	case *ast.Unary:
+		c.check(_node.Right)
+	case *ast.Grouping:
+		c.check(_node.Expression)
+	}
+}
@@ -0,0 +1,271 @@
+package check
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"stmt/parser"
+	"stmt/scanner"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   Errors
+	}{
+		{
+			name: "valid",
+			source: `
+			class A {
+				f() {
+					return this;
+				}
+			}
+			class B < A {
+				f() {
+					while (true) {
+						if (true) {
+							break;
+						}
+						continue;
+					}
+					return super.f();
+				}
+			}
+			`,
+			want: nil,
+		},
+		{
+			name:   "return at top level",
+			source: `return 1;`,
+			want: Errors{
+				{Err: ErrReturnAtTopLevel, Line: 1},
+			},
+		},
+		{
+			name: "return from init",
+			source: `
+			class A {
+				init() {
+					if (true) {
+						return;
+					}
+					fun f() {
+						return 1;
+					}
+					return 2;
+				}
+			}
+			`,
+			want: Errors{
+				{Err: ErrReturnFromInit, Line: 10},
+			},
+		},
+		{
+			name: "this and super in static",
+			source: `
+			class A {
+				static f() {
+					return 1;
+				}
+			}
+			class B < A {
+				static g() {
+					fun h() {
+						return this;
+					}
+					return super.f();
+				}
+				get x {
+					return this;
+				}
+			}
+			`,
+			want: Errors{
+				{Err: ErrThisInStatic, Line: 10},
+				{Err: ErrSuperInStatic, Line: 12},
+			},
+		},
+		{
+			name: "trait conflicts",
+			source: `
+			trait A {
+				f() {
+					return 1;
+				}
+				g() {
+					return super.g();
+				}
+			}
+			trait B {
+				f() {
+					return 2;
+				}
+				g() {
+					return this;
+				}
+			}
+			class C with A, B {
+				f() {
+					return 3;
+				}
+			}
+			class D with A, B {}
+			`,
+			want: Errors{
+				{Err: ErrSuperInTrait, Line: 7},
+				{Err: fmt.Errorf("%w: g is provided by both A and B", ErrAmbiguousTraitMethod), Line: 18},
+				{Err: fmt.Errorf("%w: f is provided by both A and B", ErrAmbiguousTraitMethod), Line: 23},
+				{Err: fmt.Errorf("%w: g is provided by both A and B", ErrAmbiguousTraitMethod), Line: 23},
+			},
+		},
+		{
+			name: "private names",
+			source: `
+			class A {
+				init() {
+					this.#count = 0;
+				}
+				#bump() {
+					this.#count = this.#count + 1;
+					fun f(other) {
+						return other.#count + other.#typo;
+					}
+					return f;
+				}
+				static make() {
+					return A().#bump();
+				}
+			}
+			class B < A {
+				get() {
+					return this.#count;
+				}
+			}
+			trait T {
+				#hidden() {
+					return 1;
+				}
+			}
+			print A().#count;
+			`,
+			want: Errors{
+				{Err: ErrUndeclaredPrivate, Line: 9},
+				{Err: ErrUndeclaredPrivate, Line: 19},
+				{Err: ErrPrivateOutsideClass, Line: 23},
+				{Err: ErrPrivateOutsideClass, Line: 27},
+			},
+		},
+		{
+			name: "this outside class",
+			source: `
+			fun f() {
+				return this;
+			}
+			`,
+			want: Errors{
+				{Err: ErrThisOutsideClass, Line: 3},
+			},
+		},
+		{
+			name: "super",
+			source: `
+			print super.f;
+			class A {
+				f() {
+					return super.f();
+				}
+			}
+			`,
+			want: Errors{
+				{Err: ErrSuperOutsideClass, Line: 2},
+				{Err: ErrSuperWithoutSuperclass, Line: 5},
+			},
+		},
+		{
+			name: "break and continue",
+			source: `
+			break;
+			while (true) {
+				fun f() {
+					continue;
+				}
+			}
+			`,
+			want: Errors{
+				{Err: ErrBreakOutsideLoop, Line: 2},
+				{Err: ErrContinueOutsideLoop, Line: 5},
+			},
+		},
+		{
+			name:   "inherit from self",
+			source: `class A < A {}`,
+			want: Errors{
+				{Err: ErrInheritFromSelf, Line: 1},
+			},
+		},
+		{
+			name: "export not top level",
+			source: `
+			{
+				export var a = 1;
+			}
+			`,
+			want: Errors{
+				{Err: ErrExportNotTopLevel, Line: 3},
+			},
+		},
+		{
+			name: "all errors",
+			source: `
+			return;
+			print this;
+			try {
+				break;
+			} finally {
+				continue;
+			}
+			`,
+			want: Errors{
+				{Err: ErrReturnAtTopLevel, Line: 2},
+				{Err: ErrThisOutsideClass, Line: 3},
+				{Err: ErrBreakOutsideLoop, Line: 5},
+				{Err: ErrContinueOutsideLoop, Line: 7},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes, err := parser.New(scanner.New(tt.source).Scan()).Parse()
+			if err != nil {
+				t.Fatalf("Parse() err = %v", err)
+			}
+			err = Check(nodes)
+			if tt.want == nil {
+				if err != nil {
+					t.Errorf("Check() err = %v, want nil", err)
+				}
+				return
+			}
+			var got Errors
+			if !errors.As(err, &got) {
+				t.Fatalf("Check() err = %v, want Errors", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Check() got = %v, want %v", got, tt.want)
+			}
+			for _, want := range tt.want {
+				// 带上下文的错误要按其哨兵错误匹配
+				sentinel := want.Err
+				if inner := errors.Unwrap(sentinel); inner != nil {
+					sentinel = inner
+				}
+				if !errors.Is(err, sentinel) {
+					t.Errorf("errors.Is(%v) = false", sentinel)
+				}
+			}
+		})
+	}
+}
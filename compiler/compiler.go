@@ -1,40 +1,113 @@
 package compiler
 
 import (
+	"math"
+	"slices"
 	"stmt/ast"
+	"stmt/check"
+	"stmt/module"
 	"stmt/opcode"
+	"stmt/optimize"
 	"stmt/token"
 	"stmt/value"
 )
 
 type Compiler struct {
-	ast       []ast.Node
-	constants []value.Value
+	ast           []ast.Node
+	constants     []value.Value
+	constantIndex map[constantKey]uint64 // 已加入常量表的 Int、Float、String 常量的下标
+	Path          string                 // 当前编译的文件路径，import 相对它所在的目录查找模块
+	Loader        *module.Loader         // 为 nil 时不支持 import
+	Fold          bool                   // 编译前折叠常量表达式，New 默认开启
+	Peephole      bool                   // 对生成的字节码做窥孔优化，New 默认开启
+	Register      bool                   // 选择寄存器后端：编译为寄存器指令，不做窥孔优化，vm.Run 据此选择执行器
+	Strict        bool                   // 在 and、or 之后检查结果是 bool，用于以严格模式运行的虚拟机
+	numGlobals    uint64                 // 程序和已编译模块占用的全局变量总数
+	modules       map[string]uint64
+	exports       map[string]uint64 // 当前编译的模块导出的名字
 }
 
 func New(ast []ast.Node) *Compiler {
 	return &Compiler{
-		ast:       ast,
-		constants: []value.Value{},
+		ast:           ast,
+		constants:     []value.Value{},
+		constantIndex: map[constantKey]uint64{},
+		Fold:          true,
+		Peephole:      true,
+		modules:       map[string]uint64{},
+		exports:       map[string]uint64{},
 	}
 }
 
+// NumGlobals 返回运行编译结果需要的全局变量个数，包括导入的模块的全局变量
+func (c *Compiler) NumGlobals() int {
+	return int(c.numGlobals)
+}
+
 func (c *Compiler) Compile() ([]uint8, []value.Value, error) {
+	mainFunction, constants, err := c.CompileFunction()
+	if err != nil {
+		return nil, nil, err
+	}
+	return mainFunction.Code, constants, nil
+}
+
+// CompileFunction 编译整个程序，返回的 main 函数带有行号和异常处理表
+func (c *Compiler) CompileFunction() (*value.Function, []value.Value, error) {
+	err := check.Check(c.ast)
+	if err != nil {
+		return nil, nil, err
+	}
+	nodes := c.ast
+	if c.Fold {
+		nodes = optimize.Fold(nodes)
+	}
 	symbolTable := NewSymbolTable(nil)
-	for _, node := range c.ast {
+	for _, node := range nodes {
 		err := c.collectGlobal(node, symbolTable)
 		if err != nil {
 			return nil, nil, err
 		}
 	}
-	mainScope := NewScope(false)
-	for _, node := range c.ast {
-		err := c.compile(node, symbolTable, mainScope)
+	c.numGlobals = uint64(len(symbolTable.LocalValues))
+	if c.Loader != nil && c.Path != "" {
+		// 模块反过来导入主程序也是循环导入
+		err := c.Loader.Enter(c.Path)
 		if err != nil {
 			return nil, nil, err
 		}
+		defer c.Loader.Exit()
+	}
+	mainScope, compile := c.newScope()
+	for _, node := range nodes {
+		err := compile(node, symbolTable, mainScope)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	mainFunction := mainScope.Function(0, 0)
+	mainFunction.File = c.Path
+	err = c.optimize(mainFunction)
+	if err != nil {
+		return nil, nil, err
+	}
+	return mainFunction, c.constants, nil
+}
+
+// newScope 按 Register 创建顶层代码的 Scope，返回编译其中语句的方法
+func (c *Compiler) newScope() (*Scope, func(ast.Node, *SymbolTable, *Scope) error) {
+	if c.Register {
+		return NewRegisterScope(), c.registerCompile
+	}
+	return NewScope(false), c.compile
+}
+
+// optimize 对编译完成的函数做窥孔优化
+func (c *Compiler) optimize(function *value.Function) error {
+	if !c.Peephole || c.Register {
+		return nil
 	}
-	return mainScope.Code, c.constants, nil
+	return Peephole(function, c.constants)
 }
 
 func (c *Compiler) collectGlobal(node ast.Node, symbolTable *SymbolTable) error {
@@ -43,12 +116,122 @@ func (c *Compiler) collectGlobal(node ast.Node, symbolTable *SymbolTable) error
 		return symbolTable.DefineGlobal(_node.Name.Lexeme)
 	case *ast.Function:
 		return symbolTable.DefineGlobal(_node.Name.Lexeme)
+	case *ast.Class:
+		return symbolTable.DefineGlobal(_node.Name.Lexeme)
+	case *ast.Trait:
+		return symbolTable.DefineGlobal(_node.Name.Lexeme)
+	case *ast.Import:
+		return symbolTable.DefineGlobal(_node.Name.Lexeme)
+	case *ast.Export:
+		return c.collectGlobal(_node.Declaration, symbolTable)
 	default:
 		return nil
 	}
 }
 
+// compileModule 编译 name 指定的模块，同一个模块只编译一次，返回模块在常量表中的下标
+func (c *Compiler) compileModule(name string) (uint64, error) {
+	if c.Loader == nil {
+		return 0, module.ErrNoLoader
+	}
+	path, err := c.Loader.Resolve(c.Path, name)
+	if err != nil {
+		return 0, err
+	}
+	if index, ok := c.modules[path]; ok {
+		return index, nil
+	}
+	err = c.Loader.Enter(path)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Loader.Exit()
+	nodes, err := c.Loader.Parse(path)
+	if err != nil {
+		return 0, err
+	}
+	err = check.Check(nodes)
+	if err != nil {
+		return 0, err
+	}
+	if c.Fold {
+		nodes = optimize.Fold(nodes)
+	}
+
+	// 模块使用独立的全局符号表，变量下标排在已分配的全局变量之后
+	global := Global
+	symbolTable := NewSymbolTable(nil)
+	symbolTable.Offset = c.numGlobals
+	Global = global
+	for _, node := range nodes {
+		err = c.collectGlobal(node, symbolTable)
+		if err != nil {
+			return 0, err
+		}
+	}
+	c.numGlobals += uint64(len(symbolTable.LocalValues))
+
+	module_ := value.NewModule(path)
+	index := c.constantAdd(module_)
+	importer, exports := c.Path, c.exports
+	c.Path, c.exports = path, module_.Exports
+	defer func() {
+		c.Path, c.exports = importer, exports
+	}()
+	moduleScope, compile := c.newScope()
+	for _, node := range nodes {
+		err = compile(node, symbolTable, moduleScope)
+		if err != nil {
+			return 0, err
+		}
+	}
+	err = c.moduleReturnEmit(index, moduleScope)
+	if err != nil {
+		return 0, err
+	}
+	module_.Function = moduleScope.Function(0, 0)
+	module_.Function.File = path
+	err = c.optimize(module_.Function)
+	if err != nil {
+		return 0, err
+	}
+	c.modules[path] = index
+	return index, nil
+}
+
+// moduleReturnEmit 生成模块顶层代码末尾返回模块自身的指令
+func (c *Compiler) moduleReturnEmit(index uint64, scope *Scope) error {
+	if !scope.Register {
+		err := scope.ConstantEmit(index)
+		if err != nil {
+			return err
+		}
+		scope.Emit(opcode.OP_RETURN)
+		return nil
+	}
+	r, err := scope.registerAlloc()
+	if err != nil {
+		return err
+	}
+	err = scope.EmitABx(opcode.R_LOADK, r, index)
+	if err != nil {
+		return err
+	}
+	scope.EmitABC(opcode.R_RETURN, r, 0, 0)
+	return nil
+}
+
 func (c *Compiler) compile(node ast.Node, symbolTable *SymbolTable, scope *Scope) error {
+	line := scope.Line
+	if node.Pos() > 0 {
+		scope.Line = node.Pos()
+	}
+	err := c.compileNode(node, symbolTable, scope)
+	scope.Line = line
+	return err
+}
+
+func (c *Compiler) compileNode(node ast.Node, symbolTable *SymbolTable, scope *Scope) error {
 	switch _node := node.(type) {
 	case *ast.Literal:
 		switch value_ := _node.Value.(type) {
@@ -124,7 +307,10 @@ func (c *Compiler) compile(node ast.Node, symbolTable *SymbolTable, scope *Scope
 		if err != nil {
 			return err
 		}
-		if _, ok := _node.Expression.(*ast.Assign); !ok {
+		// 赋值和设置属性不产生值
+		switch _node.Expression.(type) {
+		case *ast.Assign, *ast.Set:
+		default:
 			scope.Emit(opcode.OP_POP)
 		}
 		return nil
@@ -156,7 +342,13 @@ func (c *Compiler) compile(node ast.Node, symbolTable *SymbolTable, scope *Scope
 	case *ast.Variable:
 		symbolIndex, symbolScope, ex := symbolTable.Get(_node.Name.Lexeme)
 		if !ex {
-			return ErrVariableNotDefined
+			// 没有声明同名变量时才是内置函数
+			index := slices.Index(value.Builtins, _node.Name.Lexeme)
+			if index < 0 {
+				return ErrVariableNotDefined
+			}
+			scope.EmitWithOperand(opcode.OP_GET_BUILTIN, uint64(index))
+			return nil
 		}
 		err := scope.SymbolGetEmit(symbolIndex, symbolScope)
 		if err != nil {
@@ -178,13 +370,14 @@ func (c *Compiler) compile(node ast.Node, symbolTable *SymbolTable, scope *Scope
 		}
 		return nil
 	case *ast.Block:
-		_symbolTable := NewSymbolTable(symbolTable)
+		_symbolTable := NewBlockSymbolTable(symbolTable)
 		for _, statement := range _node.Declarations {
 			err := c.compile(statement, _symbolTable, scope)
 			if err != nil {
 				return err
 			}
 		}
+		closeBlock(_symbolTable, scope)
 		return nil
 	case *ast.If:
 		err := c.compile(_node.Condition, symbolTable, scope)
@@ -227,6 +420,10 @@ func (c *Compiler) compile(node ast.Node, symbolTable *SymbolTable, scope *Scope
 			if err != nil {
 				return err
 			}
+			// 左操作数已由跳转检查，严格模式下还要检查作为结果的右操作数
+			if c.Strict {
+				scope.Emit(opcode.OP_TEST_BOOL)
+			}
 			err = scope.Patch(offsetFalse, opcode.OP_JUMP_FALSE)
 			if err != nil {
 				return err
@@ -244,6 +441,9 @@ func (c *Compiler) compile(node ast.Node, symbolTable *SymbolTable, scope *Scope
 			if err != nil {
 				return err
 			}
+			if c.Strict {
+				scope.Emit(opcode.OP_TEST_BOOL)
+			}
 			err = scope.Patch(offset, opcode.OP_JUMP)
 			if err != nil {
 				return err
@@ -260,15 +460,14 @@ func (c *Compiler) compile(node ast.Node, symbolTable *SymbolTable, scope *Scope
 		}
 		offsetFalse := scope.EmitWithOperand(opcode.OP_JUMP_FALSE, 0)
 		scope.Emit(opcode.OP_POP)
+		_symbolTable := NewBlockSymbolTable(symbolTable)
 		for _, statement := range _node.Body.Declarations {
-			err = c.compile(statement, symbolTable, scope)
+			err = c.compile(statement, _symbolTable, scope)
 			if err != nil {
 				return err
 			}
 		}
-		if err != nil {
-			return err
-		}
+		closeBlock(_symbolTable, scope)
 		scope.Loop(init)
 		err = scope.Patch(offsetFalse, opcode.OP_JUMP_FALSE)
 		if err != nil {
@@ -281,68 +480,559 @@ func (c *Compiler) compile(node ast.Node, symbolTable *SymbolTable, scope *Scope
 		if err != nil {
 			return err
 		}
-		_symbolTable := NewSymbolTable(symbolTable)
-		for _, param := range _node.Params {
-			_, _, err = _symbolTable.Define(param.Lexeme)
+		err = c.compileFunction(_node, false, symbolTable, scope)
+		if err != nil {
+			return err
+		}
+		return scope.SymbolSetEmit(symbolIndex, symbolScope)
+	case *ast.Class:
+		return c.compileClass(_node, symbolTable, scope)
+	case *ast.Trait:
+		return c.compileTrait(_node, symbolTable, scope)
+	case *ast.Call:
+		return c.compileCall(_node, opcode.OP_CALL, symbolTable, scope)
+	case *ast.Return:
+		scope.HaveReturn = true
+		// 不在 try 中时尾调用复用当前栈帧，被调用函数直接返回到调用者
+		if call, ok := _node.Expression.(*ast.Call); ok && len(scope.Tries) == 0 {
+			return c.compileCall(call, opcode.OP_TAIL_CALL, symbolTable, scope)
+		}
+		if _node.Expression != nil {
+			err := c.compile(_node.Expression, symbolTable, scope)
 			if err != nil {
 				return err
 			}
+		} else {
+			scope.ResultEmit()
 		}
-		_scope := NewScope(false)
-		for _, statement := range _node.Body.Declarations {
-			err = c.compile(statement, _symbolTable, _scope)
+		if !scope.HaveFinally() {
+			scope.Emit(opcode.OP_RETURN)
+			return nil
+		}
+		// 返回前依次执行所在 try 语句的 finally，返回值暂存在隐藏的局部变量中
+		_symbolTable := NewBlockSymbolTable(symbolTable)
+		symbolIndex, symbolScope, err := _symbolTable.Define("return")
+		if err != nil {
+			return err
+		}
+		err = scope.SymbolSetEmit(symbolIndex, symbolScope)
+		if err != nil {
+			return err
+		}
+		tries := scope.Tries
+		for i := len(tries) - 1; i >= 0; i-- {
+			tries[i].close(scope.Offset())
+			if tries[i].Finally == nil {
+				continue
+			}
+			scope.Tries = append([]*TryBlock{}, tries[:i]...)
+			err = c.compile(tries[i].Finally, _symbolTable, scope)
 			if err != nil {
 				return err
 			}
 		}
-		if !_scope.HaveReturn {
-			_scope.Emit(opcode.OP_NIL)
-			_scope.Emit(opcode.OP_RETURN)
+		scope.Tries = tries
+		err = scope.SymbolGetEmit(symbolIndex, symbolScope)
+		if err != nil {
+			return err
 		}
-		obj := value.NewFunction(_scope.Code, uint64(len(_node.Params)), uint64(len(_symbolTable.UpValues)))
-		index := c.constantAdd(obj)
-		err = scope.ClosureEmit(index, _symbolTable.UpValues)
+		scope.Emit(opcode.OP_RETURN)
+		for _, try := range tries {
+			try.open(scope.Offset())
+		}
+		_symbolTable.Close()
+		return nil
+	case *ast.Throw:
+		err := c.compile(_node.Expression, symbolTable, scope)
 		if err != nil {
 			return err
 		}
-		err = scope.SymbolSetEmit(symbolIndex, symbolScope)
+		scope.Emit(opcode.OP_THROW)
+		return nil
+	case *ast.Try:
+		return c.compileTry(_node, symbolTable, scope)
+	case *ast.Import:
+		index, err := c.compileModule(_node.Path)
 		if err != nil {
 			return err
 		}
+		if index > math.MaxUint16 {
+			return ErrInvalidConstantIndex
+		}
+		scope.EmitWithOperand(opcode.OP_IMPORT, index)
+		symbolIndex, symbolScope, err := symbolTable.Define(_node.Name.Lexeme)
+		if err != nil {
+			return err
+		}
+		return scope.SymbolSetEmit(symbolIndex, symbolScope)
+	case *ast.Export:
+		err := c.compile(_node.Declaration, symbolTable, scope)
+		if err != nil {
+			return err
+		}
+		var name string
+		switch declaration := _node.Declaration.(type) {
+		case *ast.Var:
+			name = declaration.Name.Lexeme
+		case *ast.Function:
+			name = declaration.Name.Lexeme
+		case *ast.Class:
+			name = declaration.Name.Lexeme
+		case *ast.Trait:
+			name = declaration.Name.Lexeme
+		default:
+			return ErrInvalidNodeType
+		}
+		symbolIndex, _, _ := symbolTable.Get(name)
+		c.exports[name] = symbolIndex
 		return nil
-	case *ast.Call:
-		err := c.compile(_node.Callee, symbolTable, scope)
+	case *ast.Get:
+		err := c.compile(_node.Object, symbolTable, scope)
+		if err != nil {
+			return err
+		}
+		return scope.PropertyGetEmit(_node.Name.Lexeme)
+	case *ast.Set:
+		err := c.compile(_node.Object, symbolTable, scope)
 		if err != nil {
 			return err
 		}
-		for _, argument := range _node.Arguments {
-			err = c.compile(argument, symbolTable, scope)
+		err = c.compile(_node.Value, symbolTable, scope)
+		if err != nil {
+			return err
+		}
+		return scope.PropertySetEmit(_node.Name.Lexeme)
+	case *ast.This:
+		symbolIndex, symbolScope, ex := symbolTable.Get("this")
+		if !ex {
+			return ErrVariableNotDefined
+		}
+		return scope.SymbolGetEmit(symbolIndex, symbolScope)
+	case *ast.Super:
+		for _, name := range []string{"this", "super"} {
+			symbolIndex, symbolScope, ex := symbolTable.Get(name)
+			if !ex {
+				return ErrVariableNotDefined
+			}
+			err := scope.SymbolGetEmit(symbolIndex, symbolScope)
 			if err != nil {
 				return err
 			}
 		}
-		scope.EmitWithOperand(opcode.OP_CALL, uint64(len(_node.Arguments)))
+		index := c.constantAdd(value.NewString(_node.Method.Lexeme))
+		if index > math.MaxUint16 {
+			return ErrInvalidConstantIndex
+		}
+		scope.EmitWithOperand(opcode.OP_GET_SUPER, index)
 		return nil
-	case *ast.Return:
-		scope.HaveReturn = true
-		if _node.Expression != nil {
-			err := c.compile(_node.Expression, symbolTable, scope)
-			if err != nil {
-				return err
-			}
-		} else {
-			scope.Emit(opcode.OP_NIL)
+	case *ast.Index:
+		err := c.compile(_node.Object, symbolTable, scope)
+		if err != nil {
+			return err
 		}
-		scope.Emit(opcode.OP_RETURN)
+		err = c.compile(_node.Index, symbolTable, scope)
+		if err != nil {
+			return err
+		}
+		scope.Emit(opcode.OP_INDEX)
 		return nil
 	default:
 		return ErrInvalidNodeType
 	}
 }
 
+// compileFunction 编译函数声明并把闭包入栈。method 为 true 时编译为方法，this 占用第 0 个槽位
+func (c *Compiler) compileFunction(node *ast.Function, method bool, symbolTable *SymbolTable, scope *Scope) error {
+	_symbolTable := NewSymbolTable(symbolTable)
+	if method {
+		_, _, err := _symbolTable.Define("this")
+		if err != nil {
+			return err
+		}
+	}
+	_scope := NewScope(false)
+	_scope.Line = node.Line
+	_scope.Init = method && node.Name.Lexeme == "init"
+	var err error
+	numOptional := uint64(0)
+	var params []string
+	for i, param := range node.Params {
+		params = append(params, param.Lexeme)
+		if node.Defaults != nil && node.Defaults[i] != nil {
+			// 默认值中只能看到排在前面的参数
+			err = c.compileDefault(uint64(i), node.Defaults[i], _symbolTable, _scope)
+			if err != nil {
+				return err
+			}
+			numOptional++
+		}
+		_, _, err = _symbolTable.Define(param.Lexeme)
+		if err != nil {
+			return err
+		}
+	}
+	if node.Rest != nil {
+		params = append(params, node.Rest.Lexeme)
+		_, _, err = _symbolTable.Define(node.Rest.Lexeme)
+		if err != nil {
+			return err
+		}
+	}
+	for _, statement := range node.Body.Declarations {
+		err = c.compile(statement, _symbolTable, _scope)
+		if err != nil {
+			return err
+		}
+	}
+	if !endsWithReturn(node.Body) {
+		_scope.ResultEmit()
+		_scope.Emit(opcode.OP_RETURN)
+	}
+	obj := _scope.Function(uint64(len(node.Params)), uint64(len(_symbolTable.UpValues)))
+	obj.Name = node.Name.Lexeme
+	obj.Params = params
+	obj.File = c.Path
+	obj.Line = node.Line
+	err = c.optimize(obj)
+	if err != nil {
+		return err
+	}
+	obj.NumOptional = numOptional
+	obj.Variadic = node.Rest != nil
+	obj.Method = method
+	index := c.constantAdd(obj)
+	return scope.ClosureEmit(index, _symbolTable.UpValues)
+}
+
+// compileClass 编译类声明：
+//
+//	OP_CLASS name
+//	保存到类名变量
+//	父类                 有父类时，父类保存在块作用域的 super 变量中，供方法捕获
+//	类
+//	OP_INHERIT
+//	类
+//	trait                每个 trait 一次，按 with 之后的顺序
+//	OP_WITH
+//	方法的闭包
+//	OP_METHOD name       每个方法一次，static 方法和访问器分别是 OP_STATIC、OP_GETTER 和 OP_SETTER
+//	OP_POP
+func (c *Compiler) compileClass(node *ast.Class, symbolTable *SymbolTable, scope *Scope) error {
+	symbolIndex, symbolScope, err := symbolTable.Define(node.Name.Lexeme)
+	if err != nil {
+		return err
+	}
+	nameIndex := c.constantAdd(value.NewString(node.Name.Lexeme))
+	if nameIndex > math.MaxUint16 {
+		return ErrInvalidConstantIndex
+	}
+	scope.EmitWithOperand(opcode.OP_CLASS, nameIndex)
+	err = scope.SymbolSetEmit(symbolIndex, symbolScope)
+	if err != nil {
+		return err
+	}
+	_symbolTable := NewBlockSymbolTable(symbolTable)
+	if node.SuperClass != nil {
+		err = c.compile(node.SuperClass, _symbolTable, scope)
+		if err != nil {
+			return err
+		}
+		superIndex, superScope, err := _symbolTable.Define("super")
+		if err != nil {
+			return err
+		}
+		err = scope.SymbolSetEmit(superIndex, superScope)
+		if err != nil {
+			return err
+		}
+		err = scope.SymbolGetEmit(superIndex, superScope)
+		if err != nil {
+			return err
+		}
+		err = scope.SymbolGetEmit(symbolIndex, symbolScope)
+		if err != nil {
+			return err
+		}
+		scope.Emit(opcode.OP_INHERIT)
+		scope.Emit(opcode.OP_POP)
+	}
+	err = scope.SymbolGetEmit(symbolIndex, symbolScope)
+	if err != nil {
+		return err
+	}
+	for _, trait := range node.Traits {
+		err = c.compile(trait, _symbolTable, scope)
+		if err != nil {
+			return err
+		}
+		scope.Emit(opcode.OP_WITH)
+	}
+	members := []struct {
+		methods []*ast.Function
+		op      uint8
+	}{
+		{node.Methods, opcode.OP_METHOD},
+		{node.Statics, opcode.OP_STATIC},
+		{node.Getters, opcode.OP_GETTER},
+		{node.Setters, opcode.OP_SETTER},
+	}
+	for _, member := range members {
+		for _, method := range member.methods {
+			// static 方法没有 this，编译为普通函数
+			err = c.compileFunction(method, member.op != opcode.OP_STATIC, _symbolTable, scope)
+			if err != nil {
+				return err
+			}
+			index := c.constantAdd(value.NewString(method.Name.Lexeme))
+			if index > math.MaxUint16 {
+				return ErrInvalidConstantIndex
+			}
+			scope.EmitWithOperand(member.op, index)
+		}
+	}
+	scope.Emit(opcode.OP_POP)
+	closeBlock(_symbolTable, scope)
+	return nil
+}
+
+// compileTrait 编译 trait 声明：
+//
+//	OP_TRAIT name
+//	保存到 trait 名变量
+//	trait
+//	方法的闭包
+//	OP_METHOD name       每个方法一次
+//	OP_POP
+func (c *Compiler) compileTrait(node *ast.Trait, symbolTable *SymbolTable, scope *Scope) error {
+	symbolIndex, symbolScope, err := symbolTable.Define(node.Name.Lexeme)
+	if err != nil {
+		return err
+	}
+	nameIndex := c.constantAdd(value.NewString(node.Name.Lexeme))
+	if nameIndex > math.MaxUint16 {
+		return ErrInvalidConstantIndex
+	}
+	scope.EmitWithOperand(opcode.OP_TRAIT, nameIndex)
+	err = scope.SymbolSetEmit(symbolIndex, symbolScope)
+	if err != nil {
+		return err
+	}
+	err = scope.SymbolGetEmit(symbolIndex, symbolScope)
+	if err != nil {
+		return err
+	}
+	for _, method := range node.Methods {
+		err = c.compileFunction(method, true, symbolTable, scope)
+		if err != nil {
+			return err
+		}
+		index := c.constantAdd(value.NewString(method.Name.Lexeme))
+		if index > math.MaxUint16 {
+			return ErrInvalidConstantIndex
+		}
+		scope.EmitWithOperand(opcode.OP_METHOD, index)
+	}
+	scope.Emit(opcode.OP_POP)
+	return nil
+}
+
+// compileCall 编译函数调用，op 为 OP_CALL 或 OP_TAIL_CALL
+func (c *Compiler) compileCall(node *ast.Call, op uint8, symbolTable *SymbolTable, scope *Scope) error {
+	if get, ok := node.Callee.(*ast.Get); ok && op == opcode.OP_CALL && len(node.Arguments) <= math.MaxUint8 {
+		return c.compileInvoke(get, node.Arguments, symbolTable, scope)
+	}
+	err := c.compile(node.Callee, symbolTable, scope)
+	if err != nil {
+		return err
+	}
+	for _, argument := range node.Arguments {
+		err = c.compile(argument, symbolTable, scope)
+		if err != nil {
+			return err
+		}
+	}
+	scope.EmitWithOperand(op, uint64(len(node.Arguments)))
+	return nil
+}
+
+// compileInvoke 把调用属性编译为 OP_INVOKE，调用方法时不需要创建绑定了 this 的方法
+func (c *Compiler) compileInvoke(callee *ast.Get, arguments []ast.Expr, symbolTable *SymbolTable, scope *Scope) error {
+	err := c.compile(callee.Object, symbolTable, scope)
+	if err != nil {
+		return err
+	}
+	for _, argument := range arguments {
+		err = c.compile(argument, symbolTable, scope)
+		if err != nil {
+			return err
+		}
+	}
+	index, err := scope.CacheAdd(callee.Name.Lexeme)
+	if err != nil {
+		return err
+	}
+	scope.EmitWithOperand(opcode.OP_INVOKE, index<<8|uint64(len(arguments)))
+	return nil
+}
+
+// compileDefault 编译第 index 个参数的默认值，只在调用时没有传入该参数时求值：
+//
+//	OP_MISSING_ARG index
+//	OP_JUMP_FALSE skip
+//	OP_POP
+//	默认值
+//	OP_SET_LOCAL index
+//	OP_JUMP end
+//	skip: OP_POP
+//	end:
+func (c *Compiler) compileDefault(index uint64, default_ ast.Expr, symbolTable *SymbolTable, scope *Scope) error {
+	scope.EmitWithOperand(opcode.OP_MISSING_ARG, index)
+	offsetFalse := scope.EmitWithOperand(opcode.OP_JUMP_FALSE, 0)
+	scope.Emit(opcode.OP_POP)
+	err := c.compile(default_, symbolTable, scope)
+	if err != nil {
+		return err
+	}
+	// 方法的参数排在 this 之后，所以槽位不一定等于 index
+	scope.EmitWithOperand(opcode.OP_SET_LOCAL, symbolTable.NumSlots())
+	offset := scope.EmitWithOperand(opcode.OP_JUMP, 0)
+	err = scope.Patch(offsetFalse, opcode.OP_JUMP_FALSE)
+	if err != nil {
+		return err
+	}
+	scope.Emit(opcode.OP_POP)
+	return scope.Patch(offset, opcode.OP_JUMP)
+}
+
+// compileTry 编译 try 语句，字节码布局为：
+//
+//	try 代码块
+//	OP_JUMP finally
+//	catch:       异常值已在栈顶，保存到 catch 变量后执行 catch 代码块
+//	OP_JUMP finally
+//	rethrow:     异常值已在栈顶，暂存后执行 finally 代码块，再重新抛出
+//	finally:     正常执行 finally 代码块
+func (c *Compiler) compileTry(node *ast.Try, symbolTable *SymbolTable, scope *Scope) error {
+	slots := symbolTable.NumSlots()
+	scope.TryBegin(node.FinallyBody)
+	err := c.compile(node.Body, symbolTable, scope)
+	if err != nil {
+		return err
+	}
+	try := scope.TryEnd()
+	offsets := []uint64{scope.EmitWithOperand(opcode.OP_JUMP, 0)}
+	if node.CatchBody != nil {
+		scope.HandlerAdd(try, scope.Offset(), slots)
+		if node.FinallyBody != nil {
+			// catch 代码块中抛出的异常也要先执行 finally
+			scope.TryBegin(node.FinallyBody)
+		}
+		_symbolTable := NewBlockSymbolTable(symbolTable)
+		symbolIndex, symbolScope, err := _symbolTable.Define(node.CatchName.Lexeme)
+		if err != nil {
+			return err
+		}
+		err = scope.SymbolSetEmit(symbolIndex, symbolScope)
+		if err != nil {
+			return err
+		}
+		for _, statement := range node.CatchBody.Declarations {
+			err = c.compile(statement, _symbolTable, scope)
+			if err != nil {
+				return err
+			}
+		}
+		closeBlock(_symbolTable, scope)
+		if node.FinallyBody != nil {
+			try = scope.TryEnd()
+			offsets = append(offsets, scope.EmitWithOperand(opcode.OP_JUMP, 0))
+			scope.HandlerAdd(try, scope.Offset(), slots)
+		}
+	} else {
+		scope.HandlerAdd(try, scope.Offset(), slots)
+	}
+	if node.FinallyBody != nil {
+		_symbolTable := NewBlockSymbolTable(symbolTable)
+		symbolIndex, symbolScope, err := _symbolTable.Define("throw")
+		if err != nil {
+			return err
+		}
+		err = scope.SymbolSetEmit(symbolIndex, symbolScope)
+		if err != nil {
+			return err
+		}
+		err = c.compile(node.FinallyBody, _symbolTable, scope)
+		if err != nil {
+			return err
+		}
+		err = scope.SymbolGetEmit(symbolIndex, symbolScope)
+		if err != nil {
+			return err
+		}
+		scope.Emit(opcode.OP_THROW)
+		_symbolTable.Close()
+	}
+	for _, offset := range offsets {
+		err = scope.Patch(offset, opcode.OP_JUMP)
+		if err != nil {
+			return err
+		}
+	}
+	if node.FinallyBody != nil {
+		err = c.compile(node.FinallyBody, symbolTable, scope)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeBlock 结束块作用域。块内有被内层函数捕获的局部变量时先关闭它们，
+// 这样每次进入块（比如每轮循环）捕获的都是新的变量
+func closeBlock(symbolTable *SymbolTable, scope *Scope) {
+	if symbolTable.Captured() {
+		scope.EmitWithOperand(opcode.OP_CLOSE_UPVALUE, symbolTable.base)
+	}
+	symbolTable.Close()
+}
+
+// endsWithReturn 判断代码块是否以 return 语句结束
+func endsWithReturn(block *ast.Block) bool {
+	length := len(block.Declarations)
+	if length == 0 {
+		return false
+	}
+	_, ok := block.Declarations[length-1].(*ast.Return)
+	return ok
+}
+
 // constants
+// constantKey 是可以按值去重的常量的键
+type constantKey struct {
+	valueType uint8
+	literal   any
+}
+
+// constantAdd 把 obj 加入常量表，值相同的 Int、Float、String 常量只保存一份
 func (c *Compiler) constantAdd(obj value.Value) uint64 {
+	var key constantKey
+	switch _obj := obj.(type) {
+	case *value.Int:
+		key = constantKey{valueType: _obj.ValueType(), literal: _obj.Literal}
+	case *value.Float:
+		// 按位比较，区分 0 和 -0，NaN 也能去重
+		key = constantKey{valueType: _obj.ValueType(), literal: math.Float64bits(_obj.Literal)}
+	case *value.String:
+		key = constantKey{valueType: _obj.ValueType(), literal: _obj.Literal}
+	default:
+		c.constants = append(c.constants, obj)
+		return uint64(len(c.constants) - 1)
+	}
+	if index, ok := c.constantIndex[key]; ok {
+		return index
+	}
 	c.constants = append(c.constants, obj)
-	index := len(c.constants) - 1
-	return uint64(index)
+	index := uint64(len(c.constants) - 1)
+	c.constantIndex[key] = index
+	return index
 }
@@ -1,15 +1,19 @@
 package compiler
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"reflect"
 	"stmt/ast"
+	"stmt/check"
+	"stmt/module"
 	"stmt/opcode"
 	"stmt/parser"
 	"stmt/scanner"
 	"stmt/value"
 	"testing"
+	"testing/fstest"
 )
 
 func formatConstants(constants []value.Value) string {
@@ -52,6 +56,25 @@ func newClosureMeta(metas ...uint8) []uint8 {
 	return metas
 }
 
+// named 设置函数的名字、定义所在的行号和参数名
+func named(name string, line int, params []string, function *value.Function) *value.Function {
+	function.Name = name
+	function.Line = line
+	function.Params = params
+	return function
+}
+
+// withLines 按 (offset, line) 成对给出函数的行号表
+func withLines(function *value.Function, offsetLines ...int) *value.Function {
+	for i := 0; i+1 < len(offsetLines); i += 2 {
+		function.Lines = append(function.Lines, value.Line{
+			Offset: uint64(offsetLines[i]),
+			Line:   offsetLines[i+1],
+		})
+	}
+	return function
+}
+
 func TestCompiler_CompileExpr(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -82,6 +105,44 @@ func TestCompiler_CompileExpr(t *testing.T) {
 			},
 			err: nil,
 		},
+		{
+			name:   "dedupe constants",
+			source: `"a" + "a" + 1.0 + 1.0 + 1 + 1`,
+			code: newCode(
+				toCode(opcode.OP_CONSTANT, 0),
+				toCode(opcode.OP_CONSTANT, 0),
+				toCode(opcode.OP_ADD),
+				toCode(opcode.OP_CONSTANT, 1),
+				toCode(opcode.OP_ADD),
+				toCode(opcode.OP_CONSTANT, 1),
+				toCode(opcode.OP_ADD),
+				toCode(opcode.OP_CONSTANT, 2),
+				toCode(opcode.OP_ADD),
+				toCode(opcode.OP_CONSTANT, 2),
+				toCode(opcode.OP_ADD),
+			),
+			constants: []value.Value{
+				value.NewString("a"),
+				value.NewFloat(1),
+				value.NewInt(1),
+			},
+			err: nil,
+		},
+		{
+			name:   "1 != 2",
+			source: "1 != 2",
+			code: newCode(
+				toCode(opcode.OP_CONSTANT, 0),
+				toCode(opcode.OP_CONSTANT, 1),
+				toCode(opcode.OP_EQ),
+				toCode(opcode.OP_NOT),
+			),
+			constants: []value.Value{
+				value.NewInt(1),
+				value.NewInt(2),
+			},
+			err: nil,
+		},
 		{
 			name:   "(1)",
 			source: "(1)",
@@ -200,6 +261,9 @@ func TestCompiler_CompileExpr(t *testing.T) {
 				return
 			}
 			compiler_ := New([]ast.Node{node})
+			// 检查未经优化的字节码
+			compiler_.Fold = false
+			compiler_.Peephole = false
 			code, constants, err := compiler_.Compile()
 			if !errors.Is(err, tt.err) {
 				t.Errorf("Compile() err = %v, want %v", err, tt.err)
@@ -218,6 +282,7 @@ func TestCompiler_CompileStmtDecl(t *testing.T) {
 	tests := []struct {
 		name      string
 		source    string
+		strict    bool
 		code      []uint8
 		constants []value.Value
 	}{
@@ -449,6 +514,22 @@ func TestCompiler_CompileStmtDecl(t *testing.T) {
 			),
 			constants: []value.Value{},
 		},
+		{
+			name: "and strict",
+			source: `
+			true and true;
+			`,
+			strict: true,
+			code: newCode(
+				toCode(opcode.OP_TRUE),
+				toCode(opcode.OP_JUMP_FALSE, 3),
+				toCode(opcode.OP_POP),
+				toCode(opcode.OP_TRUE),
+				toCode(opcode.OP_TEST_BOOL),
+				toCode(opcode.OP_POP),
+			),
+			constants: []value.Value{},
+		},
 		{
 			name: "or",
 			source: `
@@ -464,6 +545,23 @@ func TestCompiler_CompileStmtDecl(t *testing.T) {
 			),
 			constants: []value.Value{},
 		},
+		{
+			name: "or strict",
+			source: `
+			true or true;
+			`,
+			strict: true,
+			code: newCode(
+				toCode(opcode.OP_TRUE),
+				toCode(opcode.OP_JUMP_FALSE, 5),
+				toCode(opcode.OP_JUMP, 3),
+				toCode(opcode.OP_POP),
+				toCode(opcode.OP_TRUE),
+				toCode(opcode.OP_TEST_BOOL),
+				toCode(opcode.OP_POP),
+			),
+			constants: []value.Value{},
+		},
 		{
 			name: "while",
 			source: `
@@ -510,12 +608,12 @@ func TestCompiler_CompileStmtDecl(t *testing.T) {
 			),
 			constants: []value.Value{
 				value.NewInt(1),
-				value.NewFunction(newCode(
+				named("pt", 2, nil, withLines(value.NewFunction(newCode(
 					toCode(opcode.OP_CONSTANT, 0),
 					toCode(opcode.OP_PRINT),
 					toCode(opcode.OP_NIL),
 					toCode(opcode.OP_RETURN),
-				), 0, 0),
+				), 0, 0), 0, 3, 3, 2)),
 			},
 		},
 		{
@@ -532,12 +630,12 @@ func TestCompiler_CompileStmtDecl(t *testing.T) {
 			),
 			constants: []value.Value{
 				value.NewInt(1),
-				value.NewFunction(newCode(
+				named("pt", 2, nil, withLines(value.NewFunction(newCode(
 					toCode(opcode.OP_CONSTANT, 0),
 					toCode(opcode.OP_PRINT),
 					toCode(opcode.OP_NIL),
 					toCode(opcode.OP_RETURN),
-				), 0, 0),
+				), 0, 0), 0, 3, 3, 4)),
 			},
 		},
 		{
@@ -555,12 +653,12 @@ func TestCompiler_CompileStmtDecl(t *testing.T) {
 			constants: []value.Value{
 				value.NewInt(1),
 				value.NewInt(2),
-				value.NewFunction(newCode(
+				named("pt", 2, nil, withLines(value.NewFunction(newCode(
 					toCode(opcode.OP_CONSTANT, 0),
 					toCode(opcode.OP_PRINT),
 					toCode(opcode.OP_CONSTANT, 1),
 					toCode(opcode.OP_RETURN),
-				), 0, 0),
+				), 0, 0), 0, 3, 3, 4)),
 			},
 		},
 		{
@@ -580,12 +678,12 @@ func TestCompiler_CompileStmtDecl(t *testing.T) {
 			),
 			constants: []value.Value{
 				value.NewInt(1),
-				value.NewFunction(newCode(
+				named("pt", 2, nil, withLines(value.NewFunction(newCode(
 					toCode(opcode.OP_CONSTANT, 0),
 					toCode(opcode.OP_PRINT),
 					toCode(opcode.OP_NIL),
 					toCode(opcode.OP_RETURN),
-				), 0, 0),
+				), 0, 0), 0, 3, 3, 2)),
 			},
 		},
 		{
@@ -606,14 +704,14 @@ func TestCompiler_CompileStmtDecl(t *testing.T) {
 				toCode(opcode.OP_POP),
 			),
 			constants: []value.Value{
-				value.NewFunction(newCode(
+				named("pt", 2, []string{"a", "b"}, withLines(value.NewFunction(newCode(
 					toCode(opcode.OP_GET_LOCAL, 0),
 					toCode(opcode.OP_GET_LOCAL, 1),
 					toCode(opcode.OP_ADD),
 					toCode(opcode.OP_PRINT),
 					toCode(opcode.OP_NIL),
 					toCode(opcode.OP_RETURN),
-				), 2, 0),
+				), 2, 0), 0, 3, 8, 2)),
 				value.NewInt(1),
 				value.NewInt(2),
 			},
@@ -636,16 +734,65 @@ func TestCompiler_CompileStmtDecl(t *testing.T) {
 				toCode(opcode.OP_PRINT),
 			),
 			constants: []value.Value{
-				value.NewFunction(newCode(
+				named("add", 2, []string{"a", "b"}, withLines(value.NewFunction(newCode(
 					toCode(opcode.OP_GET_LOCAL, 0),
 					toCode(opcode.OP_GET_LOCAL, 1),
 					toCode(opcode.OP_ADD),
 					toCode(opcode.OP_RETURN),
-				), 2, 0),
+				), 2, 0), 0, 3)),
 				value.NewInt(1),
 				value.NewInt(2),
 			},
 		},
+		{
+			name: "tail call",
+			source: `
+			fun f(n) {
+				return f(n);
+			}
+			`,
+			code: newCode(
+				toCode(opcode.OP_CLOSURE, 0),
+				toCode(opcode.OP_SET_GLOBAL, 0),
+			),
+			constants: []value.Value{
+				named("f", 2, []string{"n"}, withLines(value.NewFunction(newCode(
+					toCode(opcode.OP_GET_GLOBAL, 0),
+					toCode(opcode.OP_GET_LOCAL, 0),
+					toCode(opcode.OP_TAIL_CALL, 1),
+				), 1, 0), 0, 3)),
+			},
+		},
+		{
+			name: "function default",
+			source: `
+			fun f(a = 1) {
+				return a;
+			}
+			`,
+			code: newCode(
+				toCode(opcode.OP_CLOSURE, 1),
+				toCode(opcode.OP_SET_GLOBAL, 0),
+			),
+			constants: []value.Value{
+				value.NewInt(1),
+				named("f", 2, []string{"a"}, withLines(&value.Function{
+					Code: newCode(
+						toCode(opcode.OP_MISSING_ARG, 0),
+						toCode(opcode.OP_JUMP_FALSE, 11),
+						toCode(opcode.OP_POP),
+						toCode(opcode.OP_CONSTANT, 0),
+						toCode(opcode.OP_SET_LOCAL, 0),
+						toCode(opcode.OP_JUMP, 1),
+						toCode(opcode.OP_POP),
+						toCode(opcode.OP_GET_LOCAL, 0),
+						toCode(opcode.OP_RETURN),
+					),
+					NumParams:   1,
+					NumOptional: 1,
+				}, 0, 2, 19, 3)),
+			},
+		},
 		{
 			name: "closure",
 			source: `
@@ -667,13 +814,13 @@ func TestCompiler_CompileStmtDecl(t *testing.T) {
 			),
 			constants: []value.Value{
 				value.NewString("outside"),
-				value.NewFunction(newCode(
+				named("inner", 4, nil, withLines(value.NewFunction(newCode(
 					toCode(opcode.OP_GET_UPVALUE, 0),
 					toCode(opcode.OP_PRINT),
 					toCode(opcode.OP_NIL),
 					toCode(opcode.OP_RETURN),
-				), 0, 1),
-				value.NewFunction(newCode(
+				), 0, 1), 0, 5, 4, 4)),
+				named("outer", 2, nil, withLines(value.NewFunction(newCode(
 					toCode(opcode.OP_CONSTANT, 0),
 					toCode(opcode.OP_SET_LOCAL, 0),
 					toCode(opcode.OP_CLOSURE, 1),
@@ -684,7 +831,165 @@ func TestCompiler_CompileStmtDecl(t *testing.T) {
 					toCode(opcode.OP_POP),
 					toCode(opcode.OP_NIL),
 					toCode(opcode.OP_RETURN),
-				), 0, 0),
+				), 0, 0), 0, 3, 5, 4, 12, 7, 19, 2)),
+			},
+		},
+		{
+			name: "close upvalue",
+			source: `
+			{
+				var x = 1;
+				fun f() {
+					print x;
+				}
+			}
+			`,
+			code: newCode(
+				toCode(opcode.OP_CONSTANT, 0),
+				toCode(opcode.OP_SET_LOCAL, 0),
+				toCode(opcode.OP_CLOSURE, 1),
+				newClosureMeta(1, 0),
+				toCode(opcode.OP_SET_LOCAL, 1),
+				toCode(opcode.OP_CLOSE_UPVALUE, 0),
+			),
+			constants: []value.Value{
+				value.NewInt(1),
+				named("f", 4, nil, withLines(value.NewFunction(newCode(
+					toCode(opcode.OP_GET_UPVALUE, 0),
+					toCode(opcode.OP_PRINT),
+					toCode(opcode.OP_NIL),
+					toCode(opcode.OP_RETURN),
+				), 0, 1), 0, 5, 4, 4)),
+			},
+		},
+		{
+			name: "class",
+			source: `
+			class A {
+				f() {
+					return this.x;
+				}
+			}
+			A().f();
+			`,
+			code: newCode(
+				toCode(opcode.OP_CLASS, 0),
+				toCode(opcode.OP_SET_GLOBAL, 0),
+				toCode(opcode.OP_GET_GLOBAL, 0),
+				toCode(opcode.OP_CLOSURE, 1),
+				toCode(opcode.OP_METHOD, 2),
+				toCode(opcode.OP_POP),
+				toCode(opcode.OP_GET_GLOBAL, 0),
+				toCode(opcode.OP_CALL, 0),
+				toCode(opcode.OP_INVOKE, 0<<8|0),
+				toCode(opcode.OP_POP),
+			),
+			constants: []value.Value{
+				value.NewString("A"),
+				named("f", 3, nil, withLines(&value.Function{
+					Code: newCode(
+						toCode(opcode.OP_GET_LOCAL, 0),
+						toCode(opcode.OP_GET_PROPERTY, 0),
+						toCode(opcode.OP_RETURN),
+					),
+					Method: true,
+					Caches: []value.InlineCache{{Name: "x"}},
+				}, 0, 4)),
+				value.NewString("f"),
+			},
+		},
+		{
+			name: "trait",
+			source: `
+			trait T {
+				f() {
+					return this;
+				}
+			}
+			class A with T {}
+			`,
+			code: newCode(
+				toCode(opcode.OP_TRAIT, 0),
+				toCode(opcode.OP_SET_GLOBAL, 0),
+				toCode(opcode.OP_GET_GLOBAL, 0),
+				toCode(opcode.OP_CLOSURE, 1),
+				toCode(opcode.OP_METHOD, 2),
+				toCode(opcode.OP_POP),
+				toCode(opcode.OP_CLASS, 3),
+				toCode(opcode.OP_SET_GLOBAL, 1),
+				toCode(opcode.OP_GET_GLOBAL, 1),
+				toCode(opcode.OP_GET_GLOBAL, 0),
+				toCode(opcode.OP_WITH),
+				toCode(opcode.OP_POP),
+			),
+			constants: []value.Value{
+				value.NewString("T"),
+				named("f", 3, nil, withLines(&value.Function{
+					Code: newCode(
+						toCode(opcode.OP_GET_LOCAL, 0),
+						toCode(opcode.OP_RETURN),
+					),
+					Method: true,
+				}, 0, 4)),
+				value.NewString("f"),
+				value.NewString("A"),
+			},
+		},
+		{
+			name: "builtin",
+			source: `
+			print type(1);
+			var clock = 2;
+			print clock;
+			`,
+			code: newCode(
+				toCode(opcode.OP_GET_BUILTIN, 1),
+				toCode(opcode.OP_CONSTANT, 0),
+				toCode(opcode.OP_CALL, 1),
+				toCode(opcode.OP_PRINT),
+				toCode(opcode.OP_CONSTANT, 1),
+				toCode(opcode.OP_SET_GLOBAL, 0),
+				toCode(opcode.OP_GET_GLOBAL, 0),
+				toCode(opcode.OP_PRINT),
+			),
+			constants: []value.Value{
+				value.NewInt(1),
+				value.NewInt(2),
+			},
+		},
+		{
+			name: "throw",
+			source: `
+			throw "boom";
+			`,
+			code: newCode(
+				toCode(opcode.OP_CONSTANT, 0),
+				toCode(opcode.OP_THROW),
+			),
+			constants: []value.Value{
+				value.NewString("boom"),
+			},
+		},
+		{
+			name: "try catch",
+			source: `
+			try {
+				throw 1;
+			} catch (e) {
+				print e.message;
+			}
+			`,
+			code: newCode(
+				toCode(opcode.OP_CONSTANT, 0),
+				toCode(opcode.OP_THROW),
+				toCode(opcode.OP_JUMP, 10),
+				toCode(opcode.OP_SET_LOCAL, 0),
+				toCode(opcode.OP_GET_LOCAL, 0),
+				toCode(opcode.OP_GET_PROPERTY, 0),
+				toCode(opcode.OP_PRINT),
+			),
+			constants: []value.Value{
+				value.NewInt(1),
 			},
 		},
 	}
@@ -699,6 +1004,10 @@ func TestCompiler_CompileStmtDecl(t *testing.T) {
 				return
 			}
 			compiler_ := New(node)
+			// 检查未经优化的字节码
+			compiler_.Fold = false
+			compiler_.Peephole = false
+			compiler_.Strict = tt.strict
 			code, constants, err := compiler_.Compile()
 			if err != nil {
 				t.Errorf("Compile() err = %v", err)
@@ -713,3 +1022,456 @@ func TestCompiler_CompileStmtDecl(t *testing.T) {
 		})
 	}
 }
+
+func TestCompiler_Fold(t *testing.T) {
+	tests := []struct {
+		name      string
+		source    string
+		code      []uint8
+		constants []value.Value
+	}{
+		{
+			name:   "arithmetic",
+			source: "print -1 + 2 * 3;",
+			code: newCode(
+				toCode(opcode.OP_CONSTANT, 0),
+				toCode(opcode.OP_PRINT),
+			),
+			constants: []value.Value{
+				value.NewInt(5),
+			},
+		},
+		{
+			name:   "keep divide by zero",
+			source: "print 1 / 0;",
+			code: newCode(
+				toCode(opcode.OP_CONSTANT, 0),
+				toCode(opcode.OP_CONSTANT, 1),
+				toCode(opcode.OP_DIVIDE),
+				toCode(opcode.OP_PRINT),
+			),
+			constants: []value.Value{
+				value.NewInt(1),
+				value.NewInt(0),
+			},
+		},
+		{
+			name:      "prune",
+			source:    "if (false) { print 1; } while (false) { print 2; }",
+			code:      []uint8{},
+			constants: []value.Value{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, err := parser.New(scanner.New(tt.source).Scan()).Parse()
+			if err != nil {
+				t.Fatalf("Parse() err = %v", err)
+			}
+			code, constants, err := New(node).Compile()
+			if err != nil {
+				t.Fatalf("Compile() err = %v", err)
+			}
+			if !reflect.DeepEqual(code, tt.code) {
+				t.Errorf("Compile() \n code: \n %v \n want: \n %v", code, tt.code)
+			}
+			if !reflect.DeepEqual(constants, tt.constants) {
+				t.Errorf("\n Compile() constants: \n %v \n want: \n %v", formatConstants(constants), formatConstants(tt.constants))
+			}
+		})
+	}
+}
+
+func TestCompiler_Module(t *testing.T) {
+	fsys := fstest.MapFS{
+		"lib/strings.stmt": {Data: []byte(`
+			var count = 0;
+			export var version = 2;
+		`)},
+		"cycle/a.stmt": {Data: []byte(`import "b" as b;`)},
+		"cycle/b.stmt": {Data: []byte(`import "c" as c;`)},
+		"cycle/c.stmt": {Data: []byte(`import "a" as a;`)},
+	}
+	tests := []struct {
+		name       string
+		path       string
+		source     string
+		loader     bool
+		numGlobals int
+		exports    map[string]uint64
+		err        error
+	}{
+		{
+			name: "import",
+			path: "main.stmt",
+			source: `
+			import "lib/strings" as s;
+			import "lib/strings" as t;
+			var a = s.version;
+			`,
+			loader:     true,
+			numGlobals: 5,
+			exports:    map[string]uint64{"version": 4},
+		},
+		{
+			name:   "no_loader",
+			path:   "main.stmt",
+			source: `import "lib/strings" as s;`,
+			err:    module.ErrNoLoader,
+		},
+		{
+			name:   "not_found",
+			path:   "main.stmt",
+			source: `import "strings" as s;`,
+			loader: true,
+			err:    module.ErrModuleNotFound,
+		},
+		{
+			name:   "cycle",
+			path:   "cycle/a.stmt",
+			source: `import "b" as b;`,
+			loader: true,
+			err:    module.ErrImportCycle,
+		},
+		{
+			name: "export_in_function",
+			path: "main.stmt",
+			source: `
+			fun f() {
+				export var a = 1;
+			}
+			`,
+			loader: true,
+			err:    check.ErrExportNotTopLevel,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scanner_ := scanner.New(tt.source)
+			tokens := scanner_.Scan()
+			parser_ := parser.New(tokens)
+			node, err := parser_.Parse()
+			if err != nil {
+				t.Errorf("Parse() err = %v", err)
+				return
+			}
+			compiler_ := New(node)
+			compiler_.Path = tt.path
+			if tt.loader {
+				compiler_.Loader = module.NewLoader(fsys)
+			}
+			_, constants, err := compiler_.CompileFunction()
+			if !errors.Is(err, tt.err) {
+				t.Errorf("CompileFunction() err = %v, want %v", err, tt.err)
+				return
+			}
+			if err != nil {
+				return
+			}
+			if compiler_.NumGlobals() != tt.numGlobals {
+				t.Errorf("NumGlobals() = %d, want %d", compiler_.NumGlobals(), tt.numGlobals)
+			}
+			if len(Global.LocalValues) != 3 {
+				t.Errorf("Global has %d values, want the 3 of main", len(Global.LocalValues))
+			}
+			modules := 0
+			for _, constant := range constants {
+				if module_, ok := constant.(*value.Module); ok {
+					modules++
+					if !reflect.DeepEqual(module_.Exports, tt.exports) {
+						t.Errorf("Exports = %v, want %v", module_.Exports, tt.exports)
+					}
+				}
+			}
+			if modules != 1 {
+				t.Errorf("compiled %d modules, want 1", modules)
+			}
+		})
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	source := `
+	fun add(a, b = 1) {
+		return a + b;
+	}
+	var i = 0;
+	while (i < 2) {
+		print add(i);
+		i = i + 1;
+	}
+	`
+	node, err := parser.New(scanner.New(source).Scan()).Parse()
+	if err != nil {
+		t.Fatalf("Parse() err = %v", err)
+	}
+	compiler_ := New(node)
+	compiler_.Path = "main.stmt"
+	function, constants, err := compiler_.CompileFunction()
+	if err != nil {
+		t.Fatalf("CompileFunction() err = %v", err)
+	}
+	var buf bytes.Buffer
+	err = Disassemble(&buf, function, constants)
+	if err != nil {
+		t.Fatalf("Disassemble() err = %v", err)
+	}
+	want := `== script() main.stmt:0 ==
+0000    2 OP_CLOSURE 1 <fn add>
+0002    | OP_SET_GLOBAL 0
+0005    5 OP_CONSTANT 2 Int(0)
+0007    | OP_SET_GLOBAL 1
+0010    6 OP_GET_GLOBAL 1
+0013    | OP_CONSTANT 3 Int(2)
+0015    | OP_LT
+0016    | OP_JUMP_FALSE 25 -> 0046
+0021    | OP_POP
+0022    7 OP_GET_GLOBAL 0
+0025    | OP_GET_GLOBAL 1
+0028    | OP_CALL 1
+0031    | OP_PRINT
+0032    8 OP_GET_GLOBAL 1
+0035    | OP_CONSTANT 0 Int(1)
+0037    | OP_ADD
+0038    | OP_SET_GLOBAL 1
+0041    6 OP_LOOP 36 -> 0010
+0046    | OP_POP
+
+== add(a, b) main.stmt:2 ==
+0000    2 OP_MISSING_ARG 1
+0002    | OP_JUMP_FALSE 11 -> 0018
+0007    | OP_POP
+0008    | OP_CONSTANT 0 Int(1)
+0010    | OP_SET_LOCAL 1
+0013    | OP_JUMP 1 -> 0019
+0018    | OP_POP
+0019    3 OP_GET_LOCAL 0
+0022    | OP_GET_LOCAL 1
+0025    | OP_ADD
+0026    | OP_RETURN
+`
+	if buf.String() != want {
+		t.Errorf("Disassemble() =\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestDisassemble_Register(t *testing.T) {
+	source := `
+	fun add(a, b = 1) {
+		return a + b;
+	}
+	var i = 0;
+	while (i < 2) {
+		print add(i);
+		i = i + 1;
+	}
+	`
+	node, err := parser.New(scanner.New(source).Scan()).Parse()
+	if err != nil {
+		t.Fatalf("Parse() err = %v", err)
+	}
+	compiler_ := New(node)
+	compiler_.Path = "main.stmt"
+	compiler_.Register = true
+	function, constants, err := compiler_.CompileFunction()
+	if err != nil {
+		t.Fatalf("CompileFunction() err = %v", err)
+	}
+	var buf bytes.Buffer
+	err = Disassemble(&buf, function, constants)
+	if err != nil {
+		t.Fatalf("Disassemble() err = %v", err)
+	}
+	want := `== script() main.stmt:0 ==
+0000    2 R_CLOSURE 0 1 <fn add>
+0001    | R_SET_GLOBAL 0 0
+0002    5 R_LOADK 0 2 Int(0)
+0003    | R_SET_GLOBAL 0 1
+0004    6 R_GET_GLOBAL 1 1
+0005    | R_LOADK 2 3 Int(2)
+0006    | R_LT 0 1 2
+0007    | R_JUMP_FALSE 0 -> 0017
+0008    7 R_GET_GLOBAL 0 0
+0009    | R_GET_GLOBAL 1 1
+0010    | R_CALL 0 1
+0011    | R_PRINT 0
+0012    8 R_GET_GLOBAL 1 1
+0013    | R_LOADK 2 0 Int(1)
+0014    | R_ADD 0 1 2
+0015    | R_SET_GLOBAL 0 1
+0016    6 R_JUMP -> 0004
+
+== add(a, b) main.stmt:2 ==
+0000    2 R_MISSING_ARG 2 1
+0001    | R_JUMP_FALSE 2 -> 0003
+0002    | R_LOADK 1 0 Int(1)
+0003    3 R_ADD 2 0 1
+0004    | R_RETURN 2
+`
+	if buf.String() != want {
+		t.Errorf("Disassemble() =\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestCompiler_RegisterUnsupported(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+	}{
+		{name: "class", source: "class A {}"},
+		{name: "trait", source: "trait T {}"},
+		{name: "builtin", source: "print clock();"},
+		{name: "property assignment", source: "fun f(o) { o.x = 1; }"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, err := parser.New(scanner.New(tt.source).Scan()).Parse()
+			if err != nil {
+				t.Fatalf("Parse() err = %v", err)
+			}
+			compiler_ := New(node)
+			compiler_.Register = true
+			_, _, err = compiler_.CompileFunction()
+			if !errors.Is(err, ErrRegisterUnsupported) {
+				t.Errorf("CompileFunction() err = %v, want %v", err, ErrRegisterUnsupported)
+			}
+		})
+	}
+}
+
+func TestPeephole(t *testing.T) {
+	tests := []struct {
+		name     string
+		source   string
+		want     string
+		handlers []value.Handler // 第一个函数常量的异常处理表
+	}{
+		{
+			name: "tee and jump true",
+			source: `
+			var a = true;
+			if (!a) {
+				print 1;
+			}
+			`,
+			want: `== script() <input>:0 ==
+0000    2 OP_TRUE
+0001    | OP_TEE_GLOBAL 0
+0004    3 OP_JUMP_TRUE 9 -> 0018
+0009    | OP_POP
+0010    4 OP_CONSTANT 0 Int(1)
+0012    | OP_PRINT
+0013    3 OP_JUMP 1 -> 0019
+0018    | OP_POP
+`,
+		},
+		{
+			name: "jump to jump",
+			source: `
+			var a = 1;
+			var b = 2;
+			if (a) {
+				if (b) {
+					print 1;
+				} else {
+					print 2;
+				}
+			} else {
+				print 3;
+			}
+			`,
+			want: `== script() <input>:0 ==
+0000    2 OP_CONSTANT 0 Int(1)
+0002    | OP_SET_GLOBAL 0
+0005    3 OP_CONSTANT 1 Int(2)
+0007    | OP_SET_GLOBAL 1
+0010    4 OP_GET_GLOBAL 0
+0013    | OP_JUMP_FALSE 27 -> 0045
+0018    | OP_POP
+0019    5 OP_GET_GLOBAL 1
+0022    | OP_JUMP_FALSE 9 -> 0036
+0027    | OP_POP
+0028    6 OP_CONSTANT 0 Int(1)
+0030    | OP_PRINT
+0031    5 OP_JUMP 13 -> 0049
+0036    | OP_POP
+0037    8 OP_CONSTANT 1 Int(2)
+0039    | OP_PRINT
+0040    4 OP_JUMP 4 -> 0049
+0045    | OP_POP
+0046   11 OP_CONSTANT 2 Int(3)
+0048    | OP_PRINT
+`,
+		},
+		{
+			name: "keep logical value",
+			source: `
+			var a = true;
+			print !a and a;
+			`,
+			want: `== script() <input>:0 ==
+0000    2 OP_TRUE
+0001    | OP_TEE_GLOBAL 0
+0004    3 OP_NOT
+0005    | OP_JUMP_FALSE 4 -> 0014
+0010    | OP_POP
+0011    | OP_GET_GLOBAL 0
+0014    | OP_PRINT
+`,
+		},
+		{
+			name: "handler offsets",
+			source: `
+			fun f() {
+				try {
+					var a = 1;
+					print a;
+				} catch (e) {
+					print e;
+				}
+			}
+			`,
+			want: `== script() <input>:0 ==
+0000    2 OP_CLOSURE 1 <fn f>
+0002    | OP_SET_GLOBAL 0
+
+== f() <input>:2 ==
+0000    4 OP_CONSTANT 0 Int(1)
+0002    | OP_TEE_LOCAL 0
+0005    5 OP_PRINT
+0006    3 OP_JUMP 4 -> 0015
+0011    | OP_TEE_LOCAL 0
+0014    7 OP_PRINT
+0015    2 OP_NIL
+0016    | OP_RETURN
+`,
+			handlers: []value.Handler{{Start: 0, End: 6, Target: 11, Slots: 0}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, err := parser.New(scanner.New(tt.source).Scan()).Parse()
+			if err != nil {
+				t.Fatalf("Parse() err = %v", err)
+			}
+			function, constants, err := New(node).CompileFunction()
+			if err != nil {
+				t.Fatalf("CompileFunction() err = %v", err)
+			}
+			var buf bytes.Buffer
+			err = Disassemble(&buf, function, constants)
+			if err != nil {
+				t.Fatalf("Disassemble() err = %v", err)
+			}
+			if buf.String() != tt.want {
+				t.Errorf("Disassemble() =\n%s\nwant\n%s", buf.String(), tt.want)
+			}
+			if tt.handlers != nil {
+				handlers := constants[1].(*value.Function).Handlers
+				if !reflect.DeepEqual(handlers, tt.handlers) {
+					t.Errorf("Handlers = %v, want %v", handlers, tt.handlers)
+				}
+			}
+		})
+	}
+}
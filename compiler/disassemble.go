@@ -0,0 +1,197 @@
+package compiler
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"stmt/opcode"
+	"stmt/value"
+	"strings"
+)
+
+// Disassemble 把 function 的字节码以可读的形式写入 w，constants 是编译得到的常量表。
+// function 中创建的闭包的函数体随后依次输出。
+func Disassemble(w io.Writer, function *value.Function, constants []value.Value) error {
+	functions := []*value.Function{function}
+	for i := 0; i < len(functions); i++ {
+		if i > 0 {
+			_, err := fmt.Fprintln(w)
+			if err != nil {
+				return err
+			}
+		}
+		nested, err := disassembleFunction(w, functions[i], constants)
+		if err != nil {
+			return err
+		}
+		functions = append(functions, nested...)
+	}
+	return nil
+}
+
+// disassembleFunction 输出一个函数，返回其中 OP_CLOSURE 引用的函数
+func disassembleFunction(w io.Writer, function *value.Function, constants []value.Value) ([]*value.Function, error) {
+	_, err := fmt.Fprintf(w, "== %s(%s) %s ==\n", function.DisplayName(), strings.Join(function.Params, ", "), function.Location())
+	if err != nil {
+		return nil, err
+	}
+	if function.Instructions != nil {
+		return disassembleRegister(w, function, constants)
+	}
+	var nested []*value.Function
+	code := function.Code
+	line := -1
+	for offset := uint64(0); offset < uint64(len(code)); {
+		op := code[offset]
+		info := opcode.Table[op]
+		if !info.Defined {
+			return nil, ErrInvalidOpcodeType
+		}
+		name := info.Name
+		width := uint64(info.Width)
+		if offset+1+width > uint64(len(code)) {
+			return nil, ErrInvalidOperandWidth
+		}
+		operand := readOperand(code[offset+1:], width)
+
+		lineText := "   |"
+		if l := function.LineOf(offset); l != line {
+			line = l
+			lineText = fmt.Sprintf("%4d", l)
+		}
+		text := fmt.Sprintf("%04d %s %s", offset, lineText, name)
+		if width > 0 {
+			text += fmt.Sprintf(" %d", operand)
+		}
+		next := offset + 1 + width
+		switch op {
+		case opcode.OP_CONSTANT, opcode.OP_CONSTANT_2, opcode.OP_CONSTANT_4, opcode.OP_CONSTANT_8,
+			opcode.OP_IMPORT, opcode.OP_CLASS, opcode.OP_METHOD, opcode.OP_GET_SUPER,
+			opcode.OP_STATIC, opcode.OP_GETTER, opcode.OP_SETTER, opcode.OP_TRAIT:
+			if operand < uint64(len(constants)) {
+				text += " " + constants[operand].String()
+			}
+		case opcode.OP_GET_BUILTIN:
+			if operand < uint64(len(value.Builtins)) {
+				text += " " + value.Builtins[operand]
+			}
+		case opcode.OP_GET_PROPERTY, opcode.OP_SET_PROPERTY:
+			if operand < uint64(len(function.Caches)) {
+				text += " ." + function.Caches[operand].Name
+			}
+		case opcode.OP_INVOKE:
+			if cache := operand >> 8; cache < uint64(len(function.Caches)) {
+				text += fmt.Sprintf(" .%s(%d)", function.Caches[cache].Name, operand&0xff)
+			}
+		case opcode.OP_JUMP, opcode.OP_JUMP_FALSE, opcode.OP_JUMP_TRUE:
+			text += fmt.Sprintf(" -> %04d", next+operand)
+		case opcode.OP_LOOP:
+			text += fmt.Sprintf(" -> %04d", next-operand)
+		case opcode.OP_CLOSURE, opcode.OP_CLOSURE_2, opcode.OP_CLOSURE_4, opcode.OP_CLOSURE_8:
+			if operand >= uint64(len(constants)) {
+				return nil, ErrInvalidClosureIndex
+			}
+			_function, ok := constants[operand].(*value.Function)
+			if !ok {
+				return nil, ErrInvalidClosureIndex
+			}
+			nested = append(nested, _function)
+			text += fmt.Sprintf(" <fn %s>", _function.DisplayName())
+			for i := uint64(0); i < _function.NumUpvalues; i++ {
+				if next+2 > uint64(len(code)) {
+					return nil, ErrInvalidOperandWidth
+				}
+				kind := "upvalue"
+				if code[next] == 1 {
+					kind = "local"
+				}
+				text += fmt.Sprintf(" %s %d", kind, code[next+1])
+				next += 2
+			}
+		}
+		_, err = fmt.Fprintln(w, text)
+		if err != nil {
+			return nil, err
+		}
+		offset = next
+	}
+	return nested, nil
+}
+
+// disassembleRegister 输出寄存器指令，格式和字节码相同，偏移是指令下标
+func disassembleRegister(w io.Writer, function *value.Function, constants []value.Value) ([]*value.Function, error) {
+	var nested []*value.Function
+	code := function.Instructions
+	line := -1
+	for offset := uint64(0); offset < uint64(len(code)); offset++ {
+		instruction := code[offset]
+		op := opcode.Op(instruction)
+		name, ok := opcode.RegisterNames[op]
+		if !ok {
+			return nil, ErrInvalidOpcodeType
+		}
+		lineText := "   |"
+		if l := function.LineOf(offset); l != line {
+			line = l
+			lineText = fmt.Sprintf("%4d", l)
+		}
+		text := fmt.Sprintf("%04d %s %s", offset, lineText, name)
+		a, b, c, bx := opcode.A(instruction), opcode.B(instruction), opcode.C(instruction), uint64(opcode.Bx(instruction))
+		switch opcode.RegisterFormats[op] {
+		case opcode.FormatA:
+			text += fmt.Sprintf(" %d", a)
+		case opcode.FormatAB:
+			text += fmt.Sprintf(" %d %d", a, b)
+		case opcode.FormatABC:
+			text += fmt.Sprintf(" %d %d %d", a, b, c)
+		case opcode.FormatABx:
+			text += fmt.Sprintf(" %d %d", a, bx)
+		case opcode.FormatSBx:
+			text += fmt.Sprintf(" -> %04d", int(offset)+1+opcode.SBx(instruction))
+		case opcode.FormatASBx:
+			text += fmt.Sprintf(" %d -> %04d", a, int(offset)+1+opcode.SBx(instruction))
+		}
+		switch op {
+		case opcode.R_LOADK, opcode.R_GET_PROPERTY, opcode.R_IMPORT:
+			if bx < uint64(len(constants)) {
+				text += " " + constants[bx].String()
+			}
+		case opcode.R_CLOSURE:
+			if bx >= uint64(len(constants)) {
+				return nil, ErrInvalidClosureIndex
+			}
+			_function, ok := constants[bx].(*value.Function)
+			if !ok {
+				return nil, ErrInvalidClosureIndex
+			}
+			nested = append(nested, _function)
+			text += fmt.Sprintf(" <fn %s>", _function.DisplayName())
+		case opcode.R_CAPTURE:
+			if a == 1 {
+				text += " local"
+			} else {
+				text += " upvalue"
+			}
+		}
+		_, err := fmt.Fprintln(w, text)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nested, nil
+}
+
+func readOperand(code []uint8, width uint64) uint64 {
+	switch width {
+	case 1:
+		return uint64(code[0])
+	case 2:
+		return uint64(binary.BigEndian.Uint16(code))
+	case 4:
+		return uint64(binary.BigEndian.Uint32(code))
+	case 8:
+		return binary.BigEndian.Uint64(code)
+	default:
+		return 0
+	}
+}
@@ -12,4 +12,11 @@ var (
 	ErrInvalidSymbolScope     = errors.New("invalid symbol scope")
 	ErrVariableNotDefined     = errors.New("variable not defined")
 	ErrVariableAlreadyDefined = errors.New("variable already defined")
+	ErrInvalidOpcodeType      = errors.New("invalid opcode type")
+	ErrInvalidOperandWidth    = errors.New("invalid operand width")
+	ErrTooManyRegisters       = errors.New("too many registers")
+	ErrTooManyLocals          = errors.New("too many local variables for the register backend")
+	ErrRegisterUnsupported    = errors.New("not supported by the register backend")
+	ErrOperandOutOfRange      = errors.New("operand out of range")
+	ErrInvalidCacheIndex      = errors.New("invalid inline cache index")
 )
@@ -0,0 +1,242 @@
+package compiler
+
+import (
+	"stmt/opcode"
+	"stmt/value"
+)
+
+// instruction 是解码后的一条指令，跳转目标记录为指令下标
+type instruction struct {
+	Op      uint8
+	Operand uint64
+	Extra   []uint8 // OP_CLOSURE 之后的 upvalue 信息
+	Offset  uint64  // 优化前的偏移
+	Target  int     // 跳转指令的目标指令下标
+	Deleted bool
+}
+
+// isJump 判断 op 是否为以相对偏移跳转的指令
+func isJump(op uint8) bool {
+	switch op {
+	case opcode.OP_JUMP, opcode.OP_JUMP_FALSE, opcode.OP_JUMP_TRUE, opcode.OP_LOOP:
+		return true
+	default:
+		return false
+	}
+}
+
+// instructionSize 返回 op 连同操作数的字节数，不包括 OP_CLOSURE 之后的 upvalue 信息
+func instructionSize(op uint8) uint64 {
+	return uint64(1 + opcode.Table[op].Width)
+}
+
+// Peephole 在 function 的字节码上做窥孔优化，并修正跳转偏移、行号表和异常处理表：
+//
+//	OP_SET_LOCAL i; OP_GET_LOCAL i       => OP_TEE_LOCAL i（全局变量同理）
+//	OP_JUMP a; ... a: OP_JUMP b          => OP_JUMP b（OP_JUMP_FALSE、OP_JUMP_TRUE 同理）
+//	OP_JUMP a; a:                        => 删除
+//	OP_NOT; OP_JUMP_FALSE a; OP_POP; ... a: OP_POP
+//	                                     => OP_JUMP_TRUE a; OP_POP; ... a: OP_POP
+//
+// 被跳转到的指令不会和前一条指令合并。constants 用于确定 OP_CLOSURE 的长度。
+func Peephole(function *value.Function, constants []value.Value) error {
+	instructions, err := decode(function.Code, constants)
+	if err != nil {
+		return err
+	}
+	labels := make([]bool, len(instructions)+1)
+	index := map[uint64]int{uint64(len(function.Code)): len(instructions)}
+	for i, instruction_ := range instructions {
+		index[instruction_.Offset] = i
+	}
+	for i := range instructions {
+		instruction_ := &instructions[i]
+		if !isJump(instruction_.Op) {
+			continue
+		}
+		// 偏移相对于跳转指令之后的下一条指令
+		next := instruction_.Offset + instructionSize(instruction_.Op)
+		var target uint64
+		if instruction_.Op == opcode.OP_LOOP {
+			target = next - instruction_.Operand
+		} else {
+			target = next + instruction_.Operand
+		}
+		t, ok := index[target]
+		if !ok {
+			return ErrInvalidOperandWidth
+		}
+		instruction_.Target = t
+		labels[t] = true
+	}
+	for _, handler := range function.Handlers {
+		for _, offset := range []uint64{handler.Start, handler.End, handler.Target} {
+			labels[index[offset]] = true
+		}
+	}
+
+	for changed := true; changed; {
+		changed = false
+		live := liveIndexes(instructions)
+		for n, i := range live {
+			instruction_ := &instructions[i]
+			var next *instruction
+			if n+1 < len(live) {
+				next = &instructions[live[n+1]]
+			}
+			switch instruction_.Op {
+			case opcode.OP_SET_LOCAL, opcode.OP_SET_GLOBAL:
+				get := opcode.OP_GET_LOCAL
+				tee := opcode.OP_TEE_LOCAL
+				if instruction_.Op == opcode.OP_SET_GLOBAL {
+					get, tee = opcode.OP_GET_GLOBAL, opcode.OP_TEE_GLOBAL
+				}
+				if next != nil && next.Op == get && next.Operand == instruction_.Operand && !labels[live[n+1]] {
+					instruction_.Op = tee
+					next.Deleted = true
+					changed = true
+				}
+			case opcode.OP_JUMP, opcode.OP_JUMP_FALSE, opcode.OP_JUMP_TRUE:
+				target := firstLive(instructions, instruction_.Target)
+				if target < len(instructions) && instructions[target].Op == opcode.OP_JUMP && instructions[target].Target != instruction_.Target {
+					instruction_.Target = instructions[target].Target
+					labels[instruction_.Target] = true
+					changed = true
+				} else if instruction_.Op == opcode.OP_JUMP && target == firstLive(instructions, i+1) {
+					instruction_.Deleted = true
+					changed = true
+				}
+			case opcode.OP_NOT:
+				if labels[i] || next == nil || next.Op != opcode.OP_JUMP_FALSE || labels[live[n+1]] || n+2 >= len(live) {
+					break
+				}
+				// 条件值在两条路径上都会被弹出，保留取反前的值不影响结果；
+				// 严格模式下 OP_NOT 和 OP_JUMP_TRUE 对非 bool 的值报告同一个错误
+				target := firstLive(instructions, next.Target)
+				if instructions[live[n+2]].Op != opcode.OP_POP || target >= len(instructions) || instructions[target].Op != opcode.OP_POP {
+					break
+				}
+				instruction_.Deleted = true
+				next.Op = opcode.OP_JUMP_TRUE
+				changed = true
+			}
+		}
+	}
+	encode(function, instructions, index)
+	return nil
+}
+
+func decode(code []uint8, constants []value.Value) ([]instruction, error) {
+	var instructions []instruction
+	for offset := uint64(0); offset < uint64(len(code)); {
+		op := code[offset]
+		info := opcode.Table[op]
+		if !info.Defined {
+			return nil, ErrInvalidOpcodeType
+		}
+		width := info.Width
+		next := offset + 1 + uint64(width)
+		if next > uint64(len(code)) {
+			return nil, ErrInvalidOperandWidth
+		}
+		instruction_ := instruction{
+			Op:      op,
+			Operand: readOperand(code[offset+1:], uint64(width)),
+			Offset:  offset,
+		}
+		switch op {
+		case opcode.OP_CLOSURE, opcode.OP_CLOSURE_2, opcode.OP_CLOSURE_4, opcode.OP_CLOSURE_8:
+			if instruction_.Operand >= uint64(len(constants)) {
+				return nil, ErrInvalidClosureIndex
+			}
+			function, ok := constants[instruction_.Operand].(*value.Function)
+			if !ok {
+				return nil, ErrInvalidClosureIndex
+			}
+			end := next + 2*function.NumUpvalues
+			if end > uint64(len(code)) {
+				return nil, ErrInvalidOperandWidth
+			}
+			instruction_.Extra = code[next:end]
+			next = end
+		}
+		instructions = append(instructions, instruction_)
+		offset = next
+	}
+	return instructions, nil
+}
+
+// liveIndexes 返回没有被删除的指令下标
+func liveIndexes(instructions []instruction) []int {
+	var live []int
+	for i := range instructions {
+		if !instructions[i].Deleted {
+			live = append(live, i)
+		}
+	}
+	return live
+}
+
+// firstLive 返回从 i 开始第一条没有被删除的指令下标，都被删除时返回 len(instructions)
+func firstLive(instructions []instruction, i int) int {
+	for i < len(instructions) && instructions[i].Deleted {
+		i++
+	}
+	return i
+}
+
+// encode 重新生成字节码，index 是优化前的偏移到指令下标的映射
+func encode(function *value.Function, instructions []instruction, index map[uint64]int) {
+	// 被删除的指令映射到其后第一条保留的指令
+	offsets := make([]uint64, len(instructions)+1)
+	size := uint64(0)
+	for i, instruction_ := range instructions {
+		offsets[i] = size
+		if !instruction_.Deleted {
+			size += instructionSize(instruction_.Op) + uint64(len(instruction_.Extra))
+		}
+	}
+	offsets[len(instructions)] = size
+
+	code := make([]uint8, 0, size)
+	for _, instruction_ := range instructions {
+		if instruction_.Deleted {
+			continue
+		}
+		operand := instruction_.Operand
+		if isJump(instruction_.Op) {
+			from := uint64(len(code)) + instructionSize(instruction_.Op)
+			to := offsets[instruction_.Target]
+			if instruction_.Op == opcode.OP_LOOP {
+				operand = from - to
+			} else {
+				operand = to - from
+			}
+		}
+		code = append(code, CodeMake(instruction_.Op, operand)...)
+		code = append(code, instruction_.Extra...)
+	}
+	function.Code = code
+
+	var lines []value.Line
+	for _, line := range function.Lines {
+		offset := offsets[index[line.Offset]]
+		if offset >= size {
+			continue
+		}
+		if n := len(lines); n > 0 && lines[n-1].Offset == offset {
+			lines = lines[:n-1]
+		}
+		if n := len(lines); n > 0 && lines[n-1].Line == line.Line {
+			continue
+		}
+		lines = append(lines, value.Line{Offset: offset, Line: line.Line})
+	}
+	function.Lines = lines
+	for i := range function.Handlers {
+		handler := &function.Handlers[i]
+		handler.Start = offsets[index[handler.Start]]
+		handler.End = offsets[index[handler.End]]
+		handler.Target = offsets[index[handler.Target]]
+	}
+}
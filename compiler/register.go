@@ -0,0 +1,861 @@
+package compiler
+
+import (
+	"fmt"
+	"slices"
+	"stmt/ast"
+	"stmt/opcode"
+	"stmt/token"
+	"stmt/value"
+)
+
+// 编译为寄存器指令时，局部变量（包括参数）的槽位就是它所在的寄存器，
+// 表达式的中间结果保存在局部变量之上的临时寄存器中，每个表达式节点编译完后释放它使用的临时寄存器，
+// 结果要保存到临时寄存器时，左操作数直接算到其中，所以左结合的长表达式不会随项数占用更多寄存器。
+// 操作数只有 8 位，一个函数最多有 opcode.MaxRegisters 个寄存器，局部变量超出时报告 ErrTooManyLocals。
+// 类、trait 和内置函数还没有对应的寄存器指令，编译到它们时报告 ErrRegisterUnsupported。
+
+// NewRegisterScope 创建编译为寄存器指令的函数的 Scope
+func NewRegisterScope() *Scope {
+	return &Scope{
+		Register:     true,
+		Instructions: []uint32{},
+	}
+}
+
+// registerTop 把 top 及之上的寄存器标记为空闲
+func (s *Scope) registerTop(top uint64) error {
+	if top > opcode.MaxRegisters {
+		return ErrTooManyRegisters
+	}
+	s.free = top
+	if top > s.NumRegisters {
+		s.NumRegisters = top
+	}
+	return nil
+}
+
+// registerReset 释放所有临时寄存器，只保留局部变量
+func (s *Scope) registerReset(symbolTable *SymbolTable) error {
+	return s.registerTop(symbolTable.NumSlots())
+}
+
+// registerUnsupported 返回寄存器指令不支持 feature 的错误
+func registerUnsupported(feature string) error {
+	return fmt.Errorf("%w: %s", ErrRegisterUnsupported, feature)
+}
+
+// registerLocal 在定义新的局部变量前检查寄存器是否还能容纳它
+func registerLocal(symbolTable *SymbolTable) error {
+	if symbolTable.NumSlots() >= opcode.MaxRegisters {
+		return ErrTooManyLocals
+	}
+	return nil
+}
+
+// registerAlloc 分配一个临时寄存器
+func (s *Scope) registerAlloc() (uint8, error) {
+	r := s.free
+	err := s.registerTop(r + 1)
+	return uint8(r), err
+}
+
+func (s *Scope) emitInstruction(instruction uint32) uint64 {
+	offset := s.Offset()
+	s.lineAdd(offset)
+	s.Instructions = append(s.Instructions, instruction)
+	return offset
+}
+
+func (s *Scope) EmitABC(op uint8, a uint8, b uint8, c uint8) uint64 {
+	return s.emitInstruction(opcode.MakeABC(op, a, b, c))
+}
+
+func (s *Scope) EmitABx(op uint8, a uint8, bx uint64) error {
+	if bx > opcode.MaxBx {
+		return ErrOperandOutOfRange
+	}
+	s.emitInstruction(opcode.MakeABx(op, a, uint16(bx)))
+	return nil
+}
+
+// EmitJump 生成跳转到之后位置的指令，返回的偏移用于 PatchJump
+func (s *Scope) EmitJump(op uint8, a uint8) uint64 {
+	return s.emitInstruction(opcode.MakeASBx(op, a, 0))
+}
+
+// PatchJump 把 offset 处的跳转指令的目标设为当前位置
+func (s *Scope) PatchJump(offset uint64) error {
+	return s.patchJump(offset, s.Offset())
+}
+
+// JumpBack 生成跳转到之前位置 target 的指令
+func (s *Scope) JumpBack(target uint64) error {
+	offset := s.EmitJump(opcode.R_JUMP, 0)
+	return s.patchJump(offset, target)
+}
+
+func (s *Scope) patchJump(offset uint64, target uint64) error {
+	sbx := int(target) - int(offset) - 1
+	if sbx > opcode.MaxSBx || sbx < -opcode.MaxSBx {
+		return ErrOperandOutOfRange
+	}
+	instruction := s.Instructions[offset]
+	s.Instructions[offset] = opcode.MakeASBx(opcode.Op(instruction), opcode.A(instruction), sbx)
+	return nil
+}
+
+// registerConstant 把常量 obj 加载到寄存器 dst
+func (c *Compiler) registerConstant(obj value.Value, dst uint8, scope *Scope) error {
+	return scope.EmitABx(opcode.R_LOADK, dst, c.constantAdd(obj))
+}
+
+func (c *Compiler) registerCompile(node ast.Node, symbolTable *SymbolTable, scope *Scope) error {
+	line := scope.Line
+	if node.Pos() > 0 {
+		scope.Line = node.Pos()
+	}
+	err := scope.registerReset(symbolTable)
+	if err == nil {
+		err = c.registerStatement(node, symbolTable, scope)
+	}
+	if err == nil {
+		err = scope.registerReset(symbolTable)
+	}
+	scope.Line = line
+	return err
+}
+
+func (c *Compiler) registerStatement(node ast.Node, symbolTable *SymbolTable, scope *Scope) error {
+	switch _node := node.(type) {
+	case *ast.ExpressionStatement:
+		_, err := c.registerExpr(_node.Expression, symbolTable, scope)
+		return err
+	case *ast.Print:
+		r, err := c.registerExpr(_node.Expression, symbolTable, scope)
+		if err != nil {
+			return err
+		}
+		scope.EmitABC(opcode.R_PRINT, r, 0, 0)
+		return nil
+	case *ast.Var:
+		err := registerLocal(symbolTable)
+		if err != nil {
+			return err
+		}
+		r, err := scope.registerAlloc()
+		if err != nil {
+			return err
+		}
+		if _node.Initializer == nil {
+			scope.EmitABC(opcode.R_LOADNIL, r, 0, 0)
+		} else {
+			err = c.registerExprTo(_node.Initializer, r, symbolTable, scope)
+			if err != nil {
+				return err
+			}
+		}
+		symbolIndex, symbolScope, err := symbolTable.Define(_node.Name.Lexeme)
+		if err != nil {
+			return err
+		}
+		return c.registerSymbolSet(symbolIndex, symbolScope, r, scope)
+	case *ast.Block:
+		_symbolTable := NewBlockSymbolTable(symbolTable)
+		for _, statement := range _node.Declarations {
+			err := c.registerCompile(statement, _symbolTable, scope)
+			if err != nil {
+				return err
+			}
+		}
+		registerCloseBlock(_symbolTable, scope)
+		return nil
+	case *ast.If:
+		r, err := c.registerExpr(_node.Condition, symbolTable, scope)
+		if err != nil {
+			return err
+		}
+		offsetFalse := scope.EmitJump(opcode.R_JUMP_FALSE, r)
+		err = c.registerCompile(_node.ThenBranch, symbolTable, scope)
+		if err != nil {
+			return err
+		}
+		if _node.ElseBranch == nil {
+			return scope.PatchJump(offsetFalse)
+		}
+		offset := scope.EmitJump(opcode.R_JUMP, 0)
+		err = scope.PatchJump(offsetFalse)
+		if err != nil {
+			return err
+		}
+		err = c.registerCompile(_node.ElseBranch, symbolTable, scope)
+		if err != nil {
+			return err
+		}
+		return scope.PatchJump(offset)
+	case *ast.While:
+		init := scope.Offset()
+		r, err := c.registerExpr(_node.Condition, symbolTable, scope)
+		if err != nil {
+			return err
+		}
+		offsetFalse := scope.EmitJump(opcode.R_JUMP_FALSE, r)
+		_symbolTable := NewBlockSymbolTable(symbolTable)
+		for _, statement := range _node.Body.Declarations {
+			err = c.registerCompile(statement, _symbolTable, scope)
+			if err != nil {
+				return err
+			}
+		}
+		registerCloseBlock(_symbolTable, scope)
+		err = scope.JumpBack(init)
+		if err != nil {
+			return err
+		}
+		return scope.PatchJump(offsetFalse)
+	case *ast.Function:
+		return c.registerFunction(_node, symbolTable, scope)
+	case *ast.Return:
+		return c.registerReturn(_node, symbolTable, scope)
+	case *ast.Throw:
+		r, err := c.registerExpr(_node.Expression, symbolTable, scope)
+		if err != nil {
+			return err
+		}
+		scope.EmitABC(opcode.R_THROW, r, 0, 0)
+		return nil
+	case *ast.Try:
+		return c.registerTry(_node, symbolTable, scope)
+	case *ast.Class:
+		return registerUnsupported("class " + _node.Name.Lexeme)
+	case *ast.Trait:
+		return registerUnsupported("trait " + _node.Name.Lexeme)
+	case *ast.Import:
+		index, err := c.compileModule(_node.Path)
+		if err != nil {
+			return err
+		}
+		err = registerLocal(symbolTable)
+		if err != nil {
+			return err
+		}
+		// 模块的顶层代码在 R[A] 之后的寄存器中执行，所以 R[A] 必须是最上面的寄存器
+		r, err := scope.registerAlloc()
+		if err != nil {
+			return err
+		}
+		err = scope.EmitABx(opcode.R_IMPORT, r, index)
+		if err != nil {
+			return err
+		}
+		symbolIndex, symbolScope, err := symbolTable.Define(_node.Name.Lexeme)
+		if err != nil {
+			return err
+		}
+		return c.registerSymbolSet(symbolIndex, symbolScope, r, scope)
+	case *ast.Export:
+		err := c.registerCompile(_node.Declaration, symbolTable, scope)
+		if err != nil {
+			return err
+		}
+		var name string
+		switch declaration := _node.Declaration.(type) {
+		case *ast.Var:
+			name = declaration.Name.Lexeme
+		case *ast.Function:
+			name = declaration.Name.Lexeme
+		default:
+			return ErrInvalidNodeType
+		}
+		symbolIndex, _, _ := symbolTable.Get(name)
+		c.exports[name] = symbolIndex
+		return nil
+	default:
+		return ErrInvalidNodeType
+	}
+}
+
+// registerSymbolSet 把寄存器 r 的值保存到变量中。新定义的局部变量就在 r 中时不需要指令
+func (c *Compiler) registerSymbolSet(symbolIndex uint64, symbolScope string, r uint8, scope *Scope) error {
+	switch symbolScope {
+	case LocalScope:
+		if symbolIndex != uint64(r) {
+			scope.EmitABC(opcode.R_MOVE, uint8(symbolIndex), r, 0)
+		}
+		return nil
+	case UpScope:
+		return scope.EmitABx(opcode.R_SET_UPVALUE, r, symbolIndex)
+	case GlobalScope:
+		return scope.EmitABx(opcode.R_SET_GLOBAL, r, symbolIndex)
+	default:
+		return ErrInvalidSymbolScope
+	}
+}
+
+// registerCloseBlock 结束块作用域，和 closeBlock 相同
+func registerCloseBlock(symbolTable *SymbolTable, scope *Scope) {
+	if symbolTable.Captured() {
+		scope.EmitABC(opcode.R_CLOSE_UPVALUE, uint8(symbolTable.base), 0, 0)
+	}
+	symbolTable.Close()
+}
+
+// registerExpr 编译表达式，返回保存结果的寄存器。局部变量和对它的赋值直接使用它所在的寄存器，
+// 其他表达式的结果保存在新分配的临时寄存器中
+func (c *Compiler) registerExpr(node ast.Expr, symbolTable *SymbolTable, scope *Scope) (uint8, error) {
+	switch _node := node.(type) {
+	case *ast.Variable:
+		symbolIndex, symbolScope, ex := symbolTable.Get(_node.Name.Lexeme)
+		if ex && symbolScope == LocalScope {
+			return uint8(symbolIndex), nil
+		}
+	case *ast.Assign:
+		line := scope.Line
+		scope.Line = _node.Line
+		r, err := c.registerAssign(_node, symbolTable, scope)
+		scope.Line = line
+		return r, err
+	}
+	r, err := scope.registerAlloc()
+	if err != nil {
+		return 0, err
+	}
+	err = c.registerExprTo(node, r, symbolTable, scope)
+	return r, err
+}
+
+// registerOperand 编译左操作数 node。它是局部变量而之后求值的 rest 可能修改它时，
+// 先复制到临时寄存器，保证按从左到右的顺序取值
+func (c *Compiler) registerOperand(node ast.Expr, symbolTable *SymbolTable, scope *Scope, rest ...ast.Expr) (uint8, error) {
+	r, err := c.registerExpr(node, symbolTable, scope)
+	if err != nil || uint64(r) >= symbolTable.NumSlots() {
+		return r, err
+	}
+	for _, expr := range rest {
+		if !pure(expr) {
+			t, err := scope.registerAlloc()
+			if err != nil {
+				return 0, err
+			}
+			scope.EmitABC(opcode.R_MOVE, t, r, 0)
+			return t, nil
+		}
+	}
+	return r, nil
+}
+
+// registerLeft 编译保存到 dst 的运算的左操作数 node。dst 是临时寄存器时直接把 node 算到 dst 中，
+// 此时 dst 还没有保存结果，之后求值的 rest 不会读取它
+func (c *Compiler) registerLeft(node ast.Expr, dst uint8, symbolTable *SymbolTable, scope *Scope, rest ...ast.Expr) (uint8, error) {
+	if _, ok := node.(*ast.Variable); ok || uint64(dst) < symbolTable.NumSlots() {
+		return c.registerOperand(node, symbolTable, scope, rest...)
+	}
+	return dst, c.registerExprTo(node, dst, symbolTable, scope)
+}
+
+// registerExprTo 把表达式的结果保存到寄存器 dst，期间分配的临时寄存器在返回前释放
+func (c *Compiler) registerExprTo(node ast.Expr, dst uint8, symbolTable *SymbolTable, scope *Scope) error {
+	line, free := scope.Line, scope.free
+	if node.Pos() > 0 {
+		scope.Line = node.Pos()
+	}
+	err := c.registerNode(node, dst, symbolTable, scope)
+	scope.Line, scope.free = line, free
+	return err
+}
+
+func (c *Compiler) registerNode(node ast.Expr, dst uint8, symbolTable *SymbolTable, scope *Scope) error {
+	switch _node := node.(type) {
+	case *ast.Literal:
+		switch value_ := _node.Value.(type) {
+		case int64:
+			return c.registerConstant(value.NewInt(value_), dst, scope)
+		case float64:
+			return c.registerConstant(value.NewFloat(value_), dst, scope)
+		case string:
+			return c.registerConstant(value.NewString(value_), dst, scope)
+		case bool:
+			var b uint8
+			if value_ {
+				b = 1
+			}
+			scope.EmitABC(opcode.R_LOADBOOL, dst, b, 0)
+			return nil
+		case nil:
+			scope.EmitABC(opcode.R_LOADNIL, dst, 0, 0)
+			return nil
+		default:
+			return ErrInvalidOperandType
+		}
+	case *ast.Grouping:
+		return c.registerExprTo(_node.Expression, dst, symbolTable, scope)
+	case *ast.Unary:
+		var op uint8
+		switch _node.Operator.TokenType {
+		case token.MINUS:
+			op = opcode.R_NEGATE
+		case token.BANG:
+			op = opcode.R_NOT
+		default:
+			return ErrInvalidOperatorType
+		}
+		r, err := c.registerLeft(_node.Right, dst, symbolTable, scope)
+		if err != nil {
+			return err
+		}
+		scope.EmitABC(op, dst, r, 0)
+		return nil
+	case *ast.Binary:
+		op, ok := registerBinaryOps[_node.Operator.TokenType]
+		if !ok {
+			return ErrInvalidOperatorType
+		}
+		b, err := c.registerLeft(_node.Left, dst, symbolTable, scope, _node.Right)
+		if err != nil {
+			return err
+		}
+		r, err := c.registerExpr(_node.Right, symbolTable, scope)
+		if err != nil {
+			return err
+		}
+		scope.EmitABC(op, dst, b, r)
+		return nil
+	case *ast.Logical:
+		var op uint8
+		switch _node.Operator.TokenType {
+		case token.AND:
+			op = opcode.R_JUMP_FALSE
+		case token.OR:
+			op = opcode.R_JUMP_TRUE
+		default:
+			return ErrInvalidOperatorType
+		}
+		err := c.registerExprTo(_node.Left, dst, symbolTable, scope)
+		if err != nil {
+			return err
+		}
+		offset := scope.EmitJump(op, dst)
+		err = c.registerExprTo(_node.Right, dst, symbolTable, scope)
+		if err != nil {
+			return err
+		}
+		// 左操作数已由跳转检查，严格模式下还要检查作为结果的右操作数
+		if c.Strict {
+			scope.EmitABC(opcode.R_TEST_BOOL, dst, 0, 0)
+		}
+		return scope.PatchJump(offset)
+	case *ast.Variable:
+		symbolIndex, symbolScope, ex := symbolTable.Get(_node.Name.Lexeme)
+		if !ex {
+			if slices.Contains(value.Builtins, _node.Name.Lexeme) {
+				return registerUnsupported("builtin function " + _node.Name.Lexeme)
+			}
+			return ErrVariableNotDefined
+		}
+		switch symbolScope {
+		case LocalScope:
+			if symbolIndex != uint64(dst) {
+				scope.EmitABC(opcode.R_MOVE, dst, uint8(symbolIndex), 0)
+			}
+			return nil
+		case UpScope:
+			return scope.EmitABx(opcode.R_GET_UPVALUE, dst, symbolIndex)
+		case GlobalScope:
+			return scope.EmitABx(opcode.R_GET_GLOBAL, dst, symbolIndex)
+		default:
+			return ErrInvalidSymbolScope
+		}
+	case *ast.Assign:
+		r, err := c.registerAssign(_node, symbolTable, scope)
+		if err != nil {
+			return err
+		}
+		if r != dst {
+			scope.EmitABC(opcode.R_MOVE, dst, r, 0)
+		}
+		return nil
+	case *ast.Call:
+		// dst 是最上面的临时寄存器时直接在其中调用，否则调用后再复制
+		base := dst
+		if uint64(dst) < symbolTable.NumSlots() || uint64(dst)+1 != scope.free {
+			var err error
+			base, err = scope.registerAlloc()
+			if err != nil {
+				return err
+			}
+		}
+		err := c.registerCall(_node, opcode.R_CALL, base, symbolTable, scope)
+		if err != nil {
+			return err
+		}
+		if base != dst {
+			scope.EmitABC(opcode.R_MOVE, dst, base, 0)
+		}
+		return nil
+	case *ast.Get:
+		err := c.registerExprTo(_node.Object, dst, symbolTable, scope)
+		if err != nil {
+			return err
+		}
+		index := c.constantAdd(value.NewString(_node.Name.Lexeme))
+		return scope.EmitABx(opcode.R_GET_PROPERTY, dst, index)
+	case *ast.Index:
+		b, err := c.registerLeft(_node.Object, dst, symbolTable, scope, _node.Index)
+		if err != nil {
+			return err
+		}
+		r, err := c.registerExpr(_node.Index, symbolTable, scope)
+		if err != nil {
+			return err
+		}
+		scope.EmitABC(opcode.R_INDEX, dst, b, r)
+		return nil
+	case *ast.Set:
+		return registerUnsupported("property assignment")
+	case *ast.This:
+		return registerUnsupported("this")
+	case *ast.Super:
+		return registerUnsupported("super")
+	default:
+		return ErrInvalidNodeType
+	}
+}
+
+var registerBinaryOps = map[string]uint8{
+	token.PLUS:          opcode.R_ADD,
+	token.MINUS:         opcode.R_SUBTRACT,
+	token.STAR:          opcode.R_MULTIPLY,
+	token.SLASH:         opcode.R_DIVIDE,
+	token.PERCENTAGE:    opcode.R_MODULO,
+	token.GREATER:       opcode.R_GT,
+	token.LESS:          opcode.R_LT,
+	token.EQUAL_EQUAL:   opcode.R_EQ,
+	token.BANG_EQUAL:    opcode.R_NE,
+	token.GREATER_EQUAL: opcode.R_GE,
+	token.LESS_EQUAL:    opcode.R_LE,
+}
+
+// registerAssign 编译赋值，返回保存所赋的值的寄存器
+func (c *Compiler) registerAssign(node *ast.Assign, symbolTable *SymbolTable, scope *Scope) (uint8, error) {
+	symbolIndex, symbolScope, ex := symbolTable.Get(node.Name.Lexeme)
+	if !ex {
+		return 0, ErrVariableNotDefined
+	}
+	if symbolScope != LocalScope {
+		r, err := c.registerExpr(node.Value, symbolTable, scope)
+		if err != nil {
+			return 0, err
+		}
+		return r, c.registerSymbolSet(symbolIndex, symbolScope, r, scope)
+	}
+	local := uint8(symbolIndex)
+	if writesOnce(node.Value) {
+		return local, c.registerExprTo(node.Value, local, symbolTable, scope)
+	}
+	// 分多步写入结果的表达式可能在中途读取变量原来的值，先算到临时寄存器中
+	t, err := scope.registerAlloc()
+	if err != nil {
+		return 0, err
+	}
+	err = c.registerExprTo(node.Value, t, symbolTable, scope)
+	if err != nil {
+		return 0, err
+	}
+	scope.EmitABC(opcode.R_MOVE, local, t, 0)
+	return local, nil
+}
+
+// registerCall 在从 base 开始的寄存器中编译函数调用，op 为 R_CALL 或 R_TAIL_CALL。
+// base 必须是最上面的寄存器，被调用函数的栈帧从它之后开始
+func (c *Compiler) registerCall(node *ast.Call, op uint8, base uint8, symbolTable *SymbolTable, scope *Scope) error {
+	err := c.registerExprTo(node.Callee, base, symbolTable, scope)
+	if err != nil {
+		return err
+	}
+	for _, argument := range node.Arguments {
+		r, err := scope.registerAlloc()
+		if err != nil {
+			return err
+		}
+		err = c.registerExprTo(argument, r, symbolTable, scope)
+		if err != nil {
+			return err
+		}
+	}
+	scope.EmitABC(op, base, uint8(len(node.Arguments)), 0)
+	return nil
+}
+
+// registerFunction 编译函数声明，闭包直接创建在局部变量的寄存器中
+func (c *Compiler) registerFunction(node *ast.Function, symbolTable *SymbolTable, scope *Scope) error {
+	err := registerLocal(symbolTable)
+	if err != nil {
+		return err
+	}
+	symbolIndex, symbolScope, err := symbolTable.Define(node.Name.Lexeme)
+	if err != nil {
+		return err
+	}
+	dst := uint8(symbolIndex)
+	if symbolScope != LocalScope {
+		dst, err = scope.registerAlloc()
+		if err != nil {
+			return err
+		}
+	} else {
+		err = scope.registerReset(symbolTable)
+		if err != nil {
+			return err
+		}
+	}
+	_symbolTable := NewSymbolTable(symbolTable)
+	_scope := NewRegisterScope()
+	_scope.Line = node.Line
+	numRegisters := uint64(len(node.Params))
+	if node.Rest != nil {
+		numRegisters++
+	}
+	if numRegisters > opcode.MaxRegisters {
+		return ErrTooManyLocals
+	}
+	numOptional := uint64(0)
+	var params []string
+	for i, param := range node.Params {
+		params = append(params, param.Lexeme)
+		if node.Defaults != nil && node.Defaults[i] != nil {
+			err = c.registerDefault(uint8(i), node.Defaults[i], numRegisters, _symbolTable, _scope)
+			if err != nil {
+				return err
+			}
+			numOptional++
+		}
+		_, _, err = _symbolTable.Define(param.Lexeme)
+		if err != nil {
+			return err
+		}
+	}
+	if node.Rest != nil {
+		params = append(params, node.Rest.Lexeme)
+		_, _, err = _symbolTable.Define(node.Rest.Lexeme)
+		if err != nil {
+			return err
+		}
+	}
+	err = _scope.registerReset(_symbolTable)
+	if err != nil {
+		return err
+	}
+	for _, statement := range node.Body.Declarations {
+		err = c.registerCompile(statement, _symbolTable, _scope)
+		if err != nil {
+			return err
+		}
+	}
+	if !endsWithReturn(node.Body) {
+		r, err := _scope.registerAlloc()
+		if err != nil {
+			return err
+		}
+		_scope.EmitABC(opcode.R_LOADNIL, r, 0, 0)
+		_scope.EmitABC(opcode.R_RETURN, r, 0, 0)
+	}
+	obj := _scope.Function(uint64(len(node.Params)), uint64(len(_symbolTable.UpValues)))
+	obj.Name = node.Name.Lexeme
+	obj.Params = params
+	obj.File = c.Path
+	obj.Line = node.Line
+	obj.NumOptional = numOptional
+	obj.Variadic = node.Rest != nil
+	index := c.constantAdd(obj)
+	err = scope.EmitABx(opcode.R_CLOSURE, dst, index)
+	if err != nil {
+		return err
+	}
+	for _, upInfo := range _symbolTable.UpValues {
+		var isLocal uint8
+		if upInfo.IsLocal {
+			isLocal = 1
+		}
+		err = scope.EmitABx(opcode.R_CAPTURE, isLocal, upInfo.LocalIndex)
+		if err != nil {
+			return err
+		}
+	}
+	return c.registerSymbolSet(symbolIndex, symbolScope, dst, scope)
+}
+
+// registerDefault 编译第 index 个参数的默认值，只在调用时没有传入该参数时求值。
+// 参数占用前 numRegisters 个寄存器，判断用的临时寄存器在它们之上
+func (c *Compiler) registerDefault(index uint8, default_ ast.Expr, numRegisters uint64, symbolTable *SymbolTable, scope *Scope) error {
+	err := scope.registerTop(numRegisters)
+	if err != nil {
+		return err
+	}
+	r, err := scope.registerAlloc()
+	if err != nil {
+		return err
+	}
+	scope.EmitABC(opcode.R_MISSING_ARG, r, index, 0)
+	offset := scope.EmitJump(opcode.R_JUMP_FALSE, r)
+	err = c.registerExprTo(default_, index, symbolTable, scope)
+	if err != nil {
+		return err
+	}
+	return scope.PatchJump(offset)
+}
+
+// registerReturn 编译 return 语句，和栈式代码一样在 try 之外的调用编译为尾调用，
+// 在带有 finally 的 try 中先依次执行 finally
+func (c *Compiler) registerReturn(node *ast.Return, symbolTable *SymbolTable, scope *Scope) error {
+	scope.HaveReturn = true
+	if call, ok := node.Expression.(*ast.Call); ok && len(scope.Tries) == 0 {
+		base, err := scope.registerAlloc()
+		if err != nil {
+			return err
+		}
+		return c.registerCall(call, opcode.R_TAIL_CALL, base, symbolTable, scope)
+	}
+	var r uint8
+	var err error
+	if node.Expression != nil {
+		r, err = c.registerExpr(node.Expression, symbolTable, scope)
+	} else {
+		r, err = scope.registerAlloc()
+		scope.EmitABC(opcode.R_LOADNIL, r, 0, 0)
+	}
+	if err != nil {
+		return err
+	}
+	if !scope.HaveFinally() {
+		scope.EmitABC(opcode.R_RETURN, r, 0, 0)
+		return nil
+	}
+	// 返回值暂存在隐藏的局部变量中，finally 不会覆盖它
+	_symbolTable := NewBlockSymbolTable(symbolTable)
+	symbolIndex, symbolScope, err := _symbolTable.Define("return")
+	if err != nil {
+		return err
+	}
+	err = c.registerSymbolSet(symbolIndex, symbolScope, r, scope)
+	if err != nil {
+		return err
+	}
+	tries := scope.Tries
+	for i := len(tries) - 1; i >= 0; i-- {
+		tries[i].close(scope.Offset())
+		if tries[i].Finally == nil {
+			continue
+		}
+		scope.Tries = append([]*TryBlock{}, tries[:i]...)
+		err = c.registerCompile(tries[i].Finally, _symbolTable, scope)
+		if err != nil {
+			return err
+		}
+	}
+	scope.Tries = tries
+	scope.EmitABC(opcode.R_RETURN, uint8(symbolIndex), 0, 0)
+	for _, try := range tries {
+		try.open(scope.Offset())
+	}
+	_symbolTable.Close()
+	return nil
+}
+
+// registerTry 编译 try 语句，布局和 compileTry 相同。
+// 虚拟机跳转到处理代码时已把异常值放在 try 语句之前的局部变量之上的寄存器中
+func (c *Compiler) registerTry(node *ast.Try, symbolTable *SymbolTable, scope *Scope) error {
+	slots := symbolTable.NumSlots()
+	scope.TryBegin(node.FinallyBody)
+	err := c.registerCompile(node.Body, symbolTable, scope)
+	if err != nil {
+		return err
+	}
+	try := scope.TryEnd()
+	offsets := []uint64{scope.EmitJump(opcode.R_JUMP, 0)}
+	if node.CatchBody != nil {
+		scope.HandlerAdd(try, scope.Offset(), slots)
+		if node.FinallyBody != nil {
+			scope.TryBegin(node.FinallyBody)
+		}
+		_symbolTable := NewBlockSymbolTable(symbolTable)
+		_, _, err = _symbolTable.Define(node.CatchName.Lexeme)
+		if err != nil {
+			return err
+		}
+		for _, statement := range node.CatchBody.Declarations {
+			err = c.registerCompile(statement, _symbolTable, scope)
+			if err != nil {
+				return err
+			}
+		}
+		err = scope.registerReset(_symbolTable)
+		if err != nil {
+			return err
+		}
+		registerCloseBlock(_symbolTable, scope)
+		if node.FinallyBody != nil {
+			try = scope.TryEnd()
+			offsets = append(offsets, scope.EmitJump(opcode.R_JUMP, 0))
+			scope.HandlerAdd(try, scope.Offset(), slots)
+		}
+	} else {
+		scope.HandlerAdd(try, scope.Offset(), slots)
+	}
+	if node.FinallyBody != nil {
+		_symbolTable := NewBlockSymbolTable(symbolTable)
+		symbolIndex, _, err := _symbolTable.Define("throw")
+		if err != nil {
+			return err
+		}
+		err = c.registerCompile(node.FinallyBody, _symbolTable, scope)
+		if err != nil {
+			return err
+		}
+		scope.EmitABC(opcode.R_THROW, uint8(symbolIndex), 0, 0)
+		_symbolTable.Close()
+	}
+	for _, offset := range offsets {
+		err = scope.PatchJump(offset)
+		if err != nil {
+			return err
+		}
+	}
+	if node.FinallyBody != nil {
+		return c.registerCompile(node.FinallyBody, symbolTable, scope)
+	}
+	return nil
+}
+
+// pure 判断求值 node 是否不会修改任何变量
+func pure(node ast.Expr) bool {
+	switch _node := node.(type) {
+	case *ast.Literal, *ast.Variable:
+		return true
+	case *ast.Grouping:
+		return pure(_node.Expression)
+	case *ast.Unary:
+		return pure(_node.Right)
+	case *ast.Binary:
+		return pure(_node.Left) && pure(_node.Right)
+	case *ast.Logical:
+		return pure(_node.Left) && pure(_node.Right)
+	case *ast.Get:
+		return pure(_node.Object)
+	case *ast.Index:
+		return pure(_node.Object) && pure(_node.Index)
+	default:
+		return false
+	}
+}
+
+// writesOnce 判断把 node 编译到寄存器时是否在读完所有操作数之后才写入结果
+func writesOnce(node ast.Expr) bool {
+	switch _node := node.(type) {
+	case *ast.Grouping:
+		return writesOnce(_node.Expression)
+	case *ast.Logical, *ast.Get:
+		return false
+	default:
+		return true
+	}
+}
@@ -6,12 +6,23 @@ import (
 	"stmt/ast"
 	"stmt/opcode"
 	"stmt/token"
+	"stmt/value"
 )
 
-// todo 需要一个新的字段，标识当前作用域是否为 main，如果 main 中包含 return，需要在编译阶段报错
 type Scope struct {
 	Code       []uint8
 	HaveReturn bool
+	Line       int             // 当前正在编译的源码行号
+	Lines      []value.Line    // 字节码偏移到源码行号的映射
+	Handlers   []value.Handler // 异常处理表
+	Tries      []*TryBlock     // 正在编译的 try 语句，最内层在最后
+	Caches     []value.InlineCache
+	Init       bool // 是否在编译类的 init 方法，它总是返回 this
+	// 以下字段只用于编译为寄存器指令，此时偏移是指令下标
+	Register     bool
+	Instructions []uint32
+	NumRegisters uint64 // 已用到的寄存器数
+	free         uint64 // 第一个空闲的寄存器，其下是局部变量和正在使用的临时值
 }
 
 func NewScope(haveReturn bool) *Scope {
@@ -21,6 +32,70 @@ func NewScope(haveReturn bool) *Scope {
 	}
 }
 
+// TryBlock 记录一个 try 语句受保护的字节码范围。
+// 范围中内联的 finally 代码不受保护，所以一个 try 可能对应多段范围。
+type TryBlock struct {
+	Finally *ast.Block
+	Ranges  [][2]uint64
+	start   uint64
+	opened  bool
+}
+
+func (t *TryBlock) open(offset uint64) {
+	t.start = offset
+	t.opened = true
+}
+
+func (t *TryBlock) close(offset uint64) {
+	if t.opened && offset > t.start {
+		t.Ranges = append(t.Ranges, [2]uint64{t.start, offset})
+	}
+	t.opened = false
+}
+
+// TryBegin 开始保护之后生成的字节码，finally 可以为 nil
+func (s *Scope) TryBegin(finally *ast.Block) *TryBlock {
+	try := &TryBlock{
+		Finally: finally,
+	}
+	try.open(s.Offset())
+	s.Tries = append(s.Tries, try)
+	return try
+}
+
+// TryEnd 结束最内层 try 的保护范围
+func (s *Scope) TryEnd() *TryBlock {
+	try := s.Tries[len(s.Tries)-1]
+	s.Tries = s.Tries[:len(s.Tries)-1]
+	try.close(s.Offset())
+	return try
+}
+
+// HandlerAdd 为 try 的每段保护范围添加异常处理记录
+func (s *Scope) HandlerAdd(try *TryBlock, target uint64, slots uint64) {
+	for _, range_ := range try.Ranges {
+		s.Handlers = append(s.Handlers, value.Handler{
+			Start:  range_[0],
+			End:    range_[1],
+			Target: target,
+			Slots:  slots,
+		})
+	}
+}
+
+// Function 使用已生成的字节码、行号和异常处理表创建函数
+func (s *Scope) Function(numParams uint64, numUpvalues uint64) *value.Function {
+	function := value.NewFunction(s.Code, numParams, numUpvalues)
+	function.Lines = s.Lines
+	function.Handlers = s.Handlers
+	function.Caches = s.Caches
+	if s.Register {
+		function.Instructions = s.Instructions
+		function.NumRegisters = s.NumRegisters
+	}
+	return function
+}
+
 func (s *Scope) ConstantEmit(index uint64) error {
 	if index <= math.MaxUint8 {
 		s.EmitWithOperand(opcode.OP_CONSTANT, index)
@@ -77,6 +152,10 @@ func (s *Scope) BinaryEmit(node *ast.Binary) error {
 	case token.EQUAL_EQUAL:
 		s.Emit(opcode.OP_EQ)
 		return nil
+	case token.BANG_EQUAL:
+		s.Emit(opcode.OP_EQ)
+		s.Emit(opcode.OP_NOT)
+		return nil
 	case token.GREATER_EQUAL:
 		s.Emit(opcode.OP_GE)
 		return nil
@@ -120,6 +199,53 @@ func (s *Scope) SymbolSetEmit(symbolIndex uint64, symbolScope string) error {
 	}
 }
 
+// CacheAdd 为一处访问名为 name 的属性的指令分配内联缓存，返回它的下标
+func (s *Scope) CacheAdd(name string) (uint64, error) {
+	index := uint64(len(s.Caches))
+	if index > math.MaxUint16 {
+		return 0, ErrInvalidCacheIndex
+	}
+	s.Caches = append(s.Caches, value.InlineCache{Name: name})
+	return index, nil
+}
+
+func (s *Scope) PropertyGetEmit(name string) error {
+	index, err := s.CacheAdd(name)
+	if err != nil {
+		return err
+	}
+	s.EmitWithOperand(opcode.OP_GET_PROPERTY, index)
+	return nil
+}
+
+func (s *Scope) PropertySetEmit(name string) error {
+	index, err := s.CacheAdd(name)
+	if err != nil {
+		return err
+	}
+	s.EmitWithOperand(opcode.OP_SET_PROPERTY, index)
+	return nil
+}
+
+// ResultEmit 生成没有返回值的 return 返回的值：init 方法返回位于第 0 个槽位的 this，其他函数返回 nil
+func (s *Scope) ResultEmit() {
+	if s.Init {
+		s.EmitWithOperand(opcode.OP_GET_LOCAL, 0)
+		return
+	}
+	s.Emit(opcode.OP_NIL)
+}
+
+// HaveFinally 判断当前是否位于带有 finally 的 try 语句中
+func (s *Scope) HaveFinally() bool {
+	for _, try := range s.Tries {
+		if try.Finally != nil {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *Scope) ClosureEmit(index uint64, upValues []*UpInfo) error {
 	if index <= math.MaxUint8 {
 		s.EmitWithOperand(opcode.OP_CLOSURE, index)
@@ -145,12 +271,14 @@ func (s *Scope) ClosureEmit(index uint64, upValues []*UpInfo) error {
 
 func (s *Scope) Emit(opcode uint8) uint64 {
 	offset := s.Offset()
+	s.lineAdd(offset)
 	s.Code = append(s.Code, opcode)
 	return offset
 }
 
 func (s *Scope) EmitWithOperand(opcode uint8, operand uint64) uint64 {
 	offset := s.Offset()
+	s.lineAdd(offset)
 	Code := CodeMake(opcode, operand)
 	s.Code = append(s.Code, Code...)
 	return offset
@@ -160,6 +288,28 @@ func (s *Scope) EmitOther(other uint8) {
 	s.Code = append(s.Code, other)
 }
 
+// lineAdd 记录从 offset 开始的字节码所在的源码行号，行号不变时不重复记录
+func (s *Scope) lineAdd(offset uint64) {
+	if s.Line <= 0 {
+		return
+	}
+	length := len(s.Lines)
+	if length > 0 {
+		last := &s.Lines[length-1]
+		if last.Line == s.Line {
+			return
+		}
+		if last.Offset == offset {
+			last.Line = s.Line
+			return
+		}
+	}
+	s.Lines = append(s.Lines, value.Line{
+		Offset: offset,
+		Line:   s.Line,
+	})
+}
+
 func (s *Scope) Patch(offset uint64, op uint8) error {
 	_op := s.Code[offset]
 	if _op != op {
@@ -179,12 +329,15 @@ func (s *Scope) Loop(init uint64) {
 }
 
 func (s *Scope) Offset() uint64 {
+	if s.Register {
+		return uint64(len(s.Instructions))
+	}
 	offset := len(s.Code)
 	return uint64(offset)
 }
 
 func CodeMake(op uint8, operand uint64) []uint8 {
-	width := opcode.OperandWidth[op]
+	width := opcode.Table[op].Width
 	instructions := make([]uint8, 1+width)
 	instructions[0] = op
 	offset := 1
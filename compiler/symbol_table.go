@@ -11,8 +11,9 @@ const (
 )
 
 type LocalInfo struct {
-	Name  string
-	Index uint64
+	Name     string
+	Index    uint64
+	Captured bool // 是否被内层函数捕获
 }
 
 func NewLocalInfo(name string, index uint64) *LocalInfo {
@@ -38,6 +39,10 @@ type SymbolTable struct {
 	Outer       *SymbolTable
 	LocalValues map[string]*LocalInfo
 	UpValues    []*UpInfo
+	IsBlock     bool   // 块作用域和所在函数共用局部变量槽位
+	NumLocals   uint64 // 函数（顶层代码为 main）当前已占用的局部变量槽位数
+	Offset      uint64 // 全局作用域中变量下标的起始值，模块的全局变量排在导入它的程序之后
+	base        uint64 // 块作用域开始时所在函数已占用的槽位数
 }
 
 func NewSymbolTable(outer *SymbolTable) *SymbolTable {
@@ -52,11 +57,42 @@ func NewSymbolTable(outer *SymbolTable) *SymbolTable {
 	return inner
 }
 
+// NewBlockSymbolTable 创建块作用域，块内的局部变量在所在函数的栈帧中分配槽位
+func NewBlockSymbolTable(outer *SymbolTable) *SymbolTable {
+	return &SymbolTable{
+		Outer:       outer,
+		LocalValues: map[string]*LocalInfo{},
+		UpValues:    []*UpInfo{},
+		IsBlock:     true,
+		base:        outer.owner().NumLocals,
+	}
+}
+
+// owner 返回为当前作用域分配局部变量槽位的函数作用域
+func (s *SymbolTable) owner() *SymbolTable {
+	for s.IsBlock {
+		s = s.Outer
+	}
+	return s
+}
+
+// NumSlots 返回所在函数当前已占用的局部变量槽位数
+func (s *SymbolTable) NumSlots() uint64 {
+	return s.owner().NumLocals
+}
+
+// Close 在块作用域结束时释放块内的槽位，供之后的局部变量复用
+func (s *SymbolTable) Close() {
+	if s.IsBlock {
+		s.owner().NumLocals = s.base
+	}
+}
+
 func (s *SymbolTable) DefineGlobal(name string) error {
 	if _, ex := s.LocalValues[name]; ex {
 		return ErrVariableAlreadyDefined
 	}
-	index := uint64(len(s.LocalValues))
+	index := s.Offset + uint64(len(s.LocalValues))
 	localInfo := NewLocalInfo(name, index)
 	s.LocalValues[name] = localInfo
 	return nil
@@ -70,7 +106,9 @@ func (s *SymbolTable) Define(name string) (uint64, string, error) {
 	if _, ex := s.LocalValues[name]; ex {
 		return 0, "", ErrVariableAlreadyDefined
 	}
-	index := uint64(len(s.LocalValues))
+	owner := s.owner()
+	index := owner.NumLocals
+	owner.NumLocals++
 	localInfo := NewLocalInfo(name, index)
 	s.LocalValues[name] = localInfo
 	return index, LocalScope, nil
@@ -86,6 +124,9 @@ func (s *SymbolTable) Get(name string) (uint64, string, bool) {
 	if s.Outer == nil {
 		return 0, "", false
 	}
+	if s.IsBlock {
+		return s.Outer.Get(name)
+	}
 
 	symbolIndex, symbolScope, ex := s.Outer.Get(name)
 	if !ex {
@@ -95,6 +136,7 @@ func (s *SymbolTable) Get(name string) (uint64, string, bool) {
 	case GlobalScope:
 		return symbolIndex, GlobalScope, true
 	case LocalScope:
+		s.Outer.capture(name)
 		upIndex := s.UpValuesAdd(symbolIndex, true)
 		return upIndex, UpScope, true
 	case UpScope:
@@ -105,6 +147,26 @@ func (s *SymbolTable) Get(name string) (uint64, string, bool) {
 	}
 }
 
+// capture 把最近定义的名为 name 的局部变量标记为被捕获
+func (s *SymbolTable) capture(name string) {
+	for table := s; table != nil; table = table.Outer {
+		if localInfo, ex := table.LocalValues[name]; ex {
+			localInfo.Captured = true
+			return
+		}
+	}
+}
+
+// Captured 判断当前作用域中是否有被内层函数捕获的局部变量
+func (s *SymbolTable) Captured() bool {
+	for _, localInfo := range s.LocalValues {
+		if localInfo.Captured {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *SymbolTable) UpValuesAdd(symbolIndex uint64, isLocal bool) uint64 {
 	upIndex, err := s.UpValuesFind(symbolIndex, isLocal)
 	if errors.Is(err, ErrVariableNotDefined) {
@@ -1,13 +1,250 @@
 package interpreter
 
-import "time"
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"stmt/token"
+	"stmt/value"
+	"strings"
+	"time"
+)
 
 type builtin func(args ...any) (any, error)
 
-var builtins = map[string]builtin{
-	"clock": clock,
+var builtins map[string]builtin
+
+func init() {
+	// getattr、setattr 会调用访问器执行脚本代码，间接引用了 builtins，所以在 init 中初始化
+	builtins = map[string]builtin{
+		"clock":      clock,
+		"type":       typeOf,
+		"isinstance": isInstance,
+		"fields":     fields,
+		"methods":    methods,
+		"hasattr":    hasAttr,
+		"getattr":    getAttr,
+		"setattr":    setAttr,
+		"superclass": superClass,
+	}
+}
+
+// checkArgs 检查内置函数 name 的参数个数
+func checkArgs(name string, args []any, arity int) error {
+	if len(args) != arity {
+		return fmt.Errorf("%w: %s expects %d arguments but got %d", ErrNumParamsArgsNotMatch, name, arity, len(args))
+	}
+	return nil
+}
+
+// propertyName 返回内置函数按名字访问的属性名，私有名字不能通过名字访问
+func propertyName(name any) (*token.Token, error) {
+	_name, ok := name.(string)
+	if !ok {
+		return nil, ErrInvalidArgumentType
+	}
+	if strings.Contains(_name, "#") {
+		return nil, ErrPrivateProperty
+	}
+	return &token.Token{
+		TokenType: token.IDENTIFIER,
+		Lexeme:    _name,
+	}, nil
+}
+
+// names 返回 names 中除私有名字之外的名字组成的列表，按字典序排列
+func names(names []string) *list {
+	names = slices.DeleteFunc(names, func(name string) bool {
+		return strings.Contains(name, "#")
+	})
+	slices.Sort(names)
+	elements := make([]any, len(names))
+	for i, name := range names {
+		elements[i] = name
+	}
+	return &list{Elements: elements}
+}
+
+// valueType 返回值对应的类型标签，和虚拟机使用同一套标签
+func valueType(value_ any) (uint8, error) {
+	switch value_.(type) {
+	case int64:
+		return value.TypeInt, nil
+	case float64:
+		return value.TypeFloat, nil
+	case string:
+		return value.TypeString, nil
+	case bool:
+		return value.TypeBool, nil
+	case nil:
+		return value.TypeNil, nil
+	case *closure:
+		return value.TypeClosure, nil
+	case builtin:
+		return value.TypeNative, nil
+	case *errorObject:
+		return value.TypeError, nil
+	case *namespace:
+		return value.TypeModule, nil
+	case *list:
+		return value.TypeList, nil
+	case *class:
+		return value.TypeClass, nil
+	case *instance:
+		return value.TypeInstance, nil
+	case *trait:
+		return value.TypeTrait, nil
+	default:
+		return 0, fmt.Errorf("%w: unknown value type %T", ErrInvalidArgumentType, value_)
+	}
 }
 
 func clock(args ...any) (any, error) {
+	err := checkArgs("clock", args, 0)
+	if err != nil {
+		return nil, err
+	}
 	return time.Now().Unix(), nil
 }
+
+// typeOf 返回值的类型名，见 value.TypeNames
+func typeOf(args ...any) (any, error) {
+	err := checkArgs("type", args, 1)
+	if err != nil {
+		return nil, err
+	}
+	tag, err := valueType(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return value.TypeNames[tag], nil
+}
+
+// isInstance 判断值是否为类或其子类的实例
+func isInstance(args ...any) (any, error) {
+	err := checkArgs("isinstance", args, 2)
+	if err != nil {
+		return nil, err
+	}
+	cls, ok := args[1].(*class)
+	if !ok {
+		return nil, ErrInvalidArgumentType
+	}
+	ins, ok := args[0].(*instance)
+	if !ok {
+		return false, nil
+	}
+	for c := ins.Class; c != nil; c = c.SuperClass {
+		if c == cls {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// fields 返回实例的字段名
+func fields(args ...any) (any, error) {
+	err := checkArgs("fields", args, 1)
+	if err != nil {
+		return nil, err
+	}
+	ins, ok := args[0].(*instance)
+	if !ok {
+		return nil, ErrInvalidArgumentType
+	}
+	fieldNames := make([]string, 0, len(ins.Fields))
+	for name := range ins.Fields {
+		fieldNames = append(fieldNames, name)
+	}
+	return names(fieldNames), nil
+}
+
+// methods 返回类的方法名，包括继承和从 trait 组合的方法，不包括 static 方法和访问器
+func methods(args ...any) (any, error) {
+	err := checkArgs("methods", args, 1)
+	if err != nil {
+		return nil, err
+	}
+	cls, ok := args[0].(*class)
+	if !ok {
+		return nil, ErrInvalidArgumentType
+	}
+	methodNames := make([]string, 0, len(cls.Methods))
+	for name := range cls.Methods {
+		methodNames = append(methodNames, name)
+	}
+	return names(methodNames), nil
+}
+
+// hasAttr 判断实例是否有名为 name 的字段、get 访问器或方法，或者类是否有名为 name 的 static 方法。
+// 其他值和私有名字总是返回 false
+func hasAttr(args ...any) (any, error) {
+	err := checkArgs("hasattr", args, 2)
+	if err != nil {
+		return nil, err
+	}
+	name, err := propertyName(args[1])
+	if errors.Is(err, ErrPrivateProperty) {
+		return false, nil
+	} else if err != nil {
+		return nil, err
+	}
+	switch object := args[0].(type) {
+	case *instance:
+		_, field := object.Fields[name.Lexeme]
+		_, getter := object.Class.Getters[name.Lexeme]
+		_, method := object.Class.Methods[name.Lexeme]
+		return field || getter || method, nil
+	case *class:
+		_, static := object.Statics[name.Lexeme]
+		return static, nil
+	default:
+		return false, nil
+	}
+}
+
+// getAttr 读取名为 name 的属性，和 object.name 相同
+func getAttr(args ...any) (any, error) {
+	err := checkArgs("getattr", args, 2)
+	if err != nil {
+		return nil, err
+	}
+	name, err := propertyName(args[1])
+	if err != nil {
+		return nil, err
+	}
+	return getProperty(args[0], name)
+}
+
+// setAttr 设置名为 name 的属性，和 object.name = value 相同，返回设置的值
+func setAttr(args ...any) (any, error) {
+	err := checkArgs("setattr", args, 3)
+	if err != nil {
+		return nil, err
+	}
+	name, err := propertyName(args[1])
+	if err != nil {
+		return nil, err
+	}
+	err = setProperty(args[0], name, args[2])
+	if err != nil {
+		return nil, err
+	}
+	return args[2], nil
+}
+
+// superClass 返回类的父类，没有父类时返回 nil
+func superClass(args ...any) (any, error) {
+	err := checkArgs("superclass", args, 1)
+	if err != nil {
+		return nil, err
+	}
+	cls, ok := args[0].(*class)
+	if !ok {
+		return nil, ErrInvalidArgumentType
+	}
+	if cls.SuperClass == nil {
+		return nil, nil
+	}
+	return cls.SuperClass, nil
+}
@@ -1,21 +1,74 @@
 package interpreter
 
-import "stmt/token"
+import (
+	"fmt"
+	"stmt/ast"
+	"stmt/token"
+)
 
 type class struct {
+	Name       string
 	SuperClass *class
-	Closures   []*closure
+	// 以下方法表在声明时就包含了继承的方法，子类的同名方法覆盖父类的，查找方法不需要沿父类逐级查找
+	Methods map[string]*closure
+	Statics map[string]*closure // static 方法，不绑定 this
+	Getters map[string]*closure
+	Setters map[string]*closure
+}
+
+func newClass(name string, superClass *class) *class {
+	cls := &class{
+		Name:       name,
+		SuperClass: superClass,
+		Methods:    map[string]*closure{},
+		Statics:    map[string]*closure{},
+		Getters:    map[string]*closure{},
+		Setters:    map[string]*closure{},
+	}
+	if superClass != nil {
+		inherit(cls.Methods, superClass.Methods)
+		inherit(cls.Statics, superClass.Statics)
+		inherit(cls.Getters, superClass.Getters)
+		inherit(cls.Setters, superClass.Setters)
+	}
+	return cls
+}
+
+// inherit 把父类的方法表 super 复制到子类的方法表 methods 中
+func inherit(methods map[string]*closure, super map[string]*closure) {
+	for name, clo := range super {
+		methods[name] = clo
+	}
+}
+
+// trait 是一组方法，类用 with 组合 trait 时把这些方法复制到自己的方法表中
+type trait struct {
+	Name    string
+	Methods map[string]*closure
 }
 
 func (c *class) get(name *token.Token) *closure {
-	for _, clo := range c.Closures {
-		if clo.Function.Name.Lexeme == name.Lexeme {
-			return clo
-		}
+	return c.Methods[name.Lexeme]
+}
+
+// static 返回类名为 name 的 static 方法
+func (c *class) static(name *token.Token) (any, error) {
+	clo, ok := c.Statics[name.Lexeme]
+	if !ok {
+		return nil, ErrUndefinedProperty
 	}
-	if c.SuperClass != nil {
-		return c.SuperClass.get(name)
-	} else {
-		return nil
+	return clo, nil
+}
+
+// call 创建实例，有 init 方法时以参数 args 调用它初始化实例，没有时不接受参数
+func (c *class) call(args []ast.Expr, env *environment) (any, error) {
+	ins := newInstance(c)
+	init, ok := c.Methods["init"]
+	if !ok {
+		if len(args) > 0 {
+			return nil, fmt.Errorf("%w: %s expects 0 arguments but got %d", ErrNumParamsArgsNotMatch, c.Name, len(args))
+		}
+		return ins, nil
 	}
+	return ins.bind(init).call(args, env)
 }
@@ -1,22 +1,110 @@
 package interpreter
 
 import (
+	"errors"
+	"fmt"
 	"stmt/ast"
 )
 
 type closure struct {
 	Function *ast.Function
 	Env      *environment
+	Init     bool // 是否是类的 init 方法，init 总是返回 this
 }
 
-func (c *closure) bind(ins *instance) (*closure, error) {
-	env := newEnvironment(c.Env)
-	err := env.define("this", ins)
+func (c *closure) GoString() string {
+	return "<fn " + c.Function.Name.Lexeme + ">"
+}
+
+// call 在 env 中求值参数 args 后调用闭包。缺少的可选参数在被调用函数的环境中
+// 求值默认值，多余的参数收集为 ...rest 参数的列表
+func (c *closure) call(args []ast.Expr, env *environment) (any, error) {
+	err := c.checkArity(len(args))
 	if err != nil {
 		return nil, err
 	}
+	values := make([]any, len(args))
+	for i, arg := range args {
+		_arg, err := interpreter(arg, env)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = _arg
+	}
+	return c.apply(values)
+}
+
+// apply 以已经求值的参数 values 调用闭包，参数个数已经检查过
+func (c *closure) apply(values []any) (any, error) {
+	fun := c.Function
+	_env := newEnvironment(c.Env)
+	for i := range fun.Params {
+		if i < len(values) {
+			_env.define(i, values[i])
+			continue
+		}
+		value, err := interpreter(fun.Defaults[i], _env)
+		if err != nil {
+			return nil, err
+		}
+		_env.define(i, value)
+	}
+	if fun.Rest != nil {
+		rest := &list{}
+		if len(values) > len(fun.Params) {
+			rest.Elements = values[len(fun.Params):]
+		}
+		_env.define(len(fun.Params), rest)
+	}
+	result, err := interpreter(fun.Body, _env)
+	if err != nil && !errors.Is(err, ErrReturn) {
+		return nil, err
+	}
+	if c.Init {
+		// 绑定时 this 保存在闭包环境的第 0 个槽位
+		return c.Env.Values[0], nil
+	}
+	if err == nil {
+		// 没有执行 return 语句
+		return nil, nil
+	}
+	return result, nil
+}
+
+// checkArity 检查以 got 个参数调用闭包时参数个数是否符合参数列表
+func (c *closure) checkArity(got int) error {
+	fun := c.Function
+	required := len(fun.Params)
+	for required > 0 && fun.Defaults != nil && fun.Defaults[required-1] != nil {
+		required--
+	}
+	if got < required || (got > len(fun.Params) && fun.Rest == nil) {
+		return c.arityError(required, got)
+	}
+	return nil
+}
+
+// arityError 返回说明期望和实际参数个数的错误
+func (c *closure) arityError(required int, got int) error {
+	fun := c.Function
+	var expected string
+	switch {
+	case fun.Rest != nil:
+		expected = fmt.Sprintf("at least %d", required)
+	case required < len(fun.Params):
+		expected = fmt.Sprintf("%d to %d", required, len(fun.Params))
+	default:
+		expected = fmt.Sprintf("%d", required)
+	}
+	return fmt.Errorf("%w: %s expects %s arguments but got %d", ErrNumParamsArgsNotMatch, fun.Name.Lexeme, expected, got)
+}
+
+func (c *closure) bind(ins *instance) *closure {
+	env := newEnvironment(c.Env)
+	env.define(0, ins)
 	return &closure{
 		Function: c.Function,
 		Env:      env,
-	}, nil
+		Init:     c.Init,
+	}
 }
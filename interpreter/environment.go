@@ -1,78 +1,78 @@
 package interpreter
 
-import (
-	"stmt/token"
-)
+import "stmt/ast"
+
+// undefined 标记已分配但还没有执行到声明处的槽位
+type undefined struct{}
 
 type environment struct {
 	Enclosing *environment
-	Values    map[string]any
+	Values    []any
+	Module    *moduleContext // 环境所在的模块
 }
 
 func newEnvironment(enclosing *environment) *environment {
-	return &environment{
+	env := &environment{
 		Enclosing: enclosing,
-		Values:    make(map[string]any),
 	}
-}
-
-func (e *environment) define(name string, value any) error {
-	e.Values[name] = value
-	return nil
-	// todo 目前 define 是支持重复声明的。error 返回是为了之后升级到不支持重复声明可以返回错误
-}
-
-func (e *environment) find(name string) (any, error) {
-	value, ok := e.Values[name]
-	if ok {
-		return value, nil
-	} else {
-		if e.Enclosing != nil {
-			return e.Enclosing.find(name)
-		} else {
-			return nil, ErrUndefinedVariable
-		}
+	if enclosing != nil {
+		env.Module = enclosing.Module
 	}
+	return env
 }
 
-func (e *environment) this() (any, error) {
-	return e.find("this")
+// define 把 value 保存到当前环境的第 slot 个槽位
+func (e *environment) define(slot int, value any) {
+	for len(e.Values) <= slot {
+		e.Values = append(e.Values, undefined{})
+	}
+	e.Values[slot] = value
 }
 
-func (e *environment) get(name *token.Token) (any, error) {
-	value, ok := e.Values[name.Lexeme]
-	if ok {
-		return value, nil
-	} else {
-		if e.Enclosing != nil {
-			return e.Enclosing.get(name)
-		} else {
-			return nil, ErrUndefinedVariable
-		}
+// ancestor 返回向外第 depth 层的环境
+func (e *environment) ancestor(depth int) *environment {
+	env := e
+	for i := 0; i < depth; i++ {
+		env = env.Enclosing
 	}
+	return env
 }
 
-func (e *environment) assign(name *token.Token, value any) error {
-	_, ok := e.Values[name.Lexeme]
-	if ok {
-		e.Values[name.Lexeme] = value
-		return nil
-	} else {
-		if e.Enclosing != nil {
-			return e.Enclosing.assign(name, value)
-		} else {
-			return ErrUndefinedVariable
-		}
+// get 读取 node 绑定的变量
+func (e *environment) get(node ast.Node) (any, error) {
+	binding_, ok := e.Module.Bindings[node]
+	if !ok {
+		return nil, ErrUndefinedVariable
 	}
+	env := e.ancestor(binding_.Depth)
+	if binding_.Slot >= len(env.Values) {
+		return nil, ErrUndefinedVariable
+	}
+	value := env.Values[binding_.Slot]
+	if _, ok := value.(undefined); ok {
+		return nil, ErrUndefinedVariable
+	}
+	return value, nil
 }
 
-func (e *environment) copy() *environment {
-	values := make(map[string]any)
-	for k, v := range e.Values {
-		values[k] = v
+// assign 修改 node 绑定的变量
+func (e *environment) assign(node ast.Node, value any) error {
+	binding_, ok := e.Module.Bindings[node]
+	if !ok {
+		return ErrUndefinedVariable
+	}
+	env := e.ancestor(binding_.Depth)
+	if binding_.Slot >= len(env.Values) {
+		return ErrUndefinedVariable
 	}
-	return &environment{
-		Enclosing: e.Enclosing,
-		Values:    values,
+	if _, ok := env.Values[binding_.Slot].(undefined); ok {
+		return ErrUndefinedVariable
 	}
+	env.Values[binding_.Slot] = value
+	return nil
+}
+
+// declare 把 value 保存到声明语句 node 对应的槽位
+func (e *environment) declare(node ast.Node, value any) {
+	e.define(e.Module.Bindings[node].Slot, value)
 }
@@ -1,12 +1,17 @@
 package interpreter
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	ErrReturn                   = errors.New("return")   // 用于 return 语句
 	ErrBreak                    = errors.New("break")    // 用于 break 语句
 	ErrContinue                 = errors.New("continue") // 用于 continue 语句
 	ErrUndefinedVariable        = errors.New("undefined variable")
+	ErrUseBeforeDefine          = fmt.Errorf("%w: used before its declaration", ErrUndefinedVariable)
+	ErrVariableAlreadyDefined   = errors.New("variable already defined")
 	ErrInvalidNodeType          = errors.New("invalid node type")
 	ErrInvalidOperatorType      = errors.New("invalid operator type")
 	ErrInvalidOperandType       = errors.New("invalid operand type")
@@ -15,7 +20,14 @@ var (
 	ErrFunctionNotDeclare       = errors.New("function not declare")
 	ErrNumParamsArgsNotMatch    = errors.New("function parameters num should equ to call arguments num")
 	ErrNotClass                 = errors.New("superclass must be a class")
+	ErrNotTrait                 = errors.New("can only compose traits with 'with'")
 	ErrNotInstance              = errors.New("only instances have properties")
 	ErrOnlyInstanceHaveFields   = errors.New("only instances have fields")
 	ErrUndefinedProperty        = errors.New("undefined property")
+	ErrZeroInDivide             = errors.New("zero in divide")
+	ErrZeroInModulo             = errors.New("zero in modulo")
+	ErrUncaughtException        = errors.New("uncaught exception")
+	ErrIndexOutOfRange          = errors.New("index out of range")
+	ErrInvalidArgumentType      = errors.New("invalid argument type")
+	ErrPrivateProperty          = errors.New("private properties can't be accessed by name")
 )
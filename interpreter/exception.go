@@ -0,0 +1,101 @@
+package interpreter
+
+import (
+	"errors"
+	"fmt"
+	"stmt/token"
+)
+
+// RuntimeError 记录运行时错误发生的行号
+type RuntimeError struct {
+	Err  error
+	Line int
+}
+
+func (r *RuntimeError) Error() string {
+	return fmt.Sprintf("line %d: %v", r.Line, r.Err)
+}
+
+func (r *RuntimeError) Unwrap() error {
+	return r.Err
+}
+
+// Thrown 是 throw 语句抛出且未被捕获的值
+type Thrown struct {
+	Value any
+	Line  int
+}
+
+func (t *Thrown) Error() string {
+	return fmt.Sprintf("line %d: %v %#v", t.Line, ErrUncaughtException, t.Value)
+}
+
+func (t *Thrown) Unwrap() error {
+	return ErrUncaughtException
+}
+
+// errorObject 是运行时错误在脚本中的表示，可以被 catch 捕获
+type errorObject struct {
+	Message string
+	Line    int
+}
+
+func (e *errorObject) GoString() string {
+	return fmt.Sprintf("%s (line %d)", e.Message, e.Line)
+}
+
+func (e *errorObject) get(name *token.Token) (any, error) {
+	switch name.Lexeme {
+	case "message":
+		return e.Message, nil
+	case "line":
+		return int64(e.Line), nil
+	default:
+		return nil, ErrUndefinedProperty
+	}
+}
+
+// isControlFlow 判断 err 是否为 return、break、continue 使用的控制流错误
+func isControlFlow(err error) bool {
+	return errors.Is(err, ErrReturn) || errors.Is(err, ErrBreak) || errors.Is(err, ErrContinue)
+}
+
+// withLine 为尚未记录行号的运行时错误补充行号
+func withLine(err error, line int) error {
+	if err == nil || line <= 0 || isControlFlow(err) {
+		return err
+	}
+	var runtimeError *RuntimeError
+	if errors.As(err, &runtimeError) {
+		return err
+	}
+	var thrown *Thrown
+	if errors.As(err, &thrown) {
+		return err
+	}
+	return &RuntimeError{
+		Err:  err,
+		Line: line,
+	}
+}
+
+// caught 将 try 中产生的错误转换为 catch 绑定的值，控制流错误不能被捕获
+func caught(err error) (any, bool) {
+	if isControlFlow(err) {
+		return nil, false
+	}
+	var thrown *Thrown
+	if errors.As(err, &thrown) {
+		return thrown.Value, true
+	}
+	var runtimeError *RuntimeError
+	if errors.As(err, &runtimeError) {
+		return &errorObject{
+			Message: runtimeError.Err.Error(),
+			Line:    runtimeError.Line,
+		}, true
+	}
+	return &errorObject{
+		Message: err.Error(),
+	}, true
+}
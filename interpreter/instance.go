@@ -7,6 +7,7 @@ import (
 type instance struct {
 	Class  *class
 	Fields map[string]any
+	bound  map[*closure]*closure // 已绑定到实例的方法，再次访问同一个方法时复用
 }
 
 func newInstance(class *class) *instance {
@@ -16,18 +17,17 @@ func newInstance(class *class) *instance {
 	}
 }
 
+// get 读取属性，依次查找字段、get 访问器和方法
 func (i *instance) get(name *token.Token) (any, error) {
 	value, ok := i.Fields[name.Lexeme]
 	if ok {
 		return value, nil
+	} else if getter, ok := i.Class.Getters[name.Lexeme]; ok {
+		return i.bind(getter).apply(nil)
 	} else {
 		clo := i.Class.get(name)
 		if clo != nil {
-			clo, err := clo.bind(i)
-			if err != nil {
-				return nil, err
-			}
-			return clo, nil
+			return i.bind(clo), nil
 		} else {
 			print("Undefined property '" + name.Lexeme + "'.")
 			return nil, ErrUndefinedProperty
@@ -35,6 +35,40 @@ func (i *instance) get(name *token.Token) (any, error) {
 	}
 }
 
-func (i *instance) set(name *token.Token, value any) {
+// set 设置属性，有 set 访问器时调用它，否则设置字段
+func (i *instance) set(name *token.Token, value any) error {
+	if setter, ok := i.Class.Setters[name.Lexeme]; ok {
+		_, err := i.bind(setter).apply([]any{value})
+		return err
+	}
 	i.Fields[name.Lexeme] = value
+	return nil
+}
+
+// operator 以参数 args 调用类重载运算的特殊方法 name，类没有定义它时返回 false
+func (i *instance) operator(name string, args ...any) (any, bool, error) {
+	clo, ok := i.Class.Methods[name]
+	if !ok {
+		return nil, false, nil
+	}
+	bound := i.bind(clo)
+	err := bound.checkArity(len(args))
+	if err != nil {
+		return nil, true, err
+	}
+	result, err := bound.apply(args)
+	return result, true, err
+}
+
+// bind 返回绑定到实例的方法 clo，每个方法只绑定一次
+func (i *instance) bind(clo *closure) *closure {
+	if bound, ok := i.bound[clo]; ok {
+		return bound
+	}
+	if i.bound == nil {
+		i.bound = map[*closure]*closure{}
+	}
+	bound := clo.bind(i)
+	i.bound[clo] = bound
+	return bound
 }
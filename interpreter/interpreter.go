@@ -8,41 +8,96 @@ import (
 	"os"
 	"reflect"
 	"stmt/ast"
+	"stmt/check"
+	"stmt/module"
 	"stmt/token"
 )
 
 // Output 是一个可自定义的输出接口，默认为 os.Stdout
 var Output io.Writer = os.Stdout
 
+// Loader 用于查找 import 的模块，为 nil 时不支持 import
+var Loader *module.Loader
+
+// Options 是单次运行的选项
+type Options struct {
+	// Strict 为 true 时 if、while、!、and、or 只接受 bool；
+	// 否则和 Lox 一样，nil 和 false 为假，其他值都为真
+	Strict bool
+}
+
 func Interpreter(decls []ast.Node) error {
-	var err error
-	env := newEnvironment(nil)
-	for funName, fun := range builtins {
-		err = env.define(funName, fun)
+	return InterpreterFile("", decls)
+}
+
+// InterpreterFile 执行位于 path 的脚本，脚本中的 import 相对 path 所在的目录查找模块
+func InterpreterFile(path string, decls []ast.Node) error {
+	return InterpreterOptions(path, decls, Options{})
+}
+
+// InterpreterOptions 和 InterpreterFile 相同，但按 options 执行，导入的模块也使用同样的选项
+func InterpreterOptions(path string, decls []ast.Node, options Options) error {
+	context := &moduleContext{
+		Path:    path,
+		Strict:  options.Strict,
+		Exports: map[string]bool{},
+		loader:  Loader,
+		modules: map[string]*namespace{},
+	}
+	if Loader != nil && path != "" {
+		// 模块反过来导入主程序也是循环导入
+		err := Loader.Enter(path)
 		if err != nil {
 			return err
 		}
+		defer Loader.Exit()
+	}
+	_, err := run(decls, context)
+	return err
+}
+
+// run 在新的全局环境中执行 decls，返回该全局环境
+func run(decls []ast.Node, context *moduleContext) (*environment, error) {
+	err := check.Check(decls)
+	if err != nil {
+		return nil, err
+	}
+	bindings, globals, err := resolve(decls)
+	if err != nil {
+		return nil, err
+	}
+	context.Bindings = bindings
+	context.Globals = globals
+	env := newEnvironment(nil)
+	env.Module = context
+	for funName, fun := range builtins {
+		env.define(globals[funName], fun)
 	}
 	for _, decl := range decls {
 		_, err = interpreter(decl, env)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
-	return nil
+	return env, nil
 }
 
 func interpreter(node ast.Node, env *environment) (any, error) {
+	value, err := evaluate(node, env)
+	return value, withLine(err, node.Pos())
+}
+
+func evaluate(node ast.Node, env *environment) (any, error) {
 	switch _node := node.(type) {
 	case *ast.Literal:
 		return _node.Value, nil
 	case *ast.Variable:
-		return env.get(_node.Name)
+		return env.get(_node)
 	case *ast.Grouping:
 		return interpreter(_node.Expression, env)
 	case *ast.Super:
 		// 特殊的 *ast.Get
-		super, err := env.get(_node.Keyword)
+		super, err := env.get(_node)
 		if err != nil {
 			return nil, err
 		}
@@ -54,21 +109,15 @@ func interpreter(node ast.Node, env *environment) (any, error) {
 		if clo == nil {
 			return nil, ErrUndefinedProperty
 		}
-		ins, err := env.this()
-		if err != nil {
-			return nil, err
-		}
+		// this 所在的环境位于 super 所在环境的内层
+		ins := env.ancestor(env.Module.Bindings[_node].Depth - 1).Values[0]
 		_ins, ok := ins.(*instance)
 		if !ok {
 			return nil, ErrNotInstance
 		}
-		_clo, err := clo.bind(_ins)
-		if err != nil {
-			return nil, err
-		}
-		return _clo, nil
+		return _ins.bind(clo), nil
 	case *ast.This:
-		return env.get(_node.Keyword)
+		return env.get(_node)
 	case *ast.Call:
 		callable, err := interpreter(_node.Callee, env)
 		if err != nil {
@@ -76,33 +125,9 @@ func interpreter(node ast.Node, env *environment) (any, error) {
 		}
 		switch _callable := callable.(type) {
 		case *class:
-			ins := newInstance(_callable)
-			return ins, nil
+			return _callable.call(_node.Arguments, env)
 		case *closure:
-			fun := _callable.Function
-			lenParams := len(fun.Params)
-			lenArgs := len(_node.Arguments)
-			if lenParams != lenArgs {
-				return nil, ErrNumParamsArgsNotMatch
-			}
-			_env := newEnvironment(_callable.Env)
-			for i := 0; i < lenParams; i++ {
-				param := fun.Params[i]
-				arg := _node.Arguments[i]
-				_arg, err := interpreter(arg, env)
-				if err != nil {
-					return nil, err
-				}
-				err = _env.define(param.Lexeme, _arg)
-				if err != nil {
-					return nil, err
-				}
-			}
-			result, err := interpreter(fun.Body, _env)
-			if err != nil {
-				return nil, err
-			}
-			return result, nil
+			return _callable.call(_node.Arguments, env)
 		case builtin:
 			var args []any
 			for _, arg := range _node.Arguments {
@@ -125,20 +150,45 @@ func interpreter(node ast.Node, env *environment) (any, error) {
 		if err != nil {
 			return nil, err
 		}
-		ins, ok := object.(*instance)
-		if !ok {
-			return nil, ErrNotInstance
+		return getProperty(object, _node.Name)
+	case *ast.Index:
+		object, err := interpreter(_node.Object, env)
+		if err != nil {
+			return nil, err
 		}
-		property, err := ins.get(_node.Name)
+		index, err := interpreter(_node.Index, env)
 		if err != nil {
 			return nil, err
 		}
-		return property, nil
+		if ins, ok := object.(*instance); ok {
+			result, ok, err := ins.operator("__index__", index)
+			if ok {
+				return result, err
+			}
+		}
+		_object, ok := object.(*list)
+		if !ok {
+			return nil, ErrInvalidOperandType
+		}
+		return _object.index(index)
 	case *ast.Unary:
 		right, err := interpreter(_node.Right, env)
 		if err != nil {
 			return nil, err
 		}
+		if _node.Operator.TokenType == token.BANG {
+			rightValue, err := truthy(right, env.Module.Strict)
+			if err != nil {
+				return nil, err
+			}
+			return !rightValue, nil
+		}
+		if ins, ok := right.(*instance); ok {
+			result, ok, err := ins.operator("__neg__")
+			if ok {
+				return result, err
+			}
+		}
 		switch rightValue := right.(type) {
 		case int64:
 			switch _node.Operator.TokenType {
@@ -154,13 +204,6 @@ func interpreter(node ast.Node, env *environment) (any, error) {
 			default:
 				return nil, ErrInvalidOperatorType
 			}
-		case bool:
-			switch _node.Operator.TokenType {
-			case token.BANG:
-				return !rightValue, nil
-			default:
-				return nil, ErrInvalidOperatorType
-			}
 		default:
 			return nil, ErrInvalidOperandType
 		}
@@ -173,6 +216,27 @@ func interpreter(node ast.Node, env *environment) (any, error) {
 		if err != nil {
 			return nil, err
 		}
+		if ins, ok := left.(*instance); ok {
+			result, ok, err := ins.operator(operators[_node.Operator.TokenType], right)
+			if ok {
+				if err != nil || _node.Operator.TokenType != token.BANG_EQUAL {
+					return result, err
+				}
+				// != 取 __eq__ 结果的反
+				equal, err := truthy(result, env.Module.Strict)
+				return !equal, err
+			}
+		}
+		switch _node.Operator.TokenType {
+		case token.EQUAL_EQUAL:
+			return isEqual(left, right), nil
+		case token.BANG_EQUAL:
+			return !isEqual(left, right), nil
+		}
+		// nil 没有类型，和虚拟机一样作为无效的操作数
+		if left == nil || right == nil {
+			return nil, ErrInvalidOperandType
+		}
 		leftType := reflect.TypeOf(left).Kind()
 		rightType := reflect.TypeOf(right).Kind()
 		if leftType == reflect.Int64 && rightType == reflect.Int64 {
@@ -186,8 +250,14 @@ func interpreter(node ast.Node, env *environment) (any, error) {
 			case token.STAR:
 				return leftValue * rightValue, nil
 			case token.SLASH:
+				if rightValue == 0 {
+					return nil, ErrZeroInDivide
+				}
 				return leftValue / rightValue, nil
 			case token.PERCENTAGE:
+				if rightValue == 0 {
+					return nil, ErrZeroInModulo
+				}
 				return leftValue % rightValue, nil
 			case token.EQUAL_EQUAL:
 				return leftValue == rightValue, nil
@@ -215,8 +285,14 @@ func interpreter(node ast.Node, env *environment) (any, error) {
 			case token.STAR:
 				return leftValue * rightValue, nil
 			case token.SLASH:
+				if rightValue == 0 {
+					return nil, ErrZeroInDivide
+				}
 				return leftValue / rightValue, nil
 			case token.PERCENTAGE:
+				if rightValue == 0 {
+					return nil, ErrZeroInModulo
+				}
 				return math.Mod(leftValue, rightValue), nil
 			case token.EQUAL_EQUAL:
 				return leftValue == rightValue, nil
@@ -244,8 +320,14 @@ func interpreter(node ast.Node, env *environment) (any, error) {
 			case token.STAR:
 				return leftValue * rightValue, nil
 			case token.SLASH:
+				if rightValue == 0 {
+					return nil, ErrZeroInDivide
+				}
 				return leftValue / rightValue, nil
 			case token.PERCENTAGE:
+				if rightValue == 0 {
+					return nil, ErrZeroInModulo
+				}
 				return math.Mod(leftValue, rightValue), nil
 			case token.EQUAL_EQUAL:
 				return leftValue == rightValue, nil
@@ -273,8 +355,14 @@ func interpreter(node ast.Node, env *environment) (any, error) {
 			case token.STAR:
 				return leftValue * rightValue, nil
 			case token.SLASH:
+				if rightValue == 0 {
+					return nil, ErrZeroInDivide
+				}
 				return leftValue / rightValue, nil
 			case token.PERCENTAGE:
+				if rightValue == 0 {
+					return nil, ErrZeroInModulo
+				}
 				return math.Mod(leftValue, rightValue), nil
 			case token.EQUAL_EQUAL:
 				return leftValue == rightValue, nil
@@ -331,40 +419,44 @@ func interpreter(node ast.Node, env *environment) (any, error) {
 		if err != nil {
 			return nil, err
 		}
-		right, err := interpreter(_node.Right, env)
+		leftValue, err := truthy(left, env.Module.Strict)
 		if err != nil {
 			return nil, err
 		}
-		leftValue, ok := left.(bool)
-		if !ok {
-			return nil, ErrInvalidOperandType
-		}
-		rightValue, ok := right.(bool)
-		if !ok {
-			return nil, ErrInvalidOperandType
-		}
+		// 左侧已经能确定结果时不再对右侧求值，结果为决定真假的那个操作数
 		switch _node.Operator.TokenType {
 		case token.AND:
-			return leftValue && rightValue, nil
+			if !leftValue {
+				return left, nil
+			}
 		case token.OR:
-			return leftValue || rightValue, nil
+			if leftValue {
+				return left, nil
+			}
 		default:
 			return nil, ErrInvalidOperatorType
 		}
+		right, err := interpreter(_node.Right, env)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := right.(bool); env.Module.Strict && !ok {
+			return nil, ErrInvalidOperandType
+		}
+		return right, nil
 	case *ast.Assign:
 		value, err := interpreter(_node.Value, env)
 		if err != nil {
 			return nil, err
 		}
-		err = env.assign(_node.Name, value)
+		err = env.assign(_node, value)
 		return value, err
 	case *ast.Set:
 		object, err := interpreter(_node.Object, env)
 		if err != nil {
 			return nil, err
 		}
-		ins, ok := object.(*instance)
-		if !ok {
+		if _, ok := object.(*instance); !ok {
 			print("Only instances have fields.")
 			return nil, ErrOnlyInstanceHaveFields
 		}
@@ -372,7 +464,10 @@ func interpreter(node ast.Node, env *environment) (any, error) {
 		if err != nil {
 			return nil, err
 		}
-		ins.set(_node.Name, value)
+		err = setProperty(object, _node.Name, value)
+		if err != nil {
+			return nil, err
+		}
 		return value, nil
 	case *ast.ExpressionStatement:
 		_, err := interpreter(_node.Expression, env)
@@ -382,25 +477,55 @@ func interpreter(node ast.Node, env *environment) (any, error) {
 	case *ast.Continue:
 		return nil, ErrContinue
 	case *ast.Return:
+		if _node.Expression == nil {
+			return nil, ErrReturn
+		}
 		value, err := interpreter(_node.Expression, env)
 		if err != nil {
 			return nil, err
 		}
 		return value, ErrReturn
+	case *ast.Throw:
+		value, err := interpreter(_node.Expression, env)
+		if err != nil {
+			return nil, err
+		}
+		return nil, &Thrown{
+			Value: value,
+			Line:  _node.Line,
+		}
+	case *ast.Try:
+		value, err := interpreter(_node.Body, env)
+		if err != nil && _node.CatchBody != nil {
+			exception, ok := caught(err)
+			if ok {
+				_env := newEnvironment(env)
+				_env.declare(_node, exception)
+				value, err = interpreter(_node.CatchBody, _env)
+			}
+		}
+		if _node.FinallyBody != nil {
+			// finally 中的 return 或错误会覆盖 try 和 catch 的结果
+			_value, _err := interpreter(_node.FinallyBody, env)
+			if _err != nil {
+				return _value, _err
+			}
+		}
+		return value, err
 	case *ast.While:
 		for {
 			condition, err := interpreter(_node.Condition, env)
 			if err != nil {
 				return nil, err
 			}
-			_condition, ok := condition.(bool)
-			if !ok {
-				return nil, ErrInvalidOperandType
+			_condition, err := truthy(condition, env.Module.Strict)
+			if err != nil {
+				return nil, err
 			}
 			if !_condition {
 				break
 			}
-			_, err = interpreter(_node.Body, env)
+			value, err := interpreter(_node.Body, env)
 			if errors.Is(err, ErrBreak) {
 				return nil, nil
 			}
@@ -408,7 +533,7 @@ func interpreter(node ast.Node, env *environment) (any, error) {
 				continue
 			}
 			if err != nil {
-				return nil, err
+				return value, err
 			}
 		}
 		return nil, nil
@@ -417,9 +542,9 @@ func interpreter(node ast.Node, env *environment) (any, error) {
 		if err != nil {
 			return nil, err
 		}
-		_condition, ok := condition.(bool)
-		if !ok {
-			return nil, ErrInvalidOperandType
+		_condition, err := truthy(condition, env.Module.Strict)
+		if err != nil {
+			return nil, err
 		}
 		if _condition {
 			return interpreter(_node.ThenBranch, env)
@@ -435,7 +560,7 @@ func interpreter(node ast.Node, env *environment) (any, error) {
 		for _, decl := range _node.Declarations {
 			value, err := interpreter(decl, _env)
 			if errors.Is(err, ErrReturn) {
-				return value, nil
+				return value, err
 			}
 			if err != nil {
 				return nil, err
@@ -447,8 +572,30 @@ func interpreter(node ast.Node, env *environment) (any, error) {
 		if err != nil {
 			return nil, err
 		}
-		_, err = fmt.Fprintf(Output, "%#v\n", value)
-		return nil, err
+		return nil, printValue(value)
+	case *ast.Import:
+		namespace_, err := importModule(_node.Path, env)
+		if err != nil {
+			return nil, err
+		}
+		env.declare(_node, namespace_)
+		return nil, nil
+	case *ast.Export:
+		_, err := interpreter(_node.Declaration, env)
+		if err != nil {
+			return nil, err
+		}
+		switch declaration := _node.Declaration.(type) {
+		case *ast.Var:
+			env.Module.Exports[declaration.Name.Lexeme] = true
+		case *ast.Function:
+			env.Module.Exports[declaration.Name.Lexeme] = true
+		case *ast.Class:
+			env.Module.Exports[declaration.Name.Lexeme] = true
+		case *ast.Trait:
+			env.Module.Exports[declaration.Name.Lexeme] = true
+		}
+		return nil, nil
 	case *ast.Var:
 		var value any = nil
 		var err error
@@ -458,29 +605,16 @@ func interpreter(node ast.Node, env *environment) (any, error) {
 				return nil, err
 			}
 		}
-		err = env.define(_node.Name.Lexeme, value)
-		if err != nil {
-			return nil, err
-		}
+		env.declare(_node, value)
 		return nil, nil
 	case *ast.Function:
-		functionName := _node.Name.Lexeme
-		_env := env.copy()
 		clo := &closure{
 			Function: _node,
-			Env:      _env,
-		}
-		err := env.define(functionName, clo)
-		if err != nil {
-			return nil, err
-		}
-		err = _env.define(functionName, clo)
-		if err != nil {
-			return nil, err
+			Env:      env,
 		}
+		env.declare(_node, clo)
 		return nil, nil
 	case *ast.Class:
-		className := _node.Name.Lexeme
 		var superClass *class
 		if _node.SuperClass != nil {
 			super, err := interpreter(_node.SuperClass, env)
@@ -493,31 +627,154 @@ func interpreter(node ast.Node, env *environment) (any, error) {
 				return nil, ErrNotClass
 			}
 		}
-		cls := &class{
-			SuperClass: superClass,
-			Closures:   []*closure{},
-		}
-		_env := env.copy()
-		if superClass != nil {
-			_env = newEnvironment(_env)
-			err := _env.define("super", superClass)
+		cls := newClass(_node.Name.Lexeme, superClass)
+		// trait 的方法覆盖继承的方法，类自身的方法又覆盖 trait 的方法
+		for _, variable := range _node.Traits {
+			value, err := interpreter(variable, env)
 			if err != nil {
 				return nil, err
 			}
+			_trait, ok := value.(*trait)
+			if !ok {
+				return nil, ErrNotTrait
+			}
+			inherit(cls.Methods, _trait.Methods)
+		}
+		_env := env
+		if superClass != nil {
+			_env = newEnvironment(_env)
+			_env.define(0, superClass)
 		}
 		for _, method := range _node.Methods {
 			clo := &closure{
 				Function: method,
 				Env:      _env,
+				Init:     method.Name.Lexeme == "init",
 			}
-			cls.Closures = append(cls.Closures, clo)
+			cls.Methods[method.Name.Lexeme] = clo
 		}
-		err := env.define(className, cls)
-		if err != nil {
-			return nil, err
+		for _, method := range _node.Statics {
+			cls.Statics[method.Name.Lexeme] = &closure{
+				Function: method,
+				Env:      _env,
+			}
 		}
+		for _, getter := range _node.Getters {
+			cls.Getters[getter.Name.Lexeme] = &closure{
+				Function: getter,
+				Env:      _env,
+			}
+		}
+		for _, setter := range _node.Setters {
+			cls.Setters[setter.Name.Lexeme] = &closure{
+				Function: setter,
+				Env:      _env,
+			}
+		}
+		env.declare(_node, cls)
+		return nil, nil
+	case *ast.Trait:
+		_trait := &trait{
+			Name:    _node.Name.Lexeme,
+			Methods: map[string]*closure{},
+		}
+		for _, method := range _node.Methods {
+			_trait.Methods[method.Name.Lexeme] = &closure{
+				Function: method,
+				Env:      env,
+				Init:     method.Name.Lexeme == "init",
+			}
+		}
+		env.declare(_node, _trait)
 		return nil, nil
 	default:
 		return nil, ErrExpressionTypeNotSupport
 	}
 }
+
+// operators 是可以由类的特殊方法重载的二元运算符对应的方法名，左操作数是实例时调用它的方法
+var operators = map[string]string{
+	token.PLUS:          "__add__",
+	token.MINUS:         "__sub__",
+	token.STAR:          "__mul__",
+	token.SLASH:         "__div__",
+	token.PERCENTAGE:    "__mod__",
+	token.EQUAL_EQUAL:   "__eq__",
+	token.BANG_EQUAL:    "__eq__",
+	token.LESS:          "__lt__",
+	token.LESS_EQUAL:    "__le__",
+	token.GREATER:       "__gt__",
+	token.GREATER_EQUAL: "__ge__",
+}
+
+// getProperty 读取 object 名为 name 的属性
+func getProperty(object any, name *token.Token) (any, error) {
+	switch _object := object.(type) {
+	case *instance:
+		return _object.get(name)
+	case *errorObject:
+		return _object.get(name)
+	case *namespace:
+		return _object.get(name)
+	case *class:
+		return _object.static(name)
+	case *list:
+		return _object.get(name)
+	default:
+		return nil, ErrNotInstance
+	}
+}
+
+// setProperty 设置 object 名为 name 的属性，只有实例有属性
+func setProperty(object any, name *token.Token, value any) error {
+	ins, ok := object.(*instance)
+	if !ok {
+		return ErrOnlyInstanceHaveFields
+	}
+	return ins.set(name, value)
+}
+
+// printValue 打印 value，类定义了 __str__ 的实例打印该方法的返回值
+func printValue(value any) error {
+	if ins, ok := value.(*instance); ok {
+		str, ok, err := ins.operator("__str__")
+		if err != nil {
+			return err
+		}
+		if ok {
+			return printValue(str)
+		}
+	}
+	_, err := fmt.Fprintf(Output, "%#v\n", value)
+	return err
+}
+
+// isEqual 判断 left 和 right 是否相等：基本类型比较值，其他对象比较引用，不同类型的值总是不相等
+func isEqual(left any, right any) bool {
+	switch leftValue := left.(type) {
+	case int64:
+		if rightValue, ok := right.(float64); ok {
+			return float64(leftValue) == rightValue
+		}
+	case float64:
+		if rightValue, ok := right.(int64); ok {
+			return leftValue == float64(rightValue)
+		}
+	case builtin:
+		// 函数值不能直接用 == 比较
+		rightValue, ok := right.(builtin)
+		return ok && reflect.ValueOf(leftValue).Pointer() == reflect.ValueOf(rightValue).Pointer()
+	}
+	return left == right
+}
+
+// truthy 返回 value 作为条件时的真假，strict 为 true 时 value 必须是 bool
+func truthy(value any, strict bool) (bool, error) {
+	if _value, ok := value.(bool); ok {
+		return _value, nil
+	}
+	if strict {
+		return false, ErrInvalidOperandType
+	}
+	return value != nil, nil
+}
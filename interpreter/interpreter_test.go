@@ -2,10 +2,15 @@ package interpreter
 
 import (
 	"bytes"
+	"errors"
 	"reflect"
+	"stmt/ast"
+	"stmt/check"
+	"stmt/module"
 	"stmt/parser"
 	"stmt/scanner"
 	"testing"
+	"testing/fstest"
 )
 
 func TestExpr(t *testing.T) {
@@ -159,6 +164,54 @@ func TestExpr(t *testing.T) {
 			err:    nil,
 			want:   true,
 		},
+		{
+			name:   "!nil",
+			source: "!nil",
+			want:   true,
+			err:    nil,
+		},
+		{
+			name:   "!0",
+			source: "!0",
+			want:   false,
+			err:    nil,
+		},
+		{
+			name:   "nil or 1",
+			source: "nil or 1",
+			want:   int64(1),
+			err:    nil,
+		},
+		{
+			name:   "2 and 3",
+			source: "2 and 3",
+			want:   int64(3),
+			err:    nil,
+		},
+		{
+			name:   "nil and 1 / 0",
+			source: "nil and 1 / 0",
+			want:   nil,
+			err:    nil,
+		},
+		{
+			name:   "false and 1 / 0",
+			source: "false and 1 / 0",
+			want:   false,
+			err:    nil,
+		},
+		{
+			name:   "true or 1 / 0",
+			source: "true or 1 / 0",
+			want:   true,
+			err:    nil,
+		},
+		{
+			name:   "true and 1 / 0",
+			source: "true and 1 / 0",
+			want:   nil,
+			err:    ErrZeroInDivide,
+		},
 		{
 			name:   "1 > 2 and true",
 			source: "1 > 2 and true",
@@ -171,6 +224,48 @@ func TestExpr(t *testing.T) {
 			want:   nil,
 			err:    ErrUndefinedVariable,
 		},
+		{
+			name:   `1 == nil`,
+			source: `1 == nil`,
+			want:   false,
+			err:    nil,
+		},
+		{
+			name:   `nil == nil`,
+			source: `nil == nil`,
+			want:   true,
+			err:    nil,
+		},
+		{
+			name:   `1 != "1"`,
+			source: `1 != "1"`,
+			want:   true,
+			err:    nil,
+		},
+		{
+			name:   `1 == 1.0`,
+			source: `1 == 1.0`,
+			want:   true,
+			err:    nil,
+		},
+		{
+			name:   `"a" < "b"`,
+			source: `"a" < "b"`,
+			want:   true,
+			err:    nil,
+		},
+		{
+			name:   `nil < 1`,
+			source: `nil < 1`,
+			want:   nil,
+			err:    ErrInvalidOperandType,
+		},
+		{
+			name:   `nil + 1`,
+			source: `nil + 1`,
+			want:   nil,
+			err:    ErrInvalidOperandType,
+		},
 	}
 
 	for _, tt := range tests {
@@ -183,9 +278,16 @@ func TestExpr(t *testing.T) {
 				t.Errorf("Parse() err = %v", err)
 				return
 			}
-			env := newEnvironment(nil)
-			got, err := interpreter(tree, env)
-			if err != tt.err {
+			var got any
+			bindings, _, err := resolve([]ast.Node{tree})
+			if err == nil {
+				env := newEnvironment(nil)
+				env.Module = &moduleContext{
+					Bindings: bindings,
+				}
+				got, err = interpreter(tree, env)
+			}
+			if !errors.Is(err, tt.err) {
 				t.Errorf("Interpreter() got err = %v, want err = %v", err, tt.err)
 				return
 			}
@@ -308,6 +410,143 @@ func TestStmtAndDecl(t *testing.T) {
 			err:        nil,
 			wantOutput: `"outsideinside"` + "\n",
 		},
+		{
+			name: "static scope",
+			source: `
+			var a = "global";
+			{
+				fun showA() {
+					print a;
+				}
+				showA();
+				var a = "block";
+				showA();
+			}
+			`,
+			err:        nil,
+			wantOutput: `"global"` + "\n" + `"global"` + "\n",
+		},
+		{
+			name: "mutual recursion",
+			source: `
+			fun isEven(n) {
+				if (n == 0) {
+					return true;
+				}
+				return isOdd(n - 1);
+			}
+			fun isOdd(n) {
+				if (n == 0) {
+					return false;
+				}
+				return isEven(n - 1);
+			}
+			print isEven(4);
+			`,
+			err:        nil,
+			wantOutput: `true` + "\n",
+		},
+		{
+			name: "later global",
+			source: `
+			fun f() {
+				return g;
+			}
+			var g = 1;
+			print f();
+			g = 2;
+			print f();
+			`,
+			err:        nil,
+			wantOutput: `1` + "\n" + `2` + "\n",
+		},
+		{
+			name: "global assign in function",
+			source: `
+			var x = 1;
+			fun inc() {
+				x = x + 1;
+			}
+			inc();
+			inc();
+			print x;
+			`,
+			err:        nil,
+			wantOutput: `3` + "\n",
+		},
+		{
+			name: "closure counter",
+			source: `
+			fun makeCounter() {
+				var i = 0;
+				fun count() {
+					i = i + 1;
+					return i;
+				}
+				return count;
+			}
+			var c = makeCounter();
+			c();
+			print c();
+			`,
+			err:        nil,
+			wantOutput: `2` + "\n",
+		},
+		{
+			name: "call before global defined",
+			source: `
+			fun f() {
+				return g;
+			}
+			print f();
+			var g = 1;
+			`,
+			err: ErrUndefinedVariable,
+		},
+		{
+			name: "use before define",
+			source: `
+			{
+				print b;
+				var b = 1;
+			}
+			`,
+			err: ErrUseBeforeDefine,
+		},
+		{
+			name: "local function use before define",
+			source: `
+			{
+				fun f() {
+					return g();
+				}
+				fun g() {
+					return 1;
+				}
+			}
+			`,
+			err: ErrUseBeforeDefine,
+		},
+		{
+			name: "duplicate local",
+			source: `
+			{
+				var a = 1;
+				var a = 2;
+			}
+			`,
+			err: ErrVariableAlreadyDefined,
+		},
+		{
+			name:   "duplicate global",
+			source: `var a = 1; fun a() {}`,
+			err:    ErrVariableAlreadyDefined,
+		},
+		{
+			name:   "duplicate parameter",
+			source: `fun f(a, a) {}`,
+			err:    ErrVariableAlreadyDefined,
+		},
 		{
 			name: "block 5",
 			source: `
@@ -339,7 +578,9 @@ func TestStmtAndDecl(t *testing.T) {
 			name: "call",
 			source: `
 			fun count(n) {
-				if (n > 1) count(n - 1);
+				if (n > 1) {
+					count(n - 1);
+				}
 				print n;
 			}
 			count(2);
@@ -373,7 +614,9 @@ func TestStmtAndDecl(t *testing.T) {
 			name: "return",
 			source: `
 			fun fib(n) {
-				if (n <= 1) return n;
+				if (n <= 1) {
+					return n;
+				}
 				return fib(n - 2) + fib(n - 1);
 			}
 			for (var i = 0; i < 5; i = i + 1) {
@@ -506,7 +749,7 @@ func TestStmtAndDecl(t *testing.T) {
 		{
 			name:       "class this 2",
 			source:     "print this;",
-			err:        ErrUndefinedVariable,
+			err:        check.ErrThisOutsideClass,
 			wantOutput: "",
 		},
 		{
@@ -550,6 +793,569 @@ func TestStmtAndDecl(t *testing.T) {
 			err:        nil,
 			wantOutput: `"A method"` + "\n",
 		},
+		{
+			name: "class method table",
+			source: `
+			class A {
+				f() {
+					return 1;
+				}
+				g() {
+					return 2;
+				}
+			}
+			class B < A {
+				g() {
+					return 3;
+				}
+			}
+			class C < B {
+			}
+			var c = C();
+			print c.f() + c.g() * 10;
+			print c.g == c.g;
+			`,
+			err:        nil,
+			wantOutput: "31\ntrue\n",
+		},
+		{
+			name: "class init",
+			source: `
+			class Point {
+				init(x, y = 2) {
+					this.x = x;
+					this.y = y;
+					if (x > 5) {
+						return;
+					}
+					this.x = x * 10;
+				}
+			}
+			class Point3 < Point {
+				init(x, y, z) {
+					super.init(x, y);
+					this.z = z;
+				}
+			}
+			var p = Point(1);
+			print p.x + p.y;
+			print Point(6, 3).x;
+			print p.init(7) == p;
+			var q = Point3(1, 2, 3);
+			print q.x + q.y + q.z;
+			`,
+			err:        nil,
+			wantOutput: "12\n6\ntrue\n15\n",
+		},
+		{
+			name: "class init arity",
+			source: `
+			class Point {
+				init(x) {
+					this.x = x;
+				}
+			}
+			Point();
+			`,
+			err: ErrNumParamsArgsNotMatch,
+		},
+		{
+			name: "class without init arity",
+			source: `
+			class Point {
+			}
+			Point(1);
+			`,
+			err: ErrNumParamsArgsNotMatch,
+		},
+		{
+			name: "class init return value",
+			source: `
+			class Point {
+				init() {
+					return 1;
+				}
+			}
+			`,
+			err: check.ErrReturnFromInit,
+		},
+		{
+			name: "class static getter setter",
+			source: `
+			class Temp {
+				static of(c) {
+					var t = Temp();
+					t.celsius = c;
+					return t;
+				}
+				get celsius {
+					return this.c;
+				}
+				set celsius(c) {
+					this.c = c;
+				}
+				get fahrenheit {
+					return this.c * 9 / 5 + 32;
+				}
+				set fahrenheit(f) {
+					this.celsius = (f - 32) * 5 / 9;
+				}
+			}
+			class Hot < Temp {
+				get celsius {
+					return this.c + 100;
+				}
+			}
+			var t = Temp.of(100);
+			print t.fahrenheit;
+			t.fahrenheit = 32;
+			print t.celsius;
+			var h = Hot();
+			h.celsius = 1;
+			print h.celsius;
+			print Hot.of(2).celsius;
+			`,
+			err:        nil,
+			wantOutput: "212\n0\n101\n2\n",
+		},
+		{
+			name: "class static undefined",
+			source: `
+			class A {
+				f() {
+					return 1;
+				}
+			}
+			A.f();
+			`,
+			err: ErrUndefinedProperty,
+		},
+		{
+			name: "operator overloading",
+			source: `
+			class Vec {
+				init(x, y) {
+					this.x = x;
+					this.y = y;
+				}
+				__add__(o) {
+					return Vec(this.x + o.x, this.y + o.y);
+				}
+				__neg__() {
+					return Vec(-this.x, -this.y);
+				}
+				__eq__(o) {
+					return this.x == o.x and this.y == o.y;
+				}
+				__le__(o) {
+					return this.x <= o.x;
+				}
+				__index__(i) {
+					if (i == 0) {
+						return this.x;
+					}
+					return this.y;
+				}
+				__str__() {
+					return this.x * 100 + this.y;
+				}
+			}
+			var a = Vec(1, 2);
+			print a + Vec(3, 4);
+			print -a;
+			print a == Vec(1, 2);
+			print a != Vec(1, 2);
+			print a <= Vec(0, 0);
+			print a[1];
+			`,
+			err:        nil,
+			wantOutput: "406\n-102\ntrue\nfalse\nfalse\n2\n",
+		},
+		{
+			name: "operator not overloaded",
+			source: `
+			class A {}
+			print A() - 1;
+			`,
+			err: ErrInvalidOperandUnion,
+		},
+		{
+			name: "class traits",
+			source: `
+			trait Named {
+				name() {
+					return this.n;
+				}
+				greet() {
+					return 1;
+				}
+			}
+			trait Counted {
+				count() {
+					return this.name() * 10;
+				}
+			}
+			class Base {
+				greet() {
+					return 0;
+				}
+				count() {
+					return 0;
+				}
+			}
+			class Item < Base with Named, Counted {
+				init(n) {
+					this.n = n;
+				}
+				name() {
+					return this.n + 1;
+				}
+			}
+			var item = Item(2);
+			print item.name();
+			print item.greet();
+			print item.count();
+			`,
+			err:        nil,
+			wantOutput: "3\n1\n30\n",
+		},
+		{
+			name: "class with non trait",
+			source: `
+			class A {}
+			class B with A {}
+			`,
+			err: ErrNotTrait,
+		},
+		{
+			name: "class private names",
+			source: `
+			class Counter {
+				init() {
+					this.#count = 0;
+				}
+				#bump(n) {
+					this.#count = this.#count + n;
+					return this;
+				}
+				add(n) {
+					return this.#bump(n);
+				}
+				get value {
+					return this.#count;
+				}
+				static copy(other) {
+					var c = Counter();
+					c.#count = other.#count;
+					return c;
+				}
+			}
+			class Twice < Counter {
+				init() {
+					super.init();
+					this.#count = 100;
+				}
+				add(n) {
+					this.#count = this.#count + 1;
+					return super.add(n * 2);
+				}
+				get mine {
+					return this.#count;
+				}
+			}
+			var c = Counter().add(1).add(2);
+			print c.value;
+			print Counter.copy(c).add(10).value;
+			var t = Twice();
+			t.add(5);
+			print t.value;
+			print t.mine;
+			`,
+			err:        nil,
+			wantOutput: "3\n13\n10\n101\n",
+		},
+		{
+			name: "class private names same class name",
+			source: `
+			class A {
+				init() {
+					this.#secret = 42;
+				}
+				leak() {
+					class A {
+						init() {
+							this.#secret = 0;
+						}
+						peek(o) {
+							return o.#secret;
+						}
+					}
+					return A().peek(this);
+				}
+			}
+			print A().leak();
+			`,
+			err: ErrUndefinedProperty,
+		},
+		{
+			name: "reflection",
+			source: `
+			class Shape {
+				init(name) {
+					this.name = name;
+					this.#id = 7;
+				}
+				area() {
+					return 0;
+				}
+				#secret() {
+					return this.#id;
+				}
+			}
+			class Square < Shape {
+				init(side) {
+					super.init("square");
+					this.side = side;
+				}
+				area() {
+					return this.side * this.side;
+				}
+				get perimeter {
+					return this.side * 4;
+				}
+				set perimeter(p) {
+					this.side = p / 4;
+				}
+			}
+			fun perimeter(o) {
+				return getattr(o, "perimeter");
+			}
+			var s = Square(3);
+			print type(1) == "int" and type(1.5) == "float" and type("s") == "string";
+			print type(nil) == "nil" and type(true) == "bool" and type(clock) == "function";
+			print type(s) == "instance" and type(Square) == "class" and type(s.area) == "function";
+			print isinstance(s, Shape) and isinstance(s, Square);
+			print isinstance(Shape("c"), Square) or isinstance(3, Shape);
+			print superclass(Square) == Shape and superclass(Shape) == nil;
+			var f = fields(s);
+			print f.length;
+			print f[0] == "name" and f[1] == "side";
+			var m = methods(Square);
+			print m.length;
+			print m[0] == "area" and m[1] == "init";
+			print hasattr(s, "side") and hasattr(s, "perimeter") and hasattr(s, "area");
+			print hasattr(s, "Shape#id") or hasattr(s, "missing") or hasattr(1, "side");
+			print getattr(s, "perimeter");
+			print getattr(s, "area")();
+			print setattr(s, "perimeter", 20);
+			print s.side;
+			setattr(s, "color", 1);
+			print hasattr(s, "color");
+			print perimeter(s);
+			`,
+			err:        nil,
+			wantOutput: "true\ntrue\ntrue\ntrue\nfalse\ntrue\n2\ntrue\n2\ntrue\ntrue\nfalse\n12\n9\n20\n5\ntrue\n20\n",
+		},
+		{
+			name: "reflection private name",
+			source: `
+			class A {
+				init() {
+					this.#x = 1;
+				}
+			}
+			print getattr(A(), "A#x");
+			`,
+			err: ErrPrivateProperty,
+		},
+		{
+			name:   "builtin arity",
+			source: `print clock(1);`,
+			err:    ErrNumParamsArgsNotMatch,
+		},
+		{
+			name:   "reflection argument type",
+			source: `print isinstance(1, 2);`,
+			err:    ErrInvalidArgumentType,
+		},
+		{
+			name: "throw catch",
+			source: `
+			try {
+				throw "boom";
+				print "unreachable";
+			} catch (e) {
+				print e;
+			}
+			`,
+			err:        nil,
+			wantOutput: `"boom"` + "\n",
+		},
+		{
+			name: "catch runtime error",
+			source: `
+			try {
+				print 1 / 0;
+			} catch (e) {
+				print e.message;
+				print e.line;
+			}
+			`,
+			err:        nil,
+			wantOutput: `"zero in divide"` + "\n" + `3` + "\n",
+		},
+		{
+			name: "finally",
+			source: `
+			try {
+				print 1;
+			} catch (e) {
+				print 2;
+			} finally {
+				print 3;
+			}
+			`,
+			err:        nil,
+			wantOutput: `1` + "\n" + `3` + "\n",
+		},
+		{
+			name: "finally rethrow",
+			source: `
+			fun f() {
+				try {
+					throw "inner";
+				} finally {
+					print "cleanup";
+				}
+			}
+			try {
+				f();
+			} catch (e) {
+				print e;
+			}
+			`,
+			err:        nil,
+			wantOutput: `"cleanup"` + "\n" + `"inner"` + "\n",
+		},
+		{
+			name: "finally return",
+			source: `
+			fun f() {
+				try {
+					return 1;
+				} finally {
+					print "finally";
+				}
+			}
+			print f();
+			`,
+			err:        nil,
+			wantOutput: `"finally"` + "\n" + `1` + "\n",
+		},
+		{
+			name: "throw in catch",
+			source: `
+			try {
+				try {
+					throw 1;
+				} catch (e) {
+					throw e + 1;
+				} finally {
+					print "inner finally";
+				}
+			} catch (e) {
+				print e;
+			}
+			`,
+			err:        nil,
+			wantOutput: `"inner finally"` + "\n" + `2` + "\n",
+		},
+		{
+			name: "print function",
+			source: `
+			fun add(a, b) {
+				return a + b;
+			}
+			print add;
+			`,
+			err:        nil,
+			wantOutput: `<fn add>` + "\n",
+		},
+		{
+			name: "default parameters",
+			source: `
+			fun f(a, b = a + 1, c = b * 10) {
+				print a + b + c;
+			}
+			f(1);
+			f(1, 5);
+			f(1, 5, 100);
+			`,
+			err:        nil,
+			wantOutput: `23` + "\n" + `56` + "\n" + `106` + "\n",
+		},
+		{
+			name: "default sees only earlier parameters",
+			source: `
+			fun f(a = b, b = 1) {
+				print a;
+			}
+			`,
+			err: ErrUndefinedVariable,
+		},
+		{
+			name: "rest parameter",
+			source: `
+			fun f(a, ...rest) {
+				print rest.length;
+				print rest;
+				print rest[0];
+			}
+			f(1, "x", 3);
+			`,
+			err:        nil,
+			wantOutput: `2` + "\n" + `["x", 3]` + "\n" + `"x"` + "\n",
+		},
+		{
+			name: "index out of range",
+			source: `
+			fun f(...rest) {
+				return rest[0];
+			}
+			f();
+			`,
+			err: ErrIndexOutOfRange,
+		},
+		{
+			name: "arity message",
+			source: `
+			fun f(a, b = 2) {
+				return a;
+			}
+			try {
+				f();
+			} catch (e) {
+				print e.message;
+			}
+			`,
+			err:        nil,
+			wantOutput: `"function parameters num should equ to call arguments num: f expects 1 to 2 arguments but got 0"` + "\n",
+		},
+		{
+			name:   "uncaught throw",
+			source: `throw "boom";`,
+			err:    ErrUncaughtException,
+		},
+		{
+			name: "uncaught runtime error",
+			source: `
+			fun f() {
+				return 1 % 0;
+			}
+			f();
+			`,
+			err: ErrZeroInModulo,
+		},
 	}
 
 	for _, tt := range tests {
@@ -567,7 +1373,7 @@ func TestStmtAndDecl(t *testing.T) {
 				return
 			}
 			err = Interpreter(tree)
-			if err != tt.err {
+			if !errors.Is(err, tt.err) {
 				t.Errorf("Interpreter() got err = %v, want err = %v", err, tt.err)
 				return
 			}
@@ -578,3 +1384,213 @@ func TestStmtAndDecl(t *testing.T) {
 		})
 	}
 }
+
+func TestStrict(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		err    error
+	}{
+		{
+			name:   "if",
+			source: `if (1) { print 1; }`,
+			err:    ErrInvalidOperandType,
+		},
+		{
+			name:   "while",
+			source: `while (nil) { print 1; }`,
+			err:    ErrInvalidOperandType,
+		},
+		{
+			name:   "not",
+			source: `print !nil;`,
+			err:    ErrInvalidOperandType,
+		},
+		{
+			name:   "and",
+			source: `print true and 1;`,
+			err:    ErrInvalidOperandType,
+		},
+		{
+			name:   "bool",
+			source: `if (true and !false) { print 1; }`,
+			err:    nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			Output = &buf
+
+			s := scanner.New(tt.source)
+			tokens := s.Scan()
+			p := parser.New(tokens)
+			tree, err := p.Parse()
+			if err != nil {
+				t.Errorf("Parse() err = %v", err)
+				return
+			}
+			err = InterpreterOptions("", tree, Options{Strict: true})
+			if !errors.Is(err, tt.err) {
+				t.Errorf("InterpreterOptions() got err = %v, want err = %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestModule(t *testing.T) {
+	fsys := fstest.MapFS{
+		"lib/strings.stmt": {Data: []byte(`
+			var count = 0;
+			fun hidden() {
+				return "hidden";
+			}
+			export fun greet(name) {
+				count = count + 1;
+				return "hello " + name;
+			}
+			export var version = 2;
+			print "init strings";
+		`)},
+		"lib/counter.stmt": {Data: []byte(`
+			import "strings" as s;
+			export fun twice(name) {
+				s.greet(name);
+				return s.greet(name);
+			}
+		`)},
+		"lib/secret.stmt": {Data: []byte(`
+			class A {
+				init() {
+					this.#secret = 42;
+				}
+			}
+			export fun make() {
+				return A();
+			}
+		`)},
+		"cycle/a.stmt": {Data: []byte(`import "b" as b;`)},
+		"cycle/b.stmt": {Data: []byte(`import "a" as a;`)},
+	}
+	tests := []struct {
+		name       string
+		path       string
+		source     string
+		err        error
+		wantOutput string
+	}{
+		{
+			name: "import",
+			path: "main.stmt",
+			source: `
+			import "lib/strings" as s;
+			print s.greet("lox");
+			print s.version;
+			`,
+			wantOutput: `"init strings"` + "\n" + `"hello lox"` + "\n" + "2\n",
+		},
+		{
+			name: "import once",
+			path: "main.stmt",
+			source: `
+			import "lib/strings" as s;
+			import "lib/counter" as c;
+			print c.twice("lox");
+			`,
+			wantOutput: `"init strings"` + "\n" + `"hello lox"` + "\n",
+		},
+		{
+			name: "search path",
+			path: "app/main.stmt",
+			source: `
+			import "strings" as s;
+			print s.version;
+			`,
+			wantOutput: `"init strings"` + "\n" + "2\n",
+		},
+		{
+			name: "not exported",
+			path: "main.stmt",
+			source: `
+			import "lib/strings" as s;
+			s.hidden();
+			`,
+			err: ErrUndefinedProperty,
+		},
+		{
+			name: "private names across modules",
+			path: "main.stmt",
+			source: `
+			import "lib/secret" as s;
+			class A {
+				init() {
+					this.#secret = 0;
+				}
+				peek(o) {
+					return o.#secret;
+				}
+			}
+			print A().peek(s.make());
+			`,
+			err: ErrUndefinedProperty,
+		},
+		{
+			name:   "not found",
+			path:   "main.stmt",
+			source: `import "missing" as m;`,
+			err:    module.ErrModuleNotFound,
+		},
+		{
+			name:   "cycle",
+			path:   "cycle/a.stmt",
+			source: `import "b" as b;`,
+			err:    module.ErrImportCycle,
+		},
+		{
+			name: "export in block",
+			path: "main.stmt",
+			source: `
+			{
+				export var a = 1;
+			}
+			`,
+			err: check.ErrExportNotTopLevel,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			Output = &buf
+			Loader = module.NewLoader(fsys, "lib")
+			defer func() {
+				Loader = nil
+			}()
+
+			s := scanner.New(tt.source)
+			tokens := s.Scan()
+			p := parser.New(tokens)
+			tree, err := p.Parse()
+			if err != nil {
+				t.Errorf("Parse() err = %v", err)
+				return
+			}
+			err = InterpreterFile(tt.path, tree)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("InterpreterFile() got err = %v, want err = %v", err, tt.err)
+				return
+			}
+			if tt.wantOutput != "" && buf.String() != tt.wantOutput {
+				t.Errorf("InterpreterFile() output = %q, want %q", buf.String(), tt.wantOutput)
+				return
+			}
+		})
+	}
+}
+
+func TestTypeOfUnknownValue(t *testing.T) {
+	// 脚本中不会出现的值返回错误而不是 panic
+	_, err := typeOf(struct{}{})
+	if !errors.Is(err, ErrInvalidArgumentType) {
+		t.Errorf("typeOf() err = %v, want %v", err, ErrInvalidArgumentType)
+	}
+}
@@ -0,0 +1,38 @@
+package interpreter
+
+import (
+	"fmt"
+	"stmt/token"
+	"strings"
+)
+
+// list 是列表，目前只由 ...rest 参数创建
+type list struct {
+	Elements []any
+}
+
+func (l *list) GoString() string {
+	elements := make([]string, len(l.Elements))
+	for i, element := range l.Elements {
+		elements[i] = fmt.Sprintf("%#v", element)
+	}
+	return "[" + strings.Join(elements, ", ") + "]"
+}
+
+func (l *list) get(name *token.Token) (any, error) {
+	if name.Lexeme != "length" {
+		return nil, ErrUndefinedProperty
+	}
+	return int64(len(l.Elements)), nil
+}
+
+func (l *list) index(index any) (any, error) {
+	_index, ok := index.(int64)
+	if !ok {
+		return nil, ErrInvalidOperandType
+	}
+	if _index < 0 || _index >= int64(len(l.Elements)) {
+		return nil, fmt.Errorf("%w: %d", ErrIndexOutOfRange, _index)
+	}
+	return l.Elements[_index], nil
+}
@@ -0,0 +1,81 @@
+package interpreter
+
+import (
+	"stmt/ast"
+	"stmt/module"
+	"stmt/token"
+)
+
+// moduleContext 记录正在执行的文件，同一次运行中的所有模块共用 loader 和 modules
+type moduleContext struct {
+	Path     string
+	Strict   bool                 // 是否为严格模式，导入的模块沿用主程序的设置
+	Exports  map[string]bool      // 当前模块导出的名字
+	Bindings map[ast.Node]binding // 变量引用解析得到的槽位
+	Globals  map[string]int       // 全局变量的槽位
+	loader   *module.Loader
+	modules  map[string]*namespace // 已导入的模块，按路径缓存
+}
+
+// namespace 是 import 绑定的模块命名空间，通过属性访问模块导出的名字
+type namespace struct {
+	Path    string
+	Env     *environment
+	Exports map[string]bool
+	Globals map[string]int
+}
+
+func (n *namespace) GoString() string {
+	return "<module " + n.Path + ">"
+}
+
+func (n *namespace) get(name *token.Token) (any, error) {
+	if !n.Exports[name.Lexeme] {
+		return nil, ErrUndefinedProperty
+	}
+	return n.Env.Values[n.Globals[name.Lexeme]], nil
+}
+
+// importModule 导入 name 指定的模块，同一次运行中每个模块只执行一次
+func importModule(name string, env *environment) (*namespace, error) {
+	importer := env.Module
+	if importer == nil || importer.loader == nil {
+		return nil, module.ErrNoLoader
+	}
+	loader := importer.loader
+	path, err := loader.Resolve(importer.Path, name)
+	if err != nil {
+		return nil, err
+	}
+	if namespace_, ok := importer.modules[path]; ok {
+		return namespace_, nil
+	}
+	err = loader.Enter(path)
+	if err != nil {
+		return nil, err
+	}
+	defer loader.Exit()
+	decls, err := loader.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	context := &moduleContext{
+		Path:    path,
+		Strict:  importer.Strict,
+		Exports: map[string]bool{},
+		loader:  loader,
+		modules: importer.modules,
+	}
+	moduleEnv, err := run(decls, context)
+	if err != nil {
+		return nil, err
+	}
+	namespace_ := &namespace{
+		Path:    path,
+		Env:     moduleEnv,
+		Exports: context.Exports,
+		Globals: context.Globals,
+	}
+	importer.modules[path] = namespace_
+	return namespace_, nil
+}
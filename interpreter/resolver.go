@@ -0,0 +1,389 @@
+package interpreter
+
+import (
+	"fmt"
+	"sort"
+	"stmt/ast"
+)
+
+// binding 是变量解析的结果：从使用处的环境向外 Depth 层，第 Slot 个槽位
+type binding struct {
+	Depth int
+	Slot  int
+}
+
+// ResolveError 是执行前解析变量作用域时发现的错误
+type ResolveError struct {
+	Err  error
+	Name string
+	Line int
+}
+
+func (r *ResolveError) Error() string {
+	return fmt.Sprintf("line %d: %v '%s'", r.Line, r.Err, r.Name)
+}
+
+func (r *ResolveError) Unwrap() error {
+	return r.Err
+}
+
+// scope 对应运行时的一个环境，名字按声明顺序分配槽位
+type scope struct {
+	slots    map[string]int
+	defined  map[string]bool // 已执行到声明处的名字，只用于全局作用域
+	declared map[string]bool // 代码块中稍后才声明的名字，用于报告声明前使用
+}
+
+func newScope() *scope {
+	return &scope{
+		slots:    map[string]int{},
+		defined:  map[string]bool{},
+		declared: map[string]bool{},
+	}
+}
+
+func (s *scope) declare(name string) int {
+	slot := len(s.slots)
+	s.slots[name] = slot
+	return slot
+}
+
+// resolver 在执行前静态地确定每个变量引用对应的环境和槽位。
+// 它压入和弹出作用域的位置必须与 evaluate 创建环境的位置一一对应。
+type resolver struct {
+	scopes    []*scope
+	bindings  map[ast.Node]binding
+	functions int // 当前所在的函数嵌套层数，0 表示顶层代码
+}
+
+// resolve 解析一个模块的全部声明，返回变量绑定和全局变量的槽位
+func resolve(decls []ast.Node) (map[ast.Node]binding, map[string]int, error) {
+	r := &resolver{
+		bindings: map[ast.Node]binding{},
+	}
+	global := newScope()
+	names := make([]string, 0, len(builtins))
+	for name := range builtins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		global.declare(name)
+		global.defined[name] = true
+	}
+	for _, decl := range decls {
+		name, line, ok := declarationName(decl)
+		if !ok {
+			continue
+		}
+		if _, ex := global.slots[name]; ex && !global.defined[name] {
+			return nil, nil, &ResolveError{Err: ErrVariableAlreadyDefined, Name: name, Line: line}
+		}
+		if _, ex := builtins[name]; ex {
+			// 覆盖内置函数时沿用它的槽位
+			global.defined[name] = false
+			continue
+		}
+		global.declare(name)
+	}
+	r.scopes = []*scope{global}
+	for _, decl := range decls {
+		err := r.resolve(decl)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return r.bindings, global.slots, nil
+}
+
+// declarationName 返回声明语句引入的名字
+func declarationName(node ast.Node) (string, int, bool) {
+	switch _node := node.(type) {
+	case *ast.Var:
+		return _node.Name.Lexeme, _node.Line, true
+	case *ast.Function:
+		return _node.Name.Lexeme, _node.Line, true
+	case *ast.Class:
+		return _node.Name.Lexeme, _node.Line, true
+	case *ast.Trait:
+		return _node.Name.Lexeme, _node.Line, true
+	case *ast.Import:
+		return _node.Name.Lexeme, _node.Line, true
+	case *ast.Export:
+		return declarationName(_node.Declaration)
+	default:
+		return "", 0, false
+	}
+}
+
+func (r *resolver) begin() {
+	r.scopes = append(r.scopes, newScope())
+}
+
+func (r *resolver) end() {
+	r.scopes = r.scopes[:len(r.scopes)-1]
+}
+
+// define 在当前作用域声明 name，并把声明语句绑定到它的槽位
+func (r *resolver) define(node ast.Node, name string, line int) error {
+	current := r.scopes[len(r.scopes)-1]
+	if len(r.scopes) == 1 {
+		current.defined[name] = true
+		r.bindings[node] = binding{Slot: current.slots[name]}
+		return nil
+	}
+	if _, ex := current.slots[name]; ex {
+		return &ResolveError{Err: ErrVariableAlreadyDefined, Name: name, Line: line}
+	}
+	r.bindings[node] = binding{Slot: current.declare(name)}
+	return nil
+}
+
+// lookup 从内向外查找 name，并把引用它的节点绑定到找到的槽位
+func (r *resolver) lookup(node ast.Node, name string, line int) error {
+	for i := len(r.scopes) - 1; i >= 0; i-- {
+		slot, ok := r.scopes[i].slots[name]
+		if !ok {
+			continue
+		}
+		if i == 0 && r.functions == 0 && !r.scopes[i].defined[name] {
+			// 顶层代码按顺序执行，此时全局变量还没有声明
+			return &ResolveError{Err: ErrUseBeforeDefine, Name: name, Line: line}
+		}
+		r.bindings[node] = binding{
+			Depth: len(r.scopes) - 1 - i,
+			Slot:  slot,
+		}
+		return nil
+	}
+	for _, scope_ := range r.scopes {
+		if scope_.declared[name] {
+			return &ResolveError{Err: ErrUseBeforeDefine, Name: name, Line: line}
+		}
+	}
+	return &ResolveError{Err: ErrUndefinedVariable, Name: name, Line: line}
+}
+
+func (r *resolver) block(block *ast.Block) error {
+	r.begin()
+	defer r.end()
+	current := r.scopes[len(r.scopes)-1]
+	for _, decl := range block.Declarations {
+		if name, _, ok := declarationName(decl); ok {
+			current.declared[name] = true
+		}
+	}
+	for _, decl := range block.Declarations {
+		err := r.resolve(decl)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// function 解析函数的参数和函数体，scope 的嵌套方式与调用时创建的环境相同
+func (r *resolver) function(function *ast.Function) error {
+	r.functions++
+	r.begin()
+	defer func() {
+		r.end()
+		r.functions--
+	}()
+	current := r.scopes[len(r.scopes)-1]
+	params := function.Params
+	if function.Rest != nil {
+		params = append(params[:len(params):len(params)], function.Rest)
+	}
+	for i, param := range params {
+		if function.Defaults != nil && i < len(function.Defaults) {
+			// 默认值中只能看到排在前面的参数
+			err := r.resolve(function.Defaults[i])
+			if err != nil {
+				return err
+			}
+		}
+		if _, ex := current.slots[param.Lexeme]; ex {
+			return &ResolveError{Err: ErrVariableAlreadyDefined, Name: param.Lexeme, Line: param.Line}
+		}
+		current.declare(param.Lexeme)
+	}
+	return r.block(function.Body)
+}
+
+func (r *resolver) resolve(node ast.Node) error {
+	switch _node := node.(type) {
+	case nil:
+		return nil
+	case *ast.Literal, *ast.Break, *ast.Continue:
+		return nil
+	case *ast.Variable:
+		return r.lookup(_node, _node.Name.Lexeme, _node.Name.Line)
+	case *ast.Assign:
+		err := r.resolve(_node.Value)
+		if err != nil {
+			return err
+		}
+		return r.lookup(_node, _node.Name.Lexeme, _node.Name.Line)
+	case *ast.This:
+		return r.lookup(_node, "this", _node.Keyword.Line)
+	case *ast.Super:
+		return r.lookup(_node, "super", _node.Keyword.Line)
+	case *ast.Grouping:
+		return r.resolve(_node.Expression)
+	case *ast.Unary:
+		return r.resolve(_node.Right)
+	case *ast.Binary:
+		return r.resolveAll(_node.Left, _node.Right)
+	case *ast.Logical:
+		return r.resolveAll(_node.Left, _node.Right)
+	case *ast.Call:
+		err := r.resolve(_node.Callee)
+		if err != nil {
+			return err
+		}
+		for _, arg := range _node.Arguments {
+			err = r.resolve(arg)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case *ast.Get:
+		return r.resolve(_node.Object)
+	case *ast.Index:
+		return r.resolveAll(_node.Object, _node.Index)
+	case *ast.Set:
+		return r.resolveAll(_node.Object, _node.Value)
+	case *ast.ExpressionStatement:
+		return r.resolve(_node.Expression)
+	case *ast.Print:
+		return r.resolve(_node.Expression)
+	case *ast.Return:
+		if _node.Expression == nil {
+			return nil
+		}
+		return r.resolve(_node.Expression)
+	case *ast.Throw:
+		return r.resolve(_node.Expression)
+	case *ast.Block:
+		return r.block(_node)
+	case *ast.If:
+		err := r.resolveAll(_node.Condition, _node.ThenBranch)
+		if err != nil {
+			return err
+		}
+		if _node.ElseBranch == nil {
+			return nil
+		}
+		return r.resolve(_node.ElseBranch)
+	case *ast.While:
+		return r.resolveAll(_node.Condition, _node.Body)
+	case *ast.Try:
+		err := r.block(_node.Body)
+		if err != nil {
+			return err
+		}
+		if _node.CatchBody != nil {
+			r.begin()
+			err = r.define(_node, _node.CatchName.Lexeme, _node.CatchName.Line)
+			if err == nil {
+				err = r.block(_node.CatchBody)
+			}
+			r.end()
+			if err != nil {
+				return err
+			}
+		}
+		if _node.FinallyBody != nil {
+			return r.block(_node.FinallyBody)
+		}
+		return nil
+	case *ast.Var:
+		// 先解析初始化表达式，其中的同名变量指向外层
+		if _node.Initializer != nil {
+			err := r.resolve(_node.Initializer)
+			if err != nil {
+				return err
+			}
+		}
+		return r.define(_node, _node.Name.Lexeme, _node.Line)
+	case *ast.Function:
+		// 先声明函数名，函数体中可以递归调用自身
+		err := r.define(_node, _node.Name.Lexeme, _node.Line)
+		if err != nil {
+			return err
+		}
+		return r.function(_node)
+	case *ast.Class:
+		err := r.define(_node, _node.Name.Lexeme, _node.Line)
+		if err != nil {
+			return err
+		}
+		for _, trait := range _node.Traits {
+			err = r.resolve(trait)
+			if err != nil {
+				return err
+			}
+		}
+		if _node.SuperClass != nil {
+			err = r.resolve(_node.SuperClass)
+			if err != nil {
+				return err
+			}
+			r.begin()
+			r.scopes[len(r.scopes)-1].declare("super")
+			defer r.end()
+		}
+		// static 方法不绑定 this
+		for _, method := range _node.Statics {
+			err = r.function(method)
+			if err != nil {
+				return err
+			}
+		}
+		r.begin()
+		r.scopes[len(r.scopes)-1].declare("this")
+		defer r.end()
+		for _, methods := range [][]*ast.Function{_node.Methods, _node.Getters, _node.Setters} {
+			for _, method := range methods {
+				err = r.function(method)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	case *ast.Trait:
+		err := r.define(_node, _node.Name.Lexeme, _node.Line)
+		if err != nil {
+			return err
+		}
+		r.begin()
+		r.scopes[len(r.scopes)-1].declare("this")
+		defer r.end()
+		for _, method := range _node.Methods {
+			err = r.function(method)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case *ast.Import:
+		return r.define(_node, _node.Name.Lexeme, _node.Line)
+	case *ast.Export:
+		return r.resolve(_node.Declaration)
+	default:
+		return nil
+	}
+}
+
+func (r *resolver) resolveAll(nodes ...ast.Node) error {
+	for _, node := range nodes {
+		err := r.resolve(node)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
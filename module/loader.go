@@ -0,0 +1,98 @@
+package module
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"stmt/ast"
+	"stmt/parser"
+	"stmt/scanner"
+	"strings"
+)
+
+// Extension 是模块源文件的扩展名，import 的路径没有扩展名时自动补上
+const Extension = ".stmt"
+
+var (
+	ErrNoLoader       = errors.New("no module loader")
+	ErrModuleNotFound = errors.New("module not found")
+	ErrImportCycle    = errors.New("import cycle")
+)
+
+// Loader 负责查找、读取和解析模块，并检测循环导入。
+// 模块先相对导入它的文件所在目录查找，再依次在 SearchPath 中查找。
+type Loader struct {
+	FS         fs.FS
+	SearchPath []string
+	modules    map[string][]ast.Node // 已解析的模块，按路径缓存
+	loading    []string              // 正在加载的模块，最内层在最后
+}
+
+func NewLoader(fsys fs.FS, searchPath ...string) *Loader {
+	return &Loader{
+		FS:         fsys,
+		SearchPath: searchPath,
+		modules:    map[string][]ast.Node{},
+		loading:    []string{},
+	}
+}
+
+// Resolve 返回在 importer 中导入的 name 对应的模块路径
+func (l *Loader) Resolve(importer string, name string) (string, error) {
+	if path.Ext(name) == "" {
+		name += Extension
+	}
+	candidates := []string{path.Join(path.Dir(importer), name)}
+	for _, dir := range l.SearchPath {
+		candidates = append(candidates, path.Join(dir, name))
+	}
+	for _, candidate := range candidates {
+		if !fs.ValidPath(candidate) {
+			continue
+		}
+		info, err := fs.Stat(l.FS, candidate)
+		if err == nil && !info.IsDir() {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %q imported from %q", ErrModuleNotFound, name, importer)
+}
+
+// Parse 读取并解析 path 处的模块，同一路径只解析一次
+func (l *Loader) Parse(path string) ([]ast.Node, error) {
+	nodes, ok := l.modules[path]
+	if ok {
+		return nodes, nil
+	}
+	source, err := fs.ReadFile(l.FS, path)
+	if err != nil {
+		return nil, err
+	}
+	tokens := scanner.New(string(source)).Scan()
+	parser_ := parser.New(tokens)
+	parser_.File = path
+	nodes, err = parser_.Parse()
+	if err != nil {
+		return nil, err
+	}
+	l.modules[path] = nodes
+	return nodes, nil
+}
+
+// Enter 标记开始加载 path，path 已在加载中时返回 ErrImportCycle
+func (l *Loader) Enter(path string) error {
+	for i, loading := range l.loading {
+		if loading == path {
+			cycle := append(append([]string{}, l.loading[i:]...), path)
+			return fmt.Errorf("%w: %s", ErrImportCycle, strings.Join(cycle, " -> "))
+		}
+	}
+	l.loading = append(l.loading, path)
+	return nil
+}
+
+// Exit 标记最近一次 Enter 的模块加载完成
+func (l *Loader) Exit() {
+	l.loading = l.loading[:len(l.loading)-1]
+}
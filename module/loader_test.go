@@ -0,0 +1,105 @@
+package module
+
+import (
+	"errors"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoader_Resolve(t *testing.T) {
+	fsys := fstest.MapFS{
+		"app/main.stmt":         {Data: []byte(`import "util" as u;`)},
+		"app/util.stmt":         {Data: []byte(`export var a = 1;`)},
+		"app/lib/strings.stmt":  {Data: []byte(`export var b = 2;`)},
+		"std/lib/strings.stmt":  {Data: []byte(`export var c = 3;`)},
+		"std/lib/math.stmt":     {Data: []byte(`export var d = 4;`)},
+		"std/lib/dir.stmt/x.go": {Data: []byte(``)},
+	}
+	tests := []struct {
+		name     string
+		importer string
+		module   string
+		want     string
+		err      error
+	}{
+		{
+			name:     "relative",
+			importer: "app/main.stmt",
+			module:   "util",
+			want:     "app/util.stmt",
+		},
+		{
+			name:     "relative_first",
+			importer: "app/main.stmt",
+			module:   "lib/strings",
+			want:     "app/lib/strings.stmt",
+		},
+		{
+			name:     "search_path",
+			importer: "app/main.stmt",
+			module:   "lib/math",
+			want:     "std/lib/math.stmt",
+		},
+		{
+			name:     "extension",
+			importer: "app/main.stmt",
+			module:   "util.stmt",
+			want:     "app/util.stmt",
+		},
+		{
+			name:     "directory",
+			importer: "app/main.stmt",
+			module:   "lib/dir",
+			err:      ErrModuleNotFound,
+		},
+		{
+			name:     "not_found",
+			importer: "app/main.stmt",
+			module:   "missing",
+			err:      ErrModuleNotFound,
+		},
+		{
+			name:     "outside",
+			importer: "main.stmt",
+			module:   "../util",
+			err:      ErrModuleNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loader := NewLoader(fsys, "std")
+			got, err := loader.Resolve(tt.importer, tt.module)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("Resolve() err = %v, want %v", err, tt.err)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("Resolve() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoader_Enter(t *testing.T) {
+	loader := NewLoader(fstest.MapFS{})
+	for _, path := range []string{"a.stmt", "b.stmt", "c.stmt"} {
+		err := loader.Enter(path)
+		if err != nil {
+			t.Fatalf("Enter(%q) err = %v", path, err)
+		}
+	}
+	err := loader.Enter("b.stmt")
+	if !errors.Is(err, ErrImportCycle) {
+		t.Fatalf("Enter() err = %v, want %v", err, ErrImportCycle)
+	}
+	want := "import cycle: b.stmt -> c.stmt -> b.stmt"
+	if err.Error() != want {
+		t.Errorf("Enter() err = %q, want %q", err.Error(), want)
+	}
+	loader.Exit()
+	loader.Exit()
+	err = loader.Enter("b.stmt")
+	if err != nil {
+		t.Errorf("Enter() after Exit() err = %v", err)
+	}
+}
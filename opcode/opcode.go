@@ -39,44 +39,177 @@ const (
 	OP_CLOSURE_8
 	OP_GET_UPVALUE
 	OP_SET_UPVALUE
+	OP_THROW
+	OP_GET_PROPERTY // 操作数是内联缓存的下标
+	OP_IMPORT
+	OP_MISSING_ARG
+	OP_INDEX
+	OP_TEE_GLOBAL // 相当于 OP_SET_GLOBAL 后 OP_GET_GLOBAL 同一个下标
+	OP_TEE_LOCAL  // 相当于 OP_SET_LOCAL 后 OP_GET_LOCAL 同一个下标
+	OP_JUMP_TRUE  // 相当于 OP_NOT 后 OP_JUMP_FALSE，但栈顶保留取反前的值
+	OP_CLOSE_UPVALUE
+	OP_TAIL_CALL    // 相当于 OP_CALL 后 OP_RETURN，但复用当前栈帧
+	OP_CLASS        // 创建名为操作数指定常量的类并入栈
+	OP_INHERIT      // 栈顶是类，其下是父类：复制父类的方法后弹出类
+	OP_METHOD       // 栈顶是方法的闭包，其下是类：把闭包作为名为操作数指定常量的方法加入类后弹出
+	OP_SET_PROPERTY // 栈顶是值，其下是实例：设置属性后弹出两者，操作数是内联缓存的下标
+	OP_INVOKE       // 调用属性，相当于 OP_GET_PROPERTY 后 OP_CALL；操作数高 24 位是内联缓存的下标，低 8 位是参数个数
+	OP_GET_SUPER    // 栈顶是父类，其下是 this：弹出两者，压入绑定了 this 的父类方法
+	OP_STATIC       // 和 OP_METHOD 相同，但加入的是 static 方法
+	OP_GETTER       // 和 OP_METHOD 相同，但加入的是 get 访问器
+	OP_SETTER       // 和 OP_METHOD 相同，但加入的是 set 访问器
+	OP_TRAIT        // 创建名为操作数指定常量的 trait 并入栈，之后用 OP_METHOD 加入方法
+	OP_WITH         // 栈顶是 trait，其下是类：把 trait 的方法复制到类中后弹出 trait
+	OP_GET_BUILTIN  // 压入内置函数，操作数是它在 value.Builtins 中的下标
+	OP_TEST_BOOL    // 栈顶不是 bool 时报错，严格模式编译时用于检查 and、or 的结果
 )
 
 var OperandWidth = map[uint8]int{
-	OP_CONSTANT:    1,
-	OP_CONSTANT_2:  2,
-	OP_CONSTANT_4:  4,
-	OP_CONSTANT_8:  8,
-	OP_NEGATE:      0,
-	OP_ADD:         0,
-	OP_SUBTRACT:    0,
-	OP_MULTIPLY:    0,
-	OP_DIVIDE:      0,
-	OP_TRUE:        0,
-	OP_FALSE:       0,
-	OP_NIL:         0,
-	OP_NOT:         0,
-	OP_EQ:          0,
-	OP_GT:          0,
-	OP_LT:          0,
-	OP_GE:          0,
-	OP_LE:          0,
-	OP_POP:         0,
-	OP_PRINT:       0,
-	OP_SET_GLOBAL:  2,
-	OP_GET_GLOBAL:  2,
-	OP_SET_LOCAL:   2,
-	OP_GET_LOCAL:   2,
-	OP_JUMP_FALSE:  4,
-	OP_JUMP:        4,
-	OP_AND:         0,
-	OP_OR:          0,
-	OP_LOOP:        4,
-	OP_CALL:        2,
-	OP_RETURN:      0,
-	OP_CLOSURE:     1,
-	OP_CLOSURE_2:   2,
-	OP_CLOSURE_4:   4,
-	OP_CLOSURE_8:   8,
-	OP_GET_UPVALUE: 2,
-	OP_SET_UPVALUE: 2,
+	OP_CONSTANT:      1,
+	OP_CONSTANT_2:    2,
+	OP_CONSTANT_4:    4,
+	OP_CONSTANT_8:    8,
+	OP_NEGATE:        0,
+	OP_ADD:           0,
+	OP_SUBTRACT:      0,
+	OP_MULTIPLY:      0,
+	OP_DIVIDE:        0,
+	OP_MODULO:        0,
+	OP_TRUE:          0,
+	OP_FALSE:         0,
+	OP_NIL:           0,
+	OP_NOT:           0,
+	OP_EQ:            0,
+	OP_GT:            0,
+	OP_LT:            0,
+	OP_GE:            0,
+	OP_LE:            0,
+	OP_POP:           0,
+	OP_PRINT:         0,
+	OP_SET_GLOBAL:    2,
+	OP_GET_GLOBAL:    2,
+	OP_SET_LOCAL:     2,
+	OP_GET_LOCAL:     2,
+	OP_JUMP_FALSE:    4,
+	OP_JUMP:          4,
+	OP_AND:           0,
+	OP_OR:            0,
+	OP_LOOP:          4,
+	OP_CALL:          2,
+	OP_RETURN:        0,
+	OP_CLOSURE:       1,
+	OP_CLOSURE_2:     2,
+	OP_CLOSURE_4:     4,
+	OP_CLOSURE_8:     8,
+	OP_GET_UPVALUE:   2,
+	OP_SET_UPVALUE:   2,
+	OP_THROW:         0,
+	OP_GET_PROPERTY:  2,
+	OP_IMPORT:        2,
+	OP_MISSING_ARG:   1,
+	OP_INDEX:         0,
+	OP_TEE_GLOBAL:    2,
+	OP_TEE_LOCAL:     2,
+	OP_JUMP_TRUE:     4,
+	OP_CLOSE_UPVALUE: 2,
+	OP_TAIL_CALL:     2,
+	OP_CLASS:         2,
+	OP_INHERIT:       0,
+	OP_METHOD:        2,
+	OP_SET_PROPERTY:  2,
+	OP_INVOKE:        4,
+	OP_GET_SUPER:     2,
+	OP_STATIC:        2,
+	OP_GETTER:        2,
+	OP_SETTER:        2,
+	OP_TRAIT:         2,
+	OP_WITH:          0,
+	OP_GET_BUILTIN:   1,
+	OP_TEST_BOOL:     0,
+}
+
+// Names 是指令的名字，用于反汇编
+var Names = map[uint8]string{
+	OP_CONSTANT:      "OP_CONSTANT",
+	OP_CONSTANT_2:    "OP_CONSTANT_2",
+	OP_CONSTANT_4:    "OP_CONSTANT_4",
+	OP_CONSTANT_8:    "OP_CONSTANT_8",
+	OP_NEGATE:        "OP_NEGATE",
+	OP_ADD:           "OP_ADD",
+	OP_SUBTRACT:      "OP_SUBTRACT",
+	OP_MULTIPLY:      "OP_MULTIPLY",
+	OP_DIVIDE:        "OP_DIVIDE",
+	OP_MODULO:        "OP_MODULO",
+	OP_TRUE:          "OP_TRUE",
+	OP_FALSE:         "OP_FALSE",
+	OP_NIL:           "OP_NIL",
+	OP_NOT:           "OP_NOT",
+	OP_EQ:            "OP_EQ",
+	OP_GT:            "OP_GT",
+	OP_LT:            "OP_LT",
+	OP_GE:            "OP_GE",
+	OP_LE:            "OP_LE",
+	OP_POP:           "OP_POP",
+	OP_PRINT:         "OP_PRINT",
+	OP_SET_GLOBAL:    "OP_SET_GLOBAL",
+	OP_GET_GLOBAL:    "OP_GET_GLOBAL",
+	OP_SET_LOCAL:     "OP_SET_LOCAL",
+	OP_GET_LOCAL:     "OP_GET_LOCAL",
+	OP_JUMP_FALSE:    "OP_JUMP_FALSE",
+	OP_JUMP:          "OP_JUMP",
+	OP_AND:           "OP_AND",
+	OP_OR:            "OP_OR",
+	OP_LOOP:          "OP_LOOP",
+	OP_CALL:          "OP_CALL",
+	OP_RETURN:        "OP_RETURN",
+	OP_CLOSURE:       "OP_CLOSURE",
+	OP_CLOSURE_2:     "OP_CLOSURE_2",
+	OP_CLOSURE_4:     "OP_CLOSURE_4",
+	OP_CLOSURE_8:     "OP_CLOSURE_8",
+	OP_GET_UPVALUE:   "OP_GET_UPVALUE",
+	OP_SET_UPVALUE:   "OP_SET_UPVALUE",
+	OP_THROW:         "OP_THROW",
+	OP_GET_PROPERTY:  "OP_GET_PROPERTY",
+	OP_IMPORT:        "OP_IMPORT",
+	OP_MISSING_ARG:   "OP_MISSING_ARG",
+	OP_INDEX:         "OP_INDEX",
+	OP_TEE_GLOBAL:    "OP_TEE_GLOBAL",
+	OP_TEE_LOCAL:     "OP_TEE_LOCAL",
+	OP_JUMP_TRUE:     "OP_JUMP_TRUE",
+	OP_CLOSE_UPVALUE: "OP_CLOSE_UPVALUE",
+	OP_TAIL_CALL:     "OP_TAIL_CALL",
+	OP_CLASS:         "OP_CLASS",
+	OP_INHERIT:       "OP_INHERIT",
+	OP_METHOD:        "OP_METHOD",
+	OP_SET_PROPERTY:  "OP_SET_PROPERTY",
+	OP_INVOKE:        "OP_INVOKE",
+	OP_GET_SUPER:     "OP_GET_SUPER",
+	OP_STATIC:        "OP_STATIC",
+	OP_GETTER:        "OP_GETTER",
+	OP_SETTER:        "OP_SETTER",
+	OP_TRAIT:         "OP_TRAIT",
+	OP_WITH:          "OP_WITH",
+	OP_GET_BUILTIN:   "OP_GET_BUILTIN",
+	OP_TEST_BOOL:     "OP_TEST_BOOL",
+}
+
+// Info 描述一条指令
+type Info struct {
+	Name    string
+	Width   int  // 操作数的字节数
+	Defined bool // 是否为已定义的指令
+}
+
+// Table 是以指令为下标的指令表，由 OperandWidth 和 Names 生成，
+// 执行和解码字节码时用它代替查 map
+var Table [256]Info
+
+func init() {
+	for op, width := range OperandWidth {
+		Table[op] = Info{
+			Name:    Names[op],
+			Width:   width,
+			Defined: true,
+		}
+	}
 }
@@ -0,0 +1,178 @@
+package opcode
+
+// 寄存器虚拟机的指令是 32 位的字，从低位起依次是 8 位的指令和 8 位的操作数 A、B、C。
+// 需要更大操作数的指令把 B、C 合起来作为 16 位的 Bx；跳转偏移 sBx 以 Bx - MaxSBx 表示，
+// 相对于下一条指令。R[x] 表示当前栈帧的第 x 个寄存器，K[x] 表示第 x 个常量。
+const (
+	R_MOVE          uint8 = iota // R[A] = R[B]
+	R_LOADK                      // R[A] = K[Bx]
+	R_LOADBOOL                   // R[A] = B != 0
+	R_LOADNIL                    // R[A] = nil
+	R_GET_GLOBAL                 // R[A] = 第 Bx 个全局变量
+	R_SET_GLOBAL                 // 第 Bx 个全局变量 = R[A]
+	R_GET_UPVALUE                // R[A] = 第 Bx 个 upvalue
+	R_SET_UPVALUE                // 第 Bx 个 upvalue = R[A]
+	R_CLOSE_UPVALUE              // 关闭指向 R[A] 及之后寄存器的 upvalue
+	R_CLOSURE                    // R[A] = 函数 K[Bx] 的闭包，之后是每个 upvalue 一条 R_CAPTURE
+	R_CAPTURE                    // 不执行，A 为 1 时捕获寄存器 R[Bx]，否则捕获所在函数的第 Bx 个 upvalue
+	R_NEGATE                     // R[A] = -R[B]
+	R_NOT                        // R[A] = !R[B]
+	R_ADD                        // R[A] = R[B] + R[C]
+	R_SUBTRACT                   // R[A] = R[B] - R[C]
+	R_MULTIPLY                   // R[A] = R[B] * R[C]
+	R_DIVIDE                     // R[A] = R[B] / R[C]
+	R_MODULO                     // R[A] = R[B] % R[C]
+	R_EQ                         // R[A] = R[B] == R[C]
+	R_NE                         // R[A] = R[B] != R[C]
+	R_GT                         // R[A] = R[B] > R[C]
+	R_LT                         // R[A] = R[B] < R[C]
+	R_GE                         // R[A] = R[B] >= R[C]
+	R_LE                         // R[A] = R[B] <= R[C]
+	R_JUMP                       // 跳转 sBx 条指令
+	R_JUMP_FALSE                 // R[A] 为假时跳转 sBx 条指令
+	R_JUMP_TRUE                  // R[A] 为真时跳转 sBx 条指令
+	R_CALL                       // 以 R[A+1] 开始的 B 个参数调用 R[A]，结果保存到 R[A]
+	R_TAIL_CALL                  // 和 R_CALL 相同，但复用当前栈帧，被调用函数直接返回到调用者
+	R_RETURN                     // 返回 R[A]
+	R_PRINT                      // 输出 R[A]
+	R_THROW                      // 抛出 R[A]
+	R_GET_PROPERTY               // R[A] = R[A] 名为 K[Bx] 的属性
+	R_INDEX                      // R[A] = R[B][R[C]]
+	R_MISSING_ARG                // R[A] = 调用时没有传入第 B 个参数
+	R_IMPORT                     // R[A] = 模块 K[Bx]，首次导入时先执行模块的顶层代码
+	R_TEST_BOOL                  // R[A] 不是 bool 时报错，严格模式编译时用于检查 and、or 的结果
+)
+
+const (
+	MaxRegisters = 1 << 8     // 一个函数最多使用的寄存器数
+	MaxBx        = 1<<16 - 1  // Bx 的最大值
+	MaxSBx       = MaxBx >> 1 // sBx 的最大值
+)
+
+// RegisterNames 是寄存器指令的名字，用于反汇编
+var RegisterNames = map[uint8]string{
+	R_MOVE:          "R_MOVE",
+	R_LOADK:         "R_LOADK",
+	R_LOADBOOL:      "R_LOADBOOL",
+	R_LOADNIL:       "R_LOADNIL",
+	R_GET_GLOBAL:    "R_GET_GLOBAL",
+	R_SET_GLOBAL:    "R_SET_GLOBAL",
+	R_GET_UPVALUE:   "R_GET_UPVALUE",
+	R_SET_UPVALUE:   "R_SET_UPVALUE",
+	R_CLOSE_UPVALUE: "R_CLOSE_UPVALUE",
+	R_CLOSURE:       "R_CLOSURE",
+	R_CAPTURE:       "R_CAPTURE",
+	R_NEGATE:        "R_NEGATE",
+	R_NOT:           "R_NOT",
+	R_ADD:           "R_ADD",
+	R_SUBTRACT:      "R_SUBTRACT",
+	R_MULTIPLY:      "R_MULTIPLY",
+	R_DIVIDE:        "R_DIVIDE",
+	R_MODULO:        "R_MODULO",
+	R_EQ:            "R_EQ",
+	R_NE:            "R_NE",
+	R_GT:            "R_GT",
+	R_LT:            "R_LT",
+	R_GE:            "R_GE",
+	R_LE:            "R_LE",
+	R_JUMP:          "R_JUMP",
+	R_JUMP_FALSE:    "R_JUMP_FALSE",
+	R_JUMP_TRUE:     "R_JUMP_TRUE",
+	R_CALL:          "R_CALL",
+	R_TAIL_CALL:     "R_TAIL_CALL",
+	R_RETURN:        "R_RETURN",
+	R_PRINT:         "R_PRINT",
+	R_THROW:         "R_THROW",
+	R_GET_PROPERTY:  "R_GET_PROPERTY",
+	R_INDEX:         "R_INDEX",
+	R_MISSING_ARG:   "R_MISSING_ARG",
+	R_IMPORT:        "R_IMPORT",
+	R_TEST_BOOL:     "R_TEST_BOOL",
+}
+
+// 寄存器指令操作数的格式
+const (
+	FormatA    uint8 = iota // 只有 A
+	FormatAB                // A、B
+	FormatABC               // A、B、C
+	FormatABx               // A、Bx
+	FormatSBx               // 只有 sBx
+	FormatASBx              // A、sBx
+)
+
+// RegisterFormats 是寄存器指令操作数的格式，用于反汇编
+var RegisterFormats = map[uint8]uint8{
+	R_MOVE:          FormatAB,
+	R_LOADK:         FormatABx,
+	R_LOADBOOL:      FormatAB,
+	R_LOADNIL:       FormatA,
+	R_GET_GLOBAL:    FormatABx,
+	R_SET_GLOBAL:    FormatABx,
+	R_GET_UPVALUE:   FormatABx,
+	R_SET_UPVALUE:   FormatABx,
+	R_CLOSE_UPVALUE: FormatA,
+	R_CLOSURE:       FormatABx,
+	R_CAPTURE:       FormatABx,
+	R_NEGATE:        FormatAB,
+	R_NOT:           FormatAB,
+	R_ADD:           FormatABC,
+	R_SUBTRACT:      FormatABC,
+	R_MULTIPLY:      FormatABC,
+	R_DIVIDE:        FormatABC,
+	R_MODULO:        FormatABC,
+	R_EQ:            FormatABC,
+	R_NE:            FormatABC,
+	R_GT:            FormatABC,
+	R_LT:            FormatABC,
+	R_GE:            FormatABC,
+	R_LE:            FormatABC,
+	R_JUMP:          FormatSBx,
+	R_JUMP_FALSE:    FormatASBx,
+	R_JUMP_TRUE:     FormatASBx,
+	R_CALL:          FormatAB,
+	R_TAIL_CALL:     FormatAB,
+	R_RETURN:        FormatA,
+	R_PRINT:         FormatA,
+	R_THROW:         FormatA,
+	R_GET_PROPERTY:  FormatABx,
+	R_INDEX:         FormatABC,
+	R_MISSING_ARG:   FormatAB,
+	R_IMPORT:        FormatABx,
+	R_TEST_BOOL:     FormatA,
+}
+
+func MakeABC(op uint8, a uint8, b uint8, c uint8) uint32 {
+	return uint32(op) | uint32(a)<<8 | uint32(b)<<16 | uint32(c)<<24
+}
+
+func MakeABx(op uint8, a uint8, bx uint16) uint32 {
+	return uint32(op) | uint32(a)<<8 | uint32(bx)<<16
+}
+
+func MakeASBx(op uint8, a uint8, sbx int) uint32 {
+	return MakeABx(op, a, uint16(sbx+MaxSBx))
+}
+
+func Op(instruction uint32) uint8 {
+	return uint8(instruction)
+}
+
+func A(instruction uint32) uint8 {
+	return uint8(instruction >> 8)
+}
+
+func B(instruction uint32) uint8 {
+	return uint8(instruction >> 16)
+}
+
+func C(instruction uint32) uint8 {
+	return uint8(instruction >> 24)
+}
+
+func Bx(instruction uint32) uint16 {
+	return uint16(instruction >> 16)
+}
+
+func SBx(instruction uint32) int {
+	return int(Bx(instruction)) - MaxSBx
+}
@@ -0,0 +1,396 @@
+package optimize
+
+import (
+	"math"
+	"stmt/ast"
+	"stmt/token"
+)
+
+// Fold 在编译前折叠 nodes 中的常量表达式，并删除条件为 false 的分支和循环，返回折叠后的语法树。
+// nodes 保持不变：被修改的节点都是复制后再修改的，没有修改的子树与 nodes 共享，
+// 所以 module.Loader 缓存的语法树可以继续交给解释器使用。
+// 会在运行时出错的表达式（如除以 0）保持原样，错误仍在运行时报告；
+// 依赖真值规则的折叠只针对 bool 字面量，and、or 折叠后的结果也是 bool 字面量，所以结果不受严格模式影响。
+func Fold(nodes []ast.Node) []ast.Node {
+	folded := make([]ast.Node, len(nodes))
+	for i, node := range nodes {
+		folded[i] = foldNode(node)
+	}
+	return folded
+}
+
+func foldNode(node ast.Node) ast.Node {
+	switch _node := node.(type) {
+	case ast.Stmt:
+		return foldStmt(_node)
+	case ast.Expr:
+		return foldExpr(_node)
+	default:
+		return node
+	}
+}
+
+func foldBlock(block *ast.Block) *ast.Block {
+	if block == nil {
+		return nil
+	}
+	folded := *block
+	folded.Declarations = make([]ast.Stmt, len(block.Declarations))
+	for i, declaration := range block.Declarations {
+		folded.Declarations[i] = foldStmt(declaration)
+	}
+	return &folded
+}
+
+func foldFunction(function *ast.Function) *ast.Function {
+	folded := *function
+	if function.Defaults != nil {
+		folded.Defaults = make([]ast.Expr, len(function.Defaults))
+		for i, default_ := range function.Defaults {
+			if default_ != nil {
+				folded.Defaults[i] = foldExpr(default_)
+			}
+		}
+	}
+	folded.Body = foldBlock(function.Body)
+	return &folded
+}
+
+func foldFunctions(functions []*ast.Function) []*ast.Function {
+	if functions == nil {
+		return nil
+	}
+	folded := make([]*ast.Function, len(functions))
+	for i, function := range functions {
+		folded[i] = foldFunction(function)
+	}
+	return folded
+}
+
+func foldStmt(stmt ast.Stmt) ast.Stmt {
+	switch _stmt := stmt.(type) {
+	case *ast.ExpressionStatement:
+		folded := *_stmt
+		folded.Expression = foldExpr(_stmt.Expression)
+		return &folded
+	case *ast.Print:
+		folded := *_stmt
+		folded.Expression = foldExpr(_stmt.Expression)
+		return &folded
+	case *ast.Throw:
+		folded := *_stmt
+		folded.Expression = foldExpr(_stmt.Expression)
+		return &folded
+	case *ast.Return:
+		if _stmt.Expression == nil {
+			return stmt
+		}
+		folded := *_stmt
+		folded.Expression = foldExpr(_stmt.Expression)
+		return &folded
+	case *ast.Var:
+		if _stmt.Initializer == nil {
+			return stmt
+		}
+		folded := *_stmt
+		folded.Initializer = foldExpr(_stmt.Initializer)
+		return &folded
+	case *ast.Block:
+		return foldBlock(_stmt)
+	case *ast.If:
+		folded := *_stmt
+		folded.Condition = foldExpr(_stmt.Condition)
+		folded.ThenBranch = foldBlock(_stmt.ThenBranch)
+		folded.ElseBranch = foldBlock(_stmt.ElseBranch)
+		if cond, ok := boolLiteral(folded.Condition); ok {
+			if cond {
+				return folded.ThenBranch
+			}
+			if folded.ElseBranch != nil {
+				return folded.ElseBranch
+			}
+			return &ast.Block{Line: _stmt.Line}
+		}
+		return &folded
+	case *ast.While:
+		folded := *_stmt
+		folded.Condition = foldExpr(_stmt.Condition)
+		folded.Body = foldBlock(_stmt.Body)
+		if cond, ok := boolLiteral(folded.Condition); ok && !cond {
+			return &ast.Block{Line: _stmt.Line}
+		}
+		return &folded
+	case *ast.Try:
+		folded := *_stmt
+		folded.Body = foldBlock(_stmt.Body)
+		folded.CatchBody = foldBlock(_stmt.CatchBody)
+		folded.FinallyBody = foldBlock(_stmt.FinallyBody)
+		return &folded
+	case *ast.Function:
+		return foldFunction(_stmt)
+	case *ast.Class:
+		folded := *_stmt
+		folded.Methods = foldFunctions(_stmt.Methods)
+		folded.Statics = foldFunctions(_stmt.Statics)
+		folded.Getters = foldFunctions(_stmt.Getters)
+		folded.Setters = foldFunctions(_stmt.Setters)
+		return &folded
+	case *ast.Trait:
+		folded := *_stmt
+		folded.Methods = foldFunctions(_stmt.Methods)
+		return &folded
+	case *ast.Export:
+		folded := *_stmt
+		folded.Declaration = foldStmt(_stmt.Declaration)
+		return &folded
+	}
+	return stmt
+}
+
+func foldExpr(expr ast.Expr) ast.Expr {
+	switch _expr := expr.(type) {
+	case *ast.Grouping:
+		folded := *_expr
+		folded.Expression = foldExpr(_expr.Expression)
+		if literal, ok := folded.Expression.(*ast.Literal); ok {
+			return literal
+		}
+		return &folded
+	case *ast.Unary:
+		folded := *_expr
+		folded.Right = foldExpr(_expr.Right)
+		if right, ok := folded.Right.(*ast.Literal); ok {
+			if value, ok := foldUnary(_expr.Operator.TokenType, right.Value); ok {
+				return &ast.Literal{Line: _expr.Line, Value: value}
+			}
+		}
+		return &folded
+	case *ast.Binary:
+		folded := *_expr
+		folded.Left = foldExpr(_expr.Left)
+		folded.Right = foldExpr(_expr.Right)
+		left, ok := folded.Left.(*ast.Literal)
+		if !ok {
+			return &folded
+		}
+		right, ok := folded.Right.(*ast.Literal)
+		if !ok {
+			return &folded
+		}
+		if value, ok := foldBinary(_expr.Operator.TokenType, left.Value, right.Value); ok {
+			return &ast.Literal{Line: _expr.Line, Value: value}
+		}
+		return &folded
+	case *ast.Logical:
+		folded := *_expr
+		folded.Left = foldExpr(_expr.Left)
+		folded.Right = foldExpr(_expr.Right)
+		left, ok := boolLiteral(folded.Left)
+		if !ok {
+			return &folded
+		}
+		// and、or 的结果是决定真假的那个操作数。结果是右操作数时它也必须是 bool 字面量，
+		// 否则严格模式下本应报告的错误会被折叠掉
+		_, rightBool := boolLiteral(folded.Right)
+		switch _expr.Operator.TokenType {
+		case token.AND:
+			if !left {
+				return folded.Left
+			}
+			if rightBool {
+				return folded.Right
+			}
+		case token.OR:
+			if left {
+				return folded.Left
+			}
+			if rightBool {
+				return folded.Right
+			}
+		}
+		return &folded
+	case *ast.Assign:
+		folded := *_expr
+		folded.Value = foldExpr(_expr.Value)
+		return &folded
+	case *ast.Call:
+		folded := *_expr
+		folded.Callee = foldExpr(_expr.Callee)
+		folded.Arguments = make([]ast.Expr, len(_expr.Arguments))
+		for i, argument := range _expr.Arguments {
+			folded.Arguments[i] = foldExpr(argument)
+		}
+		return &folded
+	case *ast.Get:
+		folded := *_expr
+		folded.Object = foldExpr(_expr.Object)
+		return &folded
+	case *ast.Set:
+		folded := *_expr
+		folded.Object = foldExpr(_expr.Object)
+		folded.Value = foldExpr(_expr.Value)
+		return &folded
+	case *ast.Index:
+		folded := *_expr
+		folded.Object = foldExpr(_expr.Object)
+		folded.Index = foldExpr(_expr.Index)
+		return &folded
+	}
+	return expr
+}
+
+// boolLiteral 判断 expr 是否为 bool 字面量
+func boolLiteral(expr ast.Expr) (bool, bool) {
+	literal, ok := expr.(*ast.Literal)
+	if !ok {
+		return false, false
+	}
+	value, ok := literal.Value.(bool)
+	return value, ok
+}
+
+func foldUnary(operator string, right any) (any, bool) {
+	switch operator {
+	case token.MINUS:
+		switch _right := right.(type) {
+		case int64:
+			return -_right, true
+		case float64:
+			return -_right, true
+		}
+	case token.BANG:
+		if _right, ok := right.(bool); ok {
+			return !_right, true
+		}
+	}
+	return nil, false
+}
+
+// foldBinary 按运行时的规则计算 left operator right，无法在编译时确定结果时返回 false
+func foldBinary(operator string, left any, right any) (any, bool) {
+	switch operator {
+	case token.EQUAL_EQUAL:
+		return literalsEqual(left, right)
+	case token.BANG_EQUAL:
+		equal, ok := literalsEqual(left, right)
+		return !equal, ok
+	}
+	if _left, ok := left.(string); ok {
+		_right, ok := right.(string)
+		if !ok {
+			return nil, false
+		}
+		switch operator {
+		case token.PLUS:
+			return _left + _right, true
+		case token.GREATER:
+			return _left > _right, true
+		case token.GREATER_EQUAL:
+			return _left >= _right, true
+		case token.LESS:
+			return _left < _right, true
+		case token.LESS_EQUAL:
+			return _left <= _right, true
+		}
+		return nil, false
+	}
+	_left, leftInt := left.(int64)
+	_right, rightInt := right.(int64)
+	if leftInt && rightInt {
+		switch operator {
+		case token.PLUS:
+			return _left + _right, true
+		case token.MINUS:
+			return _left - _right, true
+		case token.STAR:
+			return _left * _right, true
+		case token.SLASH:
+			if _right == 0 {
+				return nil, false
+			}
+			return _left / _right, true
+		case token.PERCENTAGE:
+			if _right == 0 {
+				return nil, false
+			}
+			return _left % _right, true
+		case token.GREATER:
+			return _left > _right, true
+		case token.GREATER_EQUAL:
+			return _left >= _right, true
+		case token.LESS:
+			return _left < _right, true
+		case token.LESS_EQUAL:
+			return _left <= _right, true
+		}
+		return nil, false
+	}
+	a, ok := toFloat(left)
+	if !ok {
+		return nil, false
+	}
+	b, ok := toFloat(right)
+	if !ok {
+		return nil, false
+	}
+	switch operator {
+	case token.PLUS:
+		return a + b, true
+	case token.MINUS:
+		return a - b, true
+	case token.STAR:
+		return a * b, true
+	case token.SLASH:
+		if b == 0 {
+			return nil, false
+		}
+		return a / b, true
+	case token.PERCENTAGE:
+		if b == 0 {
+			return nil, false
+		}
+		return math.Mod(a, b), true
+	case token.GREATER:
+		return a > b, true
+	case token.GREATER_EQUAL:
+		return a >= b, true
+	case token.LESS:
+		return a < b, true
+	case token.LESS_EQUAL:
+		return a <= b, true
+	}
+	return nil, false
+}
+
+func toFloat(value any) (float64, bool) {
+	switch _value := value.(type) {
+	case int64:
+		return float64(_value), true
+	case float64:
+		return _value, true
+	default:
+		return 0, false
+	}
+}
+
+// literalsEqual 和运行时一样比较两个字面量：数字比较数值，不同类型的值总是不相等
+func literalsEqual(left any, right any) (bool, bool) {
+	if a, ok := toFloat(left); ok {
+		b, ok := toFloat(right)
+		if !ok {
+			return false, true
+		}
+		_left, leftInt := left.(int64)
+		_right, rightInt := right.(int64)
+		if leftInt && rightInt {
+			return _left == _right, true
+		}
+		return a == b, true
+	}
+	switch left.(type) {
+	case bool, string, nil:
+		return left == right, true
+	default:
+		return false, false
+	}
+}
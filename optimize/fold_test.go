@@ -0,0 +1,210 @@
+package optimize
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"stmt/ast"
+	"stmt/interpreter"
+	"stmt/parser"
+	"stmt/scanner"
+	"testing"
+)
+
+func TestFold_Expr(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   any  // 折叠后的字面量
+		folded bool // 为 false 时表达式应保持原样
+	}{
+		{name: "int arithmetic", source: "1 + 2 * 3 - 4", want: int64(3), folded: true},
+		{name: "int division", source: "7 / 2", want: int64(3), folded: true},
+		{name: "int modulo", source: "7 % 3", want: int64(1), folded: true},
+		{name: "mixed", source: "1 + 0.5", want: 1.5, folded: true},
+		{name: "float modulo", source: "7.5 % 2", want: 1.5, folded: true},
+		{name: "negate", source: "-5", want: int64(-5), folded: true},
+		{name: "negate float", source: "-(1.5)", want: -1.5, folded: true},
+		{name: "grouping", source: "(1 + 2) * 3", want: int64(9), folded: true},
+		{name: "string concat", source: `"a" + "b" + "c"`, want: "abc", folded: true},
+		{name: "string compare", source: `"a" < "b"`, want: true, folded: true},
+		{name: "compare", source: "2 >= 3", want: false, folded: true},
+		{name: "equal mixed", source: "1 == 1.0", want: true, folded: true},
+		{name: "equal different types", source: `1 == "1"`, want: false, folded: true},
+		{name: "not equal nil", source: "nil != nil", want: false, folded: true},
+		{name: "not", source: "!true", want: false, folded: true},
+		{name: "and", source: "true and false", want: false, folded: true},
+		{name: "and short circuit", source: "false and 2", want: false, folded: true},
+		{name: "or", source: "false or true", want: true, folded: true},
+		{name: "and not bool", source: "true and 2", folded: false},
+		{name: "or not bool", source: "false or nil", folded: false},
+		{name: "divide by zero", source: "1 / 0", folded: false},
+		{name: "modulo by zero", source: "1 % 0.0", folded: false},
+		{name: "type error", source: `1 + "a"`, folded: false},
+		{name: "not int", source: "!1", folded: false},
+		{name: "negate string", source: `-"a"`, folded: false},
+		{name: "variable", source: "a + 1", folded: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes, err := parser.New(scanner.New("print " + tt.source + ";").Scan()).Parse()
+			if err != nil {
+				t.Fatalf("Parse() err = %v", err)
+			}
+			nodes = Fold(nodes)
+			got := nodes[0].(*ast.Print).Expression
+			literal, ok := got.(*ast.Literal)
+			if ok != tt.folded {
+				t.Fatalf("Fold() = %#v, folded = %v, want %v", got, ok, tt.folded)
+			}
+			if ok && !reflect.DeepEqual(literal.Value, tt.want) {
+				t.Errorf("Fold() = %#v, want %#v", literal.Value, tt.want)
+			}
+		})
+	}
+}
+
+func TestFold_Stmt(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   []ast.Node
+	}{
+		{
+			name:   "if true",
+			source: "if (1 < 2) { print 1; } else { print 2; }",
+			want: []ast.Node{
+				&ast.Block{
+					Line: 1,
+					Declarations: []ast.Stmt{
+						&ast.Print{Line: 1, Expression: &ast.Literal{Line: 1, Value: int64(1)}},
+					},
+				},
+			},
+		},
+		{
+			name:   "if false",
+			source: "if (false) { print 1; } else { print 2; }",
+			want: []ast.Node{
+				&ast.Block{
+					Line: 1,
+					Declarations: []ast.Stmt{
+						&ast.Print{Line: 1, Expression: &ast.Literal{Line: 1, Value: int64(2)}},
+					},
+				},
+			},
+		},
+		{
+			name:   "if false without else",
+			source: "if (!true) { print 1; }",
+			want: []ast.Node{
+				&ast.Block{Line: 1},
+			},
+		},
+		{
+			name:   "while false",
+			source: "while (1 > 2) { print 1; }",
+			want: []ast.Node{
+				&ast.Block{Line: 1},
+			},
+		},
+		{
+			name:   "nested in function",
+			source: "fun f(a = 2 * 3) { return -1; }",
+			want: []ast.Node{
+				&ast.Function{
+					Line:     1,
+					Name:     nil,
+					Params:   nil,
+					Defaults: []ast.Expr{&ast.Literal{Line: 1, Value: int64(6)}},
+					Body: &ast.Block{
+						Line: 1,
+						Declarations: []ast.Stmt{
+							&ast.Return{Line: 1, Expression: &ast.Literal{Line: 1, Value: int64(-1)}},
+						},
+					},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes, err := parser.New(scanner.New(tt.source).Scan()).Parse()
+			if err != nil {
+				t.Fatalf("Parse() err = %v", err)
+			}
+			nodes = Fold(nodes)
+			if function, ok := nodes[0].(*ast.Function); ok {
+				// 只比较折叠的部分
+				function.Name = nil
+				function.Params = nil
+			}
+			if !reflect.DeepEqual(nodes, tt.want) {
+				t.Errorf("Fold() = %#v, want %#v", nodes[0], tt.want[0])
+			}
+		})
+	}
+}
+
+func TestFold_Copy(t *testing.T) {
+	source := `
+	var a = 1 + 2;
+	fun f(x = 2 * 3) {
+		if (true) { return -x; }
+		while (false) { print x; }
+		return f(1 + 1).y;
+	}
+	class C {
+		m() { this.z = "a" + "b"; }
+	}
+	try { throw !false; } catch (e) { print (1 < 2) and e; }
+	`
+	parse := func() []ast.Node {
+		nodes, err := parser.New(scanner.New(source).Scan()).Parse()
+		if err != nil {
+			t.Fatalf("Parse() err = %v", err)
+		}
+		return nodes
+	}
+	nodes := parse()
+	folded := Fold(nodes)
+	// 折叠结果是新的语法树，传入的语法树可能被 module.Loader 缓存并交给解释器，必须保持不变
+	if !reflect.DeepEqual(nodes, parse()) {
+		t.Errorf("Fold() modified its input")
+	}
+	if reflect.DeepEqual(folded, nodes) {
+		t.Errorf("Fold() = input, want folded copy")
+	}
+	if got := folded[0].(*ast.Var).Initializer; !reflect.DeepEqual(got, &ast.Literal{Line: 2, Value: int64(3)}) {
+		t.Errorf("Fold() initializer = %#v, want 3", got)
+	}
+}
+
+func TestFold_Strict(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		err    error
+	}{
+		{name: "and", source: `print true and 1;`, err: interpreter.ErrInvalidOperandType},
+		{name: "or", source: `print false or "x";`, err: interpreter.ErrInvalidOperandType},
+		{name: "and nil", source: `print true and nil;`, err: interpreter.ErrInvalidOperandType},
+		{name: "bool", source: `print true and !false;`, err: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			interpreter.Output = &buf
+
+			nodes, err := parser.New(scanner.New(tt.source).Scan()).Parse()
+			if err != nil {
+				t.Fatalf("Parse() err = %v", err)
+			}
+			// 折叠后严格模式下的错误应与折叠前相同
+			err = interpreter.InterpreterOptions("", Fold(nodes), interpreter.Options{Strict: true})
+			if !errors.Is(err, tt.err) {
+				t.Errorf("InterpreterOptions() err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
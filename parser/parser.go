@@ -2,20 +2,65 @@ package parser
 
 import (
 	"errors"
+	"fmt"
 	"log/slog"
 	"stmt/ast"
 	"stmt/token"
+	"strings"
 )
 
 var (
 	ErrUnexpectedEof           = errors.New("unexpected end of file")
 	ErrExpectExpression        = errors.New("expect expression")
 	ErrInvalidAssignmentTarget = errors.New("invalid assignment target")
+	ErrExpectCatchOrFinally    = errors.New("expect 'catch' or 'finally' after try body")
+	ErrExpectDeclaration       = errors.New("expect declaration after 'export'")
+	ErrExpectAs                = errors.New("expect 'as' after module path")
+	ErrRequiredAfterDefault    = errors.New("parameter without default follows parameter with default")
+	ErrRestParameterNotLast    = errors.New("rest parameter must be last")
+	ErrSetterParameter         = errors.New("setter must have exactly one parameter")
 )
 
+// Error 是一条带行号的语法错误
+type Error struct {
+	Err  error
+	Line int
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Errors 是一次解析发现的全部语法错误，按出现的顺序排列
+type Errors []*Error
+
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+func (e Errors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
+
 type Parser struct {
-	tokens  []*token.Token
-	current int
+	File       string // 被解析的文件，是私有名字前缀的一部分，所以不同模块中的同名类互不相同；可以为空
+	tokens     []*token.Token
+	current    int
+	classes    []string // 所在的类体的私有名字前缀，从外到内排列，trait 记为空串
+	classCount uint64   // 已解析的类声明的个数，用于给每个类体编号
+	errs       Errors   // 已发现的语法错误
 }
 
 func New(tokens []*token.Token) *Parser {
@@ -25,38 +70,144 @@ func New(tokens []*token.Token) *Parser {
 	}
 }
 
+// Parse 解析全部记号。遇到语法错误时跳到下一条语句继续解析，返回发现的全部错误，
+// 错误类型为 Errors，可以用 errors.Is 判断是否包含某个错误；有错误时不返回语法树
 func (p *Parser) Parse() ([]ast.Node, error) {
 	var decls []ast.Node
 	for !p.isAtEnd() {
 		decl, err := p.declaration()
 		if err != nil {
-			// todo 可能需要打印一些东西
+			p.report(err, p.peek().Line)
+			p.synchronize()
 			continue
 		}
 		decls = append(decls, decl)
 	}
+	if len(p.errs) > 0 {
+		return nil, p.errs
+	}
 	return decls, nil
 }
 
+// report 记录一个语法错误。不影响之后解析的错误（如 set 访问器的参数个数）直接记录后继续解析
+func (p *Parser) report(err error, line int) {
+	p.errs = append(p.errs, &Error{
+		Err:  err,
+		Line: line,
+	})
+}
+
+// synchronize 在语法错误之后跳过记号，直到上一条语句结束或下一条语句开始。
+// 至少跳过一个记号，所以出错的记号不会被反复解析
+func (p *Parser) synchronize() {
+	p.advance()
+	for !p.isAtEnd() {
+		if p.previous().TokenType == token.SEMICOLON {
+			return
+		}
+		switch p.peek().TokenType {
+		case token.CLASS, token.TRAIT, token.FUN, token.VAR, token.FOR, token.IF, token.WHILE,
+			token.PRINT, token.RETURN, token.THROW, token.TRY, token.IMPORT, token.EXPORT:
+			return
+		}
+		p.advance()
+	}
+}
+
 func (p *Parser) declaration() (ast.Stmt, error) {
 	if p.match(token.CLASS) {
 		return p.class()
 	}
+	if p.match(token.TRAIT) {
+		return p.trait()
+	}
 	if p.match(token.FUN) {
 		return p.fun()
 	}
 	if p.match(token.VAR) {
 		return p.var_()
 	}
+	if p.match(token.IMPORT) {
+		return p.import_()
+	}
+	if p.match(token.EXPORT) {
+		return p.export()
+	}
 	return p.statement()
 }
 
+func (p *Parser) import_() (ast.Stmt, error) {
+	kw := p.previous()
+	path, err := p.consume(token.STRING_LITERAL, "Expect module path after 'import'.")
+	if err != nil {
+		return nil, err
+	}
+	if !p.match(token.AS) {
+		token_ := p.peek()
+		slog.Error("Unexpected token.", "line", token_.Line, "message", "Expect 'as' after module path.", "token", token_)
+		return nil, ErrExpectAs
+	}
+	name, err := p.consume(token.IDENTIFIER, "Expect module name after 'as'.")
+	if err != nil {
+		return nil, err
+	}
+	_, err = p.consume(token.SEMICOLON, "Expect ';' after import.")
+	if err != nil {
+		return nil, err
+	}
+	return &ast.Import{
+		Line: kw.Line,
+		Path: path.Literal.(string),
+		Name: name,
+	}, nil
+}
+
+func (p *Parser) export() (ast.Stmt, error) {
+	kw := p.previous()
+	var declaration ast.Stmt
+	var err error
+	switch {
+	case p.match(token.CLASS):
+		declaration, err = p.class()
+	case p.match(token.TRAIT):
+		declaration, err = p.trait()
+	case p.match(token.FUN):
+		declaration, err = p.fun()
+	case p.match(token.VAR):
+		declaration, err = p.var_()
+	default:
+		token_ := p.peek()
+		slog.Error("Unexpected token.", "line", token_.Line, "message", "Expect declaration after 'export'.", "token", token_)
+		return nil, ErrExpectDeclaration
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ast.Export{
+		Line:        kw.Line,
+		Declaration: declaration,
+	}, nil
+}
+
+// privatePrefix 返回名为 name 的类声明的私有名字前缀：类名、所在文件和类声明在文件中的编号
+func (p *Parser) privatePrefix(name string) string {
+	p.classCount++
+	if p.File == "" {
+		return fmt.Sprintf("%s@%d", name, p.classCount)
+	}
+	return fmt.Sprintf("%s@%s:%d", name, p.File, p.classCount)
+}
+
 func (p *Parser) class() (ast.Stmt, error) {
 	kw := p.previous()
 	name, err := p.consume(token.IDENTIFIER, "Expect class name.")
 	if err != nil {
 		return nil, err
 	}
+	p.classes = append(p.classes, p.privatePrefix(name.Lexeme))
+	defer func() {
+		p.classes = p.classes[:len(p.classes)-1]
+	}()
 	var superClass *ast.Variable
 	if p.match(token.LESS) {
 		superClassName, err := p.consume(token.IDENTIFIER, "Expect superclass name.")
@@ -67,17 +218,59 @@ func (p *Parser) class() (ast.Stmt, error) {
 			Name: superClassName,
 		}
 	}
+	var traits []*ast.Variable
+	if p.match(token.WITH) {
+		for {
+			traitName, err := p.consume(token.IDENTIFIER, "Expect trait name.")
+			if err != nil {
+				return nil, err
+			}
+			traits = append(traits, &ast.Variable{
+				Name: traitName,
+			})
+			if !p.match(token.COMMA) {
+				break
+			}
+		}
+	}
 	_, err = p.consume(token.LEFT_BRACE, "Expect '{' before class body.")
 	if err != nil {
 		return nil, err
 	}
-	var methods []*ast.Function
+	var methods, statics, getters, setters []*ast.Function
 	for !p.check(token.RIGHT_BRACE) && !p.isAtEnd() {
-		method, err := p._method()
-		if err != nil {
-			return nil, err
+		switch {
+		case p.modifier("static"):
+			method, err := p._method()
+			if err != nil {
+				return nil, err
+			}
+			statics = append(statics, method)
+		case p.modifier("get"):
+			getter, err := p._getter()
+			if err != nil {
+				return nil, err
+			}
+			getters = append(getters, getter)
+		case p.modifier("set"):
+			setter, err := p._method()
+			if err != nil {
+				return nil, err
+			}
+			if len(setter.Params) != 1 || setter.Defaults != nil || setter.Rest != nil {
+				// 访问器已经完整解析，继续解析类的其他成员
+				slog.Error("Unexpected token.", "line", setter.Line, "message", "Setter must have exactly one parameter.", "token", setter.Name)
+				p.report(ErrSetterParameter, setter.Line)
+				continue
+			}
+			setters = append(setters, setter)
+		default:
+			method, err := p._method()
+			if err != nil {
+				return nil, err
+			}
+			methods = append(methods, method)
 		}
-		methods = append(methods, method)
 	}
 	_, err = p.consume(token.RIGHT_BRACE, "Expect '}' after class body.")
 	if err != nil {
@@ -88,11 +281,98 @@ func (p *Parser) class() (ast.Stmt, error) {
 		Name:       name,
 		Methods:    methods,
 		SuperClass: superClass,
+		Statics:    statics,
+		Getters:    getters,
+		Setters:    setters,
+		Traits:     traits,
+	}, nil
+}
+
+func (p *Parser) trait() (ast.Stmt, error) {
+	kw := p.previous()
+	name, err := p.consume(token.IDENTIFIER, "Expect trait name.")
+	if err != nil {
+		return nil, err
+	}
+	// trait 的方法会被复制到多个类中，不属于任何一个类，其中的私有名字不改写
+	p.classes = append(p.classes, "")
+	defer func() {
+		p.classes = p.classes[:len(p.classes)-1]
+	}()
+	_, err = p.consume(token.LEFT_BRACE, "Expect '{' before trait body.")
+	if err != nil {
+		return nil, err
+	}
+	var methods []*ast.Function
+	for !p.check(token.RIGHT_BRACE) && !p.isAtEnd() {
+		method, err := p._method()
+		if err != nil {
+			return nil, err
+		}
+		methods = append(methods, method)
+	}
+	_, err = p.consume(token.RIGHT_BRACE, "Expect '}' after trait body.")
+	if err != nil {
+		return nil, err
+	}
+	return &ast.Trait{
+		Line:    kw.Line,
+		Name:    name,
+		Methods: methods,
+	}, nil
+}
+
+// property 解析属性名或方法名，它可以是私有名字 #name。类体中的私有名字改写为 类名@编号#name，
+// 编号对每个类声明唯一，所以即使类同名，不同类体的私有名字也互不相同，类外的代码也无法写出改写后的名字
+func (p *Parser) property(message string) (*token.Token, error) {
+	if !p.match(token.PRIVATE_IDENTIFIER) {
+		return p.consume(token.IDENTIFIER, message)
+	}
+	name := p.previous()
+	if len(p.classes) == 0 || p.classes[len(p.classes)-1] == "" {
+		// 留给检查报告在类外使用私有名字
+		return name, nil
+	}
+	return token.New(name.TokenType, p.classes[len(p.classes)-1]+name.Lexeme, nil, name.Line), nil
+}
+
+// modifier 判断类成员是否以 name 修饰，是时跳过它。static、get 和 set 不是关键字，
+// 只有后面紧跟成员名时才是修饰符，所以它们仍然可以作为方法名
+func (p *Parser) modifier(name string) bool {
+	if !p.check(token.IDENTIFIER) || p.peek().Lexeme != name {
+		return false
+	}
+	next := p.tokens[p.current+1]
+	if next.TokenType != token.IDENTIFIER {
+		return false
+	}
+	p.advance()
+	return true
+}
+
+// _getter 解析 get 之后的访问器，它没有参数列表
+func (p *Parser) _getter() (*ast.Function, error) {
+	name, err := p.consume(token.IDENTIFIER, "Expect getter name.")
+	if err != nil {
+		return nil, err
+	}
+	_, err = p.consume(token.LEFT_BRACE, "Expect '{' before getter body.")
+	if err != nil {
+		return nil, err
+	}
+	body, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	return &ast.Function{
+		Line: name.Line,
+		Name: name,
+		Body: body,
 	}, nil
 }
 
 func (p *Parser) _method() (*ast.Function, error) {
-	name, err := p.consume(token.IDENTIFIER, "Expect method name.")
+	name, err := p.property("Expect method name.")
 	if err != nil {
 		return nil, err
 	}
@@ -100,9 +380,12 @@ func (p *Parser) _method() (*ast.Function, error) {
 	if err != nil {
 		return nil, err
 	}
-	var parameters []*token.Token
+	function := &ast.Function{
+		Line: name.Line,
+		Name: name,
+	}
 	if !p.match(token.RIGHT_PAREN) {
-		parameters, err = p._parameters()
+		err = p._parameters(function)
 		if err != nil {
 			return nil, err
 		}
@@ -115,16 +398,11 @@ func (p *Parser) _method() (*ast.Function, error) {
 	if err != nil {
 		return nil, err
 	}
-	body, err := p.block()
+	function.Body, err = p.block()
 	if err != nil {
 		return nil, err
 	}
-	return &ast.Function{
-		Line:   name.Line,
-		Name:   name,
-		Params: parameters,
-		Body:   body,
-	}, nil
+	return function, nil
 }
 
 func (p *Parser) fun() (ast.Stmt, error) {
@@ -137,9 +415,12 @@ func (p *Parser) fun() (ast.Stmt, error) {
 	if err != nil {
 		return nil, err
 	}
-	var parameters []*token.Token
+	function := &ast.Function{
+		Line: kw.Line,
+		Name: name,
+	}
 	if !p.match(token.RIGHT_PAREN) {
-		parameters, err = p._parameters()
+		err = p._parameters(function)
 		if err != nil {
 			return nil, err
 		}
@@ -152,31 +433,56 @@ func (p *Parser) fun() (ast.Stmt, error) {
 	if err != nil {
 		return nil, err
 	}
-	body, err := p.block()
+	function.Body, err = p.block()
 	if err != nil {
 		return nil, err
 	}
-	return &ast.Function{
-		Line:   kw.Line,
-		Name:   name,
-		Params: parameters,
-		Body:   body,
-	}, nil
+	return function, nil
 }
 
-func (p *Parser) _parameters() ([]*token.Token, error) {
-	var parameters []*token.Token
+// _parameters 解析参数列表：有默认值的参数必须排在没有默认值的参数之后，...rest 只能是最后一个参数
+func (p *Parser) _parameters(function *ast.Function) error {
+	var defaults []ast.Expr
+	haveDefault := false
 	for {
+		if p.match(token.ELLIPSIS) {
+			rest, err := p.consume(token.IDENTIFIER, "Expect parameter name after '...'.")
+			if err != nil {
+				return err
+			}
+			function.Rest = rest
+			if p.check(token.COMMA) {
+				token_ := p.peek()
+				slog.Error("Unexpected token.", "line", token_.Line, "message", "Rest parameter must be last.", "token", token_)
+				return ErrRestParameterNotLast
+			}
+			break
+		}
 		name, err := p.consume(token.IDENTIFIER, "Expect parameter name.")
 		if err != nil {
-			return nil, err
+			return err
+		}
+		function.Params = append(function.Params, name)
+		var default_ ast.Expr
+		if p.match(token.EQUAL) {
+			default_, err = p.Expression()
+			if err != nil {
+				return err
+			}
+			haveDefault = true
+		} else if haveDefault {
+			slog.Error("Unexpected token.", "line", name.Line, "message", "Parameter without default follows parameter with default.", "token", name)
+			return ErrRequiredAfterDefault
 		}
-		parameters = append(parameters, name)
+		defaults = append(defaults, default_)
 		if !p.match(token.COMMA) {
 			break
 		}
 	}
-	return parameters, nil
+	if haveDefault {
+		function.Defaults = defaults
+	}
+	return nil
 }
 
 func (p *Parser) var_() (ast.Stmt, error) {
@@ -228,6 +534,12 @@ func (p *Parser) statement() (ast.Stmt, error) {
 	if p.match(token.CONTINUE) {
 		return p.continue_()
 	}
+	if p.match(token.THROW) {
+		return p.throw()
+	}
+	if p.match(token.TRY) {
+		return p.try()
+	}
 	return p.expressionStatement()
 }
 
@@ -456,6 +768,81 @@ func (p *Parser) continue_() (ast.Stmt, error) {
 	}, nil
 }
 
+func (p *Parser) throw() (ast.Stmt, error) {
+	kw := p.previous()
+	value, err := p.Expression()
+	if err != nil {
+		return nil, err
+	}
+	_, err = p.consume(token.SEMICOLON, "Expect ';' after thrown value.")
+	if err != nil {
+		return nil, err
+	}
+	return &ast.Throw{
+		Line:       kw.Line,
+		Expression: value,
+	}, nil
+}
+
+func (p *Parser) try() (ast.Stmt, error) {
+	kw := p.previous()
+	_, err := p.consume(token.LEFT_BRACE, "Expect '{' after 'try'.")
+	if err != nil {
+		return nil, err
+	}
+	body, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	var catchName *token.Token
+	var catchBody *ast.Block
+	if p.match(token.CATCH) {
+		_, err = p.consume(token.LEFT_PAREN, "Expect '(' after 'catch'.")
+		if err != nil {
+			return nil, err
+		}
+		catchName, err = p.consume(token.IDENTIFIER, "Expect exception variable name.")
+		if err != nil {
+			return nil, err
+		}
+		_, err = p.consume(token.RIGHT_PAREN, "Expect ')' after exception variable name.")
+		if err != nil {
+			return nil, err
+		}
+		_, err = p.consume(token.LEFT_BRACE, "Expect '{' before catch body.")
+		if err != nil {
+			return nil, err
+		}
+		catchBody, err = p.block()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var finallyBody *ast.Block
+	if p.match(token.FINALLY) {
+		_, err = p.consume(token.LEFT_BRACE, "Expect '{' before finally body.")
+		if err != nil {
+			return nil, err
+		}
+		finallyBody, err = p.block()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if catchBody == nil && finallyBody == nil {
+		token_ := p.peek()
+		slog.Error("Unexpected token.", "line", token_.Line, "message", "Expect 'catch' or 'finally' after try body.", "token", token_)
+		return nil, ErrExpectCatchOrFinally
+	}
+	return &ast.Try{
+		Line:        kw.Line,
+		Body:        body,
+		CatchName:   catchName,
+		CatchBody:   catchBody,
+		FinallyBody: finallyBody,
+	}, nil
+}
+
 func (p *Parser) expressionStatement() (ast.Stmt, error) {
 	expr, err := p.Expression()
 	if err != nil {
@@ -674,8 +1061,23 @@ func (p *Parser) call() (ast.Expr, error) {
 				Arguments: arguments,
 				Callee:    expr,
 			}
+		} else if p.match(token.LEFT_BRACKET) {
+			kw := p.previous()
+			index, err := p.Expression()
+			if err != nil {
+				return nil, err
+			}
+			_, err = p.consume(token.RIGHT_BRACKET, "Expect ']' after index.")
+			if err != nil {
+				return nil, err
+			}
+			expr = &ast.Index{
+				Line:   kw.Line,
+				Object: expr,
+				Index:  index,
+			}
 		} else if p.match(token.DOT) {
-			name, err := p.consume(token.IDENTIFIER, "Expect property name after '.'.")
+			name, err := p.property("Expect property name after '.'.")
 			if err != nil {
 				return nil, err
 			}
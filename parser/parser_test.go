@@ -489,6 +489,27 @@ func TestParser_Expression(t *testing.T) {
 			},
 			err: nil,
 		},
+		{
+			name:   "index",
+			source: "list[1]",
+			want: &ast.Index{
+				Line: 1,
+				Object: &ast.Variable{
+					Line: 1,
+					Name: &token.Token{
+						TokenType: token.IDENTIFIER,
+						Lexeme:    "list",
+						Line:      1,
+						Literal:   nil,
+					},
+				},
+				Index: &ast.Literal{
+					Line:  1,
+					Value: int64(1),
+				},
+			},
+			err: nil,
+		},
 		{
 			name:   "set",
 			source: "someObject.someProperty = value;",
@@ -725,6 +746,91 @@ func TestParser_statement(t *testing.T) {
 			},
 			err: nil,
 		},
+		{
+			name:   "throw",
+			source: `throw "boom";`,
+			want: &ast.Throw{
+				Line: 1,
+				Expression: &ast.Literal{
+					Line:  1,
+					Value: "boom",
+				},
+			},
+			err: nil,
+		},
+		{
+			name: "try catch finally",
+			source: `
+			try {
+				123;
+			} catch (e) {
+				e;
+			} finally {
+				456;
+			}
+			`,
+			want: &ast.Try{
+				Line: 2,
+				Body: &ast.Block{
+					Line: 2,
+					Declarations: []ast.Stmt{
+						&ast.ExpressionStatement{
+							Line: 3,
+							Expression: &ast.Literal{
+								Line:  3,
+								Value: int64(123),
+							},
+						},
+					},
+				},
+				CatchName: &token.Token{
+					TokenType: token.IDENTIFIER,
+					Lexeme:    "e",
+					Literal:   nil,
+					Line:      4,
+				},
+				CatchBody: &ast.Block{
+					Line: 4,
+					Declarations: []ast.Stmt{
+						&ast.ExpressionStatement{
+							Line: 5,
+							Expression: &ast.Variable{
+								Line: 5,
+								Name: &token.Token{
+									TokenType: token.IDENTIFIER,
+									Lexeme:    "e",
+									Literal:   nil,
+									Line:      5,
+								},
+							},
+						},
+					},
+				},
+				FinallyBody: &ast.Block{
+					Line: 6,
+					Declarations: []ast.Stmt{
+						&ast.ExpressionStatement{
+							Line: 7,
+							Expression: &ast.Literal{
+								Line:  7,
+								Value: int64(456),
+							},
+						},
+					},
+				},
+			},
+			err: nil,
+		},
+		{
+			name: "try without catch or finally",
+			source: `
+			try {
+				123;
+			}
+			`,
+			want: nil,
+			err:  ErrExpectCatchOrFinally,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -976,6 +1082,327 @@ func TestParser_declaration(t *testing.T) {
 			},
 			err: nil,
 		},
+		{
+			name: "class accessors",
+			source: `
+			class A {
+				static make() {}
+				get x {}
+				set x(v) {}
+				get() {}
+			}
+			`,
+			want: &ast.Class{
+				Line: 2,
+				Name: &token.Token{
+					TokenType: token.IDENTIFIER,
+					Lexeme:    "A",
+					Line:      2,
+					Literal:   nil,
+				},
+				Methods: []*ast.Function{
+					{
+						Line: 6,
+						Name: &token.Token{
+							TokenType: token.IDENTIFIER,
+							Lexeme:    "get",
+							Line:      6,
+							Literal:   nil,
+						},
+						Body: &ast.Block{
+							Line:         6,
+							Declarations: nil,
+						},
+					},
+				},
+				Statics: []*ast.Function{
+					{
+						Line: 3,
+						Name: &token.Token{
+							TokenType: token.IDENTIFIER,
+							Lexeme:    "make",
+							Line:      3,
+							Literal:   nil,
+						},
+						Body: &ast.Block{
+							Line:         3,
+							Declarations: nil,
+						},
+					},
+				},
+				Getters: []*ast.Function{
+					{
+						Line: 4,
+						Name: &token.Token{
+							TokenType: token.IDENTIFIER,
+							Lexeme:    "x",
+							Line:      4,
+							Literal:   nil,
+						},
+						Body: &ast.Block{
+							Line:         4,
+							Declarations: nil,
+						},
+					},
+				},
+				Setters: []*ast.Function{
+					{
+						Line: 5,
+						Name: &token.Token{
+							TokenType: token.IDENTIFIER,
+							Lexeme:    "x",
+							Line:      5,
+							Literal:   nil,
+						},
+						Params: []*token.Token{
+							{
+								TokenType: token.IDENTIFIER,
+								Lexeme:    "v",
+								Line:      5,
+								Literal:   nil,
+							},
+						},
+						Body: &ast.Block{
+							Line:         5,
+							Declarations: nil,
+						},
+					},
+				},
+			},
+			err: nil,
+		},
+		{
+			name: "trait",
+			source: `
+			trait Walk {
+				walk() {}
+			}
+			`,
+			want: &ast.Trait{
+				Line: 2,
+				Name: &token.Token{
+					TokenType: token.IDENTIFIER,
+					Lexeme:    "Walk",
+					Line:      2,
+					Literal:   nil,
+				},
+				Methods: []*ast.Function{
+					{
+						Line: 3,
+						Name: &token.Token{
+							TokenType: token.IDENTIFIER,
+							Lexeme:    "walk",
+							Line:      3,
+							Literal:   nil,
+						},
+						Body: &ast.Block{
+							Line:         3,
+							Declarations: nil,
+						},
+					},
+				},
+			},
+			err: nil,
+		},
+		{
+			name: "class with traits",
+			source: `
+			class Duck < Bird with Walk, Swim {
+			}
+			`,
+			want: &ast.Class{
+				Line: 2,
+				Name: &token.Token{
+					TokenType: token.IDENTIFIER,
+					Lexeme:    "Duck",
+					Line:      2,
+					Literal:   nil,
+				},
+				SuperClass: &ast.Variable{
+					Name: &token.Token{
+						TokenType: token.IDENTIFIER,
+						Lexeme:    "Bird",
+						Line:      2,
+						Literal:   nil,
+					},
+				},
+				Traits: []*ast.Variable{
+					{
+						Name: &token.Token{
+							TokenType: token.IDENTIFIER,
+							Lexeme:    "Walk",
+							Line:      2,
+							Literal:   nil,
+						},
+					},
+					{
+						Name: &token.Token{
+							TokenType: token.IDENTIFIER,
+							Lexeme:    "Swim",
+							Line:      2,
+							Literal:   nil,
+						},
+					},
+				},
+			},
+			err: nil,
+		},
+		{
+			name: "class private names",
+			source: `
+			class A {
+				#f() {
+					return this.#x;
+				}
+			}
+			`,
+			want: &ast.Class{
+				Line: 2,
+				Name: &token.Token{
+					TokenType: token.IDENTIFIER,
+					Lexeme:    "A",
+					Line:      2,
+					Literal:   nil,
+				},
+				Methods: []*ast.Function{
+					{
+						Line: 3,
+						Name: &token.Token{
+							TokenType: token.PRIVATE_IDENTIFIER,
+							Lexeme:    "A@1#f",
+							Line:      3,
+							Literal:   nil,
+						},
+						Body: &ast.Block{
+							Line: 3,
+							Declarations: []ast.Stmt{
+								&ast.Return{
+									Line: 4,
+									Expression: &ast.Get{
+										Line: 4,
+										Name: &token.Token{
+											TokenType: token.PRIVATE_IDENTIFIER,
+											Lexeme:    "A@1#x",
+											Line:      4,
+											Literal:   nil,
+										},
+										Object: &ast.This{
+											Line: 4,
+											Keyword: &token.Token{
+												TokenType: token.THIS,
+												Lexeme:    "this",
+												Line:      4,
+												Literal:   nil,
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+			err: nil,
+		},
+		{
+			name:   "import",
+			source: `import "lib/strings" as s;`,
+			want: &ast.Import{
+				Line: 1,
+				Path: "lib/strings",
+				Name: &token.Token{
+					TokenType: token.IDENTIFIER,
+					Lexeme:    "s",
+					Line:      1,
+					Literal:   nil,
+				},
+			},
+			err: nil,
+		},
+		{
+			name:   "export",
+			source: `export var a = 1;`,
+			want: &ast.Export{
+				Line: 1,
+				Declaration: &ast.Var{
+					Line: 1,
+					Name: &token.Token{
+						TokenType: token.IDENTIFIER,
+						Lexeme:    "a",
+						Line:      1,
+						Literal:   nil,
+					},
+					Initializer: &ast.Literal{
+						Line:  1,
+						Value: int64(1),
+					},
+				},
+			},
+			err: nil,
+		},
+		{
+			name:   "function defaults and rest",
+			source: `fun f(a, b = 1, ...rest) {}`,
+			want: &ast.Function{
+				Line: 1,
+				Name: &token.Token{
+					TokenType: token.IDENTIFIER,
+					Lexeme:    "f",
+					Line:      1,
+					Literal:   nil,
+				},
+				Params: []*token.Token{
+					{
+						TokenType: token.IDENTIFIER,
+						Lexeme:    "a",
+						Line:      1,
+						Literal:   nil,
+					},
+					{
+						TokenType: token.IDENTIFIER,
+						Lexeme:    "b",
+						Line:      1,
+						Literal:   nil,
+					},
+				},
+				Defaults: []ast.Expr{
+					nil,
+					&ast.Literal{
+						Line:  1,
+						Value: int64(1),
+					},
+				},
+				Rest: &token.Token{
+					TokenType: token.IDENTIFIER,
+					Lexeme:    "rest",
+					Line:      1,
+					Literal:   nil,
+				},
+				Body: &ast.Block{
+					Line:         1,
+					Declarations: nil,
+				},
+			},
+			err: nil,
+		},
+		{
+			name:   "function required after default",
+			source: `fun f(a = 1, b) {}`,
+			want:   nil,
+			err:    ErrRequiredAfterDefault,
+		},
+		{
+			name:   "function rest not last",
+			source: `fun f(...rest, a) {}`,
+			want:   nil,
+			err:    ErrRestParameterNotLast,
+		},
+		{
+			name:   "export statement",
+			source: `export print 1;`,
+			want:   nil,
+			err:    ErrExpectDeclaration,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -996,3 +1423,157 @@ func TestParser_declaration(t *testing.T) {
 		})
 	}
 }
+
+func TestParser_Parse(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		err    error
+		count  int // 报告的错误个数
+	}{
+		{
+			name: "braced bodies",
+			source: `
+			fun count(n) {
+				if (n > 1) {
+					count(n - 1);
+				}
+				while (n > 1) {
+					n = n - 1;
+				}
+				for (var i = 0; i < n; i = i + 1) {
+					print i;
+				}
+			}
+			`,
+		},
+		{
+			name: "synchronize after error",
+			source: `
+			var = 1;
+			print 1;
+			var b = ;
+			print 2;
+			`,
+			err:   ErrExpectExpression,
+			count: 2,
+		},
+		{
+			name:   "required parameter after default",
+			source: `fun f(a = 1, b) {} print 1;`,
+			err:    ErrRequiredAfterDefault,
+			count:  1,
+		},
+		{
+			name:   "rest parameter not last",
+			source: `fun f(...r, a) {} print 1;`,
+			err:    ErrRestParameterNotLast,
+			count:  1,
+		},
+		{
+			name:   "try without catch or finally",
+			source: `try { print 1; }`,
+			err:    ErrExpectCatchOrFinally,
+			count:  1,
+		},
+		{
+			name:   "import without as",
+			source: `import "x"; print 1;`,
+			err:    ErrExpectAs,
+			count:  1,
+		},
+		{
+			name:   "export statement",
+			source: `export print 1;`,
+			err:    ErrExpectDeclaration,
+			count:  1,
+		},
+		{
+			name: "setter parameter",
+			source: `
+			class A {
+				set x(a, b) {}
+				set y() {}
+				f() {
+					return 1;
+				}
+			}
+			print 1;
+			`,
+			err:   ErrSetterParameter,
+			count: 2,
+		},
+		{
+			name:   "error at statement start",
+			source: `) print 1;`,
+			err:    ErrExpectExpression,
+			count:  1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := New(scanner.New(tt.source).Scan()).Parse()
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Parse() error = %v, want err %v", err, tt.err)
+			}
+			if tt.err == nil {
+				if len(got) == 0 {
+					t.Errorf("Parse() got no declarations")
+				}
+				return
+			}
+			var errs Errors
+			if !errors.As(err, &errs) || len(errs) != tt.count {
+				t.Errorf("Parse() error = %v, want %d errors", err, tt.count)
+			}
+			if got != nil {
+				t.Errorf("Parse() got = %v, want nil", got)
+			}
+		})
+	}
+}
+
+func TestParser_PrivatePrefix(t *testing.T) {
+	source := `
+	class A {
+		#f() {}
+	}
+	class A {
+		#f() {}
+	}
+	`
+	tests := []struct {
+		name string
+		file string
+		want []string // 每个类的私有方法名
+	}{
+		{
+			name: "no file",
+			want: []string{"A@1#f", "A@2#f"},
+		},
+		{
+			name: "file",
+			file: "lib/a.stmt",
+			want: []string{"A@lib/a.stmt:1#f", "A@lib/a.stmt:2#f"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 编号只取决于被解析的源码，多次解析结果相同
+			for range 2 {
+				p := New(scanner.New(source).Scan())
+				p.File = tt.file
+				got, err := p.Parse()
+				if err != nil {
+					t.Fatalf("Parse() error = %v", err)
+				}
+				for i, want := range tt.want {
+					name := got[i].(*ast.Class).Methods[0].Name.Lexeme
+					if name != want {
+						t.Errorf("Parse() class %d method = %q, want %q", i, name, want)
+					}
+				}
+			}
+		})
+	}
+}
@@ -21,4 +21,13 @@ var keywords = map[string]string{
 	"while":    token.WHILE,
 	"break":    token.BREAK,
 	"continue": token.CONTINUE,
+	"throw":    token.THROW,
+	"try":      token.TRY,
+	"catch":    token.CATCH,
+	"finally":  token.FINALLY,
+	"import":   token.IMPORT,
+	"export":   token.EXPORT,
+	"as":       token.AS,
+	"trait":    token.TRAIT,
+	"with":     token.WITH,
 }
@@ -49,10 +49,20 @@ func (s *Scanner) scan() {
 		s.AddToken(token.LEFT_BRACE, nil)
 	case '}':
 		s.AddToken(token.RIGHT_BRACE, nil)
+	case '[':
+		s.AddToken(token.LEFT_BRACKET, nil)
+	case ']':
+		s.AddToken(token.RIGHT_BRACKET, nil)
 	case ',':
 		s.AddToken(token.COMMA, nil)
 	case '.':
-		s.AddToken(token.DOT, nil)
+		if s.Peek() == '.' && s.PeekNext() == '.' {
+			s.Advance()
+			s.Advance()
+			s.AddToken(token.ELLIPSIS, nil)
+		} else {
+			s.AddToken(token.DOT, nil)
+		}
 	case ';':
 		s.AddToken(token.SEMICOLON, nil)
 	case '+':
@@ -97,6 +107,12 @@ func (s *Scanner) scan() {
 		}
 	case '"':
 		s.String()
+	case '#':
+		if s.IsAlpha(s.Peek()) {
+			s.Private()
+		} else {
+			print("Invalid character.")
+		}
 	default:
 		if s.IsDigit(char) {
 			s.Number()
@@ -222,6 +238,14 @@ func (s *Scanner) IsKeyword() (bool, string) {
 	return ok, tokenType
 }
 
+// Private 扫描私有名字 #name，词素包括 #
+func (s *Scanner) Private() {
+	for s.IsAlpha(s.Peek()) || s.IsDigit(s.Peek()) {
+		s.Advance()
+	}
+	s.AddToken(token.PRIVATE_IDENTIFIER, nil)
+}
+
 func (s *Scanner) Identifier() {
 	for s.IsAlpha(s.Peek()) || s.IsDigit(s.Peek()) {
 		s.Advance()
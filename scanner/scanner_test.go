@@ -90,6 +90,16 @@ func TestScanner_ScanTokens(t *testing.T) {
 				token.New(token.EOF, "", nil, 1),
 			},
 		},
+		{
+			name:   "private identifier",
+			source: "this.#count2",
+			want: []*token.Token{
+				token.New(token.THIS, "this", nil, 1),
+				token.New(token.DOT, ".", nil, 1),
+				token.New(token.PRIVATE_IDENTIFIER, "#count2", nil, 1),
+				token.New(token.EOF, "", nil, 1),
+			},
+		},
 		{
 			name:   "int literal",
 			source: "1234",
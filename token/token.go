@@ -4,20 +4,23 @@ const (
 	EOF = "EOF"
 
 	// Single-character tokens.
-	LEFT_PAREN  = "LEFT_PAREN"
-	RIGHT_PAREN = "RIGHT_PAREN"
-	LEFT_BRACE  = "LEFT_BRACE"
-	RIGHT_BRACE = "RIGHT_BRACE"
-	COMMA       = "COMMA"
-	DOT         = "DOT"
-	MINUS       = "MINUS"
-	PLUS        = "PLUS"
-	SEMICOLON   = "SEMICOLON"
-	SLASH       = "SLASH"
-	STAR        = "STAR"
-	PERCENTAGE  = "PERCENTAGE"
+	LEFT_PAREN    = "LEFT_PAREN"
+	RIGHT_PAREN   = "RIGHT_PAREN"
+	LEFT_BRACE    = "LEFT_BRACE"
+	RIGHT_BRACE   = "RIGHT_BRACE"
+	LEFT_BRACKET  = "LEFT_BRACKET"
+	RIGHT_BRACKET = "RIGHT_BRACKET"
+	COMMA         = "COMMA"
+	DOT           = "DOT"
+	MINUS         = "MINUS"
+	PLUS          = "PLUS"
+	SEMICOLON     = "SEMICOLON"
+	SLASH         = "SLASH"
+	STAR          = "STAR"
+	PERCENTAGE    = "PERCENTAGE"
 
 	// One or two character tokens.
+	ELLIPSIS      = "ELLIPSIS"
 	BANG          = "BANG"
 	BANG_EQUAL    = "BANG_EQUAL"
 	EQUAL         = "EQUAL"
@@ -27,7 +30,8 @@ const (
 	LESS          = "LESS"
 	LESS_EQUAL    = "LESS_EQUAL"
 
-	IDENTIFIER = "IDENTIFIER"
+	IDENTIFIER         = "IDENTIFIER"
+	PRIVATE_IDENTIFIER = "PRIVATE_IDENTIFIER" // #name，只能作为属性名和方法名
 
 	// Literals.
 	STRING_LITERAL = "STRING_LITERAL"
@@ -53,6 +57,15 @@ const (
 	WHILE    = "WHILE"
 	BREAK    = "BREAK"
 	CONTINUE = "CONTINUE"
+	THROW    = "THROW"
+	TRY      = "TRY"
+	CATCH    = "CATCH"
+	FINALLY  = "FINALLY"
+	IMPORT   = "IMPORT"
+	EXPORT   = "EXPORT"
+	AS       = "AS"
+	TRAIT    = "TRAIT"
+	WITH     = "WITH"
 )
 
 type Token struct {
@@ -0,0 +1,224 @@
+package value
+
+import (
+	"fmt"
+	"io"
+)
+
+// Class 是类。方法表在声明时就包含了继承的方法，查找方法不需要沿父类逐级查找
+type Class struct {
+	Name    string
+	Super   *Class
+	Methods map[string]*Closure
+	Statics map[string]*Closure // static 方法，不是方法闭包，没有 this
+	Getters map[string]*Closure
+	Setters map[string]*Closure
+	Shape   *Shape // 新创建的实例的 Shape，没有任何字段
+}
+
+func NewClass(name string) *Class {
+	class := &Class{
+		Name:    name,
+		Methods: map[string]*Closure{},
+		Statics: map[string]*Closure{},
+		Getters: map[string]*Closure{},
+		Setters: map[string]*Closure{},
+	}
+	class.Shape = NewShape(class)
+	return class
+}
+
+// Inherit 把父类 super 的方法复制到类中，之后添加的同名方法覆盖它们
+func (c *Class) Inherit(super *Class) {
+	c.Super = super
+	inherit(c.Methods, super.Methods)
+	inherit(c.Statics, super.Statics)
+	inherit(c.Getters, super.Getters)
+	inherit(c.Setters, super.Setters)
+}
+
+func inherit(methods map[string]*Closure, super map[string]*Closure) {
+	for name, method := range super {
+		methods[name] = method
+	}
+}
+
+func (c *Class) String() string {
+	return fmt.Sprintf("Class(%s)", c.Name)
+}
+
+func (c *Class) Print(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "<class %s>\n", c.Name)
+	return err
+}
+
+func (c *Class) ValueType() uint8 {
+	return TypeClass
+}
+
+func (c *Class) WriteTo(w io.Writer) (int64, error) {
+	return 0, nil
+}
+
+func (c *Class) GetLiteral() any {
+	panic("class have no literal")
+}
+
+func (c *Class) SetLiteral(literal any) {
+	panic("class have no literal")
+}
+
+// Trait 是一组方法，类用 with 组合 trait 时把这些方法复制到自己的方法表中
+type Trait struct {
+	Name    string
+	Methods map[string]*Closure
+}
+
+func NewTrait(name string) *Trait {
+	return &Trait{
+		Name:    name,
+		Methods: map[string]*Closure{},
+	}
+}
+
+func (t *Trait) String() string {
+	return fmt.Sprintf("Trait(%s)", t.Name)
+}
+
+func (t *Trait) Print(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "<trait %s>\n", t.Name)
+	return err
+}
+
+func (t *Trait) ValueType() uint8 {
+	return TypeTrait
+}
+
+func (t *Trait) WriteTo(w io.Writer) (int64, error) {
+	return 0, nil
+}
+
+func (t *Trait) GetLiteral() any {
+	panic("trait have no literal")
+}
+
+func (t *Trait) SetLiteral(literal any) {
+	panic("trait have no literal")
+}
+
+// Shape 描述实例有哪些字段以及它们在 Fields 中的下标。同一个类按相同顺序添加相同字段的实例
+// 共用一个 Shape，所以 Shape 相同的两个实例，同名字段的下标和同名方法都相同
+type Shape struct {
+	Class       *Class
+	Index       map[string]int // 字段名到下标
+	transitions map[string]*Shape
+}
+
+func NewShape(class *Class) *Shape {
+	return &Shape{
+		Class:       class,
+		Index:       map[string]int{},
+		transitions: map[string]*Shape{},
+	}
+}
+
+// Transition 返回在当前字段之后添加字段 name 得到的 Shape，同一个字段只创建一次
+func (s *Shape) Transition(name string) *Shape {
+	if next, ok := s.transitions[name]; ok {
+		return next
+	}
+	next := NewShape(s.Class)
+	for field, index := range s.Index {
+		next.Index[field] = index
+	}
+	next.Index[name] = len(s.Index)
+	s.transitions[name] = next
+	return next
+}
+
+// Instance 是类的实例，字段的值按 Shape 中的下标保存
+type Instance struct {
+	Class  *Class
+	Shape  *Shape
+	Fields []Slot
+}
+
+func NewInstance(class *Class) *Instance {
+	return &Instance{
+		Class: class,
+		Shape: class.Shape,
+	}
+}
+
+func (i *Instance) String() string {
+	return fmt.Sprintf("Instance(%s)", i.Class.Name)
+}
+
+func (i *Instance) Print(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "<%s instance>\n", i.Class.Name)
+	return err
+}
+
+func (i *Instance) ValueType() uint8 {
+	return TypeInstance
+}
+
+func (i *Instance) WriteTo(w io.Writer) (int64, error) {
+	return 0, nil
+}
+
+func (i *Instance) GetLiteral() any {
+	panic("instance have no literal")
+}
+
+func (i *Instance) SetLiteral(literal any) {
+	panic("instance have no literal")
+}
+
+// BoundMethod 是绑定了实例的方法，调用时 Receiver 作为 this
+type BoundMethod struct {
+	Receiver Slot
+	Method   *Closure
+}
+
+func NewBoundMethod(receiver Slot, method *Closure) *BoundMethod {
+	return &BoundMethod{
+		Receiver: receiver,
+		Method:   method,
+	}
+}
+
+func (b *BoundMethod) String() string {
+	return fmt.Sprintf("BoundMethod(%s)", b.Method.Function.DisplayName())
+}
+
+func (b *BoundMethod) Print(w io.Writer) error {
+	return b.Method.Print(w)
+}
+
+func (b *BoundMethod) ValueType() uint8 {
+	return TypeBoundMethod
+}
+
+func (b *BoundMethod) WriteTo(w io.Writer) (int64, error) {
+	return 0, nil
+}
+
+func (b *BoundMethod) GetLiteral() any {
+	panic("bound method have no literal")
+}
+
+func (b *BoundMethod) SetLiteral(literal any) {
+	panic("bound method have no literal")
+}
+
+// InlineCache 是一处属性读写或方法调用的内联缓存，记录上次遇到的实例的 Shape 和查找结果。
+// 再次遇到相同 Shape 的实例时直接使用结果，不需要按名字查找
+type InlineCache struct {
+	Name       string
+	Shape      *Shape   // 上次遇到的实例的 Shape，nil 表示还没有缓存
+	Index      int      // 字段的下标
+	Method     *Closure // 不为 nil 时属性是类的方法
+	Accessor   *Closure // 不为 nil 时属性是类的 get 或 set 访问器
+	Transition *Shape   // 不为 nil 时设置的是新字段，实例随后变为这个 Shape
+}
@@ -4,12 +4,43 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"maps"
+	"math"
+	"slices"
 )
 
 type Function struct {
-	Code        []uint8
-	NumParams   uint64
-	NumUpvalues uint64
+	Name   string   // 函数名，顶层代码为空
+	Params []string // 参数名，Variadic 时最后一个是 ...rest 参数
+	File   string   // 定义函数的源文件
+	Line   int      // 定义函数的源码行号
+	Code   []uint8
+	// Instructions 是编译为寄存器指令时的代码，此时 Code 为空，Lines 和 Handlers 中的偏移是指令下标
+	Instructions []uint32
+	NumRegisters uint64 // 栈帧使用的寄存器数，包括参数和局部变量
+	NumParams    uint64 // 不含 ...rest 参数
+	NumOptional  uint64 // 末尾带默认值的参数个数
+	Variadic     bool   // 是否有 ...rest 参数，它位于第 NumParams 个槽位
+	NumUpvalues  uint64
+	Method       bool          // 是否是方法，方法的 this 位于第 0 个槽位，参数从第 1 个槽位开始
+	Caches       []InlineCache // 属性读写和方法调用的内联缓存，每处一个
+	Lines        []Line        // 字节码偏移到源码行号的映射
+	Handlers     []Handler     // 异常处理表，内层 try 的记录排在前面
+}
+
+// Line 表示从 Offset 开始的字节码来自源码第 Line 行
+type Line struct {
+	Offset uint64
+	Line   int
+}
+
+// Handler 表示在 [Start, End) 范围内抛出的异常跳转到 Target 处理，
+// 跳转前栈被恢复为只保留 Slots 个局部变量
+type Handler struct {
+	Start  uint64
+	End    uint64
+	Target uint64
+	Slots  uint64
 }
 
 func NewFunction(code []uint8, numParams uint64, numUpvalues uint64) *Function {
@@ -20,12 +51,64 @@ func NewFunction(code []uint8, numParams uint64, numUpvalues uint64) *Function {
 	}
 }
 
+// NumArgSlots 返回调用时参数占用的槽位数，包括 ...rest 参数和方法的 this
+func (f *Function) NumArgSlots() uint64 {
+	slots := f.NumParams
+	if f.Variadic {
+		slots++
+	}
+	if f.Method {
+		slots++
+	}
+	return slots
+}
+
+// LineOf 返回偏移 offset 处的字节码对应的源码行号，没有行号信息时返回 0
+func (f *Function) LineOf(offset uint64) int {
+	line := 0
+	for _, l := range f.Lines {
+		if l.Offset > offset {
+			break
+		}
+		line = l.Line
+	}
+	return line
+}
+
+// HandlerOf 返回覆盖偏移 offset 的最内层异常处理记录
+func (f *Function) HandlerOf(offset uint64) *Handler {
+	for i := range f.Handlers {
+		handler := &f.Handlers[i]
+		if handler.Start <= offset && offset < handler.End {
+			return handler
+		}
+	}
+	return nil
+}
+
+// DisplayName 返回用于打印和调用栈的函数名，顶层代码为 script
+func (f *Function) DisplayName() string {
+	if f.Name == "" {
+		return "script"
+	}
+	return f.Name
+}
+
+// Location 返回定义函数的位置，形如 file:line
+func (f *Function) Location() string {
+	file := f.File
+	if file == "" {
+		file = "<input>"
+	}
+	return fmt.Sprintf("%s:%d", file, f.Line)
+}
+
 func (f *Function) String() string {
 	return fmt.Sprintf("Function(%d, %d)%v", f.NumParams, f.NumUpvalues, f.Code)
 }
 
 func (f *Function) Print(w io.Writer) error {
-	_, err := w.Write([]byte(f.String() + "\n"))
+	_, err := fmt.Fprintf(w, "<fn %s>\n", f.DisplayName())
 	return err
 }
 
@@ -33,23 +116,106 @@ func (f *Function) ValueType() uint8 {
 	return TypeFunction
 }
 
-func (f *Function) WriteTo(w io.Writer) error {
-	// 格式: [type:1byte][numParams:8bytes][numUpvalues:8bytes][codeLength:8bytes][code:codeLength bytes]
-	if err := binary.Write(w, binary.BigEndian, f.ValueType()); err != nil {
-		return err
+func (f *Function) WriteTo(w io.Writer) (int64, error) {
+	// 格式: [type:1byte][name:string][file:string][line:8bytes][numParams:8bytes][numOptional:8bytes][variadic:1byte][method:1byte]
+	// [numNames:8bytes][names:numNames strings][numUpvalues:8bytes][codeLength:8bytes][code:codeLength bytes]
+	// [numRegisters:8bytes][numInstructions:8bytes][instructions:numInstructions*4bytes]
+	// [numCaches:8bytes][cacheNames:numCaches strings]
+	// [numLines:8bytes][lines:numLines*([offset:8bytes][line:8bytes])]
+	// [numHandlers:8bytes][handlers:numHandlers*([start:8bytes][end:8bytes][target:8bytes][slots:8bytes])]，
+	// 其中 string 为 [length:8bytes][bytes:length bytes]
+	buf := []byte{f.ValueType()}
+	buf = appendString(buf, f.Name)
+	buf = appendString(buf, f.File)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(f.Line))
+	buf = binary.BigEndian.AppendUint64(buf, f.NumParams)
+	buf = binary.BigEndian.AppendUint64(buf, f.NumOptional)
+	if f.Variadic {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
 	}
-	if err := binary.Write(w, binary.BigEndian, f.NumParams); err != nil {
-		return err
+	if f.Method {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
 	}
-	if err := binary.Write(w, binary.BigEndian, f.NumUpvalues); err != nil {
-		return err
+	buf = binary.BigEndian.AppendUint64(buf, uint64(len(f.Params)))
+	for _, param := range f.Params {
+		buf = appendString(buf, param)
 	}
-	codeLength := int64(len(f.Code))
-	if err := binary.Write(w, binary.BigEndian, codeLength); err != nil {
-		return err
+	buf = binary.BigEndian.AppendUint64(buf, f.NumUpvalues)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(len(f.Code)))
+	buf = append(buf, f.Code...)
+	buf = binary.BigEndian.AppendUint64(buf, f.NumRegisters)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(len(f.Instructions)))
+	for _, instruction := range f.Instructions {
+		buf = binary.BigEndian.AppendUint32(buf, instruction)
 	}
-	_, err := w.Write(f.Code)
-	return err
+	// 内联缓存只保存属性名，Shape、方法等运行时状态不保存
+	buf = binary.BigEndian.AppendUint64(buf, uint64(len(f.Caches)))
+	for _, cache := range f.Caches {
+		buf = appendString(buf, cache.Name)
+	}
+	buf = binary.BigEndian.AppendUint64(buf, uint64(len(f.Lines)))
+	for _, line := range f.Lines {
+		buf = binary.BigEndian.AppendUint64(buf, line.Offset)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(line.Line))
+	}
+	buf = binary.BigEndian.AppendUint64(buf, uint64(len(f.Handlers)))
+	for _, handler := range f.Handlers {
+		buf = binary.BigEndian.AppendUint64(buf, handler.Start)
+		buf = binary.BigEndian.AppendUint64(buf, handler.End)
+		buf = binary.BigEndian.AppendUint64(buf, handler.Target)
+		buf = binary.BigEndian.AppendUint64(buf, handler.Slots)
+	}
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+// ReadFrom 按 WriteTo 的格式读取函数，覆盖 f 原有的内容
+func (f *Function) ReadFrom(r io.Reader) (int64, error) {
+	rd := &reader{r: r}
+	if rd.byte() != f.ValueType() && rd.err == nil {
+		return rd.n, ErrInvalidValueType
+	}
+	*f = Function{}
+	f.Name = rd.string()
+	f.File = rd.string()
+	f.Line = int(rd.uint64())
+	f.NumParams = rd.uint64()
+	f.NumOptional = rd.uint64()
+	f.Variadic = rd.byte() == 1
+	f.Method = rd.byte() == 1
+	for i, n := uint64(0), rd.uint64(); i < n && rd.err == nil; i++ {
+		f.Params = append(f.Params, rd.string())
+	}
+	f.NumUpvalues = rd.uint64()
+	f.Code = rd.bytes(rd.uint64())
+	f.NumRegisters = rd.uint64()
+	for i, n := uint64(0), rd.uint64(); i < n && rd.err == nil; i++ {
+		f.Instructions = append(f.Instructions, rd.uint32())
+	}
+	for i, n := uint64(0), rd.uint64(); i < n && rd.err == nil; i++ {
+		f.Caches = append(f.Caches, InlineCache{Name: rd.string()})
+	}
+	for i, n := uint64(0), rd.uint64(); i < n && rd.err == nil; i++ {
+		f.Lines = append(f.Lines, Line{Offset: rd.uint64(), Line: int(rd.uint64())})
+	}
+	for i, n := uint64(0), rd.uint64(); i < n && rd.err == nil; i++ {
+		f.Handlers = append(f.Handlers, Handler{
+			Start:  rd.uint64(),
+			End:    rd.uint64(),
+			Target: rd.uint64(),
+			Slots:  rd.uint64(),
+		})
+	}
+	return rd.n, rd.err
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.BigEndian.AppendUint64(buf, uint64(len(s)))
+	return append(buf, s...)
 }
 
 func (f *Function) GetLiteral() any {
@@ -59,3 +225,146 @@ func (f *Function) GetLiteral() any {
 func (f *Function) SetLiteral(literal any) {
 	panic("function have no literal")
 }
+
+// Module 是编译后的模块。模块的全局变量和导入它的程序位于同一个全局变量表中，
+// Exports 记录导出的名字对应的全局变量下标，Function 执行模块的顶层代码并返回模块自身
+type Module struct {
+	Path     string
+	Function *Function
+	Exports  map[string]uint64
+}
+
+func NewModule(path string) *Module {
+	return &Module{
+		Path:    path,
+		Exports: map[string]uint64{},
+	}
+}
+
+func (m *Module) String() string {
+	return fmt.Sprintf("Module(%s)", m.Path)
+}
+
+func (m *Module) Print(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "<module %s>\n", m.Path)
+	return err
+}
+
+func (m *Module) ValueType() uint8 {
+	return TypeModule
+}
+
+func (m *Module) WriteTo(w io.Writer) (int64, error) {
+	// 格式: [type:1byte][path:string][hasFunction:1byte][function:Function.WriteTo 的格式，hasFunction 为 1 时才有]
+	// [numExports:8bytes][exports:numExports*([name:string][globalIndex:8bytes])]，
+	// 其中 string 为 [length:8bytes][bytes:length bytes]，exports 按名字排序
+	buf := []byte{m.ValueType()}
+	buf = appendString(buf, m.Path)
+	if m.Function == nil {
+		buf = append(buf, 0)
+	} else {
+		buf = append(buf, 1)
+	}
+	n, err := w.Write(buf)
+	written := int64(n)
+	if err != nil {
+		return written, err
+	}
+	if m.Function != nil {
+		n, err := m.Function.WriteTo(w)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	buf = binary.BigEndian.AppendUint64(nil, uint64(len(m.Exports)))
+	for _, name := range slices.Sorted(maps.Keys(m.Exports)) {
+		buf = appendString(buf, name)
+		buf = binary.BigEndian.AppendUint64(buf, m.Exports[name])
+	}
+	n, err = w.Write(buf)
+	return written + int64(n), err
+}
+
+// ReadFrom 按 WriteTo 的格式读取模块，覆盖 m 原有的内容
+func (m *Module) ReadFrom(r io.Reader) (int64, error) {
+	rd := &reader{r: r}
+	if rd.byte() != m.ValueType() && rd.err == nil {
+		return rd.n, ErrInvalidValueType
+	}
+	*m = *NewModule(rd.string())
+	if rd.byte() == 1 {
+		m.Function = &Function{}
+		n, err := m.Function.ReadFrom(r)
+		rd.n += n
+		if err != nil {
+			return rd.n, err
+		}
+	}
+	for i, n := uint64(0), rd.uint64(); i < n && rd.err == nil; i++ {
+		name := rd.string()
+		m.Exports[name] = rd.uint64()
+	}
+	return rd.n, rd.err
+}
+
+func (m *Module) GetLiteral() any {
+	panic("module have no literal")
+}
+
+func (m *Module) SetLiteral(literal any) {
+	panic("module have no literal")
+}
+
+// reader 按 WriteTo 的格式读取数据，记录已读取的字节数。
+// 出错后的读取都返回零值，由调用者最后检查 err
+type reader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+// bytes 读取 n 个字节，n 为 0 时返回 nil。n 来自输入，所以边读边分配，损坏的长度不会导致一次分配大量内存
+func (rd *reader) bytes(n uint64) []byte {
+	if rd.err != nil || n == 0 {
+		return nil
+	}
+	buf, err := io.ReadAll(io.LimitReader(rd.r, int64(min(n, math.MaxInt64))))
+	rd.n += int64(len(buf))
+	if err == nil && uint64(len(buf)) < n {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		rd.err = err
+		return nil
+	}
+	return buf
+}
+
+func (rd *reader) byte() uint8 {
+	buf := rd.bytes(1)
+	if buf == nil {
+		return 0
+	}
+	return buf[0]
+}
+
+func (rd *reader) uint32() uint32 {
+	buf := rd.bytes(4)
+	if buf == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(buf)
+}
+
+func (rd *reader) uint64() uint64 {
+	buf := rd.bytes(8)
+	if buf == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(buf)
+}
+
+func (rd *reader) string() string {
+	return string(rd.bytes(rd.uint64()))
+}
@@ -0,0 +1,151 @@
+package value
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestFunction_WriteTo(t *testing.T) {
+	tests := []struct {
+		name     string
+		function *Function
+	}{
+		{
+			name: "stack",
+			function: &Function{
+				Name:        "f",
+				Params:      []string{"a", "b", "rest"},
+				File:        "lib/a.stmt",
+				Line:        3,
+				Code:        []uint8{10, 19, 31},
+				NumParams:   2,
+				NumOptional: 1,
+				Variadic:    true,
+				NumUpvalues: 1,
+				Method:      true,
+				Caches: []InlineCache{
+					{Name: "x"},
+					{Name: "sum"},
+				},
+				Lines: []Line{
+					{Offset: 0, Line: 3},
+					{Offset: 2, Line: 4},
+				},
+				Handlers: []Handler{
+					{Start: 0, End: 2, Target: 2, Slots: 4},
+				},
+			},
+		},
+		{
+			name: "register",
+			function: &Function{
+				Line:         1,
+				Instructions: []uint32{0x01020304, 0x0a0b0c0d},
+				NumRegisters: 2,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			n, err := tt.function.WriteTo(&buf)
+			if err != nil {
+				t.Fatalf("WriteTo() err = %v", err)
+			}
+			if n != int64(buf.Len()) {
+				t.Errorf("WriteTo() n = %d, want %d", n, buf.Len())
+			}
+			var got Function
+			m, err := got.ReadFrom(&buf)
+			if err != nil {
+				t.Fatalf("ReadFrom() err = %v", err)
+			}
+			if m != n {
+				t.Errorf("ReadFrom() n = %d, want %d", m, n)
+			}
+			if !reflect.DeepEqual(&got, tt.function) {
+				t.Errorf("ReadFrom() = %+v, want %+v", &got, tt.function)
+			}
+		})
+	}
+}
+
+func TestFunction_ReadFrom(t *testing.T) {
+	var buf bytes.Buffer
+	_, err := (&Function{Name: "f", Code: []uint8{10}}).WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("WriteTo() err = %v", err)
+	}
+	encoded := buf.Bytes()
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{name: "truncated", data: encoded[:len(encoded)-1], err: io.ErrUnexpectedEOF},
+		{name: "empty", data: nil, err: io.ErrUnexpectedEOF},
+		{name: "not function", data: append([]byte{TypeInt}, encoded[1:]...), err: ErrInvalidValueType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Function
+			_, err := got.ReadFrom(bytes.NewReader(tt.data))
+			if !errors.Is(err, tt.err) {
+				t.Errorf("ReadFrom() err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestModule_WriteTo(t *testing.T) {
+	tests := []struct {
+		name   string
+		module *Module
+	}{
+		{
+			name: "compiled",
+			module: &Module{
+				Path: "lib/a.stmt",
+				Function: &Function{
+					Name: "lib/a.stmt",
+					File: "lib/a.stmt",
+					Code: []uint8{10, 31},
+				},
+				Exports: map[string]uint64{
+					"b": 3,
+					"a": 2,
+				},
+			},
+		},
+		{
+			name:   "not compiled",
+			module: NewModule("lib/b.stmt"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			n, err := tt.module.WriteTo(&buf)
+			if err != nil {
+				t.Fatalf("WriteTo() err = %v", err)
+			}
+			if n != int64(buf.Len()) {
+				t.Errorf("WriteTo() n = %d, want %d", n, buf.Len())
+			}
+			var got Module
+			m, err := got.ReadFrom(&buf)
+			if err != nil {
+				t.Fatalf("ReadFrom() err = %v", err)
+			}
+			if m != n {
+				t.Errorf("ReadFrom() n = %d, want %d", m, n)
+			}
+			if !reflect.DeepEqual(&got, tt.module) {
+				t.Errorf("ReadFrom() = %+v, want %+v", &got, tt.module)
+			}
+		})
+	}
+}
@@ -0,0 +1,7 @@
+package value
+
+import "errors"
+
+var (
+	ErrInvalidValueType = errors.New("invalid value type")
+)
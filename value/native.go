@@ -0,0 +1,58 @@
+package value
+
+import (
+	"fmt"
+	"io"
+)
+
+// Builtins 是内置函数的名字。编译器把未声明的同名变量编译为 OP_GET_BUILTIN，
+// 操作数是名字在其中的下标，虚拟机按相同的下标提供实现
+var Builtins = []string{
+	"clock",
+	"type",
+	"isinstance",
+	"fields",
+	"methods",
+	"hasattr",
+	"getattr",
+	"setattr",
+	"superclass",
+}
+
+// Native 是内置函数，Index 是它在 Builtins 中的下标
+type Native struct {
+	Name  string
+	Index int
+}
+
+func NewNative(name string, index int) *Native {
+	return &Native{
+		Name:  name,
+		Index: index,
+	}
+}
+
+func (n *Native) String() string {
+	return fmt.Sprintf("Native(%s)", n.Name)
+}
+
+func (n *Native) Print(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "<native fn %s>\n", n.Name)
+	return err
+}
+
+func (n *Native) ValueType() uint8 {
+	return TypeNative
+}
+
+func (n *Native) WriteTo(w io.Writer) (int64, error) {
+	return 0, nil
+}
+
+func (n *Native) GetLiteral() any {
+	panic("native have no literal")
+}
+
+func (n *Native) SetLiteral(literal any) {
+	panic("native have no literal")
+}
@@ -1,8 +1,11 @@
 package value
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"slices"
+	"strings"
 )
 
 type Bool struct {
@@ -28,8 +31,8 @@ func (b *Bool) ValueType() uint8 {
 	return TypeBool
 }
 
-func (b *Bool) WriteTo(w io.Writer) error {
-	return nil
+func (b *Bool) WriteTo(w io.Writer) (int64, error) {
+	return 0, nil
 }
 
 func (b *Bool) GetLiteral() any {
@@ -60,8 +63,8 @@ func (n *Nil) ValueType() uint8 {
 	return TypeNil
 }
 
-func (n *Nil) WriteTo(w io.Writer) error {
-	return nil
+func (n *Nil) WriteTo(w io.Writer) (int64, error) {
+	return 0, nil
 }
 
 func (n *Nil) GetLiteral() any {
@@ -73,13 +76,15 @@ func (n *Nil) SetLiteral(literal any) {
 
 type Closure struct {
 	Function *Function
-	Upvalues []Value
+	Upvalues []*Upvalue
+	Caches   []InlineCache // Function.Caches 的副本，由执行这个闭包的虚拟机更新，编译结果本身不被修改
 }
 
 func NewClosure(function *Function) *Closure {
 	return &Closure{
 		Function: function,
-		Upvalues: make([]Value, function.NumUpvalues),
+		Upvalues: make([]*Upvalue, function.NumUpvalues),
+		Caches:   slices.Clone(function.Caches),
 	}
 }
 
@@ -88,16 +93,15 @@ func (c *Closure) String() string {
 }
 
 func (c *Closure) Print(w io.Writer) error {
-	_, err := fmt.Fprintf(w, "closure\n")
-	return err
+	return c.Function.Print(w)
 }
 
 func (c *Closure) ValueType() uint8 {
 	return TypeClosure
 }
 
-func (c *Closure) WriteTo(w io.Writer) error {
-	return nil
+func (c *Closure) WriteTo(w io.Writer) (int64, error) {
+	return 0, nil
 }
 
 func (c *Closure) GetLiteral() any {
@@ -107,3 +111,90 @@ func (c *Closure) GetLiteral() any {
 func (c *Closure) SetLiteral(literal any) {
 	panic("closure have no literal")
 }
+
+// Error 是运行时错误在脚本中的表示，可以被 catch 捕获
+type Error struct {
+	Message string
+	Line    int64
+}
+
+func NewError(message string, line int64) *Error {
+	return &Error{
+		Message: message,
+		Line:    line,
+	}
+}
+
+func (e *Error) String() string {
+	return fmt.Sprintf("Error(%s, %d)", e.Message, e.Line)
+}
+
+func (e *Error) Print(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "%s (line %d)\n", e.Message, e.Line)
+	return err
+}
+
+func (e *Error) ValueType() uint8 {
+	return TypeError
+}
+
+func (e *Error) WriteTo(w io.Writer) (int64, error) {
+	return 0, nil
+}
+
+func (e *Error) GetLiteral() any {
+	panic("error have no literal")
+}
+
+func (e *Error) SetLiteral(literal any) {
+	panic("error have no literal")
+}
+
+// List 是列表，目前只由 ...rest 参数创建
+type List struct {
+	Elements []Value
+}
+
+func NewList(elements []Value) *List {
+	return &List{
+		Elements: elements,
+	}
+}
+
+func (l *List) String() string {
+	elements := make([]string, len(l.Elements))
+	for i, element := range l.Elements {
+		elements[i] = element.String()
+	}
+	return fmt.Sprintf("List(%s)", strings.Join(elements, ", "))
+}
+
+func (l *List) Print(w io.Writer) error {
+	elements := make([]string, len(l.Elements))
+	for i, element := range l.Elements {
+		var buf bytes.Buffer
+		err := element.Print(&buf)
+		if err != nil {
+			return err
+		}
+		elements[i] = strings.TrimSuffix(buf.String(), "\n")
+	}
+	_, err := fmt.Fprintf(w, "[%s]\n", strings.Join(elements, ", "))
+	return err
+}
+
+func (l *List) ValueType() uint8 {
+	return TypeList
+}
+
+func (l *List) WriteTo(w io.Writer) (int64, error) {
+	return 0, nil
+}
+
+func (l *List) GetLiteral() any {
+	panic("list have no literal")
+}
+
+func (l *List) SetLiteral(literal any) {
+	panic("list have no literal")
+}
@@ -0,0 +1,129 @@
+package value
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+// Slot 是虚拟机栈和全局变量中值的表示。int、float、bool 和 nil 直接保存在 Bits 中，
+// 不需要在堆上分配；其他值是堆上的对象，保存在 Object 中。
+type Slot struct {
+	Type   uint8
+	Bits   uint64
+	Object Value
+}
+
+func IntSlot(literal int64) Slot {
+	return Slot{
+		Type: TypeInt,
+		Bits: uint64(literal),
+	}
+}
+
+func FloatSlot(literal float64) Slot {
+	return Slot{
+		Type: TypeFloat,
+		Bits: math.Float64bits(literal),
+	}
+}
+
+func BoolSlot(literal bool) Slot {
+	slot := Slot{
+		Type: TypeBool,
+	}
+	if literal {
+		slot.Bits = 1
+	}
+	return slot
+}
+
+func NilSlot() Slot {
+	return Slot{
+		Type: TypeNil,
+	}
+}
+
+// SlotOf 返回 value_ 对应的 Slot，数字、bool 和 nil 被拆箱
+func SlotOf(value_ Value) Slot {
+	switch _value := value_.(type) {
+	case nil, *Nil:
+		return NilSlot()
+	case *Int:
+		return IntSlot(_value.Literal)
+	case *Float:
+		return FloatSlot(_value.Literal)
+	case *Bool:
+		return BoolSlot(_value.Literal)
+	default:
+		return Slot{
+			Type:   value_.ValueType(),
+			Object: value_,
+		}
+	}
+}
+
+func (s Slot) Int() int64 {
+	return int64(s.Bits)
+}
+
+func (s Slot) Float() float64 {
+	return math.Float64frombits(s.Bits)
+}
+
+func (s Slot) Bool() bool {
+	return s.Bits != 0
+}
+
+// IsObject 判断 s 是否保存的是堆上的对象
+func (s Slot) IsObject() bool {
+	return s.Object != nil
+}
+
+// Box 返回 s 对应的 Value，拆箱的值会重新分配
+func (s Slot) Box() Value {
+	switch s.Type {
+	case TypeInt:
+		return NewInt(s.Int())
+	case TypeFloat:
+		return NewFloat(s.Float())
+	case TypeBool:
+		return NewBool(s.Bool())
+	case TypeNil:
+		return NewNil()
+	default:
+		return s.Object
+	}
+}
+
+func (s Slot) String() string {
+	return s.Box().String()
+}
+
+// Print 和对应的 Value 输出相同的内容，拆箱的值不需要分配
+func (s Slot) Print(w io.Writer) error {
+	switch s.Type {
+	case TypeInt:
+		_, err := fmt.Fprintf(w, "%d\n", s.Int())
+		return err
+	case TypeFloat:
+		_, err := fmt.Fprintf(w, "%f\n", s.Float())
+		return err
+	case TypeBool:
+		_, err := fmt.Fprintf(w, "%t\n", s.Bool())
+		return err
+	case TypeNil:
+		_, err := fmt.Fprintf(w, "nil\n")
+		return err
+	default:
+		return s.Object.Print(w)
+	}
+}
+
+// Upvalue 是闭包捕获的变量。变量仍在栈上时它是打开的，读写栈上下标为 Index 的槽位；
+// 变量离开作用域时被关闭，值移到 Closed 中，之后由捕获它的闭包共享
+type Upvalue struct {
+	Index  uint64
+	Open   bool
+	Closed Slot
+}
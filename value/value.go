@@ -4,13 +4,14 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
 )
 
 type Value interface {
 	String() string
 	Print(w io.Writer) error
 	ValueType() uint8
-	WriteTo(w io.Writer) error
+	WriteTo(w io.Writer) (int64, error)
 	GetLiteral() any
 	SetLiteral(literal any)
 }
@@ -23,8 +24,36 @@ const (
 	TypeBool
 	TypeNil
 	TypeClosure
+	TypeError
+	TypeModule
+	TypeList
+	TypeClass
+	TypeInstance
+	TypeBoundMethod
+	TypeTrait
+	TypeNative
 )
 
+// TypeNames 是各类型标签在脚本中的名字，即内置函数 type 的返回值。
+// 函数、闭包、绑定的方法和内置函数都是 function
+var TypeNames = map[uint8]string{
+	TypeInt:         "int",
+	TypeFloat:       "float",
+	TypeString:      "string",
+	TypeFunction:    "function",
+	TypeBool:        "bool",
+	TypeNil:         "nil",
+	TypeClosure:     "function",
+	TypeError:       "error",
+	TypeModule:      "module",
+	TypeList:        "list",
+	TypeClass:       "class",
+	TypeInstance:    "instance",
+	TypeBoundMethod: "function",
+	TypeTrait:       "trait",
+	TypeNative:      "function",
+}
+
 type Int struct {
 	Literal int64
 }
@@ -48,12 +77,12 @@ func (i *Int) ValueType() uint8 {
 	return TypeInt
 }
 
-func (i *Int) WriteTo(w io.Writer) error {
+func (i *Int) WriteTo(w io.Writer) (int64, error) {
 	// 格式: [type:1byte][value:8bytes]
-	if err := binary.Write(w, binary.BigEndian, i.ValueType()); err != nil {
-		return err
-	}
-	return binary.Write(w, binary.BigEndian, i.Literal)
+	buf := []byte{i.ValueType()}
+	buf = binary.BigEndian.AppendUint64(buf, uint64(i.Literal))
+	n, err := w.Write(buf)
+	return int64(n), err
 }
 
 func (i *Int) GetLiteral() any {
@@ -87,12 +116,12 @@ func (f *Float) ValueType() uint8 {
 	return TypeFloat
 }
 
-func (f *Float) WriteTo(w io.Writer) error {
+func (f *Float) WriteTo(w io.Writer) (int64, error) {
 	// 格式: [type:1byte][value:8bytes]
-	if err := binary.Write(w, binary.BigEndian, f.ValueType()); err != nil {
-		return err
-	}
-	return binary.Write(w, binary.BigEndian, f.Literal)
+	buf := []byte{f.ValueType()}
+	buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(f.Literal))
+	n, err := w.Write(buf)
+	return int64(n), err
 }
 
 func (f *Float) GetLiteral() any {
@@ -126,17 +155,13 @@ func (s *String) ValueType() uint8 {
 	return TypeString
 }
 
-func (s *String) WriteTo(w io.Writer) error {
+func (s *String) WriteTo(w io.Writer) (int64, error) {
 	// 格式: [type:1byte][length:8bytes][data:length bytes]
-	if err := binary.Write(w, binary.BigEndian, s.ValueType()); err != nil {
-		return err
-	}
-	length := int64(len(s.Literal))
-	if err := binary.Write(w, binary.BigEndian, length); err != nil {
-		return err
-	}
-	_, err := w.Write([]byte(s.Literal))
-	return err
+	buf := []byte{s.ValueType()}
+	buf = binary.BigEndian.AppendUint64(buf, uint64(len(s.Literal)))
+	buf = append(buf, s.Literal...)
+	n, err := w.Write(buf)
+	return int64(n), err
 }
 
 func (s *String) GetLiteral() any {
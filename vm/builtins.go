@@ -0,0 +1,226 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"stmt/value"
+	"strings"
+	"time"
+)
+
+// native 是一个内置函数的实现，args 是栈上的参数，arity 为参数个数。
+// fn 调用 get 或 set 访问器时压入访问器的栈帧并返回 true，由访问器的栈帧完成调用，
+// 否则返回值替换栈上的内置函数和参数
+type native struct {
+	arity int
+	fn    func(vm *VM, args []value.Slot) (value.Slot, bool, error)
+}
+
+var natives = map[string]native{
+	"clock":      {0, clock},
+	"type":       {1, typeOf},
+	"isinstance": {2, isInstance},
+	"fields":     {1, fields},
+	"methods":    {1, methods},
+	"hasattr":    {2, hasAttr},
+	"getattr":    {2, getAttr},
+	"setattr":    {3, setAttr},
+	"superclass": {1, superClass},
+}
+
+// builtins 是各内置函数的值，下标和 value.Builtins 相同。内置函数没有状态，所有虚拟机共用
+var builtins []value.Slot
+
+func init() {
+	for i, name := range value.Builtins {
+		if _, ok := natives[name]; !ok {
+			panic("vm: builtin " + name + " is not implemented")
+		}
+		builtins = append(builtins, value.SlotOf(value.NewNative(name, i)))
+	}
+}
+
+// callNative 以栈顶的 argCount 个参数调用内置函数 callee
+func (vm *VM) callNative(callee *value.Native, argCount uint64) error {
+	native := natives[callee.Name]
+	if argCount != uint64(native.arity) {
+		return fmt.Errorf("%w: %s expects %d arguments but got %d", ErrNumParamsArgsNotMatch, callee.Name, native.arity, argCount)
+	}
+	index := vm.StackLen() - argCount - 1
+	result, called, err := native.fn(vm, vm.Stack[index+1:vm.sp])
+	if err != nil || called {
+		return err
+	}
+	vm.StackResize(index)
+	vm.StackPush(result)
+	return nil
+}
+
+// propertyName 返回内置函数按名字访问的属性名，私有名字不能通过名字访问
+func propertyName(name value.Slot) (string, error) {
+	_name, ok := name.Object.(*value.String)
+	if !ok {
+		return "", ErrInvalidArgumentType
+	}
+	if strings.Contains(_name.Literal, "#") {
+		return "", ErrPrivateProperty
+	}
+	return _name.Literal, nil
+}
+
+// names 返回 names 中除私有名字之外的名字组成的列表，按字典序排列
+func (vm *VM) names(names []string) (value.Slot, error) {
+	names = slices.DeleteFunc(names, func(name string) bool {
+		return strings.Contains(name, "#")
+	})
+	slices.Sort(names)
+	elements := make([]value.Value, len(names))
+	for i, name := range names {
+		str, err := vm.intern(name)
+		if err != nil {
+			return value.Slot{}, err
+		}
+		elements[i] = str.Object
+	}
+	list := value.NewList(elements)
+	err := vm.Allocate(SizeOf(list))
+	if err != nil {
+		return value.Slot{}, err
+	}
+	return value.SlotOf(list), nil
+}
+
+func clock(vm *VM, args []value.Slot) (value.Slot, bool, error) {
+	return value.IntSlot(time.Now().Unix()), false, nil
+}
+
+// typeOf 返回值的类型名，见 value.TypeNames
+func typeOf(vm *VM, args []value.Slot) (value.Slot, bool, error) {
+	str, err := vm.intern(value.TypeNames[args[0].Type])
+	return str, false, err
+}
+
+// isInstance 判断值是否为类或其子类的实例
+func isInstance(vm *VM, args []value.Slot) (value.Slot, bool, error) {
+	class, ok := args[1].Object.(*value.Class)
+	if !ok {
+		return value.Slot{}, false, ErrInvalidArgumentType
+	}
+	instance, ok := args[0].Object.(*value.Instance)
+	if !ok {
+		return value.BoolSlot(false), false, nil
+	}
+	for c := instance.Class; c != nil; c = c.Super {
+		if c == class {
+			return value.BoolSlot(true), false, nil
+		}
+	}
+	return value.BoolSlot(false), false, nil
+}
+
+// fields 返回实例的字段名
+func fields(vm *VM, args []value.Slot) (value.Slot, bool, error) {
+	instance, ok := args[0].Object.(*value.Instance)
+	if !ok {
+		return value.Slot{}, false, ErrInvalidArgumentType
+	}
+	names := make([]string, 0, len(instance.Shape.Index))
+	for name := range instance.Shape.Index {
+		names = append(names, name)
+	}
+	list, err := vm.names(names)
+	return list, false, err
+}
+
+// methods 返回类的方法名，包括继承和从 trait 组合的方法，不包括 static 方法和访问器
+func methods(vm *VM, args []value.Slot) (value.Slot, bool, error) {
+	class, ok := args[0].Object.(*value.Class)
+	if !ok {
+		return value.Slot{}, false, ErrInvalidArgumentType
+	}
+	names := make([]string, 0, len(class.Methods))
+	for name := range class.Methods {
+		names = append(names, name)
+	}
+	list, err := vm.names(names)
+	return list, false, err
+}
+
+// hasAttr 判断实例是否有名为 name 的字段、get 访问器或方法，或者类是否有名为 name 的 static 方法。
+// 其他值和私有名字总是返回 false
+func hasAttr(vm *VM, args []value.Slot) (value.Slot, bool, error) {
+	name, err := propertyName(args[1])
+	if errors.Is(err, ErrPrivateProperty) {
+		return value.BoolSlot(false), false, nil
+	} else if err != nil {
+		return value.Slot{}, false, err
+	}
+	switch object := args[0].Object.(type) {
+	case *value.Instance:
+		_, field := object.Shape.Index[name]
+		_, getter := object.Class.Getters[name]
+		_, method := object.Class.Methods[name]
+		return value.BoolSlot(field || getter || method), false, nil
+	case *value.Class:
+		_, static := object.Statics[name]
+		return value.BoolSlot(static), false, nil
+	default:
+		return value.BoolSlot(false), false, nil
+	}
+}
+
+// getAttr 读取名为 name 的属性，和 object.name 相同
+func getAttr(vm *VM, args []value.Slot) (value.Slot, bool, error) {
+	name, err := propertyName(args[1])
+	if err != nil {
+		return value.Slot{}, false, err
+	}
+	object := args[0]
+	property, getter, err := vm.getProperty(object, &value.InlineCache{Name: name})
+	if err != nil || getter == nil {
+		return property, false, err
+	}
+	// 实例替换内置函数作为 get 访问器的 this，访问器的返回值就是调用的结果
+	index := vm.StackLen() - uint64(len(args)) - 1
+	vm.StackResize(index)
+	vm.StackPush(object)
+	return value.Slot{}, true, vm.call(getter, 0)
+}
+
+// setAttr 设置名为 name 的属性，和 object.name = value 相同，返回设置的值
+func setAttr(vm *VM, args []value.Slot) (value.Slot, bool, error) {
+	name, err := propertyName(args[1])
+	if err != nil {
+		return value.Slot{}, false, err
+	}
+	object, value_ := args[0], args[2]
+	setter, err := vm.setProperty(object, value_, &value.InlineCache{Name: name})
+	if err != nil || setter == nil {
+		return value_, false, err
+	}
+	// 设置的值替换内置函数作为调用的结果，其上是 set 访问器的 this 和参数，访问器的返回值被丢弃
+	index := vm.StackLen() - uint64(len(args)) - 1
+	vm.StackResize(index)
+	vm.StackPush(value_)
+	vm.StackPush(object)
+	vm.StackPush(value_)
+	err = vm.call(setter, 1)
+	if err != nil {
+		return value.Slot{}, true, err
+	}
+	vm.FramesTop().Discard = true
+	return value.Slot{}, true, nil
+}
+
+// superClass 返回类的父类，没有父类时返回 nil
+func superClass(vm *VM, args []value.Slot) (value.Slot, bool, error) {
+	class, ok := args[0].Object.(*value.Class)
+	if !ok {
+		return value.Slot{}, false, ErrInvalidArgumentType
+	}
+	if class.Super == nil {
+		return value.NilSlot(), false, nil
+	}
+	return value.SlotOf(class.Super), false, nil
+}
@@ -0,0 +1,236 @@
+package vm
+
+import (
+	"fmt"
+	"stmt/value"
+)
+
+// callable 准备调用栈顶 argCount 个参数之下的值，返回要执行的闭包。
+// 调用绑定的方法时 this 替换被调用的值，成为方法的第 0 个局部变量；
+// 调用类时创建实例，有 init 方法时返回它，否则实例替换类留在栈顶，返回 nil；
+// 调用内置函数时直接执行它并返回 nil，结果留在栈顶，或者由它压入的访问器栈帧返回
+func (vm *VM) callable(argCount uint64) (*value.Closure, error) {
+	index := vm.StackLen() - argCount - 1
+	switch callee := vm.Stack[index].Object.(type) {
+	case *value.Closure:
+		return callee, nil
+	case *value.BoundMethod:
+		vm.Stack[index] = callee.Receiver
+		return callee.Method, nil
+	case *value.Native:
+		return nil, vm.callNative(callee, argCount)
+	case *value.Class:
+		instance := value.NewInstance(callee)
+		err := vm.Allocate(SizeOf(instance))
+		if err != nil {
+			return nil, err
+		}
+		// 有 init 方法时实例替换类作为 init 的 this，init 返回 this
+		if init, ok := callee.Methods["init"]; ok {
+			vm.Stack[index] = value.SlotOf(instance)
+			return init, nil
+		}
+		if argCount > 0 {
+			return nil, fmt.Errorf("%w: %s expects 0 arguments but got %d", ErrNumParamsArgsNotMatch, callee.Name, argCount)
+		}
+		vm.StackResize(index)
+		vm.StackPush(value.SlotOf(instance))
+		return nil, nil
+	default:
+		return nil, ErrInvalidCallType
+	}
+}
+
+// call 为 closure 压入新栈帧，它的参数已在栈顶。方法的栈帧从 this 开始
+func (vm *VM) call(closure *value.Closure, argCount uint64) error {
+	err := vm.StackAdjustArgs(closure.Function, argCount)
+	if err != nil {
+		return err
+	}
+	basePointer := vm.StackLen() - closure.Function.NumArgSlots()
+	return vm.FramesPush(NewFrame(closure, basePointer, argCount))
+}
+
+// callValue 调用栈顶 argCount 个参数之下的值，是闭包时压入它的栈帧
+func (vm *VM) callValue(argCount uint64) error {
+	closure, err := vm.callable(argCount)
+	if err != nil || closure == nil {
+		return err
+	}
+	return vm.call(closure, argCount)
+}
+
+// invoke 调用栈顶 argCount 个参数之下的值名为 cache.Name 的属性，是闭包时压入它的栈帧。
+// 属性是实例的方法时实例留在原处作为 this，不需要创建绑定的方法；
+// 属性是 get 访问器时先以实例的副本为 this 调用它，返回后再以参数调用它的返回值
+func (vm *VM) invoke(cache *value.InlineCache, argCount uint64) error {
+	index := vm.StackLen() - argCount - 1
+	receiver := vm.Stack[index]
+	instance, ok := receiver.Object.(*value.Instance)
+	if !ok {
+		property, err := vm.property(receiver, cache.Name)
+		if err != nil {
+			return err
+		}
+		vm.Stack[index] = property
+		return vm.callValue(argCount)
+	}
+	if instance.Shape != cache.Shape {
+		err := lookup(instance, cache)
+		if err != nil {
+			return err
+		}
+	}
+	switch {
+	case cache.Method != nil:
+		return vm.call(cache.Method, argCount)
+	case cache.Accessor != nil:
+		vm.StackPush(receiver)
+		err := vm.call(cache.Accessor, 0)
+		if err != nil {
+			return err
+		}
+		vm.FramesTop().Invoke = argCount + 1
+		return nil
+	}
+	vm.Stack[index] = instance.Fields[cache.Index]
+	return vm.callValue(argCount)
+}
+
+// returnFrom 结束当前栈帧，返回值 result 替换被调用的值。
+// set 访问器的返回值被丢弃，OP_INVOKE 调用的 get 访问器的返回值随后以栈顶的参数被调用，
+// 尾调用的内置函数压入的访问器栈帧返回后，之下的栈帧以栈顶的值返回
+func (vm *VM) returnFrom(result value.Slot) error {
+	frame := vm.FramesTop()
+	vm.UpvaluesClose(frame.BasePointer)
+	vm.StackResize(frame.Callee())
+	discard, invoke, tail := frame.Discard, frame.Invoke, frame.Tail
+	vm.FramesPop()
+	switch {
+	case discard:
+	case invoke == 0:
+		vm.StackPush(result)
+	default:
+		argCount := invoke - 1
+		vm.Stack[vm.StackLen()-argCount-1] = result
+		return vm.callValue(argCount)
+	}
+	if tail {
+		return vm.returnFrom(vm.StackPop())
+	}
+	return nil
+}
+
+// operator 返回栈顶 argCount 个参数之下的运算数的类重载运算的特殊方法 name，
+// 运算数不是实例或者类没有定义该方法时返回 nil
+func (vm *VM) operator(name string, argCount uint64) *value.Closure {
+	instance, ok := vm.StackPeek(argCount).Object.(*value.Instance)
+	if !ok {
+		return nil
+	}
+	return instance.Class.Methods[name]
+}
+
+// lookup 在 instance 的字段、类的 get 访问器和方法中依次查找 cache.Name，把结果记入 cache
+func lookup(instance *value.Instance, cache *value.InlineCache) error {
+	if index, ok := instance.Shape.Index[cache.Name]; ok {
+		*cache = value.InlineCache{
+			Name:  cache.Name,
+			Shape: instance.Shape,
+			Index: index,
+		}
+		return nil
+	}
+	if getter, ok := instance.Class.Getters[cache.Name]; ok {
+		*cache = value.InlineCache{
+			Name:     cache.Name,
+			Shape:    instance.Shape,
+			Accessor: getter,
+		}
+		return nil
+	}
+	method, ok := instance.Class.Methods[cache.Name]
+	if !ok {
+		return ErrUndefinedProperty
+	}
+	*cache = value.InlineCache{
+		Name:   cache.Name,
+		Shape:  instance.Shape,
+		Method: method,
+	}
+	return nil
+}
+
+// getProperty 读取 object 名为 cache.Name 的属性，实例的方法被绑定到实例上。
+// 属性是 get 访问器时返回它，由调用者以实例为 this 调用
+func (vm *VM) getProperty(object value.Slot, cache *value.InlineCache) (value.Slot, *value.Closure, error) {
+	instance, ok := object.Object.(*value.Instance)
+	if !ok {
+		property, err := vm.property(object, cache.Name)
+		return property, nil, err
+	}
+	if instance.Shape != cache.Shape {
+		err := lookup(instance, cache)
+		if err != nil {
+			return value.Slot{}, nil, err
+		}
+	}
+	switch {
+	case cache.Accessor != nil:
+		return value.Slot{}, cache.Accessor, nil
+	case cache.Method == nil:
+		return instance.Fields[cache.Index], nil, nil
+	}
+	bound := value.NewBoundMethod(object, cache.Method)
+	err := vm.Allocate(SizeOf(bound))
+	if err != nil {
+		return value.Slot{}, nil, err
+	}
+	return value.SlotOf(bound), nil, nil
+}
+
+// setProperty 设置 object 名为 cache.Name 的字段，字段不存在时添加到实例末尾。
+// 类有同名的 set 访问器时返回它，由调用者以实例为 this、value_ 为参数调用
+func (vm *VM) setProperty(object value.Slot, value_ value.Slot, cache *value.InlineCache) (*value.Closure, error) {
+	instance, ok := object.Object.(*value.Instance)
+	if !ok {
+		return nil, ErrOnlyInstanceHaveFields
+	}
+	if instance.Shape != cache.Shape {
+		shape := instance.Shape
+		if setter, ok := instance.Class.Setters[cache.Name]; ok {
+			*cache = value.InlineCache{
+				Name:     cache.Name,
+				Shape:    shape,
+				Accessor: setter,
+			}
+		} else if index, ok := shape.Index[cache.Name]; ok {
+			*cache = value.InlineCache{
+				Name:  cache.Name,
+				Shape: shape,
+				Index: index,
+			}
+		} else {
+			*cache = value.InlineCache{
+				Name:       cache.Name,
+				Shape:      shape,
+				Index:      len(instance.Fields),
+				Transition: shape.Transition(cache.Name),
+			}
+		}
+	}
+	if cache.Accessor != nil {
+		return cache.Accessor, nil
+	}
+	if cache.Transition == nil {
+		instance.Fields[cache.Index] = value_
+		return nil, nil
+	}
+	err := vm.Allocate(sizeWord)
+	if err != nil {
+		return nil, err
+	}
+	instance.Fields = append(instance.Fields, value_)
+	instance.Shape = cache.Transition
+	return nil, nil
+}
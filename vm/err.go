@@ -3,13 +3,24 @@ package vm
 import "errors"
 
 var (
-	ErrInvalidOpcodeType   = errors.New("invalid opcode type")
-	ErrOpcodeHaveNoOperand = errors.New("opcode have no operand")
-	ErrInvalidOperandWidth = errors.New("invalid operand width")
-	ErrInvalidOperandType  = errors.New("invalid operand type")
-	ErrInvalidCondType     = errors.New("invalid cond type")
-	ErrInvalidCallType     = errors.New("invalid call type")
-	ErrInvalidClosureType  = errors.New("invalid closure type")
-	ErrZeroInDivide        = errors.New("zero in divide")
-	ErrZeroInModulo        = errors.New("zero in modulo")
+	ErrInvalidOpcodeType      = errors.New("invalid opcode type")
+	ErrOpcodeHaveNoOperand    = errors.New("opcode have no operand")
+	ErrInvalidOperandWidth    = errors.New("invalid operand width")
+	ErrInvalidOperandType     = errors.New("invalid operand type")
+	ErrInvalidCondType        = errors.New("invalid cond type")
+	ErrInvalidCallType        = errors.New("invalid call type")
+	ErrInvalidClosureType     = errors.New("invalid closure type")
+	ErrZeroInDivide           = errors.New("zero in divide")
+	ErrZeroInModulo           = errors.New("zero in modulo")
+	ErrMemoryLimitExceeded    = errors.New("memory limit exceeded")
+	ErrNotInstance            = errors.New("only instances have properties")
+	ErrUndefinedProperty      = errors.New("undefined property")
+	ErrUncaughtException      = errors.New("uncaught exception")
+	ErrNumParamsArgsNotMatch  = errors.New("function parameters num should equ to call arguments num")
+	ErrIndexOutOfRange        = errors.New("index out of range")
+	ErrNotClass               = errors.New("superclass must be a class")
+	ErrNotTrait               = errors.New("can only compose traits with 'with'")
+	ErrOnlyInstanceHaveFields = errors.New("only instances have fields")
+	ErrInvalidArgumentType    = errors.New("invalid argument type")
+	ErrPrivateProperty        = errors.New("private properties can't be accessed by name")
 )
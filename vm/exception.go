@@ -0,0 +1,112 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"stmt/value"
+	"strings"
+)
+
+// Exception 是脚本中抛出的异常，未被捕获时由 Run 返回
+type Exception struct {
+	Value value.Value  // 被抛出的值
+	Line  int          // 抛出异常的源码行号
+	Err   error        // 由运行时错误转换而来时的原始错误
+	Trace []TraceFrame // 抛出异常时的调用栈，最内层在前
+}
+
+// TraceFrame 是调用栈中的一层：正在执行的函数和执行到的位置
+type TraceFrame struct {
+	Function string
+	File     string
+	Line     int
+}
+
+func (t TraceFrame) String() string {
+	file := t.File
+	if file == "" {
+		file = "<input>"
+	}
+	return fmt.Sprintf("at %s (%s:%d)", t.Function, file, t.Line)
+}
+
+// StackTrace 返回错误信息和调用栈，每层一行
+func (e *Exception) StackTrace() string {
+	var b strings.Builder
+	b.WriteString(e.Error())
+	for _, frame := range e.Trace {
+		b.WriteString("\n    ")
+		b.WriteString(frame.String())
+	}
+	return b.String()
+}
+
+func (e *Exception) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+	}
+	return fmt.Sprintf("line %d: %v %s", e.Line, ErrUncaughtException, e.Value.String())
+}
+
+func (e *Exception) Unwrap() error {
+	if e.Err != nil {
+		return e.Err
+	}
+	return ErrUncaughtException
+}
+
+// Trace 返回当前的调用栈，最内层在前。尾调用复用了调用者的栈帧，所以调用者不在其中
+func (vm *VM) Trace() []TraceFrame {
+	trace := make([]TraceFrame, 0, len(vm.Frames))
+	for i := len(vm.Frames) - 1; i >= 0; i-- {
+		frame := vm.Frames[i]
+		function := frame.Closure.Function
+		trace = append(trace, TraceFrame{
+			Function: function.DisplayName(),
+			File:     function.File,
+			Line:     frame.Line(),
+		})
+	}
+	return trace
+}
+
+// Throw 将 err 作为异常抛出：运行时错误被转换为 value.Error，
+// 然后沿 Frames 由内向外查找异常处理表。找到处理代码时返回 nil，
+// 否则返回未被捕获的异常。超出内存限制不能被脚本捕获。
+func (vm *VM) Throw(err error) error {
+	if errors.Is(err, ErrMemoryLimitExceeded) {
+		return err
+	}
+	var exception *Exception
+	if !errors.As(err, &exception) {
+		line := vm.FramesTop().Line()
+		errorValue := value.NewError(err.Error(), int64(line))
+		allocErr := vm.Allocate(SizeOf(errorValue))
+		if allocErr != nil {
+			return allocErr
+		}
+		exception = &Exception{
+			Value: errorValue,
+			Line:  line,
+			Err:   err,
+		}
+	}
+	if exception.Trace == nil {
+		exception.Trace = vm.Trace()
+	}
+	for {
+		frame := vm.FramesTop()
+		handler := frame.Closure.Function.HandlerOf(frame.Ip - 1)
+		if handler != nil {
+			vm.UpvaluesClose(frame.BasePointer + handler.Slots)
+			vm.StackResize(frame.BasePointer + handler.Slots)
+			vm.StackPush(value.SlotOf(exception.Value))
+			frame.Ip = handler.Target
+			return nil
+		}
+		if len(vm.Frames) == 1 {
+			return exception
+		}
+		vm.Frames = vm.Frames[:len(vm.Frames)-1]
+	}
+}
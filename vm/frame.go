@@ -2,75 +2,51 @@ package vm
 
 import (
 	"encoding/binary"
-	"stmt/opcode"
 	"stmt/value"
 )
 
 type Frame struct {
 	Closure     *value.Closure
 	BasePointer uint64
-	Ip          uint64
+	Ip          uint64 // 调用其他函数时才从 run 的局部变量写回
+	ArgCount    uint64 // 调用时实际传入的参数个数
+	Discard     bool   // 返回值不入栈，用于 set 访问器
+	Invoke      uint64 // 不为 0 时返回值是 get 访问器的值，返回后以它之下的 Invoke-1 个参数调用它，用于 OP_INVOKE
+	Tail        bool   // 返回后它之下的栈帧随之返回，用于尾调用的内置函数压入的访问器栈帧
 }
 
-func NewFrame(closure *value.Closure, basePointer uint64) *Frame {
-	return &Frame{
+func NewFrame(closure *value.Closure, basePointer uint64, argCount uint64) Frame {
+	return Frame{
 		Closure:     closure,
 		BasePointer: basePointer,
-		Ip:          0,
+		ArgCount:    argCount,
 	}
 }
 
-func (f *Frame) MoveIp(offset uint64) {
-	f.Ip += offset
-}
-
-func (f *Frame) CodeSize() uint64 {
-	function := f.Closure.Function
-	code := function.Code
-	size := len(code)
-	return uint64(size)
-}
-
-func (f *Frame) Opcode() uint8 {
-	function := f.Closure.Function
-	code := function.Code
-	char := code[f.Ip]
-	f.Ip++
-	return char
-}
-
-func (f *Frame) Operand(op uint8) (uint64, error) {
-	width, ok := opcode.OperandWidth[op]
-	if !ok {
-		return 0, ErrOpcodeHaveNoOperand
-	}
-	function := f.Closure.Function
-	code := function.Code
+// readOperand 读取 code 开头宽度为 width 字节的操作数
+func readOperand(code []uint8, width int) uint64 {
 	switch width {
 	case 1:
-		operand := uint64(code[f.Ip])
-		f.Ip++
-		return operand, nil
+		return uint64(code[0])
 	case 2:
-		operand := uint64(binary.BigEndian.Uint16(code[f.Ip:]))
-		f.Ip += 2
-		return operand, nil
+		return uint64(binary.BigEndian.Uint16(code))
 	case 4:
-		operand := uint64(binary.BigEndian.Uint32(code[f.Ip:]))
-		f.Ip += 4
-		return operand, nil
-	case 8:
-		operand := binary.BigEndian.Uint64(code[f.Ip:])
-		f.Ip += 8
-		return operand, nil
+		return uint64(binary.BigEndian.Uint32(code))
 	default:
-		return 0, ErrInvalidOperandWidth
+		return binary.BigEndian.Uint64(code)
 	}
 }
 
-func (f *Frame) CodeNext() uint8 {
-	code := f.Closure.Function.Code
-	char := code[f.Ip]
-	f.Ip++
-	return char
+// Line 返回刚执行的指令所在的源码行号
+func (f *Frame) Line() int {
+	return f.Closure.Function.LineOf(f.Ip - 1)
+}
+
+// Callee 返回被调用的值所在的槽位，函数返回时栈恢复到这里。
+// 方法的这个槽位保存 this，是它的第 0 个局部变量
+func (f *Frame) Callee() uint64 {
+	if f.Closure.Function.Method {
+		return f.BasePointer
+	}
+	return f.BasePointer - 1
 }
@@ -0,0 +1,80 @@
+package vm
+
+import "stmt/value"
+
+// 各类值在堆上占用的近似字节数，用于内存配额统计
+const (
+	sizeWord   uint64 = 8
+	sizeHeader uint64 = 16                      // string 和 slice 的头部
+	sizeSlot   uint64 = sizeWord*2 + sizeHeader // 栈上的一个槽位
+	sizeFrame  uint64 = sizeWord * 7            // 调用栈上的一个栈帧
+	sizeCache  uint64 = sizeWord*5 + sizeHeader // 闭包中的一个内联缓存
+)
+
+// SizeOf 返回值 value_ 在堆上占用的近似字节数
+func SizeOf(value_ value.Value) uint64 {
+	switch _value := value_.(type) {
+	case *value.Int, *value.Float, *value.Bool:
+		return sizeWord
+	case *value.Nil:
+		return 0
+	case *value.String:
+		return sizeHeader + uint64(len(_value.Literal))
+	case *value.Error:
+		return sizeWord + sizeHeader + uint64(len(_value.Message))
+	case *value.List:
+		return sizeHeader + sizeWord*uint64(len(_value.Elements))
+	case *value.Closure:
+		return sizeWord + sizeHeader*2 + sizeHeader*uint64(len(_value.Upvalues)) + sizeCache*uint64(len(_value.Caches))
+	case *value.Class:
+		return sizeWord*2 + sizeHeader + uint64(len(_value.Name))
+	case *value.Instance:
+		return sizeWord*2 + sizeHeader + sizeWord*uint64(len(_value.Fields))
+	case *value.BoundMethod:
+		return sizeWord * 3
+	case *value.Trait:
+		return sizeWord + sizeHeader + uint64(len(_value.Name))
+	case *value.Native:
+		return sizeWord*2 + sizeHeader + uint64(len(_value.Name))
+	default:
+		return sizeWord
+	}
+}
+
+// Allocate 记录一次 size 字节的分配，超出 MemoryLimit 时返回 ErrMemoryLimitExceeded。
+// MemoryLimit 为 0 表示不限制。
+func (vm *VM) Allocate(size uint64) error {
+	vm.MemoryUsed += size
+	if vm.MemoryLimit != 0 && vm.MemoryUsed > vm.MemoryLimit {
+		return ErrMemoryLimitExceeded
+	}
+	return nil
+}
+
+// allocateStacks 把栈和调用栈在预先分配的容量之外增长的部分计入内存。
+// 每次压入栈帧时统计，所以无限递归会在超出上限时报错，而不会耗尽宿主的内存
+func (vm *VM) allocateStacks() error {
+	var size uint64
+	if n := uint64(len(vm.Stack)); n > vm.stackAllocated {
+		size += sizeSlot * (n - vm.stackAllocated)
+		vm.stackAllocated = n
+	}
+	if n := uint64(cap(vm.Frames)); n > vm.framesAllocated {
+		size += sizeFrame * (n - vm.framesAllocated)
+		vm.framesAllocated = n
+	}
+	if size == 0 {
+		return nil
+	}
+	return vm.Allocate(size)
+}
+
+// StackPushAlloc 统计新分配的 value_ 占用的内存后再入栈
+func (vm *VM) StackPushAlloc(value_ value.Value) error {
+	err := vm.Allocate(SizeOf(value_))
+	if err != nil {
+		return err
+	}
+	vm.StackPush(value.SlotOf(value_))
+	return nil
+}
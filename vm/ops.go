@@ -0,0 +1,283 @@
+package vm
+
+import (
+	"fmt"
+	"math"
+	"stmt/opcode"
+	"stmt/value"
+)
+
+// 栈虚拟机和寄存器虚拟机共用的运算，结果由调用者保存到栈或寄存器
+
+// intern 返回内容为 literal 的驻留字符串，第一次出现时才分配。
+// 驻留的字符串在本次运行中不会释放，只用于常量、类型名和属性名这类数量有限的字符串
+func (vm *VM) intern(literal string) (value.Slot, error) {
+	if interned, ok := vm.Strings[literal]; ok {
+		return value.SlotOf(interned), nil
+	}
+	r := value.NewString(literal)
+	err := vm.Allocate(SizeOf(r))
+	if err != nil {
+		return value.Slot{}, err
+	}
+	vm.Strings[literal] = r
+	return value.SlotOf(r), nil
+}
+
+// newString 返回内容为 literal 的字符串，已有驻留字符串时复用它，否则分配一个不驻留的新字符串，
+// 用于拼接结果这类运行时产生、数量不受限制的字符串
+func (vm *VM) newString(literal string) (value.Slot, error) {
+	if interned, ok := vm.Strings[literal]; ok {
+		return value.SlotOf(interned), nil
+	}
+	r := value.NewString(literal)
+	err := vm.Allocate(SizeOf(r))
+	if err != nil {
+		return value.Slot{}, err
+	}
+	return value.SlotOf(r), nil
+}
+
+func slotOfConstant(constant value.Value) (value.Slot, error) {
+	switch constant.(type) {
+	case *value.Int, *value.Float, *value.String, *value.Module:
+		return value.SlotOf(constant), nil
+	default:
+		return value.Slot{}, ErrInvalidOperandType
+	}
+}
+
+func (vm *VM) property(object value.Slot, name string) (value.Slot, error) {
+	switch _object := object.Object.(type) {
+	case *value.Error:
+		switch name {
+		case "message":
+			return vm.newString(_object.Message)
+		case "line":
+			return value.IntSlot(_object.Line), nil
+		default:
+			return value.Slot{}, ErrUndefinedProperty
+		}
+	case *value.List:
+		if name != "length" {
+			return value.Slot{}, ErrUndefinedProperty
+		}
+		return value.IntSlot(int64(len(_object.Elements))), nil
+	case *value.Module:
+		globalIndex, ok := _object.Exports[name]
+		if !ok {
+			return value.Slot{}, ErrUndefinedProperty
+		}
+		return vm.Globals[globalIndex], nil
+	case *value.Class:
+		static, ok := _object.Statics[name]
+		if !ok {
+			return value.Slot{}, ErrUndefinedProperty
+		}
+		return value.SlotOf(static), nil
+	default:
+		return value.Slot{}, ErrNotInstance
+	}
+}
+
+func indexOf(object value.Slot, index value.Slot) (value.Slot, error) {
+	list, ok := object.Object.(*value.List)
+	if !ok {
+		return value.Slot{}, ErrInvalidOperandType
+	}
+	if index.Type != value.TypeInt {
+		return value.Slot{}, ErrInvalidOperandType
+	}
+	_index := index.Int()
+	if _index < 0 || _index >= int64(len(list.Elements)) {
+		return value.Slot{}, fmt.Errorf("%w: %d", ErrIndexOutOfRange, _index)
+	}
+	return value.SlotOf(list.Elements[_index]), nil
+}
+
+// bothInt 判断 a 和 b 是否都是 int
+func bothInt(a value.Slot, b value.Slot) bool {
+	return a.Type == value.TypeInt && b.Type == value.TypeInt
+}
+
+// toFloat 把数字 a 转换为 float，a 不是数字时返回 false
+func toFloat(a value.Slot) (float64, bool) {
+	switch a.Type {
+	case value.TypeInt:
+		return float64(a.Int()), true
+	case value.TypeFloat:
+		return a.Float(), true
+	default:
+		return 0, false
+	}
+}
+
+// floats 把两个数字操作数都转换为 float，有一个不是数字时返回 false
+func floats(a value.Slot, b value.Slot) (float64, float64, bool) {
+	x, ok := toFloat(a)
+	if !ok {
+		return 0, 0, false
+	}
+	y, ok := toFloat(b)
+	if !ok {
+		return 0, 0, false
+	}
+	return x, y, true
+}
+
+func negate(a value.Slot) (value.Slot, error) {
+	switch a.Type {
+	case value.TypeInt:
+		return value.IntSlot(-a.Int()), nil
+	case value.TypeFloat:
+		return value.FloatSlot(-a.Float()), nil
+	default:
+		return value.Slot{}, ErrInvalidOperandType
+	}
+}
+
+func (vm *VM) add(a value.Slot, b value.Slot) (value.Slot, error) {
+	if bothInt(a, b) {
+		return value.IntSlot(a.Int() + b.Int()), nil
+	}
+	if a.Type == value.TypeString && b.Type == value.TypeString {
+		return vm.newString(a.Object.(*value.String).Literal + b.Object.(*value.String).Literal)
+	}
+	x, y, ok := floats(a, b)
+	if !ok {
+		return value.Slot{}, ErrInvalidOperandType
+	}
+	return value.FloatSlot(x + y), nil
+}
+
+func subtract(a value.Slot, b value.Slot) (value.Slot, error) {
+	if bothInt(a, b) {
+		return value.IntSlot(a.Int() - b.Int()), nil
+	}
+	x, y, ok := floats(a, b)
+	if !ok {
+		return value.Slot{}, ErrInvalidOperandType
+	}
+	return value.FloatSlot(x - y), nil
+}
+
+func multiply(a value.Slot, b value.Slot) (value.Slot, error) {
+	if bothInt(a, b) {
+		return value.IntSlot(a.Int() * b.Int()), nil
+	}
+	x, y, ok := floats(a, b)
+	if !ok {
+		return value.Slot{}, ErrInvalidOperandType
+	}
+	return value.FloatSlot(x * y), nil
+}
+
+func divide(a value.Slot, b value.Slot) (value.Slot, error) {
+	if bothInt(a, b) {
+		if b.Int() == 0 {
+			return value.Slot{}, ErrZeroInDivide
+		}
+		return value.IntSlot(a.Int() / b.Int()), nil
+	}
+	x, y, ok := floats(a, b)
+	if !ok {
+		return value.Slot{}, ErrInvalidOperandType
+	}
+	if y == 0 {
+		return value.Slot{}, ErrZeroInDivide
+	}
+	return value.FloatSlot(x / y), nil
+}
+
+func modulo(a value.Slot, b value.Slot) (value.Slot, error) {
+	if bothInt(a, b) {
+		if b.Int() == 0 {
+			return value.Slot{}, ErrZeroInModulo
+		}
+		return value.IntSlot(a.Int() % b.Int()), nil
+	}
+	x, y, ok := floats(a, b)
+	if !ok {
+		return value.Slot{}, ErrInvalidOperandType
+	}
+	if y == 0 {
+		return value.Slot{}, ErrZeroInModulo
+	}
+	return value.FloatSlot(math.Mod(x, y)), nil
+}
+
+// truthy 返回 a 作为条件时的真假，vm.Strict 为 true 时 a 必须是 bool
+func (vm *VM) truthy(a value.Slot) (bool, error) {
+	switch a.Type {
+	case value.TypeBool:
+		return a.Bool(), nil
+	case value.TypeNil:
+		if vm.Strict {
+			return false, ErrInvalidOperandType
+		}
+		return false, nil
+	default:
+		if vm.Strict {
+			return false, ErrInvalidOperandType
+		}
+		return true, nil
+	}
+}
+
+// valuesEqual 判断 a 和 b 是否相等：基本类型比较值，其他对象比较引用，不同类型的值总是不相等
+func valuesEqual(a value.Slot, b value.Slot) bool {
+	if bothInt(a, b) {
+		return a.Int() == b.Int()
+	}
+	if x, y, ok := floats(a, b); ok {
+		return x == y
+	}
+	if a.Type != b.Type {
+		return false
+	}
+	switch a.Type {
+	case value.TypeBool:
+		return a.Bool() == b.Bool()
+	case value.TypeNil:
+		return true
+	case value.TypeString:
+		// 驻留的字符串内容相同时是同一个对象
+		_a := a.Object.(*value.String)
+		_b := b.Object.(*value.String)
+		return _a == _b || _a.Literal == _b.Literal
+	default:
+		return a.Object == b.Object
+	}
+}
+
+// compareSlots 比较 a 和 b，op 是 OP_GT、OP_LT、OP_GE 或 OP_LE。
+// 数字之间按数值比较，字符串之间按字典序比较
+func compareSlots(op uint8, a value.Slot, b value.Slot) (value.Slot, error) {
+	var r bool
+	switch {
+	case bothInt(a, b):
+		r = compare(op, a.Int(), b.Int())
+	case a.Type == value.TypeString && b.Type == value.TypeString:
+		r = compare(op, a.Object.(*value.String).Literal, b.Object.(*value.String).Literal)
+	default:
+		x, y, ok := floats(a, b)
+		if !ok {
+			return value.Slot{}, ErrInvalidOperandType
+		}
+		r = compare(op, x, y)
+	}
+	return value.BoolSlot(r), nil
+}
+
+func compare[T int64 | float64 | string](op uint8, a T, b T) bool {
+	switch op {
+	case opcode.OP_GT:
+		return a > b
+	case opcode.OP_LT:
+		return a < b
+	case opcode.OP_GE:
+		return a >= b
+	default:
+		return a <= b
+	}
+}
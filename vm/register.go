@@ -0,0 +1,283 @@
+package vm
+
+import (
+	"stmt/opcode"
+	"stmt/value"
+)
+
+// registers 为 frame 准备寄存器：栈顶移到它使用的最后一个寄存器之后，返回它的寄存器窗口
+func (vm *VM) registers(frame *Frame) []value.Slot {
+	function := frame.Closure.Function
+	top := frame.BasePointer + function.NumRegisters
+	for top > uint64(len(vm.Stack)) {
+		vm.Stack = append(vm.Stack, make([]value.Slot, len(vm.Stack))...)
+	}
+	vm.sp = top
+	return vm.Stack[frame.BasePointer:top:top]
+}
+
+// runRegister 执行寄存器指令。栈帧的寄存器就是从 BasePointer 开始的栈槽位，
+// 调用时被调用的闭包和参数放在调用者最上面的寄存器中，被调用函数的栈帧紧接在闭包之后，
+// 所以参数正好是它的前几个寄存器，返回值写回闭包所在的寄存器
+func (vm *VM) runRegister() error {
+	frame := vm.FramesTop()
+	code := frame.Closure.Function.Instructions
+	ip := frame.Ip
+	registers := vm.registers(frame)
+	defer func() {
+		vm.FramesTop().Ip = ip
+	}()
+	for ip < uint64(len(code)) {
+		instruction := code[ip]
+		ip++
+		vm.Steps++
+		a := opcode.A(instruction)
+		switch opcode.Op(instruction) {
+		case opcode.R_MOVE:
+			registers[a] = registers[opcode.B(instruction)]
+		case opcode.R_LOADK:
+			r, err := slotOfConstant(vm.Constants[opcode.Bx(instruction)])
+			if err != nil {
+				return err
+			}
+			registers[a] = r
+		case opcode.R_LOADBOOL:
+			registers[a] = value.BoolSlot(opcode.B(instruction) != 0)
+		case opcode.R_LOADNIL:
+			registers[a] = value.NilSlot()
+		case opcode.R_GET_GLOBAL:
+			registers[a] = vm.Globals[opcode.Bx(instruction)]
+		case opcode.R_SET_GLOBAL:
+			vm.Globals[opcode.Bx(instruction)] = registers[a]
+		case opcode.R_GET_UPVALUE:
+			upvalue := frame.Closure.Upvalues[opcode.Bx(instruction)]
+			if upvalue.Open {
+				registers[a] = vm.Stack[upvalue.Index]
+			} else {
+				registers[a] = upvalue.Closed
+			}
+		case opcode.R_SET_UPVALUE:
+			upvalue := frame.Closure.Upvalues[opcode.Bx(instruction)]
+			if upvalue.Open {
+				vm.Stack[upvalue.Index] = registers[a]
+			} else {
+				upvalue.Closed = registers[a]
+			}
+		case opcode.R_CLOSE_UPVALUE:
+			vm.UpvaluesClose(frame.BasePointer + uint64(a))
+		case opcode.R_CLOSURE:
+			_function, ok := vm.Constants[opcode.Bx(instruction)].(*value.Function)
+			if !ok {
+				return ErrInvalidClosureType
+			}
+			closure := value.NewClosure(_function)
+			for i := range closure.Upvalues {
+				capture := code[ip]
+				ip++
+				index := uint64(opcode.Bx(capture))
+				if opcode.A(capture) == 1 {
+					closure.Upvalues[i] = vm.UpvalueCapture(frame.BasePointer + index)
+				} else {
+					closure.Upvalues[i] = frame.Closure.Upvalues[index]
+				}
+			}
+			err := vm.Allocate(SizeOf(closure))
+			if err != nil {
+				return err
+			}
+			registers[a] = value.SlotOf(closure)
+		case opcode.R_NEGATE:
+			r, err := negate(registers[opcode.B(instruction)])
+			if err != nil {
+				return err
+			}
+			registers[a] = r
+		case opcode.R_NOT:
+			cond, err := vm.truthy(registers[opcode.B(instruction)])
+			if err != nil {
+				return ErrInvalidOperandType
+			}
+			registers[a] = value.BoolSlot(!cond)
+		case opcode.R_ADD:
+			x, y := registers[opcode.B(instruction)], registers[opcode.C(instruction)]
+			if bothInt(x, y) {
+				registers[a] = value.IntSlot(x.Int() + y.Int())
+				continue
+			}
+			r, err := vm.add(x, y)
+			if err != nil {
+				return err
+			}
+			registers[a] = r
+		case opcode.R_SUBTRACT:
+			r, err := subtract(registers[opcode.B(instruction)], registers[opcode.C(instruction)])
+			if err != nil {
+				return err
+			}
+			registers[a] = r
+		case opcode.R_MULTIPLY:
+			r, err := multiply(registers[opcode.B(instruction)], registers[opcode.C(instruction)])
+			if err != nil {
+				return err
+			}
+			registers[a] = r
+		case opcode.R_DIVIDE:
+			r, err := divide(registers[opcode.B(instruction)], registers[opcode.C(instruction)])
+			if err != nil {
+				return err
+			}
+			registers[a] = r
+		case opcode.R_MODULO:
+			r, err := modulo(registers[opcode.B(instruction)], registers[opcode.C(instruction)])
+			if err != nil {
+				return err
+			}
+			registers[a] = r
+		case opcode.R_EQ:
+			registers[a] = value.BoolSlot(valuesEqual(registers[opcode.B(instruction)], registers[opcode.C(instruction)]))
+		case opcode.R_NE:
+			registers[a] = value.BoolSlot(!valuesEqual(registers[opcode.B(instruction)], registers[opcode.C(instruction)]))
+		case opcode.R_GT, opcode.R_LT, opcode.R_GE, opcode.R_LE:
+			r, err := compareSlots(registerCompareOps[opcode.Op(instruction)], registers[opcode.B(instruction)], registers[opcode.C(instruction)])
+			if err != nil {
+				return err
+			}
+			registers[a] = r
+		case opcode.R_JUMP:
+			ip = uint64(int64(ip) + int64(opcode.SBx(instruction)))
+		case opcode.R_JUMP_FALSE:
+			cond, err := vm.truthy(registers[a])
+			if err != nil {
+				return err
+			}
+			if !cond {
+				ip = uint64(int64(ip) + int64(opcode.SBx(instruction)))
+			}
+		case opcode.R_JUMP_TRUE:
+			cond, err := vm.truthy(registers[a])
+			if err != nil {
+				return err
+			}
+			if cond {
+				ip = uint64(int64(ip) + int64(opcode.SBx(instruction)))
+			}
+		case opcode.R_CALL:
+			argCount := uint64(opcode.B(instruction))
+			_closure, ok := registers[a].Object.(*value.Closure)
+			if !ok {
+				return ErrInvalidCallType
+			}
+			basePointer := frame.BasePointer + uint64(a) + 1
+			vm.sp = basePointer + argCount
+			err := vm.StackAdjustArgs(_closure.Function, argCount)
+			if err != nil {
+				return err
+			}
+			frame.Ip = ip
+			err = vm.FramesPush(NewFrame(_closure, basePointer, argCount))
+			if err != nil {
+				return err
+			}
+			frame = vm.FramesTop()
+			code = _closure.Function.Instructions
+			ip = 0
+			registers = vm.registers(frame)
+		case opcode.R_TAIL_CALL:
+			argCount := uint64(opcode.B(instruction))
+			_closure, ok := registers[a].Object.(*value.Closure)
+			if !ok {
+				return ErrInvalidCallType
+			}
+			// 当前函数的寄存器不再需要，把被调用的闭包和参数移到当前栈帧的位置，再替换当前栈帧
+			vm.UpvaluesClose(frame.BasePointer)
+			start := frame.BasePointer + uint64(a)
+			copy(vm.Stack[frame.BasePointer-1:], vm.Stack[start:start+argCount+1])
+			vm.sp = frame.BasePointer + argCount
+			err := vm.StackAdjustArgs(_closure.Function, argCount)
+			if err != nil {
+				return err
+			}
+			*frame = NewFrame(_closure, frame.BasePointer, argCount)
+			code = _closure.Function.Instructions
+			ip = 0
+			registers = vm.registers(frame)
+		case opcode.R_RETURN:
+			result := registers[a]
+			vm.UpvaluesClose(frame.BasePointer)
+			vm.Stack[frame.BasePointer-1] = result
+			frame = vm.FramesPop()
+			code = frame.Closure.Function.Instructions
+			ip = frame.Ip
+			registers = vm.registers(frame)
+		case opcode.R_PRINT:
+			err := registers[a].Print(Output)
+			if err != nil {
+				return err
+			}
+		case opcode.R_THROW:
+			return &Exception{
+				Value: registers[a].Box(),
+				Line:  frame.Closure.Function.LineOf(ip - 1),
+			}
+		case opcode.R_GET_PROPERTY:
+			name, ok := vm.Constants[opcode.Bx(instruction)].(*value.String)
+			if !ok {
+				return ErrInvalidOperandType
+			}
+			r, err := vm.property(registers[a], name.Literal)
+			if err != nil {
+				return err
+			}
+			registers[a] = r
+		case opcode.R_INDEX:
+			r, err := indexOf(registers[opcode.B(instruction)], registers[opcode.C(instruction)])
+			if err != nil {
+				return err
+			}
+			registers[a] = r
+		case opcode.R_MISSING_ARG:
+			registers[a] = value.BoolSlot(frame.ArgCount <= uint64(opcode.B(instruction)))
+		case opcode.R_TEST_BOOL:
+			if registers[a].Type != value.TypeBool {
+				return ErrInvalidOperandType
+			}
+		case opcode.R_IMPORT:
+			module, ok := vm.Constants[opcode.Bx(instruction)].(*value.Module)
+			if !ok {
+				return ErrInvalidOperandType
+			}
+			if vm.Imported[module] {
+				registers[a] = value.SlotOf(module)
+				continue
+			}
+			// 首次导入时像调用一样执行模块的顶层代码，它返回模块自身
+			vm.Imported[module] = true
+			closure := value.NewClosure(module.Function)
+			err := vm.Allocate(SizeOf(closure))
+			if err != nil {
+				return err
+			}
+			registers[a] = value.SlotOf(closure)
+			frame.Ip = ip
+			err = vm.FramesPush(NewFrame(closure, frame.BasePointer+uint64(a)+1, 0))
+			if err != nil {
+				return err
+			}
+			frame = vm.FramesTop()
+			code = closure.Function.Instructions
+			ip = 0
+			registers = vm.registers(frame)
+		default:
+			return ErrInvalidOpcodeType
+		}
+	}
+	return nil
+}
+
+// registerCompareOps 把寄存器的比较指令对应到 compareSlots 使用的字节码
+var registerCompareOps = [256]uint8{
+	opcode.R_GT: opcode.OP_GT,
+	opcode.R_LT: opcode.OP_LT,
+	opcode.R_GE: opcode.OP_GE,
+	opcode.R_LE: opcode.OP_LE,
+}
@@ -1,8 +1,8 @@
 package vm
 
 import (
+	"fmt"
 	"io"
-	"math"
 	"os"
 	"stmt/opcode"
 	"stmt/value"
@@ -10,11 +10,26 @@ import (
 
 var Output io.Writer = os.Stdout
 
+const (
+	StackSize  = 1 << 12 // 栈预先分配的槽位数，不够时加倍
+	FramesSize = 1 << 6  // 调用栈预先分配的栈帧数
+)
+
 type VM struct {
-	Stack     []value.Value
-	Globals   []value.Value
-	Frames    []*Frame
-	Constants []value.Value
+	Stack           []value.Slot // 预先分配的栈，只有前 StackLen() 个槽位有效
+	Globals         []value.Slot
+	Frames          []Frame // 预先分配的调用栈，最内层在最后
+	Constants       []value.Value
+	MemoryLimit     uint64                   // 单次运行允许分配的字节数上限，0 表示不限制
+	MemoryUsed      uint64                   // 本次运行已分配的字节数
+	Strict          bool                     // 为 true 时条件跳转和 ! 只接受 bool，and、or 的结果由严格模式编译的 OP_TEST_BOOL 检查
+	Imported        map[*value.Module]bool   // 已执行过顶层代码的模块
+	Strings         map[string]*value.String // 驻留的常量和名字，运行时产生的同内容字符串复用其中的对象
+	Steps           uint64                   // 已执行的指令数
+	sp              uint64                   // 栈顶的下一个槽位
+	openUpvalues    []*value.Upvalue         // 仍指向栈上变量的 upvalue，按 Index 升序排列
+	stackAllocated  uint64                   // 已计入内存的栈槽位数，预先分配的不计入
+	framesAllocated uint64                   // 已计入内存的栈帧数，预先分配的不计入
 }
 
 func New(code []uint8, constants []value.Value, globalCount int) *VM {
@@ -23,49 +38,103 @@ func New(code []uint8, constants []value.Value, globalCount int) *VM {
 		NumParams:   0,
 		NumUpvalues: 0,
 	}
-	mainClosure := &value.Closure{
-		Function: mainFunction,
-	}
-	mainFrame := NewFrame(mainClosure, 0)
-	return &VM{
-		Stack:     []value.Value{},
-		Globals:   make([]value.Value, globalCount),
-		Frames:    []*Frame{mainFrame},
+	return NewFromFunction(mainFunction, constants, globalCount)
+}
+
+// NewFromFunction 使用编译得到的 main 函数创建虚拟机，保留其中的行号和异常处理表
+func NewFromFunction(mainFunction *value.Function, constants []value.Value, globalCount int) *VM {
+	mainClosure := value.NewClosure(mainFunction)
+	frames := make([]Frame, 0, FramesSize)
+	frames = append(frames, NewFrame(mainClosure, 0, 0))
+	vm := &VM{
+		Stack:     make([]value.Slot, StackSize),
+		Globals:   make([]value.Slot, globalCount),
+		Frames:    frames,
 		Constants: constants,
+		Imported:  map[*value.Module]bool{},
+		Strings:   map[string]*value.String{},
+	}
+	vm.stackAllocated = uint64(len(vm.Stack))
+	vm.framesAllocated = uint64(cap(vm.Frames))
+	for i := range vm.Globals {
+		vm.Globals[i] = value.NilSlot()
+	}
+	for i, constant := range constants {
+		if _constant, ok := constant.(*value.String); ok {
+			if interned, ok := vm.Strings[_constant.Literal]; ok {
+				vm.Constants[i] = interned
+			} else {
+				vm.Strings[_constant.Literal] = _constant
+			}
+		}
 	}
+	return vm
 }
 
+// Run 执行程序，main 函数编译为寄存器指令时用寄存器执行器，否则用栈式执行器
 func (vm *VM) Run() error {
+	run := vm.run
+	if vm.Frames[0].Closure.Function.Instructions != nil {
+		run = vm.runRegister
+	}
+	for {
+		err := run()
+		if err == nil {
+			return nil
+		}
+		// 异常被脚本捕获后从处理代码处继续执行
+		err = vm.Throw(err)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (vm *VM) run() error {
 	frame := vm.FramesTop()
-	for frame.Ip < frame.CodeSize() {
-		op := frame.Opcode()
+	// 当前函数的字节码和 ip 缓存在局部变量中，切换栈帧时才写回 Frame
+	code := frame.Closure.Function.Code
+	ip := frame.Ip
+	defer func() {
+		vm.FramesTop().Ip = ip
+	}()
+	for ip < uint64(len(code)) {
+		op := code[ip]
+		ip++
+		vm.Steps++
+		var operand uint64
+		var overload *value.Closure // 运算数是实例时它的类重载该运算的方法
+		if width := opcode.Table[op].Width; width > 0 {
+			operand = readOperand(code[ip:], width)
+			ip += uint64(width)
+		}
 		switch op {
 		case opcode.OP_CONSTANT, opcode.OP_CONSTANT_2, opcode.OP_CONSTANT_4, opcode.OP_CONSTANT_8:
-			globalIndex, err := frame.Operand(op)
-			if err != nil {
-				return err
-			}
-			global := vm.Constants[globalIndex]
-			err = vm.StackPushConstant(global)
+			globalIndex := operand
+			constant := vm.Constants[globalIndex]
+			err := vm.StackPushConstant(constant)
 			if err != nil {
 				return err
 			}
 		case opcode.OP_TRUE:
-			r := value.NewBool(true)
-			vm.StackPush(r)
+			vm.StackPush(value.BoolSlot(true))
 		case opcode.OP_FALSE:
-			r := value.NewBool(false)
-			vm.StackPush(r)
+			vm.StackPush(value.BoolSlot(false))
 		case opcode.OP_NIL:
-			r := value.NewNil()
-			vm.StackPush(r)
+			vm.StackPush(value.NilSlot())
 		case opcode.OP_NEGATE:
+			if overload = vm.operator("__neg__", 0); overload != nil {
+				break
+			}
 			a := vm.StackPop()
 			err := vm.StackPushNegate(a)
 			if err != nil {
 				return err
 			}
 		case opcode.OP_ADD:
+			if overload = vm.operator("__add__", 1); overload != nil {
+				break
+			}
 			b := vm.StackPop()
 			a := vm.StackPop()
 			err := vm.StackPushAdd(a, b)
@@ -73,6 +142,9 @@ func (vm *VM) Run() error {
 				return err
 			}
 		case opcode.OP_SUBTRACT:
+			if overload = vm.operator("__sub__", 1); overload != nil {
+				break
+			}
 			b := vm.StackPop()
 			a := vm.StackPop()
 			err := vm.StackPushSubtract(a, b)
@@ -80,6 +152,9 @@ func (vm *VM) Run() error {
 				return err
 			}
 		case opcode.OP_MULTIPLY:
+			if overload = vm.operator("__mul__", 1); overload != nil {
+				break
+			}
 			b := vm.StackPop()
 			a := vm.StackPop()
 			err := vm.StackPushMultiply(a, b)
@@ -87,6 +162,9 @@ func (vm *VM) Run() error {
 				return err
 			}
 		case opcode.OP_DIVIDE:
+			if overload = vm.operator("__div__", 1); overload != nil {
+				break
+			}
 			b := vm.StackPop()
 			a := vm.StackPop()
 			err := vm.StackPushDivide(a, b)
@@ -94,6 +172,9 @@ func (vm *VM) Run() error {
 				return err
 			}
 		case opcode.OP_MODULO:
+			if overload = vm.operator("__mod__", 1); overload != nil {
+				break
+			}
 			b := vm.StackPop()
 			a := vm.StackPop()
 			err := vm.StackPushModulo(a, b)
@@ -101,133 +182,212 @@ func (vm *VM) Run() error {
 				return err
 			}
 		case opcode.OP_NOT:
-			a := vm.StackPop()
-			err := vm.StackPushNot(a)
+			cond, err := vm.truthy(vm.StackPop())
 			if err != nil {
-				return err
+				return ErrInvalidOperandType
 			}
+			vm.StackPush(value.BoolSlot(!cond))
 		case opcode.OP_EQ:
+			if overload = vm.operator("__eq__", 1); overload != nil {
+				break
+			}
 			b := vm.StackPop()
 			a := vm.StackPop()
-			err := vm.StackPushEQ(a, b)
-			if err != nil {
-				return err
-			}
+			vm.StackPush(value.BoolSlot(valuesEqual(a, b)))
 		case opcode.OP_GT:
+			if overload = vm.operator("__gt__", 1); overload != nil {
+				break
+			}
 			b := vm.StackPop()
 			a := vm.StackPop()
-			err := vm.StackPushGT(a, b)
+			err := vm.StackPushCompare(opcode.OP_GT, a, b)
 			if err != nil {
 				return err
 			}
 		case opcode.OP_LT:
+			if overload = vm.operator("__lt__", 1); overload != nil {
+				break
+			}
 			b := vm.StackPop()
 			a := vm.StackPop()
-			err := vm.StackPushLT(a, b)
+			err := vm.StackPushCompare(opcode.OP_LT, a, b)
 			if err != nil {
 				return err
 			}
 		case opcode.OP_GE:
+			if overload = vm.operator("__ge__", 1); overload != nil {
+				break
+			}
 			b := vm.StackPop()
 			a := vm.StackPop()
-			err := vm.StackPushGE(a, b)
+			err := vm.StackPushCompare(opcode.OP_GE, a, b)
 			if err != nil {
 				return err
 			}
 		case opcode.OP_LE:
+			if overload = vm.operator("__le__", 1); overload != nil {
+				break
+			}
 			b := vm.StackPop()
 			a := vm.StackPop()
-			err := vm.StackPushLE(a, b)
+			err := vm.StackPushCompare(opcode.OP_LE, a, b)
 			if err != nil {
 				return err
 			}
 		case opcode.OP_POP:
 			vm.StackPop()
 		case opcode.OP_PRINT:
+			if overload = vm.operator("__str__", 0); overload != nil {
+				// __str__ 返回后再次执行 OP_PRINT 打印它的返回值
+				ip--
+				break
+			}
 			a := vm.StackPop()
 			err := a.Print(Output)
 			if err != nil {
 				return err
 			}
 		case opcode.OP_SET_GLOBAL:
-			globalIndex, err := frame.Operand(op)
-			if err != nil {
-				return err
-			}
+			globalIndex := operand
 			globalValue := vm.StackPop()
 			vm.Globals[globalIndex] = globalValue
+		case opcode.OP_TEE_GLOBAL:
+			globalIndex := operand
+			vm.Globals[globalIndex] = vm.StackPeek(0)
 		case opcode.OP_GET_GLOBAL:
-			globalIndex, err := frame.Operand(op)
-			if err != nil {
-				return err
-			}
+			globalIndex := operand
 			globalValue := vm.Globals[globalIndex]
 			vm.StackPush(globalValue)
-		case opcode.OP_SET_LOCAL:
-			localIndex, err := frame.Operand(op)
-			if err != nil {
-				return err
+		case opcode.OP_GET_BUILTIN:
+			vm.StackPush(builtins[operand])
+		case opcode.OP_TEST_BOOL:
+			if vm.StackPeek(0).Type != value.TypeBool {
+				return ErrInvalidOperandType
 			}
+		case opcode.OP_SET_LOCAL:
+			localIndex := operand
+			stackIndex := frame.BasePointer + localIndex
+			value_ := vm.StackPop()
+			vm.StackSet(stackIndex, value_)
+		case opcode.OP_TEE_LOCAL:
+			localIndex := operand
 			stackIndex := frame.BasePointer + localIndex
 			value_ := vm.StackPop()
 			vm.StackSet(stackIndex, value_)
+			vm.StackPush(value_)
 		case opcode.OP_GET_LOCAL:
-			localIndex, err := frame.Operand(op)
-			if err != nil {
-				return err
-			}
+			localIndex := operand
 			stackIndex := frame.BasePointer + localIndex
 			value_ := vm.StackGet(stackIndex)
 			vm.StackPush(value_)
 		case opcode.OP_JUMP_FALSE:
-			offset, err := frame.Operand(op)
+			offset := operand
+			cond, err := vm.truthy(vm.StackPeek(0))
 			if err != nil {
 				return err
 			}
-			cond := vm.StackPeek(0)
-			switch _cond := cond.(type) {
-			case *value.Bool:
-				if !_cond.Literal {
-					frame.MoveIp(offset)
-				}
-			default:
-				return ErrInvalidCondType
+			if !cond {
+				ip += offset
 			}
-		case opcode.OP_JUMP:
-			offset, err := frame.Operand(op)
+		case opcode.OP_JUMP_TRUE:
+			offset := operand
+			cond, err := vm.truthy(vm.StackPeek(0))
 			if err != nil {
 				return err
 			}
-			frame.MoveIp(offset)
+			if cond {
+				ip += offset
+			}
+		case opcode.OP_JUMP:
+			ip += operand
 		case opcode.OP_LOOP:
-			offset, err := frame.Operand(op)
+			ip -= operand
+		case opcode.OP_CALL, opcode.OP_INVOKE:
+			var err error
+			frame.Ip = ip
+			if op == opcode.OP_INVOKE {
+				err = vm.invoke(&frame.Closure.Caches[operand>>8], operand&0xff)
+			} else if closure, ok := vm.StackPeek(operand).Object.(*value.Closure); ok {
+				err = vm.call(closure, operand)
+			} else {
+				err = vm.callValue(operand)
+			}
 			if err != nil {
 				return err
 			}
-			frame.MoveIp(-offset)
-		case opcode.OP_CALL:
-			argCount, err := frame.Operand(op)
+			// 调用类而没有 init 方法时不压入栈帧，栈顶仍是当前栈帧
+			frame = vm.FramesTop()
+			code = frame.Closure.Function.Code
+			ip = frame.Ip
+		case opcode.OP_TAIL_CALL:
+			argCount := operand
+			frame.Ip = ip
+			frames := len(vm.Frames)
+			_closure, err := vm.callable(argCount)
 			if err != nil {
 				return err
 			}
-			closure := vm.StackPeek(argCount)
-			_closure, ok := closure.(*value.Closure)
-			if !ok {
-				return ErrInvalidCallType
+			if len(vm.Frames) > frames {
+				// 内置函数压入了访问器的栈帧，当前函数在它返回后随之返回
+				frame = vm.FramesTop()
+				frame.Tail = true
+				code = frame.Closure.Function.Code
+				ip = frame.Ip
+				continue
+			}
+			callee := frame.Callee()
+			if _closure == nil {
+				// 调用类不执行代码，直接返回创建的实例
+				err = vm.returnFrom(vm.StackPop())
+				frame = vm.FramesTop()
+				code = frame.Closure.Function.Code
+				ip = frame.Ip
+				if err != nil {
+					return err
+				}
+				continue
 			}
-			basePointer := vm.StackLen() - argCount
-			frame = NewFrame(_closure, basePointer)
-			vm.FramesPush(frame)
+			err = vm.StackAdjustArgs(_closure.Function, argCount)
+			if err != nil {
+				return err
+			}
+			// 当前函数的局部变量不再需要，把被调用的值和参数移到当前栈帧的位置，再替换当前栈帧。
+			// 方法的 this 已经替换了被调用的值
+			slots := _closure.Function.NumArgSlots()
+			start := vm.StackLen() - slots
+			if !_closure.Function.Method {
+				start--
+			}
+			length := vm.sp - start
+			vm.UpvaluesClose(frame.BasePointer)
+			copy(vm.Stack[callee:], vm.Stack[start:vm.sp])
+			vm.StackResize(callee + length)
+			discard, invoke, tail := frame.Discard, frame.Invoke, frame.Tail
+			*frame = NewFrame(_closure, callee+length-slots, argCount)
+			frame.Discard, frame.Invoke, frame.Tail = discard, invoke, tail
+			code = _closure.Function.Code
+			ip = 0
 		case opcode.OP_RETURN:
 			result := vm.StackPop()
-			vm.StackResize(frame.BasePointer)
+			if frame.Discard || frame.Invoke != 0 || frame.Tail {
+				err := vm.returnFrom(result)
+				frame = vm.FramesTop()
+				code = frame.Closure.Function.Code
+				ip = frame.Ip
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			vm.UpvaluesClose(frame.BasePointer)
+			// 同时弹出被调用的值
+			vm.StackResize(frame.Callee())
 			vm.StackPush(result)
 			frame = vm.FramesPop()
+			code = frame.Closure.Function.Code
+			ip = frame.Ip
 		case opcode.OP_CLOSURE, opcode.OP_CLOSURE_2, opcode.OP_CLOSURE_4, opcode.OP_CLOSURE_8:
-			functionIndex, err := frame.Operand(op)
-			if err != nil {
-				return err
-			}
+			functionIndex := operand
 			function := vm.Constants[functionIndex]
 			_function, ok := function.(*value.Function)
 			if !ok {
@@ -235,48 +395,229 @@ func (vm *VM) Run() error {
 			}
 			closure := value.NewClosure(_function)
 			for i := uint64(0); i < _function.NumUpvalues; i++ {
-				isLocal := frame.CodeNext()
-				index := frame.CodeNext()
+				isLocal := code[ip]
+				index := code[ip+1]
+				ip += 2
 				if isLocal == 1 {
 					localIndex := index
 					stackIndex := frame.BasePointer + uint64(localIndex)
-					upvalue := vm.StackGet(stackIndex)
-					closure.Upvalues[i] = upvalue
+					closure.Upvalues[i] = vm.UpvalueCapture(stackIndex)
 				} else {
 					upvalueIndex := index
 					upvalue := frame.Closure.Upvalues[upvalueIndex]
 					closure.Upvalues[i] = upvalue
 				}
 			}
-			vm.StackPush(closure)
-		case opcode.OP_SET_UPVALUE:
-			upvalueIndex, err := frame.Operand(op)
+			err := vm.StackPushAlloc(closure)
 			if err != nil {
 				return err
 			}
+		case opcode.OP_SET_UPVALUE:
+			upvalueIndex := operand
 			value_ := vm.StackPop()
 			upvalue := frame.Closure.Upvalues[upvalueIndex]
-			upvalue.SetLiteral(value_.GetLiteral())
+			if upvalue.Open {
+				vm.Stack[upvalue.Index] = value_
+			} else {
+				upvalue.Closed = value_
+			}
 		case opcode.OP_GET_UPVALUE:
-			upvalueIndex, err := frame.Operand(op)
+			upvalueIndex := operand
+			upvalue := frame.Closure.Upvalues[upvalueIndex]
+			if upvalue.Open {
+				vm.StackPush(vm.Stack[upvalue.Index])
+			} else {
+				vm.StackPush(upvalue.Closed)
+			}
+		case opcode.OP_CLOSE_UPVALUE:
+			localIndex := operand
+			vm.UpvaluesClose(frame.BasePointer + localIndex)
+		case opcode.OP_THROW:
+			a := vm.StackPop()
+			return &Exception{
+				Value: a.Box(),
+				Line:  frame.Closure.Function.LineOf(ip - 1),
+			}
+		case opcode.OP_GET_PROPERTY:
+			object := vm.StackPeek(0)
+			r, getter, err := vm.getProperty(object, &frame.Closure.Caches[operand])
 			if err != nil {
 				return err
 			}
-			value_ := frame.Closure.Upvalues[upvalueIndex]
-			vm.StackPush(value_)
+			if getter == nil {
+				vm.Stack[vm.sp-1] = r
+				continue
+			}
+			// 对象留在栈顶作为 get 访问器的 this，返回值替换它
+			frame.Ip = ip
+			err = vm.call(getter, 0)
+			if err != nil {
+				return err
+			}
+			frame = vm.FramesTop()
+			code = getter.Function.Code
+			ip = 0
+		case opcode.OP_SET_PROPERTY:
+			value_ := vm.StackPeek(0)
+			object := vm.StackPeek(1)
+			setter, err := vm.setProperty(object, value_, &frame.Closure.Caches[operand])
+			if err != nil {
+				return err
+			}
+			if setter == nil {
+				vm.StackResize(vm.sp - 2)
+				continue
+			}
+			// 对象和值留在栈顶作为 set 访问器的 this 和参数，返回值被丢弃
+			frame.Ip = ip
+			err = vm.call(setter, 1)
+			if err != nil {
+				return err
+			}
+			frame = vm.FramesTop()
+			frame.Discard = true
+			code = setter.Function.Code
+			ip = 0
+		case opcode.OP_CLASS:
+			name, ok := vm.Constants[operand].(*value.String)
+			if !ok {
+				return ErrInvalidOperandType
+			}
+			err := vm.StackPushAlloc(value.NewClass(name.Literal))
+			if err != nil {
+				return err
+			}
+		case opcode.OP_INHERIT:
+			class := vm.StackPop().Object.(*value.Class)
+			super, ok := vm.StackPeek(0).Object.(*value.Class)
+			if !ok {
+				return ErrNotClass
+			}
+			class.Inherit(super)
+		case opcode.OP_METHOD, opcode.OP_STATIC, opcode.OP_GETTER, opcode.OP_SETTER:
+			name, ok := vm.Constants[operand].(*value.String)
+			if !ok {
+				return ErrInvalidOperandType
+			}
+			method := vm.StackPop().Object.(*value.Closure)
+			if trait, ok := vm.StackPeek(0).Object.(*value.Trait); ok {
+				trait.Methods[name.Literal] = method
+				continue
+			}
+			class := vm.StackPeek(0).Object.(*value.Class)
+			methods := class.Methods
+			switch op {
+			case opcode.OP_STATIC:
+				methods = class.Statics
+			case opcode.OP_GETTER:
+				methods = class.Getters
+			case opcode.OP_SETTER:
+				methods = class.Setters
+			}
+			methods[name.Literal] = method
+		case opcode.OP_TRAIT:
+			name, ok := vm.Constants[operand].(*value.String)
+			if !ok {
+				return ErrInvalidOperandType
+			}
+			err := vm.StackPushAlloc(value.NewTrait(name.Literal))
+			if err != nil {
+				return err
+			}
+		case opcode.OP_WITH:
+			trait, ok := vm.StackPop().Object.(*value.Trait)
+			if !ok {
+				return ErrNotTrait
+			}
+			// trait 的方法覆盖继承的方法，之后加入的类自身的方法又覆盖它们
+			class := vm.StackPeek(0).Object.(*value.Class)
+			for name, method := range trait.Methods {
+				class.Methods[name] = method
+			}
+		case opcode.OP_GET_SUPER:
+			name, ok := vm.Constants[operand].(*value.String)
+			if !ok {
+				return ErrInvalidOperandType
+			}
+			super := vm.StackPop().Object.(*value.Class)
+			this := vm.StackPop()
+			method, ok := super.Methods[name.Literal]
+			if !ok {
+				return ErrUndefinedProperty
+			}
+			err := vm.StackPushAlloc(value.NewBoundMethod(this, method))
+			if err != nil {
+				return err
+			}
+		case opcode.OP_MISSING_ARG:
+			paramIndex := operand
+			vm.StackPush(value.BoolSlot(frame.ArgCount <= paramIndex))
+		case opcode.OP_INDEX:
+			if overload = vm.operator("__index__", 1); overload != nil {
+				break
+			}
+			index := vm.StackPop()
+			object := vm.StackPop()
+			err := vm.StackPushIndex(object, index)
+			if err != nil {
+				return err
+			}
+		case opcode.OP_IMPORT:
+			moduleIndex := operand
+			module, ok := vm.Constants[moduleIndex].(*value.Module)
+			if !ok {
+				return ErrInvalidOperandType
+			}
+			if vm.Imported[module] {
+				vm.StackPush(value.SlotOf(module))
+			} else {
+				// 首次导入时执行模块的顶层代码，它返回模块自身
+				vm.Imported[module] = true
+				closure := value.NewClosure(module.Function)
+				err := vm.StackPushAlloc(closure)
+				if err != nil {
+					return err
+				}
+				frame.Ip = ip
+				err = vm.FramesPush(NewFrame(closure, vm.StackLen(), 0))
+				if err != nil {
+					return err
+				}
+				frame = vm.FramesTop()
+				code = closure.Function.Code
+				ip = 0
+			}
 		default:
 			return ErrInvalidOpcodeType
 		}
+		if overload != nil {
+			// 运算数已按 this 和参数的顺序位于栈顶，方法的返回值替换它们
+			argCount := uint64(1)
+			if op == opcode.OP_NEGATE || op == opcode.OP_PRINT {
+				argCount = 0
+			}
+			frame.Ip = ip
+			err := vm.call(overload, argCount)
+			if err != nil {
+				return err
+			}
+			frame = vm.FramesTop()
+			code = overload.Function.Code
+			ip = 0
+		}
 	}
 	return nil
 }
 
+// FramesTop 返回当前栈帧。Frames 扩容后之前返回的指针失效，压入栈帧后要重新获取
 func (vm *VM) FramesTop() *Frame {
-	return vm.Frames[len(vm.Frames)-1]
+	return &vm.Frames[len(vm.Frames)-1]
 }
 
-func (vm *VM) FramesPush(frame *Frame) {
+// FramesPush 压入 frame，并统计栈和调用栈增长占用的内存
+func (vm *VM) FramesPush(frame Frame) error {
 	vm.Frames = append(vm.Frames, frame)
+	return vm.allocateStacks()
 }
 
 func (vm *VM) FramesPop() *Frame {
@@ -284,454 +625,172 @@ func (vm *VM) FramesPop() *Frame {
 	return vm.FramesTop()
 }
 
-func (vm *VM) StackPush(value_ value.Value) {
-	vm.Stack = append(vm.Stack, value_)
+func (vm *VM) StackPush(slot value.Slot) {
+	if vm.sp == uint64(len(vm.Stack)) {
+		vm.Stack = append(vm.Stack, make([]value.Slot, len(vm.Stack))...)
+	}
+	vm.Stack[vm.sp] = slot
+	vm.sp++
 }
 
-func (vm *VM) StackPop() value.Value {
-	offset := len(vm.Stack) - 1
-	value_ := vm.Stack[offset]
-	vm.Stack = vm.Stack[:offset]
-	return value_
+func (vm *VM) StackPop() value.Slot {
+	vm.sp--
+	return vm.Stack[vm.sp]
 }
 
-func (vm *VM) StackPeek(num uint64) value.Value {
-	return vm.Stack[uint64(len(vm.Stack))-1-num]
+func (vm *VM) StackPeek(num uint64) value.Slot {
+	return vm.Stack[vm.sp-1-num]
 }
 
-func (vm *VM) StackSet(index uint64, value_ value.Value) {
-	if vm.StackLen() == index {
-		vm.StackPush(value_)
+func (vm *VM) StackSet(index uint64, slot value.Slot) {
+	if vm.sp == index {
+		vm.StackPush(slot)
 	} else {
-		vm.Stack[index] = value_
+		vm.Stack[index] = slot
 	}
 }
 
-func (vm *VM) StackGet(index uint64) value.Value {
+func (vm *VM) StackGet(index uint64) value.Slot {
 	return vm.Stack[index]
 }
 
 func (vm *VM) StackLen() uint64 {
-	return uint64(len(vm.Stack))
+	return vm.sp
 }
 
 func (vm *VM) StackResize(basePointer uint64) {
-	vm.Stack = vm.Stack[:basePointer]
+	vm.sp = basePointer
 }
 
-func (vm *VM) StackPushConstant(global value.Value) error {
-	switch global.(type) {
-	case *value.Int, *value.Float, *value.String:
-		vm.StackPush(global)
-		return nil
-	default:
-		return ErrInvalidOperandType
+// UpvalueCapture 返回指向栈上下标为 index 的变量的 upvalue，
+// 同一个变量只有一个打开的 upvalue，捕获它的闭包共享对它的修改
+func (vm *VM) UpvalueCapture(index uint64) *value.Upvalue {
+	i := len(vm.openUpvalues)
+	for i > 0 && vm.openUpvalues[i-1].Index >= index {
+		if vm.openUpvalues[i-1].Index == index {
+			return vm.openUpvalues[i-1]
+		}
+		i--
 	}
-}
-
-func (vm *VM) StackPushNegate(a value.Value) error {
-	switch _a := a.(type) {
-	case *value.Int:
-		r := value.NewInt(-_a.Literal)
-		vm.StackPush(r)
-		return nil
-	case *value.Float:
-		r := value.NewFloat(-_a.Literal)
-		vm.StackPush(r)
-		return nil
-	default:
-		return ErrInvalidOperandType
+	upvalue := &value.Upvalue{
+		Index: index,
+		Open:  true,
 	}
+	vm.openUpvalues = append(vm.openUpvalues, nil)
+	copy(vm.openUpvalues[i+1:], vm.openUpvalues[i:])
+	vm.openUpvalues[i] = upvalue
+	return upvalue
 }
 
-func (vm *VM) StackPushAdd(a value.Value, b value.Value) error {
-	switch _a := a.(type) {
-	case *value.Int:
-		switch _b := b.(type) {
-		case *value.Int:
-			r := value.NewInt(_a.Literal + _b.Literal)
-			vm.StackPush(r)
-			return nil
-		case *value.Float:
-			r := value.NewFloat(float64(_a.Literal) + _b.Literal)
-			vm.StackPush(r)
-			return nil
-		default:
-			return ErrInvalidOperandType
-		}
-	case *value.Float:
-		switch _b := b.(type) {
-		case *value.Int:
-			r := value.NewFloat(_a.Literal + float64(_b.Literal))
-			vm.StackPush(r)
-			return nil
-		case *value.Float:
-			r := value.NewFloat(_a.Literal + _b.Literal)
-			vm.StackPush(r)
-			return nil
-		default:
-			return ErrInvalidOperandType
-		}
-	case *value.String:
-		switch _b := b.(type) {
-		case *value.String:
-			r := value.NewString(_a.Literal + _b.Literal)
-			vm.StackPush(r)
-			return nil
-		default:
-			return ErrInvalidOperandType
+// UpvaluesClose 关闭指向栈上下标不小于 from 的变量的 upvalue，把变量的值移到 upvalue 中
+func (vm *VM) UpvaluesClose(from uint64) {
+	i := len(vm.openUpvalues)
+	for i > 0 && vm.openUpvalues[i-1].Index >= from {
+		upvalue := vm.openUpvalues[i-1]
+		upvalue.Closed = value.NilSlot()
+		if upvalue.Index < vm.sp {
+			upvalue.Closed = vm.Stack[upvalue.Index]
 		}
-	default:
-		return ErrInvalidOperandType
+		upvalue.Open = false
+		i--
 	}
+	vm.openUpvalues = vm.openUpvalues[:i]
 }
 
-func (vm *VM) StackPushSubtract(a value.Value, b value.Value) error {
-	switch _a := a.(type) {
-	case *value.Int:
-		switch _b := b.(type) {
-		case *value.Int:
-			r := value.NewInt(_a.Literal - _b.Literal)
-			vm.StackPush(r)
-			return nil
-		case *value.Float:
-			r := value.NewFloat(float64(_a.Literal) - _b.Literal)
-			vm.StackPush(r)
-			return nil
-		default:
-			return ErrInvalidOperandType
-		}
-	case *value.Float:
-		switch _b := b.(type) {
-		case *value.Int:
-			r := value.NewFloat(_a.Literal - float64(_b.Literal))
-			vm.StackPush(r)
-			return nil
-		case *value.Float:
-			r := value.NewFloat(_a.Literal - _b.Literal)
-			vm.StackPush(r)
-			return nil
-		default:
-			return ErrInvalidOperandType
-		}
-	default:
-		return ErrInvalidOperandType
-	}
+// StackPushString 把内容为 literal 的驻留字符串入栈，第一次出现时才分配
+func (vm *VM) StackPushString(literal string) error {
+	return vm.stackPushResult(vm.intern(literal))
 }
 
-func (vm *VM) StackPushMultiply(a value.Value, b value.Value) error {
-	switch _a := a.(type) {
-	case *value.Int:
-		switch _b := b.(type) {
-		case *value.Int:
-			r := value.NewInt(_a.Literal * _b.Literal)
-			vm.StackPush(r)
-			return nil
-		case *value.Float:
-			r := value.NewFloat(float64(_a.Literal) * _b.Literal)
-			vm.StackPush(r)
-			return nil
-		default:
-			return ErrInvalidOperandType
-		}
-	case *value.Float:
-		switch _b := b.(type) {
-		case *value.Int:
-			r := value.NewFloat(_a.Literal * float64(_b.Literal))
-			vm.StackPush(r)
-			return nil
-		case *value.Float:
-			r := value.NewFloat(_a.Literal * _b.Literal)
-			vm.StackPush(r)
-			return nil
-		default:
-			return ErrInvalidOperandType
-		}
-	default:
-		return ErrInvalidOperandType
-	}
+func (vm *VM) StackPushConstant(constant value.Value) error {
+	return vm.stackPushResult(slotOfConstant(constant))
 }
 
-func (vm *VM) StackPushDivide(a value.Value, b value.Value) error {
-	switch _a := a.(type) {
-	case *value.Int:
-		switch _b := b.(type) {
-		case *value.Int:
-			if _b.Literal == 0 {
-				return ErrZeroInDivide
-			}
-			r := value.NewInt(_a.Literal / _b.Literal)
-			vm.StackPush(r)
-			return nil
-		case *value.Float:
-			if _b.Literal == 0 {
-				return ErrZeroInDivide
-			}
-			r := value.NewFloat(float64(_a.Literal) / _b.Literal)
-			vm.StackPush(r)
-			return nil
-		default:
-			return ErrInvalidOperandType
-		}
-	case *value.Float:
-		switch _b := b.(type) {
-		case *value.Int:
-			if _b.Literal == 0 {
-				return ErrZeroInDivide
-			}
-			r := value.NewFloat(_a.Literal / float64(_b.Literal))
-			vm.StackPush(r)
-			return nil
-		case *value.Float:
-			if _b.Literal == 0 {
-				return ErrZeroInDivide
-			}
-			r := value.NewFloat(_a.Literal / _b.Literal)
-			vm.StackPush(r)
-			return nil
-		default:
-			return ErrInvalidOperandType
-		}
-	default:
-		return ErrInvalidOperandType
-	}
+func (vm *VM) StackPushProperty(object value.Slot, name string) error {
+	return vm.stackPushResult(vm.property(object, name))
 }
 
-func (vm *VM) StackPushModulo(a value.Value, b value.Value) error {
-	switch _a := a.(type) {
-	case *value.Int:
-		switch _b := b.(type) {
-		case *value.Int:
-			if _b.Literal == 0 {
-				return ErrZeroInModulo
-			}
-			r := value.NewInt(_a.Literal % _b.Literal)
-			vm.StackPush(r)
-			return nil
-		case *value.Float:
-			if _b.Literal == 0 {
-				return ErrZeroInModulo
-			}
-			r := value.NewFloat(math.Mod(float64(_a.Literal), _b.Literal))
-			vm.StackPush(r)
-			return nil
-		default:
-			return ErrInvalidOperandType
-		}
-	case *value.Float:
-		switch _b := b.(type) {
-		case *value.Int:
-			if _b.Literal == 0 {
-				return ErrZeroInModulo
-			}
-			r := value.NewFloat(math.Mod(_a.Literal, float64(_b.Literal)))
-			vm.StackPush(r)
-			return nil
-		case *value.Float:
-			if _b.Literal == 0 {
-				return ErrZeroInModulo
-			}
-			r := value.NewFloat(math.Mod(_a.Literal, _b.Literal))
-			vm.StackPush(r)
-			return nil
-		default:
-			return ErrInvalidOperandType
-		}
-	default:
-		return ErrInvalidOperandType
-	}
+func (vm *VM) StackPushIndex(object value.Slot, index value.Slot) error {
+	return vm.stackPushResult(indexOf(object, index))
 }
 
-func (vm *VM) StackPushNot(a any) error {
-	switch _a := a.(type) {
-	case *value.Bool:
-		r := value.NewBool(!_a.Literal)
-		vm.StackPush(r)
-		return nil
-	default:
-		return ErrInvalidOperandType
-	}
+func (vm *VM) StackPushNegate(a value.Slot) error {
+	return vm.stackPushResult(negate(a))
 }
 
-func (vm *VM) StackPushEQ(a any, b any) error {
-	switch _a := a.(type) {
-	case *value.Int:
-		switch _b := b.(type) {
-		case *value.Int:
-			r := value.NewBool(_a.Literal == _b.Literal)
-			vm.StackPush(r)
-			return nil
-		case *value.Float:
-			r := value.NewBool(float64(_a.Literal) == _b.Literal)
-			vm.StackPush(r)
-			return nil
-		default:
-			return ErrInvalidOperandType
-		}
-	case *value.Float:
-		switch _b := b.(type) {
-		case *value.Int:
-			r := value.NewBool(_a.Literal == float64(_b.Literal))
-			vm.StackPush(r)
-			return nil
-		case *value.Float:
-			r := value.NewBool(_a.Literal == _b.Literal)
-			vm.StackPush(r)
-			return nil
-		default:
-			return ErrInvalidOperandType
-		}
-	case *value.Bool:
-		switch _b := b.(type) {
-		case *value.Bool:
-			r := value.NewBool(_a.Literal == _b.Literal)
-			vm.StackPush(r)
-			return nil
-		default:
-			return ErrInvalidOperandType
-		}
-	case *value.Nil:
-		switch b.(type) {
-		case *value.Nil:
-			r := value.NewBool(true)
-			vm.StackPush(r)
-			return nil
-		default:
-			return ErrInvalidOperandType
-		}
-	default:
-		return ErrInvalidOperandType
-	}
+func (vm *VM) StackPushAdd(a value.Slot, b value.Slot) error {
+	return vm.stackPushResult(vm.add(a, b))
 }
 
-func (vm *VM) StackPushGT(a any, b any) error {
-	switch _a := a.(type) {
-	case *value.Int:
-		switch _b := b.(type) {
-		case *value.Int:
-			r := value.NewBool(_a.Literal > _b.Literal)
-			vm.StackPush(r)
-			return nil
-		case *value.Float:
-			r := value.NewBool(float64(_a.Literal) > _b.Literal)
-			vm.StackPush(r)
-			return nil
-		default:
-			return ErrInvalidOperandType
-		}
-	case *value.Float:
-		switch _b := b.(type) {
-		case *value.Int:
-			r := value.NewBool(_a.Literal > float64(_b.Literal))
-			vm.StackPush(r)
-			return nil
-		case *value.Float:
-			r := value.NewBool(_a.Literal > _b.Literal)
-			vm.StackPush(r)
-			return nil
-		default:
-			return ErrInvalidOperandType
-		}
-	default:
-		return ErrInvalidOperandType
-	}
+func (vm *VM) StackPushSubtract(a value.Slot, b value.Slot) error {
+	return vm.stackPushResult(subtract(a, b))
 }
 
-func (vm *VM) StackPushLT(a any, b any) error {
-	switch _a := a.(type) {
-	case *value.Int:
-		switch _b := b.(type) {
-		case *value.Int:
-			r := value.NewBool(_a.Literal < _b.Literal)
-			vm.StackPush(r)
-			return nil
-		case *value.Float:
-			r := value.NewBool(float64(_a.Literal) < _b.Literal)
-			vm.StackPush(r)
-			return nil
-		default:
-			return ErrInvalidOperandType
-		}
-	case *value.Float:
-		switch _b := b.(type) {
-		case *value.Int:
-			r := value.NewBool(_a.Literal < float64(_b.Literal))
-			vm.StackPush(r)
-			return nil
-		case *value.Float:
-			r := value.NewBool(_a.Literal < _b.Literal)
-			vm.StackPush(r)
-			return nil
-		default:
-			return ErrInvalidOperandType
-		}
-	default:
-		return ErrInvalidOperandType
+func (vm *VM) StackPushMultiply(a value.Slot, b value.Slot) error {
+	return vm.stackPushResult(multiply(a, b))
+}
+
+func (vm *VM) StackPushDivide(a value.Slot, b value.Slot) error {
+	return vm.stackPushResult(divide(a, b))
+}
+
+func (vm *VM) StackPushModulo(a value.Slot, b value.Slot) error {
+	return vm.stackPushResult(modulo(a, b))
+}
+
+// StackPushCompare 比较 a 和 b 并把结果入栈，op 是 OP_GT、OP_LT、OP_GE 或 OP_LE
+func (vm *VM) StackPushCompare(op uint8, a value.Slot, b value.Slot) error {
+	return vm.stackPushResult(compareSlots(op, a, b))
+}
+
+// stackPushResult 在运算没有出错时把结果入栈
+func (vm *VM) stackPushResult(r value.Slot, err error) error {
+	if err != nil {
+		return err
 	}
+	vm.StackPush(r)
+	return nil
 }
 
-func (vm *VM) StackPushGE(a any, b any) error {
-	switch _a := a.(type) {
-	case *value.Int:
-		switch _b := b.(type) {
-		case *value.Int:
-			r := value.NewBool(_a.Literal >= _b.Literal)
-			vm.StackPush(r)
-			return nil
-		case *value.Float:
-			r := value.NewBool(float64(_a.Literal) >= _b.Literal)
-			vm.StackPush(r)
-			return nil
-		default:
-			return ErrInvalidOperandType
-		}
-	case *value.Float:
-		switch _b := b.(type) {
-		case *value.Int:
-			r := value.NewBool(_a.Literal >= float64(_b.Literal))
-			vm.StackPush(r)
-			return nil
-		case *value.Float:
-			r := value.NewBool(_a.Literal >= _b.Literal)
-			vm.StackPush(r)
-			return nil
-		default:
-			return ErrInvalidOperandType
+// StackAdjustArgs 检查栈顶 argCount 个参数是否符合 function 的参数列表，
+// 为缺少的可选参数补 nil，并把多余的参数收集为 ...rest 参数的列表
+func (vm *VM) StackAdjustArgs(function *value.Function, argCount uint64) error {
+	required := function.NumParams - function.NumOptional
+	if argCount < required || (argCount > function.NumParams && !function.Variadic) {
+		return arityError(function, argCount)
+	}
+	for i := argCount; i < function.NumParams; i++ {
+		vm.StackPush(value.NilSlot())
+	}
+	if !function.Variadic {
+		return nil
+	}
+	var rest []value.Value
+	if argCount > function.NumParams {
+		start := vm.StackLen() - (argCount - function.NumParams)
+		for _, slot := range vm.Stack[start:vm.sp] {
+			rest = append(rest, slot.Box())
 		}
-	default:
-		return ErrInvalidOperandType
+		vm.StackResize(start)
 	}
+	return vm.StackPushAlloc(value.NewList(rest))
 }
 
-func (vm *VM) StackPushLE(a any, b any) error {
-	switch _a := a.(type) {
-	case *value.Int:
-		switch _b := b.(type) {
-		case *value.Int:
-			r := value.NewBool(_a.Literal <= _b.Literal)
-			vm.StackPush(r)
-			return nil
-		case *value.Float:
-			r := value.NewBool(float64(_a.Literal) <= _b.Literal)
-			vm.StackPush(r)
-			return nil
-		default:
-			return ErrInvalidOperandType
-		}
-	case *value.Float:
-		switch _b := b.(type) {
-		case *value.Int:
-			r := value.NewBool(_a.Literal <= float64(_b.Literal))
-			vm.StackPush(r)
-			return nil
-		case *value.Float:
-			r := value.NewBool(_a.Literal <= _b.Literal)
-			vm.StackPush(r)
-			return nil
-		default:
-			return ErrInvalidOperandType
-		}
+// arityError 返回说明 function 期望和实际参数个数的错误
+func arityError(function *value.Function, argCount uint64) error {
+	name := function.Name
+	if name == "" {
+		name = "function"
+	}
+	required := function.NumParams - function.NumOptional
+	var expected string
+	switch {
+	case function.Variadic:
+		expected = fmt.Sprintf("at least %d", required)
+	case function.NumOptional > 0:
+		expected = fmt.Sprintf("%d to %d", required, function.NumParams)
 	default:
-		return ErrInvalidOperandType
+		expected = fmt.Sprintf("%d", required)
 	}
+	return fmt.Errorf("%w: %s expects %s arguments but got %d", ErrNumParamsArgsNotMatch, name, expected, argCount)
 }
@@ -3,326 +3,357 @@ package vm
 import (
 	"bytes"
 	"errors"
-	"reflect"
-	"stmt/ast"
+	"fmt"
+	"io"
 	"stmt/compiler"
+	"stmt/interpreter"
+	"stmt/module"
 	"stmt/parser"
 	"stmt/scanner"
 	"stmt/value"
+	"strconv"
+	"strings"
 	"testing"
+	"testing/fstest"
 )
 
 func TestVM_RunExpr(t *testing.T) {
 	tests := []struct {
-		name     string
-		source   string
-		err      error
-		result   any
-		stackLen int
+		name   string
+		source string
+		err    error
+		result string // 输出的结果
 	}{
 		{
-			name:     "1",
-			source:   "1",
-			err:      nil,
-			result:   value.NewInt(1),
-			stackLen: 1,
+			name:   "1",
+			source: "1",
+			err:    nil,
+			result: "1",
+		},
+		{
+			name:   "1.5",
+			source: "1.5",
+			err:    nil,
+			result: "1.500000",
+		},
+		{
+			name:   `"abc"`,
+			source: `"abc"`,
+			err:    nil,
+			result: "abc",
+		},
+		{
+			name:   "true",
+			source: "true",
+			err:    nil,
+			result: "true",
+		},
+		{
+			name:   "false",
+			source: "false",
+			err:    nil,
+			result: "false",
+		},
+		{
+			name:   "nil",
+			source: "nil",
+			err:    nil,
+			result: "nil",
+		},
+		{
+			name:   "-1",
+			source: "-1",
+			err:    nil,
+			result: "-1",
+		},
+		{
+			name:   "1+2",
+			source: "1+2",
+			err:    nil,
+			result: "3",
+		},
+		{
+			name:   "1-2",
+			source: "1-2",
+			err:    nil,
+			result: "-1",
+		},
+		{
+			name:   "1*2",
+			source: "1*2",
+			err:    nil,
+			result: "2",
+		},
+		{
+			name:   "1_/_2",
+			source: "1/2",
+			err:    nil,
+			result: "0",
+		},
+		{
+			name:   "!true",
+			source: "!true",
+			err:    nil,
+			result: "false",
+		},
+		{
+			name:   "!false",
+			source: "!false",
+			err:    nil,
+			result: "true",
 		},
 		{
-			name:     "1.5",
-			source:   "1.5",
-			err:      nil,
-			result:   value.NewFloat(1.5),
-			stackLen: 1,
+			name:   "1==1",
+			source: "1==1",
+			err:    nil,
+			result: "true",
 		},
 		{
-			name:     `"abc"`,
-			source:   `"abc"`,
-			err:      nil,
-			result:   value.NewString("abc"),
-			stackLen: 1,
+			name:   "1==1.0",
+			source: "1==1.0",
+			err:    nil,
+			result: "true",
 		},
 		{
-			name:     "true",
-			source:   "true",
-			err:      nil,
-			result:   value.NewBool(true),
-			stackLen: 1,
+			name:   "1.0==1",
+			source: "1.0==1",
+			err:    nil,
+			result: "true",
 		},
 		{
-			name:     "false",
-			source:   "false",
-			err:      nil,
-			result:   value.NewBool(false),
-			stackLen: 1,
+			name:   "1.0==1.0",
+			source: "1.0==1.0",
+			err:    nil,
+			result: "true",
 		},
 		{
-			name:     "nil",
-			source:   "nil",
-			err:      nil,
-			result:   value.NewNil(),
-			stackLen: 1,
+			name:   "1==2",
+			source: "1==2",
+			err:    nil,
+			result: "false",
 		},
 		{
-			name:     "-1",
-			source:   "-1",
-			err:      nil,
-			result:   value.NewInt(-1),
-			stackLen: 1,
+			name:   "1.0==2",
+			source: "1.0==2",
+			err:    nil,
+			result: "false",
 		},
 		{
-			name:     "1+2",
-			source:   "1+2",
-			err:      nil,
-			result:   value.NewInt(3),
-			stackLen: 1,
+			name:   "1==2.0",
+			source: "1==2.0",
+			err:    nil,
+			result: "false",
 		},
 		{
-			name:     "1-2",
-			source:   "1-2",
-			err:      nil,
-			result:   value.NewInt(-1),
-			stackLen: 1,
+			name:   "1.0==2.0",
+			source: "1.0==2.0",
+			err:    nil,
+			result: "false",
 		},
 		{
-			name:     "1*2",
-			source:   "1*2",
-			err:      nil,
-			result:   value.NewInt(2),
-			stackLen: 1,
+			name:   "true==true",
+			source: "true==true",
+			err:    nil,
+			result: "true",
 		},
 		{
-			name:     "1_/_2",
-			source:   "1/2",
-			err:      nil,
-			result:   value.NewInt(0),
-			stackLen: 1,
+			name:   "false==false",
+			source: "false==false",
+			err:    nil,
+			result: "true",
 		},
 		{
-			name:     "!true",
-			source:   "!true",
-			err:      nil,
-			result:   value.NewBool(false),
-			stackLen: 1,
+			name:   "true==false",
+			source: "true==false",
+			err:    nil,
+			result: "false",
 		},
 		{
-			name:     "!false",
-			source:   "!false",
-			err:      nil,
-			result:   value.NewBool(true),
-			stackLen: 1,
+			name:   "false==true",
+			source: "false==true",
+			err:    nil,
+			result: "false",
 		},
 		{
-			name:     "1==1",
-			source:   "1==1",
-			err:      nil,
-			result:   value.NewBool(true),
-			stackLen: 1,
+			name:   "nil==nil",
+			source: "nil==nil",
+			err:    nil,
+			result: "true",
 		},
 		{
-			name:     "1==1.0",
-			source:   "1==1.0",
-			err:      nil,
-			result:   value.NewBool(true),
-			stackLen: 1,
+			name:   "1>2",
+			source: "1>2",
+			err:    nil,
+			result: "false",
 		},
 		{
-			name:     "1.0==1",
-			source:   "1.0==1",
-			err:      nil,
-			result:   value.NewBool(true),
-			stackLen: 1,
+			name:   "1<2",
+			source: "1<2",
+			err:    nil,
+			result: "true",
 		},
 		{
-			name:     "1.0==1.0",
-			source:   "1.0==1.0",
-			err:      nil,
-			result:   value.NewBool(true),
-			stackLen: 1,
+			name:   "1>=2",
+			source: "1>=2",
+			err:    nil,
+			result: "false",
 		},
 		{
-			name:     "1==2",
-			source:   "1==2",
-			err:      nil,
-			result:   value.NewBool(false),
-			stackLen: 1,
+			name:   "1<=2",
+			source: "1<=2",
+			err:    nil,
+			result: "true",
 		},
 		{
-			name:     "1.0==2",
-			source:   "1.0==2",
-			err:      nil,
-			result:   value.NewBool(false),
-			stackLen: 1,
+			name:   `"a"+"b"`,
+			source: `"a"+"b"`,
+			err:    nil,
+			result: "ab",
 		},
 		{
-			name:     "1==2.0",
-			source:   "1==2.0",
-			err:      nil,
-			result:   value.NewBool(false),
-			stackLen: 1,
+			name:   "true_and_true",
+			source: "true and true",
+			err:    nil,
+			result: "true",
 		},
 		{
-			name:     "1.0==2.0",
-			source:   "1.0==2.0",
-			err:      nil,
-			result:   value.NewBool(false),
-			stackLen: 1,
+			name:   "true_and_false",
+			source: `true and false`,
+			err:    nil,
+			result: "false",
 		},
 		{
-			name:     "true==true",
-			source:   "true==true",
-			err:      nil,
-			result:   value.NewBool(true),
-			stackLen: 1,
+			name:   "false_and_true",
+			source: `false and true`,
+			err:    nil,
+			result: "false",
 		},
 		{
-			name:     "false==false",
-			source:   "false==false",
-			err:      nil,
-			result:   value.NewBool(true),
-			stackLen: 1,
+			name:   "false_and_false",
+			source: `false and false`,
+			err:    nil,
+			result: "false",
 		},
 		{
-			name:     "true==false",
-			source:   "true==false",
-			err:      nil,
-			result:   value.NewBool(false),
-			stackLen: 1,
+			name:   "true_or_true",
+			source: "true or true",
+			err:    nil,
+			result: "true",
 		},
 		{
-			name:     "false==true",
-			source:   "false==true",
-			err:      nil,
-			result:   value.NewBool(false),
-			stackLen: 1,
+			name:   "true_or_false",
+			source: `true or false`,
+			err:    nil,
+			result: "true",
 		},
 		{
-			name:     "nil==nil",
-			source:   "nil==nil",
-			err:      nil,
-			result:   value.NewBool(true),
-			stackLen: 1,
+			name:   "false_or_true",
+			source: `false or true`,
+			err:    nil,
+			result: "true",
 		},
 		{
-			name:     "1>2",
-			source:   "1>2",
-			err:      nil,
-			result:   value.NewBool(false),
-			stackLen: 1,
+			name:   "false_or_false",
+			source: `false or false`,
+			err:    nil,
+			result: "false",
 		},
 		{
-			name:     "1<2",
-			source:   "1<2",
-			err:      nil,
-			result:   value.NewBool(true),
-			stackLen: 1,
+			name:   "1_bang_equal_2",
+			source: `1 != 2`,
+			err:    nil,
+			result: "true",
 		},
 		{
-			name:     "1>=2",
-			source:   "1>=2",
-			err:      nil,
-			result:   value.NewBool(false),
-			stackLen: 1,
+			name:   "1_bang_equal_1.0",
+			source: `1 != 1.0`,
+			err:    nil,
+			result: "false",
 		},
 		{
-			name:     "1<=2",
-			source:   "1<=2",
-			err:      nil,
-			result:   value.NewBool(true),
-			stackLen: 1,
+			name:   "string_equal",
+			source: `"ab" == "ab"`,
+			err:    nil,
+			result: "true",
 		},
 		{
-			name:     `"a"+"b"`,
-			source:   `"a"+"b"`,
-			err:      nil,
-			result:   value.NewString("ab"),
-			stackLen: 1,
+			name:   "string_bang_equal",
+			source: `"ab" != "ac"`,
+			err:    nil,
+			result: "true",
 		},
 		{
-			name:     "true_and_true",
-			source:   "true and true",
-			err:      nil,
-			result:   value.NewBool(true),
-			stackLen: 1,
+			name:   "1_equal_nil",
+			source: `1 == nil`,
+			err:    nil,
+			result: "false",
 		},
 		{
-			name:     "true_and_false",
-			source:   `true and false`,
-			err:      nil,
-			result:   value.NewBool(false),
-			stackLen: 1,
+			name:   "nil_equal_nil",
+			source: `nil == nil`,
+			err:    nil,
+			result: "true",
 		},
 		{
-			name:     "false_and_true",
-			source:   `false and true`,
-			err:      nil,
-			result:   value.NewBool(false),
-			stackLen: 1,
+			name:   "1_equal_string",
+			source: `1 == "1"`,
+			err:    nil,
+			result: "false",
 		},
 		{
-			name:     "false_and_false",
-			source:   `false and false`,
-			err:      nil,
-			result:   value.NewBool(false),
-			stackLen: 1,
+			name:   "true_bang_equal_nil",
+			source: `true != nil`,
+			err:    nil,
+			result: "true",
 		},
 		{
-			name:     "true_or_true",
-			source:   "true or true",
-			err:      nil,
-			result:   value.NewBool(true),
-			stackLen: 1,
+			name:   "string_less",
+			source: `"abc" < "abd"`,
+			err:    nil,
+			result: "true",
 		},
 		{
-			name:     "true_or_false",
-			source:   `true or false`,
-			err:      nil,
-			result:   value.NewBool(true),
-			stackLen: 1,
+			name:   "string_greater",
+			source: `"b" > "abc"`,
+			err:    nil,
+			result: "true",
 		},
 		{
-			name:     "false_or_true",
-			source:   `false or true`,
-			err:      nil,
-			result:   value.NewBool(true),
-			stackLen: 1,
+			name:   "string_less_equal",
+			source: `"ab" <= "ab"`,
+			err:    nil,
+			result: "true",
 		},
 		{
-			name:     "false_or_false",
-			source:   `false or false`,
-			err:      nil,
-			result:   value.NewBool(false),
-			stackLen: 1,
+			name:   "string_greater_equal",
+			source: `"a" >= "ab"`,
+			err:    nil,
+			result: "false",
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			scanner_ := scanner.New(tt.source)
-			tokens := scanner_.Scan()
-			parser_ := parser.New(tokens)
-			node, err := parser_.Expression()
-			if err != nil {
-				t.Errorf("Parse() err = %v", err)
-				return
-			}
-			compiler_ := compiler.New([]ast.Node{node})
-			code, constants, err := compiler_.Compile()
-			if err != nil {
-				t.Errorf("Compile() err = %v", err)
-				return
-			}
-			vm := New(code, constants, len(compiler.Global.LocalValues))
-			err = vm.Run()
-			if !errors.Is(err, tt.err) {
-				t.Errorf("Run() err = %v, want %v", err, tt.err)
-			}
-			result := vm.StackPeek(0)
-			if !reflect.DeepEqual(result, tt.result) {
-				t.Errorf("result = %v, want %v", result, tt.result)
-			}
-			stackLen := vm.StackLen()
-			if stackLen != uint64(tt.stackLen) {
-				t.Errorf("stackLen = %v, want %v", stackLen, tt.stackLen)
-			}
+			forEachBackend(t, func(t *testing.T, register bool) {
+				var buf bytes.Buffer
+				Output = &buf
+				function, constants, numGlobals, err := compileProgram("print "+tt.source+";", register)
+				if err != nil {
+					t.Errorf("CompileFunction() err = %v", err)
+					return
+				}
+				vm := NewFromFunction(function, constants, numGlobals)
+				err = vm.Run()
+				if !errors.Is(err, tt.err) {
+					t.Errorf("Run() err = %v, want %v", err, tt.err)
+				}
+				if buf.String() != tt.result+"\n" {
+					t.Errorf("Run() output = %q, want %q", buf.String(), tt.result+"\n")
+				}
+				// print 弹出了表达式的值，栈上不应该留下任何东西
+				if !register && vm.StackLen() != 0 {
+					t.Errorf("StackLen() = %v, want 0", vm.StackLen())
+				}
+			})
 		})
 	}
 }
@@ -579,32 +610,2514 @@ func TestVM_RunStmtDecl(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			// 创建一个缓冲区来捕获输出
-			var buf bytes.Buffer
-			Output = &buf
+			forEachBackend(t, func(t *testing.T, register bool) {
+				// 创建一个缓冲区来捕获输出
+				var buf bytes.Buffer
+				Output = &buf
 
-			scanner_ := scanner.New(tt.source)
-			tokens := scanner_.Scan()
-			parser_ := parser.New(tokens)
-			node, err := parser_.Parse()
-			if err != nil {
-				t.Errorf("Parse() err = %v", err)
-				return
+				scanner_ := scanner.New(tt.source)
+				tokens := scanner_.Scan()
+				parser_ := parser.New(tokens)
+				node, err := parser_.Parse()
+				if err != nil {
+					t.Errorf("Parse() err = %v", err)
+					return
+				}
+				compiler_ := compiler.New(node)
+				compiler_.Register = register
+				function, constants, err := compiler_.CompileFunction()
+				if err != nil {
+					t.Errorf("CompileFunction() err = %v", err)
+					return
+				}
+				vm := NewFromFunction(function, constants, compiler_.NumGlobals())
+				err = vm.Run()
+				if !errors.Is(err, tt.err) {
+					t.Errorf("Run() err = %v, want %v", err, tt.err)
+				}
+				if tt.result != "" && buf.String() != tt.result {
+					t.Errorf("Run() output = %q, want %q", buf.String(), tt.result)
+				}
+			})
+		})
+	}
+}
+
+func TestVM_Truthiness(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		strict bool
+		err    error
+		result string
+	}{
+		{
+			name: "if",
+			source: `
+			if (nil) { print 1; } else { print 2; }
+			if (0) { print 3; }
+			if ("") { print 4; }
+			`,
+			result: "2" + "\n" + "3" + "\n" + "4" + "\n",
+		},
+		{
+			name: "while",
+			source: `
+			var a = 3;
+			var b = 0;
+			while (a) {
+				b = b + 1;
+				if (b == 3) {
+					a = nil;
+				}
 			}
-			compiler_ := compiler.New(node)
-			code, constants, err := compiler_.Compile()
-			if err != nil {
-				t.Errorf("Compile() err = %v", err)
-				return
+			print b;
+			`,
+			result: "3" + "\n",
+		},
+		{
+			name: "not",
+			source: `
+			print !nil;
+			print !0;
+			print !!"a";
+			`,
+			result: "true" + "\n" + "false" + "\n" + "true" + "\n",
+		},
+		{
+			name: "and_or_operands",
+			source: `
+			print nil or 1;
+			print 2 and 3;
+			print nil and 4;
+			print false or nil;
+			`,
+			result: "1" + "\n" + "3" + "\n" + "nil" + "\n" + "nil" + "\n",
+		},
+		{
+			name:   "strict_if",
+			source: `if (1) { print 1; }`,
+			strict: true,
+			err:    ErrInvalidOperandType,
+		},
+		{
+			name:   "strict_not",
+			source: `print !nil;`,
+			strict: true,
+			err:    ErrInvalidOperandType,
+		},
+		{
+			name:   "strict_and",
+			source: `print true and 1;`,
+			strict: true,
+			err:    ErrInvalidOperandType,
+		},
+		{
+			name:   "strict_or",
+			source: `print false or 1;`,
+			strict: true,
+			err:    ErrInvalidOperandType,
+		},
+		{
+			name:   "strict_and_nil",
+			source: `print true and nil;`,
+			strict: true,
+			err:    ErrInvalidOperandType,
+		},
+		{
+			name:   "strict_bool",
+			source: `if (true and !false) { print 1; }`,
+			strict: true,
+			result: "1" + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, register bool) {
+				var buf bytes.Buffer
+				Output = &buf
+
+				scanner_ := scanner.New(tt.source)
+				tokens := scanner_.Scan()
+				parser_ := parser.New(tokens)
+				node, err := parser_.Parse()
+				if err != nil {
+					t.Errorf("Parse() err = %v", err)
+					return
+				}
+				compiler_ := compiler.New(node)
+				compiler_.Register = register
+				compiler_.Strict = tt.strict
+				function, constants, err := compiler_.CompileFunction()
+				if err != nil {
+					t.Errorf("CompileFunction() err = %v", err)
+					return
+				}
+				vm := NewFromFunction(function, constants, compiler_.NumGlobals())
+				vm.Strict = tt.strict
+				err = vm.Run()
+				if !errors.Is(err, tt.err) {
+					t.Errorf("Run() err = %v, want %v", err, tt.err)
+				}
+				if tt.result != "" && buf.String() != tt.result {
+					t.Errorf("Run() output = %q, want %q", buf.String(), tt.result)
+				}
+			})
+		})
+	}
+}
+
+func TestVM_MemoryLimit(t *testing.T) {
+	tests := []struct {
+		name        string
+		source      string
+		memoryLimit uint64
+		err         error
+	}{
+		{
+			name: "unlimited",
+			source: `
+			var s = "ab";
+			var i = 0;
+			while (i < 10) {
+				s = s + s;
+				i = i + 1;
 			}
-			vm := New(code, constants, len(compiler.Global.LocalValues))
-			err = vm.Run()
-			if !errors.Is(err, tt.err) {
-				t.Errorf("Run() err = %v, want %v", err, tt.err)
+			`,
+			memoryLimit: 0,
+			err:         nil,
+		},
+		{
+			name: "under_limit",
+			source: `
+			var one = 1;
+			var a = one + 2;
+			var s = "a";
+			s = s + "b";
+			`,
+			memoryLimit: 1024,
+			err:         nil,
+		},
+		{
+			name: "string_grow",
+			source: `
+			var s = "ab";
+			while (true) {
+				s = s + s;
 			}
-			if tt.result != "" && buf.String() != tt.result {
-				t.Errorf("Run() output = %q, want %q", buf.String(), tt.result)
+			`,
+			memoryLimit: 1 << 20,
+			err:         ErrMemoryLimitExceeded,
+		},
+		{
+			name: "closure",
+			source: `
+			fun outer() {
+				var x = 1;
+				fun inner() {
+					print x;
+				}
+				return inner;
+			}
+			while (true) {
+				outer();
+			}
+			`,
+			memoryLimit: 1 << 16,
+			err:         ErrMemoryLimitExceeded,
+		},
+		{
+			name: "deep_recursion",
+			source: `
+			fun f(n) {
+				return f(n + 1) + 1;
+			}
+			f(0);
+			`,
+			memoryLimit: 1 << 20,
+			err:         ErrMemoryLimitExceeded,
+		},
+		{
+			name: "not_catchable",
+			source: `
+			fun f() {
+				try {
+					var s = "ab";
+					while (true) {
+						s = s + s;
+					}
+				} catch (e) {
+					print "caught";
+				}
 			}
+			f();
+			`,
+			memoryLimit: 1 << 20,
+			err:         ErrMemoryLimitExceeded,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, register bool) {
+				var buf bytes.Buffer
+				Output = &buf
+
+				scanner_ := scanner.New(tt.source)
+				tokens := scanner_.Scan()
+				parser_ := parser.New(tokens)
+				node, err := parser_.Parse()
+				if err != nil {
+					t.Errorf("Parse() err = %v", err)
+					return
+				}
+				compiler_ := compiler.New(node)
+				compiler_.Register = register
+				function, constants, err := compiler_.CompileFunction()
+				if err != nil {
+					t.Errorf("CompileFunction() err = %v", err)
+					return
+				}
+				vm := NewFromFunction(function, constants, compiler_.NumGlobals())
+				vm.MemoryLimit = tt.memoryLimit
+				err = vm.Run()
+				if !errors.Is(err, tt.err) {
+					t.Errorf("Run() err = %v, want %v", err, tt.err)
+				}
+				if tt.err == nil && vm.MemoryUsed == 0 {
+					t.Errorf("MemoryUsed = 0, want > 0")
+				}
+			})
+		})
+	}
+}
+
+// backends 是虚拟机的两种指令集
+var backends = []struct {
+	name     string
+	register bool
+}{
+	{name: "stack", register: false},
+	{name: "register", register: true},
+}
+
+// forEachBackend 把 f 作为子测试分别在栈式和寄存器指令上运行
+func forEachBackend(t *testing.T, f func(t *testing.T, register bool)) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			f(t, backend.register)
+		})
+	}
+}
+
+// compileProgram 编译 source，返回 main 函数、常量和全局变量个数。register 为 true 时编译为寄存器指令
+func compileProgram(source string, register bool) (*value.Function, []value.Value, int, error) {
+	node, err := parser.New(scanner.New(source).Scan()).Parse()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	compiler_ := compiler.New(node)
+	compiler_.Register = register
+	function, constants, err := compiler_.CompileFunction()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return function, constants, compiler_.NumGlobals(), nil
+}
+
+func TestVM_Registers(t *testing.T) {
+	// 300 项的左结合表达式，a 是参数所以不会被折叠
+	terms := make([]string, 300)
+	for i := range terms {
+		terms[i] = strconv.Itoa(i)
+	}
+	// locals 返回定义 n 个局部变量 v0 到 vn-1 的语句
+	locals := func(n int) string {
+		var b strings.Builder
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(&b, "var v%d = %d;\n", i, i)
+		}
+		return b.String()
+	}
+	tests := []struct {
+		name   string
+		source string
+		want   string
+		err    error // 寄存器指令的编译错误
+	}{
+		{
+			name:   "long_expression",
+			source: "fun f(a) { return a + " + strings.Join(terms, " + ") + "; }\nprint f(1);",
+			want:   "44851\n",
+		},
+		{
+			name:   "long_expression_with_locals",
+			source: "fun f(a) {\n" + locals(250) + "return a * 2 + " + strings.Join(terms, " + ") + " + v249; }\nprint f(1);",
+			want:   "45101\n",
+		},
+		{
+			name:   "too_many_locals",
+			source: "fun f() {\n" + locals(300) + "}\n",
+			err:    compiler.ErrTooManyLocals,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, register bool) {
+				var buf bytes.Buffer
+				Output = &buf
+				function, constants, numGlobals, err := compileProgram(tt.source, register)
+				if register && tt.err != nil {
+					if !errors.Is(err, tt.err) {
+						t.Errorf("CompileFunction() err = %v, want %v", err, tt.err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("CompileFunction() err = %v", err)
+				}
+				err = NewFromFunction(function, constants, numGlobals).Run()
+				if err != nil {
+					t.Fatalf("Run() err = %v", err)
+				}
+				if tt.want != "" && buf.String() != tt.want {
+					t.Errorf("Run() output = %q, want %q", buf.String(), tt.want)
+				}
+			})
 		})
 	}
 }
+
+func TestVM_Unboxed(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, register bool) {
+		// 数字、bool 和 nil 的运算不在堆上分配，循环次数不影响分配次数
+		source := `
+	var i = 0;
+	var sum = 0.5;
+	while (i < %d) {
+		sum = sum + i * 2;
+		if (i %% 2 == 0 and !false) {
+			sum = -sum;
+		}
+		i = i + 1;
+	}
+	print sum != nil;
+	`
+		allocs := make([]float64, 2)
+		for i, n := range []int{10, 10000} {
+			function, constants, numGlobals, err := compileProgram(fmt.Sprintf(source, n), register)
+			if err != nil {
+				t.Fatalf("compile err = %v", err)
+			}
+			var vm *VM
+			allocs[i] = testing.AllocsPerRun(10, func() {
+				Output = io.Discard
+				vm = NewFromFunction(function, constants, numGlobals)
+				err = vm.Run()
+			})
+			if err != nil {
+				t.Fatalf("Run() err = %v", err)
+			}
+			if vm.MemoryUsed != 0 {
+				t.Errorf("MemoryUsed = %d, want 0", vm.MemoryUsed)
+			}
+		}
+		if allocs[0] != allocs[1] {
+			t.Errorf("allocs = %v for 10 iterations, %v for 10000 iterations, want equal", allocs[0], allocs[1])
+		}
+	})
+}
+
+func TestVM_Exception(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		err    error
+		result string
+	}{
+		{
+			name: "throw_catch",
+			source: `
+			try {
+				throw "boom";
+				print "unreachable";
+			} catch (e) {
+				print e;
+			}
+			`,
+			err:    nil,
+			result: "boom" + "\n",
+		},
+		{
+			name: "catch_runtime_error",
+			source: `
+			try {
+				print 1 / 0;
+			} catch (e) {
+				print e.message;
+				print e.line;
+			}
+			`,
+			err:    nil,
+			result: "zero in divide" + "\n" + "3" + "\n",
+		},
+		{
+			name: "finally",
+			source: `
+			try {
+				print 1;
+			} catch (e) {
+				print 2;
+			} finally {
+				print 3;
+			}
+			`,
+			err:    nil,
+			result: "1" + "\n" + "3" + "\n",
+		},
+		{
+			name: "finally_rethrow",
+			source: `
+			fun f() {
+				try {
+					throw "inner";
+				} finally {
+					print "cleanup";
+				}
+			}
+			try {
+				f();
+			} catch (e) {
+				print e;
+			}
+			`,
+			err:    nil,
+			result: "cleanup" + "\n" + "inner" + "\n",
+		},
+		{
+			name: "finally_return",
+			source: `
+			fun f() {
+				try {
+					return 1;
+				} finally {
+					print "finally";
+				}
+			}
+			print f();
+			`,
+			err:    nil,
+			result: "finally" + "\n" + "1" + "\n",
+		},
+		{
+			name: "return_in_catch",
+			source: `
+			fun f() {
+				try {
+					throw 1;
+				} catch (e) {
+					return e + 1;
+				} finally {
+					print "finally";
+				}
+				return 0;
+			}
+			print f();
+			`,
+			err:    nil,
+			result: "finally" + "\n" + "2" + "\n",
+		},
+		{
+			name: "throw_in_catch",
+			source: `
+			try {
+				try {
+					throw 1;
+				} catch (e) {
+					throw e + 1;
+				} finally {
+					print "inner finally";
+				}
+			} catch (e) {
+				print e;
+			}
+			`,
+			err:    nil,
+			result: "inner finally" + "\n" + "2" + "\n",
+		},
+		{
+			name: "unwind_frames",
+			source: `
+			fun f(n) {
+				if (n == 0) {
+					throw "bottom";
+				}
+				return f(n - 1) + 1;
+			}
+			var a = 1;
+			try {
+				print f(3);
+			} catch (e) {
+				print e;
+			}
+			print a + 1;
+			`,
+			err:    nil,
+			result: "bottom" + "\n" + "2" + "\n",
+		},
+		{
+			name: "restore_locals",
+			source: `
+			fun f() {
+				var a = 1;
+				try {
+					var b = 2;
+					print a + b + 1 / 0;
+				} catch (e) {
+					print a;
+				}
+				var c = 3;
+				print a + c;
+			}
+			f();
+			`,
+			err:    nil,
+			result: "1" + "\n" + "4" + "\n",
+		},
+		{
+			name:   "uncaught_throw",
+			source: `throw "boom";`,
+			err:    ErrUncaughtException,
+			result: "",
+		},
+		{
+			name: "uncaught_runtime_error",
+			source: `
+			fun f() {
+				return 1 % 0;
+			}
+			f();
+			`,
+			err:    ErrZeroInModulo,
+			result: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, register bool) {
+				var buf bytes.Buffer
+				Output = &buf
+
+				scanner_ := scanner.New(tt.source)
+				tokens := scanner_.Scan()
+				parser_ := parser.New(tokens)
+				node, err := parser_.Parse()
+				if err != nil {
+					t.Errorf("Parse() err = %v", err)
+					return
+				}
+				compiler_ := compiler.New(node)
+				compiler_.Register = register
+				function, constants, err := compiler_.CompileFunction()
+				if err != nil {
+					t.Errorf("CompileFunction() err = %v", err)
+					return
+				}
+				vm := NewFromFunction(function, constants, len(compiler.Global.LocalValues))
+				err = vm.Run()
+				if !errors.Is(err, tt.err) {
+					t.Errorf("Run() err = %v, want %v", err, tt.err)
+				}
+				if tt.result != "" && buf.String() != tt.result {
+					t.Errorf("Run() output = %q, want %q", buf.String(), tt.result)
+				}
+			})
+		})
+	}
+}
+
+func TestVM_Module(t *testing.T) {
+	fsys := fstest.MapFS{
+		"lib/strings.stmt": {Data: []byte(`
+			var count = 0;
+			fun hidden() {
+				return "hidden";
+			}
+			export fun greet(name) {
+				count = count + 1;
+				return "hello " + name;
+			}
+			export fun calls() {
+				return count;
+			}
+			export var version = 2;
+			print "init strings";
+		`)},
+		"lib/counter.stmt": {Data: []byte(`
+			import "strings" as s;
+			export fun twice(name) {
+				s.greet(name);
+				return s.greet(name);
+			}
+		`)},
+		"lib/broken.stmt": {Data: []byte(`throw "broken";`)},
+		"cycle/a.stmt":    {Data: []byte(`import "b" as b;`)},
+		"cycle/b.stmt":    {Data: []byte(`import "a" as a;`)},
+	}
+	tests := []struct {
+		name   string
+		path   string
+		source string
+		err    error
+		result string
+	}{
+		{
+			name: "import",
+			path: "main.stmt",
+			source: `
+			import "lib/strings" as s;
+			print s.greet("lox");
+			print s.version;
+			`,
+			result: "init strings" + "\n" + "hello lox" + "\n" + "2" + "\n",
+		},
+		{
+			name: "import_once",
+			path: "main.stmt",
+			source: `
+			import "lib/strings" as s;
+			import "lib/counter" as c;
+			print c.twice("lox");
+			print s.calls();
+			`,
+			result: "init strings" + "\n" + "hello lox" + "\n" + "2" + "\n",
+		},
+		{
+			name: "local_import",
+			path: "main.stmt",
+			source: `
+			fun f() {
+				import "lib/strings" as s;
+				return s.version;
+			}
+			print f() + f();
+			`,
+			result: "init strings" + "\n" + "4" + "\n",
+		},
+		{
+			name: "search_path",
+			path: "app/main.stmt",
+			source: `
+			import "strings" as s;
+			print s.version;
+			`,
+			result: "init strings" + "\n" + "2" + "\n",
+		},
+		{
+			name: "not_exported",
+			path: "main.stmt",
+			source: `
+			import "lib/strings" as s;
+			s.hidden();
+			`,
+			err: ErrUndefinedProperty,
+		},
+		{
+			name: "catch_module_exception",
+			path: "main.stmt",
+			source: `
+			try {
+				import "lib/broken" as b;
+			} catch (e) {
+				print e;
+			}
+			`,
+			result: "broken" + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, register bool) {
+				var buf bytes.Buffer
+				Output = &buf
+
+				scanner_ := scanner.New(tt.source)
+				tokens := scanner_.Scan()
+				parser_ := parser.New(tokens)
+				node, err := parser_.Parse()
+				if err != nil {
+					t.Errorf("Parse() err = %v", err)
+					return
+				}
+				compiler_ := compiler.New(node)
+				compiler_.Register = register
+				compiler_.Path = tt.path
+				compiler_.Loader = module.NewLoader(fsys, "lib")
+				function, constants, err := compiler_.CompileFunction()
+				if err != nil {
+					t.Errorf("CompileFunction() err = %v", err)
+					return
+				}
+				vm := NewFromFunction(function, constants, compiler_.NumGlobals())
+				err = vm.Run()
+				if !errors.Is(err, tt.err) {
+					t.Errorf("Run() err = %v, want %v", err, tt.err)
+				}
+				if tt.result != "" && buf.String() != tt.result {
+					t.Errorf("Run() output = %q, want %q", buf.String(), tt.result)
+				}
+			})
+		})
+	}
+}
+
+// TestVM_Differential 在解释器和虚拟机上运行同一段程序，两者的输出和是否出错应当一致。
+// 两个后端打印字符串和 nil 的格式不同，所以程序只打印整数和布尔值。
+func TestVM_Call(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		err    error
+		result string
+	}{
+		{
+			name: "too_few_arguments",
+			source: `
+			fun g(a, b) {
+				return a + b;
+			}
+			try {
+				g(1);
+			} catch (e) {
+				print e.message;
+			}
+			`,
+			err:    nil,
+			result: "function parameters num should equ to call arguments num: g expects 2 arguments but got 1" + "\n",
+		},
+		{
+			name: "too_many_arguments",
+			source: `
+			fun g(a, b = 2) {
+				return a + b;
+			}
+			g(1, 2, 3);
+			`,
+			err:    ErrNumParamsArgsNotMatch,
+			result: "",
+		},
+		{
+			name: "variadic_too_few_arguments",
+			source: `
+			fun g(a, ...rest) {
+				return a;
+			}
+			try {
+				g();
+			} catch (e) {
+				print e.message;
+			}
+			`,
+			err:    nil,
+			result: "function parameters num should equ to call arguments num: g expects at least 1 arguments but got 0" + "\n",
+		},
+		{
+			name: "default",
+			source: `
+			fun f(a, b = a + 1, c = b * 10) {
+				print a + b + c;
+			}
+			f(1);
+			f(1, 5);
+			f(1, 5, 100);
+			f(1, nil == nil and 2, 0);
+			`,
+			err:    nil,
+			result: "23" + "\n" + "56" + "\n" + "106" + "\n" + "3" + "\n",
+		},
+		{
+			name: "default_captured",
+			source: `
+			fun f(a, b = 10) {
+				fun g() {
+					return a + b;
+				}
+				return g;
+			}
+			print f(1)();
+			`,
+			err:    nil,
+			result: "11" + "\n",
+		},
+		{
+			name: "rest",
+			source: `
+			fun f(a, ...rest) {
+				print rest.length;
+				print rest;
+				var i = 0;
+				var sum = a;
+				while (i < rest.length) {
+					sum = sum + rest[i];
+					i = i + 1;
+				}
+				return sum;
+			}
+			print f(1);
+			print f(1, 2, 3);
+			`,
+			err:    nil,
+			result: "0" + "\n" + "[]" + "\n" + "1" + "\n" + "2" + "\n" + "[2, 3]" + "\n" + "6" + "\n",
+		},
+		{
+			name: "print_function",
+			source: `
+			fun add(a, b) {
+				return a + b;
+			}
+			print add;
+			`,
+			err:    nil,
+			result: "<fn add>" + "\n",
+		},
+		{
+			name: "shared_constant_not_modified",
+			source: `
+			fun counter() {
+				var c = 0;
+				fun inc() {
+					c = c + 1;
+					return c;
+				}
+				return inc;
+			}
+			var a = counter();
+			a();
+			var z = 0;
+			print z;
+			`,
+			err:    nil,
+			result: "0" + "\n",
+		},
+		{
+			name: "index_out_of_range",
+			source: `
+			fun f(...rest) {
+				return rest[2];
+			}
+			f(1, 2);
+			`,
+			err:    ErrIndexOutOfRange,
+			result: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, register bool) {
+				var buf bytes.Buffer
+				Output = &buf
+
+				node, err := parser.New(scanner.New(tt.source).Scan()).Parse()
+				if err != nil {
+					t.Errorf("Parse() err = %v", err)
+					return
+				}
+				compiler_ := compiler.New(node)
+				compiler_.Register = register
+				function, constants, err := compiler_.CompileFunction()
+				if err != nil {
+					t.Errorf("CompileFunction() err = %v", err)
+					return
+				}
+				err = NewFromFunction(function, constants, compiler_.NumGlobals()).Run()
+				if !errors.Is(err, tt.err) {
+					t.Errorf("Run() err = %v, want %v", err, tt.err)
+				}
+				if tt.result != "" && buf.String() != tt.result {
+					t.Errorf("Run() output = %q, want %q", buf.String(), tt.result)
+				}
+			})
+		})
+	}
+}
+
+func TestVM_Intern(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, register bool) {
+		source := `
+	var a = "ab";
+	var b = "a" + "b";
+	var c = "a";
+	c = c + "b";
+	print a == b and b == c;
+	`
+		var buf bytes.Buffer
+		Output = &buf
+		node, err := parser.New(scanner.New(source).Scan()).Parse()
+		if err != nil {
+			t.Fatalf("Parse() err = %v", err)
+		}
+		compiler_ := compiler.New(node)
+		compiler_.Register = register
+		function, constants, err := compiler_.CompileFunction()
+		if err != nil {
+			t.Fatalf("CompileFunction() err = %v", err)
+		}
+		vm := NewFromFunction(function, constants, compiler_.NumGlobals())
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("Run() err = %v", err)
+		}
+		if buf.String() != "true\n" {
+			t.Errorf("Run() output = %q, want %q", buf.String(), "true\n")
+		}
+		a, b, c := vm.Globals[0].Object, vm.Globals[1].Object, vm.Globals[2].Object
+		if a != b || b != c {
+			t.Errorf("equal strings are not interned: %p %p %p", a, b, c)
+		}
+	})
+}
+
+func TestVM_InternConcatenation(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, register bool) {
+		source := `
+	var s = "";
+	for (var i = 0; i < 100; i = i + 1) {
+		s = s + "x";
+	}
+	print s == s + "";
+	`
+		var buf bytes.Buffer
+		Output = &buf
+		node, err := parser.New(scanner.New(source).Scan()).Parse()
+		if err != nil {
+			t.Fatalf("Parse() err = %v", err)
+		}
+		compiler_ := compiler.New(node)
+		compiler_.Register = register
+		function, constants, err := compiler_.CompileFunction()
+		if err != nil {
+			t.Fatalf("CompileFunction() err = %v", err)
+		}
+		vm := NewFromFunction(function, constants, compiler_.NumGlobals())
+		before := len(vm.Strings)
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("Run() err = %v", err)
+		}
+		if buf.String() != "true\n" {
+			t.Errorf("Run() output = %q, want %q", buf.String(), "true\n")
+		}
+		// 拼接的中间结果不驻留，驻留表只包含常量
+		if len(vm.Strings) != before {
+			t.Errorf("len(Strings) = %d, want %d", len(vm.Strings), before)
+		}
+	})
+}
+
+func TestVM_StackTrace(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, register bool) {
+		source := `
+	fun inner(x) {
+		return x / 0;
+	}
+	fun outer() {
+		var r = inner(1);
+		return r;
+	}
+	outer();
+	`
+		node, err := parser.New(scanner.New(source).Scan()).Parse()
+		if err != nil {
+			t.Fatalf("Parse() err = %v", err)
+		}
+		compiler_ := compiler.New(node)
+		compiler_.Register = register
+		compiler_.Path = "main.stmt"
+		function, constants, err := compiler_.CompileFunction()
+		if err != nil {
+			t.Fatalf("CompileFunction() err = %v", err)
+		}
+		err = NewFromFunction(function, constants, compiler_.NumGlobals()).Run()
+		var exception *Exception
+		if !errors.As(err, &exception) {
+			t.Fatalf("Run() err = %v, want *Exception", err)
+		}
+		want := "line 3: zero in divide" +
+			"\n    at inner (main.stmt:3)" +
+			"\n    at outer (main.stmt:6)" +
+			"\n    at script (main.stmt:9)"
+		if got := exception.StackTrace(); got != want {
+			t.Errorf("StackTrace() = %q, want %q", got, want)
+		}
+	})
+}
+
+func TestVM_TailCall(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, register bool) {
+		source := `
+	fun even(n) {
+		if (n == 0) {
+			return true;
+		}
+		return odd(n - 1);
+	}
+	fun odd(n) {
+		if (n == 0) {
+			return false;
+		}
+		return even(n - 1);
+	}
+	fun count(n, acc) {
+		if (n == 0) {
+			return acc;
+		}
+		return count(n - 1, acc + 1);
+	}
+	print count(1000000, 0);
+	print even(1000001);
+	`
+		var buf bytes.Buffer
+		Output = &buf
+		function, constants, numGlobals, err := compileProgram(source, register)
+		if err != nil {
+			t.Fatalf("compile err = %v", err)
+		}
+		vm := NewFromFunction(function, constants, numGlobals)
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("Run() err = %v", err)
+		}
+		if buf.String() != "1000000\nfalse\n" {
+			t.Errorf("Run() output = %q, want %q", buf.String(), "1000000\nfalse\n")
+		}
+		if cap(vm.Frames) != FramesSize {
+			t.Errorf("cap(Frames) = %d, want %d", cap(vm.Frames), FramesSize)
+		}
+		if len(vm.Stack) != StackSize {
+			t.Errorf("len(Stack) = %d, want %d", len(vm.Stack), StackSize)
+		}
+	})
+}
+
+// 寄存器指令还不支持类，以下测试只使用栈式指令
+func TestVM_Class(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		err    error
+		result string
+	}{
+		{
+			name: "print",
+			source: `
+			class A {
+				f() {
+					return 1;
+				}
+			}
+			var a = A();
+			print A;
+			print a;
+			print a.f;
+			`,
+			result: "<class A>\n<A instance>\n<fn f>\n",
+		},
+		{
+			name: "field_shadows_method",
+			source: `
+			class A {
+				f() {
+					return 1;
+				}
+			}
+			var a = A();
+			print a.f();
+			a.f = 2;
+			print a.f;
+			`,
+			result: "1\n2\n",
+		},
+		{
+			name: "default_argument",
+			source: `
+			class A {
+				f(x, y = x + 1) {
+					return this.n + x + y;
+				}
+			}
+			var a = A();
+			a.n = 100;
+			print a.f(1);
+			print a.f(1, 10);
+			`,
+			result: "103\n111\n",
+		},
+		{
+			name: "tail_call_method",
+			source: `
+			class A {
+				count(n, acc) {
+					if (n == 0) {
+						return acc;
+					}
+					return this.count(n - 1, acc + 1);
+				}
+				make() {
+					return A();
+				}
+			}
+			print A().count(100000, 0);
+			print A().make().count(1, 0);
+			`,
+			result: "100000\n1\n",
+		},
+		{
+			name: "export_class",
+			source: `
+			export class A {}
+			print A;
+			`,
+			result: "<class A>\n",
+		},
+		{
+			name: "init",
+			source: `
+			class Point {
+				init(x, y = 2) {
+					this.x = x;
+					this.y = y;
+					if (x > 5) {
+						return;
+					}
+					this.x = x * 10;
+				}
+			}
+			fun make(x) {
+				return Point(x);
+			}
+			var p = Point(1);
+			print p.x + p.y;
+			print make(6).x;
+			print p.init(7) == p;
+			`,
+			result: "12\n6\ntrue\n",
+		},
+		{
+			name: "init_arity",
+			source: `
+			class Point {
+				init(x) {
+					this.x = x;
+				}
+			}
+			Point();
+			`,
+			err: ErrNumParamsArgsNotMatch,
+		},
+		{
+			name: "class_without_init_arity",
+			source: `
+			class Point {}
+			Point(1);
+			`,
+			err: ErrNumParamsArgsNotMatch,
+		},
+		{
+			name: "static",
+			source: `
+			class A {
+				static make(x) {
+					return x + 1;
+				}
+			}
+			class B < A {}
+			print B.make(1);
+			var f = A.make;
+			print f(2);
+			`,
+			result: "2\n3\n",
+		},
+		{
+			name: "static_undefined",
+			source: `
+			class A {
+				f() {
+					return 1;
+				}
+			}
+			A.f();
+			`,
+			err: ErrUndefinedProperty,
+		},
+		{
+			name: "getter_setter",
+			source: `
+			class Box {
+				get value {
+					return this.v;
+				}
+				set value(v) {
+					this.v = v * 2;
+				}
+			}
+			var b = Box();
+			b.value = 3;
+			print b.value;
+			print b.v;
+			`,
+			result: "6\n6\n",
+		},
+		{
+			name: "getter_tail_call",
+			source: `
+			class A {
+				init(n) {
+					this.n = n;
+				}
+				get next {
+					return A(this.n + 1);
+				}
+				get self {
+					return this.same();
+				}
+				same() {
+					return this;
+				}
+				set n2(n) {
+					return this.set(n);
+				}
+				set(n) {
+					this.n = n;
+					return n;
+				}
+			}
+			var a = A(1);
+			print a.next.n;
+			print a.self.n;
+			a.n2 = 7;
+			print a.n;
+			`,
+			result: "2\n1\n7\n",
+		},
+		{
+			name: "trait",
+			source: `
+			trait T {
+				init(x) {
+					this.x = x;
+				}
+			}
+			class A with T {}
+			print T;
+			print A(5).x;
+			`,
+			result: "<trait T>\n5\n",
+		},
+		{
+			name: "with_non_trait",
+			source: `
+			class A {}
+			class B with A {}
+			`,
+			err: ErrNotTrait,
+		},
+		{
+			name: "operator_str",
+			source: `
+			class Money {
+				init(cents) {
+					this.cents = cents;
+				}
+				__str__() {
+					return "$" + "1.25";
+				}
+			}
+			print Money(125);
+			`,
+			result: "$1.25\n",
+		},
+		{
+			name: "operator_not_overloaded",
+			source: `
+			class A {}
+			print A() + 1;
+			`,
+			err: ErrInvalidOperandType,
+		},
+		{
+			name: "operator_arity",
+			source: `
+			class A {
+				__add__() {
+					return 1;
+				}
+			}
+			print A() + 1;
+			`,
+			err: ErrNumParamsArgsNotMatch,
+		},
+		{
+			name: "private_same_class_name",
+			source: `
+			class A {
+				init() {
+					this.#secret = 42;
+				}
+				leak() {
+					class A {
+						init() {
+							this.#secret = 0;
+						}
+						peek(o) {
+							return o.#secret;
+						}
+					}
+					return A().peek(this);
+				}
+			}
+			print A().leak();
+			`,
+			err: ErrUndefinedProperty,
+		},
+		{
+			name: "setattr_tail_call",
+			source: `
+			class A {
+				set x(v) {
+					this.y = v + 1;
+					return 99;
+				}
+			}
+			fun set(o, v) {
+				return setattr(o, "x", v);
+			}
+			var a = A();
+			print set(a, 1);
+			print a.y;
+			`,
+			result: "1\n2\n",
+		},
+		{
+			name: "reflection_private_name",
+			source: `
+			class A {
+				init() {
+					this.#x = 1;
+				}
+			}
+			print getattr(A(), "A#x");
+			`,
+			err: ErrPrivateProperty,
+		},
+		{
+			name:   "reflection_argument_type",
+			source: `print isinstance(1, 2);`,
+			err:    ErrInvalidArgumentType,
+		},
+		{
+			name:   "builtin_arity",
+			source: `print type();`,
+			err:    ErrNumParamsArgsNotMatch,
+		},
+		{
+			name:   "clock_arity",
+			source: `print clock(1);`,
+			err:    ErrNumParamsArgsNotMatch,
+		},
+		{
+			name: "undefined_property",
+			source: `
+			class A {}
+			print A().x;
+			`,
+			err: ErrUndefinedProperty,
+		},
+		{
+			name: "set_on_non_instance",
+			source: `
+			var a = 1;
+			a.x = 1;
+			`,
+			err: ErrOnlyInstanceHaveFields,
+		},
+		{
+			name: "inherit_non_class",
+			source: `
+			var a = 1;
+			class A < a {}
+			`,
+			err: ErrNotClass,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			Output = &buf
+			function, constants, numGlobals, err := compileProgram(tt.source, false)
+			if err != nil {
+				t.Fatalf("compile err = %v", err)
+			}
+			err = NewFromFunction(function, constants, numGlobals).Run()
+			if !errors.Is(err, tt.err) {
+				t.Errorf("Run() err = %v, want %v", err, tt.err)
+			}
+			if tt.result != "" && buf.String() != tt.result {
+				t.Errorf("Run() output = %q, want %q", buf.String(), tt.result)
+			}
+		})
+	}
+}
+
+func TestVM_InlineCache(t *testing.T) {
+	// 同一处的属性访问遇到相同 Shape 的实例时命中缓存，调用方法不创建绑定的方法，循环次数不影响分配次数
+	source := `
+	class Point {
+		sum() {
+			return this.x + this.y;
+		}
+	}
+	var p = Point();
+	p.x = 1;
+	p.y = 2;
+	var i = 0;
+	var total = 0;
+	while (i < %d) {
+		p.x = i;
+		total = total + p.sum();
+		i = i + 1;
+	}
+	print total > 0;
+	`
+	allocs := make([]float64, 2)
+	for i, n := range []int{10, 10000} {
+		function, constants, numGlobals, err := compileProgram(fmt.Sprintf(source, n), false)
+		if err != nil {
+			t.Fatalf("compile err = %v", err)
+		}
+		var vm *VM
+		allocs[i] = testing.AllocsPerRun(10, func() {
+			Output = io.Discard
+			vm = NewFromFunction(function, constants, numGlobals)
+			err = vm.Run()
+		})
+		if err != nil {
+			t.Fatalf("Run() err = %v", err)
+		}
+		for _, cache := range vm.Frames[0].Closure.Caches {
+			if cache.Shape == nil {
+				t.Errorf("cache %s is empty", cache.Name)
+			}
+			if cache.Name == "sum" && cache.Method == nil {
+				t.Errorf("cache sum.Method = nil, want method")
+			}
+		}
+		// 缓存属于虚拟机中的闭包，运行同一份编译结果的虚拟机互不影响
+		for _, cache := range function.Caches {
+			if cache != (value.InlineCache{Name: cache.Name}) {
+				t.Errorf("compiled cache %s = %+v, want empty", cache.Name, cache)
+			}
+		}
+	}
+	if allocs[0] != allocs[1] {
+		t.Errorf("allocs = %v for 10 iterations, %v for 10000 iterations, want equal", allocs[0], allocs[1])
+	}
+}
+
+func TestVM_ReadFrom(t *testing.T) {
+	// 读写属性和调用方法的函数写出再读回后仍能运行，内联缓存只保留属性名
+	source := `
+	class Point {
+		sum() {
+			return this.x + this.y;
+		}
+	}
+	var p = Point();
+	p.x = 1;
+	p.y = 2;
+	print p.x;
+	print p.sum();
+	`
+	function, constants, numGlobals, err := compileProgram(source, false)
+	if err != nil {
+		t.Fatalf("compile err = %v", err)
+	}
+	var want bytes.Buffer
+	Output = &want
+	err = NewFromFunction(function, constants, numGlobals).Run()
+	if err != nil {
+		t.Fatalf("Run() err = %v", err)
+	}
+
+	var buf bytes.Buffer
+	_, err = function.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("WriteTo() err = %v", err)
+	}
+	var read value.Function
+	_, err = read.ReadFrom(&buf)
+	if err != nil {
+		t.Fatalf("ReadFrom() err = %v", err)
+	}
+	if len(read.Caches) != len(function.Caches) {
+		t.Fatalf("ReadFrom() caches = %d, want %d", len(read.Caches), len(function.Caches))
+	}
+	for i, cache := range read.Caches {
+		if cache != (value.InlineCache{Name: function.Caches[i].Name}) {
+			t.Errorf("ReadFrom() cache %d = %+v, want only name %q", i, cache, function.Caches[i].Name)
+		}
+	}
+	var got bytes.Buffer
+	Output = &got
+	err = NewFromFunction(&read, constants, numGlobals).Run()
+	if err != nil {
+		t.Fatalf("Run() read function err = %v", err)
+	}
+	if got.String() != want.String() {
+		t.Errorf("Run() read function output = %q, want %q", got.String(), want.String())
+	}
+}
+
+func TestVM_Differential(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		stack  bool // 只在栈式指令上运行，寄存器指令应报告 ErrRegisterUnsupported
+	}{
+		{
+			name: "binary_order",
+			source: `
+			fun f(x) {
+				print x;
+				return x;
+			}
+			print f(1) + f(2) * f(3);
+			print f(4) - f(5) < f(6);
+			`,
+		},
+		{
+			name: "and_short_circuit",
+			source: `
+			fun t(x) {
+				print x;
+				return true;
+			}
+			fun f(x) {
+				print x;
+				return false;
+			}
+			print f(1) and t(2);
+			print t(3) and f(4);
+			print t(5) and t(6);
+			`,
+		},
+		{
+			name: "or_short_circuit",
+			source: `
+			fun t(x) {
+				print x;
+				return true;
+			}
+			fun f(x) {
+				print x;
+				return false;
+			}
+			print t(1) or f(2);
+			print f(3) or t(4);
+			print f(5) or f(6);
+			`,
+		},
+		{
+			name: "nested_logical",
+			source: `
+			fun t(x) {
+				print x;
+				return true;
+			}
+			fun f(x) {
+				print x;
+				return false;
+			}
+			print (f(1) or t(2)) and (t(3) or t(4));
+			print f(5) and (t(6) or t(7)) or f(8);
+			`,
+		},
+		{
+			name: "nil_guard",
+			source: `
+			var x = nil;
+			print x != nil and x > 0;
+			x = 3;
+			print x != nil and x > 0;
+			`,
+		},
+		{
+			name: "nil_less",
+			source: `
+			print 1;
+			print nil < 1;
+			`,
+		},
+		{
+			name: "nil_add",
+			source: `
+			print 1;
+			print nil + 1;
+			`,
+		},
+		{
+			name: "add_nil",
+			source: `
+			print 1;
+			print 1 + nil;
+			`,
+		},
+		{
+			name: "call_arguments_order",
+			source: `
+			fun f(x) {
+				print x;
+				return x;
+			}
+			fun g(a, b, c) {
+				return a * 100 + b * 10 + c;
+			}
+			print g(f(1), f(2), f(3));
+			`,
+		},
+		{
+			name: "loop_condition",
+			source: `
+			var i = 0;
+			while (i < 3 and i != 5) {
+				print i;
+				i = i + 1;
+			}
+			`,
+		},
+		{
+			name: "truthiness",
+			source: `
+			if (0) { print 1; }
+			if (nil) { print 2; } else { print 3; }
+			print !nil;
+			print nil or 4;
+			print 5 and 6;
+			`,
+		},
+		{
+			name: "default_and_rest",
+			source: `
+			fun f(a, b = a * 2, ...rest) {
+				print a + b;
+				print rest.length;
+				print rest;
+			}
+			f(1);
+			f(1, 3, 5, 7);
+			`,
+		},
+		{
+			name: "arity_error",
+			source: `
+			fun f(a, b) {
+				print a;
+			}
+			print 1;
+			f(1);
+			print 2;
+			`,
+		},
+		{
+			name: "shared_upvalue",
+			source: `
+			fun counter() {
+				var n = 0;
+				fun inc() {
+					n = n + 1;
+				}
+				fun get() {
+					return n;
+				}
+				inc();
+				inc();
+				print get();
+				n = 10;
+				print get();
+				inc();
+				print n;
+			}
+			counter();
+			`,
+		},
+		{
+			name: "upvalue_per_iteration",
+			source: `
+			var first;
+			var second;
+			var i = 0;
+			while (i < 2) {
+				var j = i * 10;
+				fun g() {
+					return j;
+				}
+				if (i == 0) {
+					first = g;
+				} else {
+					second = g;
+				}
+				i = i + 1;
+			}
+			print first();
+			print second();
+			`,
+		},
+		{
+			name: "upvalue_after_return",
+			source: `
+			fun make() {
+				var x = 1;
+				fun add(n) {
+					x = x + n;
+					return x;
+				}
+				return add;
+			}
+			var a = make();
+			var b = make();
+			print a(1);
+			print a(1);
+			print b(5);
+			`,
+		},
+		{
+			name: "deep_recursion",
+			source: `
+			fun sum(n) {
+				if (n == 0) {
+					return 0;
+				}
+				var rest = sum(n - 1);
+				return n + rest;
+			}
+			print sum(5000);
+			`,
+		},
+		{
+			name: "tail_call",
+			source: `
+			fun last(first, ...rest) {
+				if (rest.length == 0) {
+					return first;
+				}
+				return f(rest);
+			}
+			fun f(list) {
+				return list[list.length - 1];
+			}
+			fun make(n) {
+				var x = n;
+				fun get() {
+					return x;
+				}
+				return id(get);
+			}
+			fun id(v) {
+				return v;
+			}
+			fun wrap(n) {
+				try {
+					return boom(n);
+				} catch (e) {
+					return e + 1;
+				}
+			}
+			fun boom(n) {
+				throw n;
+			}
+			print last(1, 2, 3);
+			print make(7)();
+			print wrap(1);
+			`,
+		},
+		{
+			name: "register_operands",
+			source: `
+			fun f() {
+				var a = 1;
+				fun bump() {
+					a = a + 10;
+					return a;
+				}
+				print a + bump();
+				print a * 2 - bump();
+				var b = 0;
+				b = 1 and b;
+				print b;
+				var c = 5;
+				c = c == 5 or c;
+				print c;
+				var d = 3;
+				d = (d > 2 and d + 1) or 0;
+				print d;
+				return a;
+			}
+			print f();
+			`,
+		},
+		{
+			name: "error_after_output",
+			source: `
+			print 1;
+			print 1 % 0;
+			print 2;
+			`,
+		},
+		{
+			name:  "class",
+			stack: true,
+			source: `
+			class A {
+				hi(x) {
+					print x;
+					return this.n;
+				}
+				get() {
+					return this.n;
+				}
+			}
+			class B < A {
+				hi(x) {
+					print 0;
+					return super.hi(x) + 1;
+				}
+				twice() {
+					fun f() {
+						return this.n * 2;
+					}
+					return f;
+				}
+			}
+			var b = B();
+			b.n = 10;
+			print b.hi(1);
+			var f = b.twice();
+			b.n = 20;
+			print f();
+			var get = b.get;
+			print get();
+			class C < A {
+				init(n) {
+					this.n = n;
+				}
+			}
+			class D < C {
+				init() {
+					super.init(5);
+					this.n = this.n + 1;
+				}
+			}
+			print D().get();
+			print C(3).hi(4);
+			b.make = A;
+			b.make().n = 1;
+			var i = 0;
+			var sum = 0;
+			while (i < 10) {
+				var a = A();
+				if (i > 4) {
+					a.m = 1;
+				}
+				a.n = i;
+				sum = sum + a.get() + a.n;
+				i = i + 1;
+			}
+			print sum;
+			`,
+		},
+		{
+			name:  "operator_overloading",
+			stack: true,
+			source: `
+			class Vec {
+				init(x, y) {
+					this.x = x;
+					this.y = y;
+				}
+				__add__(o) {
+					return Vec(this.x + o.x, this.y + o.y);
+				}
+				__sub__(o) {
+					return Vec(this.x - o.x, this.y - o.y);
+				}
+				__mul__(k) {
+					return Vec(this.x * k, this.y * k);
+				}
+				__neg__() {
+					return Vec(-this.x, -this.y);
+				}
+				__eq__(o) {
+					return this.x == o.x and this.y == o.y;
+				}
+				__lt__(o) {
+					return this.x * this.x + this.y * this.y < o.x * o.x + o.y * o.y;
+				}
+				__index__(i) {
+					if (i == 0) {
+						return this.x;
+					}
+					return this.y;
+				}
+				__str__() {
+					return this.x * 100 + this.y;
+				}
+			}
+			var a = Vec(1, 2);
+			var b = Vec(3, 4);
+			print a + b;
+			print (b - a) * 3;
+			print -a;
+			print a == Vec(1, 2);
+			print a != Vec(1, 2);
+			print a == b;
+			print a < b;
+			print b < a;
+			print (a + b)[0] + (a + b)[1];
+			var sum = Vec(0, 0);
+			var i = 0;
+			while (i < 5) {
+				sum = sum + Vec(i, 1);
+				i = i + 1;
+			}
+			print sum;
+			class Plain {}
+			var p = Plain();
+			print p == p;
+			print p != Plain();
+			`,
+		},
+		{
+			name:  "traits",
+			stack: true,
+			source: `
+			trait Walk {
+				move() {
+					return this.legs;
+				}
+				speed() {
+					return this.move() * 2;
+				}
+			}
+			trait Swim {
+				move() {
+					return 100;
+				}
+				dive(depth) {
+					return depth + this.legs;
+				}
+			}
+			class Animal {
+				init(legs) {
+					this.legs = legs;
+				}
+				speed() {
+					return 0;
+				}
+				name() {
+					return 1;
+				}
+			}
+			class Duck < Animal with Walk, Swim {
+				move() {
+					return super.speed() + 7;
+				}
+			}
+			var d = Duck(2);
+			print d.move();
+			print d.speed();
+			print d.dive(3);
+			print d.name();
+			fun make() {
+				var first = Walk;
+				var second = Swim;
+				class Frog < Animal with first, second {}
+				return Frog(4);
+			}
+			var f = make();
+			print f.move();
+			print f.speed();
+			`,
+		},
+		{
+			name:  "private_names",
+			stack: true,
+			source: `
+			class Counter {
+				init() {
+					this.#count = 0;
+				}
+				#bump(n) {
+					this.#count = this.#count + n;
+					return this;
+				}
+				add(n) {
+					return this.#bump(n);
+				}
+				get value {
+					return this.#count;
+				}
+				static copy(other) {
+					var c = Counter();
+					c.#count = other.#count;
+					return c;
+				}
+			}
+			class Twice < Counter {
+				init() {
+					super.init();
+					this.#count = 100;
+				}
+				add(n) {
+					this.#count = this.#count + 1;
+					return super.add(n * 2);
+				}
+				get mine {
+					return this.#count;
+				}
+			}
+			var c = Counter().add(1).add(2);
+			print c.value;
+			print Counter.copy(c).add(10).value;
+			var t = Twice();
+			t.add(5);
+			print t.value;
+			print t.mine;
+			`,
+		},
+		{
+			name:  "reflection",
+			stack: true,
+			source: `
+			class Shape {
+				init(name) {
+					this.name = name;
+					this.#id = 7;
+				}
+				area() {
+					return 0;
+				}
+				#secret() {
+					return this.#id;
+				}
+			}
+			class Square < Shape {
+				init(side) {
+					super.init("square");
+					this.side = side;
+				}
+				area() {
+					return this.side * this.side;
+				}
+				get perimeter {
+					return this.side * 4;
+				}
+				set perimeter(p) {
+					this.side = p / 4;
+				}
+			}
+			fun perimeter(o) {
+				return getattr(o, "perimeter");
+			}
+			var s = Square(3);
+			print type(1) == "int" and type(1.5) == "float" and type("s") == "string";
+			print type(nil) == "nil" and type(true) == "bool" and type(clock) == "function";
+			print type(s) == "instance" and type(Square) == "class" and type(s.area) == "function";
+			print isinstance(s, Shape) and isinstance(s, Square);
+			print isinstance(Shape("c"), Square) or isinstance(3, Shape);
+			print superclass(Square) == Shape and superclass(Shape) == nil;
+			var f = fields(s);
+			print f.length;
+			print f[0] == "name" and f[1] == "side";
+			var m = methods(Square);
+			print m.length;
+			print m[0] == "area" and m[1] == "init";
+			print hasattr(s, "side") and hasattr(s, "perimeter") and hasattr(s, "area");
+			print hasattr(s, "Shape#id") or hasattr(s, "missing") or hasattr(1, "side");
+			print getattr(s, "perimeter");
+			print getattr(s, "area")();
+			print setattr(s, "perimeter", 20);
+			print s.side;
+			setattr(s, "color", 1);
+			print hasattr(s, "color");
+			print perimeter(s);
+			`,
+		},
+		{
+			name:  "class_accessors",
+			stack: true,
+			source: `
+			class Temp {
+				static zero() {
+					return Temp.of(0);
+				}
+				static of(c) {
+					var t = Temp();
+					t.celsius = c;
+					return t;
+				}
+				get fahrenheit {
+					return this.c * 9 / 5 + 32;
+				}
+				set fahrenheit(f) {
+					this.celsius = (f - 32) * 5 / 9;
+				}
+				get celsius {
+					return this.c;
+				}
+				set celsius(c) {
+					this.c = c;
+					this.sets = this.count() + 1;
+					return c;
+				}
+				get adder {
+					var base = this.c;
+					fun add(x) {
+						return base + x;
+					}
+					return add;
+				}
+				init() {
+					this.sets = 0;
+				}
+				count() {
+					return this.sets;
+				}
+			}
+			class Hot < Temp {
+				get celsius {
+					return this.c + 100;
+				}
+			}
+			var t = Temp.zero();
+			print t.fahrenheit;
+			t.fahrenheit = 212;
+			print t.celsius;
+			print t.adder(1);
+			print t.count();
+			var h = Hot.of(1);
+			print h.celsius;
+			print h.fahrenheit;
+			var i = 0;
+			while (i < 5) {
+				t.celsius = i;
+				i = i + 1;
+			}
+			print t.celsius + t.count();
+			`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, register bool) {
+				if register && tt.stack {
+					// 寄存器指令还不支持类和内置函数，应明确报告而不是当作其他错误
+					_, _, _, err := compileProgram(tt.source, true)
+					if !errors.Is(err, compiler.ErrRegisterUnsupported) {
+						t.Errorf("CompileFunction() err = %v, want %v", err, compiler.ErrRegisterUnsupported)
+					}
+					return
+				}
+				var interpreterOutput bytes.Buffer
+				interpreter.Output = &interpreterOutput
+				node, err := parser.New(scanner.New(tt.source).Scan()).Parse()
+				if err != nil {
+					t.Fatalf("Parse() err = %v", err)
+				}
+				interpreterErr := interpreter.Interpreter(node)
+
+				var vmOutput bytes.Buffer
+				Output = &vmOutput
+				node, err = parser.New(scanner.New(tt.source).Scan()).Parse()
+				if err != nil {
+					t.Fatalf("Parse() err = %v", err)
+				}
+				compiler_ := compiler.New(node)
+				compiler_.Register = register
+				function, constants, err := compiler_.CompileFunction()
+				if err != nil {
+					t.Fatalf("CompileFunction() err = %v", err)
+				}
+				vmErr := NewFromFunction(function, constants, compiler_.NumGlobals()).Run()
+
+				if (interpreterErr == nil) != (vmErr == nil) {
+					t.Errorf("interpreter err = %v, vm err = %v", interpreterErr, vmErr)
+				}
+				if interpreterOutput.String() != vmOutput.String() {
+					t.Errorf("interpreter output = %q, vm output = %q", interpreterOutput.String(), vmOutput.String())
+				}
+			})
+		})
+	}
+}
+
+// peepholePrograms 是比较窥孔优化前后执行的指令数所用的程序
+var peepholePrograms = []struct {
+	name   string
+	source string
+}{
+	{
+		name: "fib",
+		source: `
+		fun fib(n) {
+			if (n < 2) {
+				return n;
+			}
+			return fib(n - 1) + fib(n - 2);
+		}
+		print fib(15);
+		`,
+	},
+	{
+		name: "loop",
+		source: `
+		var i = 0;
+		var sum = 0;
+		while (i < 1000) {
+			sum = sum + i;
+			i = i + 1;
+			if (!(i < 500)) {
+				sum = sum - 1;
+			}
+		}
+		print sum;
+		`,
+	},
+	{
+		name: "locals",
+		source: `
+		fun f() {
+			var total = 0;
+			var i = 0;
+			while (i < 100) {
+				var c = i * 2;
+				total = c + total;
+				i = i + 1;
+			}
+			return total;
+		}
+		print f() == f();
+		`,
+	},
+}
+
+// runPeephole 编译并运行 source，返回输出和执行的指令数。strict 为 true 时以严格模式编译和运行
+func runPeephole(source string, peephole bool, strict bool) (string, uint64, error) {
+	var buf bytes.Buffer
+	Output = &buf
+	node, err := parser.New(scanner.New(source).Scan()).Parse()
+	if err != nil {
+		return "", 0, err
+	}
+	compiler_ := compiler.New(node)
+	compiler_.Peephole = peephole
+	compiler_.Strict = strict
+	function, constants, err := compiler_.CompileFunction()
+	if err != nil {
+		return "", 0, err
+	}
+	vm := NewFromFunction(function, constants, compiler_.NumGlobals())
+	vm.Strict = strict
+	err = vm.Run()
+	return buf.String(), vm.Steps, err
+}
+
+func TestVM_Peephole(t *testing.T) {
+	for _, tt := range peepholePrograms {
+		t.Run(tt.name, func(t *testing.T) {
+			output, steps, err := runPeephole(tt.source, false, false)
+			if err != nil {
+				t.Fatalf("Run() err = %v", err)
+			}
+			optimizedOutput, optimizedSteps, err := runPeephole(tt.source, true, false)
+			if err != nil {
+				t.Fatalf("Run() optimized err = %v", err)
+			}
+			if optimizedOutput != output {
+				t.Errorf("optimized output = %q, want %q", optimizedOutput, output)
+			}
+			if optimizedSteps >= steps {
+				t.Errorf("optimized steps = %d, want fewer than %d", optimizedSteps, steps)
+			}
+		})
+	}
+}
+
+func TestVM_PeepholeStrict(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+	}{
+		{name: "not int", source: `if (!1) { print 1; }`},
+		{name: "not nil", source: `var a; while (!a) { print 1; }`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// OP_NOT 和 OP_JUMP_FALSE 合并为 OP_JUMP_TRUE 后严格模式下的错误不变
+			for _, peephole := range []bool{false, true} {
+				_, _, err := runPeephole(tt.source, peephole, true)
+				if !errors.Is(err, ErrInvalidOperandType) {
+					t.Errorf("Run() peephole = %v, err = %v, want %v", peephole, err, ErrInvalidOperandType)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkVM_Peephole(b *testing.B) {
+	for _, program := range peepholePrograms {
+		for _, peephole := range []bool{false, true} {
+			name := program.name + "/off"
+			if peephole {
+				name = program.name + "/on"
+			}
+			b.Run(name, func(b *testing.B) {
+				var steps uint64
+				for i := 0; i < b.N; i++ {
+					_, n, err := runPeephole(program.source, peephole, false)
+					if err != nil {
+						b.Fatalf("Run() err = %v", err)
+					}
+					steps = n
+				}
+				b.ReportMetric(float64(steps), "instructions/op")
+			})
+		}
+	}
+}
+
+// benchmarkPrograms 是衡量虚拟机执行速度所用的程序
+var benchmarkPrograms = []struct {
+	name   string
+	source string
+	stack  bool // 只在栈式指令上运行
+}{
+	{
+		name: "fib",
+		source: `
+		fun fib(n) {
+			if (n < 2) {
+				return n;
+			}
+			return fib(n - 1) + fib(n - 2);
+		}
+		print fib(20);
+		`,
+	},
+	{
+		name: "loop",
+		source: `
+		var i = 0;
+		var sum = 0.0;
+		while (i < 100000) {
+			sum = sum + i * 0.5;
+			i = i + 1;
+		}
+		print sum;
+		`,
+	},
+	{
+		name: "closure",
+		source: `
+		fun counter() {
+			var n = 0;
+			fun inc() {
+				n = n + 1;
+				return n;
+			}
+			return inc;
+		}
+		var inc = counter();
+		var i = 0;
+		while (i < 10000) {
+			inc();
+			i = i + 1;
+		}
+		print inc();
+		`,
+	},
+	{
+		name:  "oop",
+		stack: true,
+		source: `
+		class Vector {
+			add(other) {
+				var v = Vector();
+				v.x = this.x + other.x;
+				v.y = this.y + other.y;
+				return v;
+			}
+			dot(other) {
+				return this.x * other.x + this.y * other.y;
+			}
+		}
+		var a = Vector();
+		a.x = 1;
+		a.y = 2;
+		var b = Vector();
+		b.x = 3;
+		b.y = 4;
+		var i = 0;
+		var sum = 0;
+		while (i < 10000) {
+			sum = sum + a.add(b).dot(b);
+			i = i + 1;
+		}
+		print sum;
+		`,
+	},
+	{
+		name: "string",
+		source: `
+		var s = "";
+		var i = 0;
+		while (i < 1000) {
+			s = s + "x";
+			i = i + 1;
+		}
+		print s == s;
+		`,
+	},
+}
+
+// BenchmarkVM 衡量虚拟机的执行速度，ops/s 是每秒执行的指令数。
+// 每个程序分别在栈式和寄存器指令上运行，两者的 ns/op 可以直接比较，ops/s 因指令粒度不同不能比较。
+// 比较改动前后的结果可以发现性能回退：
+//
+//	go test ./vm -run '^$' -bench '^BenchmarkVM$' -count 10 > new.txt
+//	benchstat old.txt new.txt
+func BenchmarkVM(b *testing.B) {
+	for _, program := range benchmarkPrograms {
+		for _, backend := range backends {
+			if program.stack && backend.register {
+				continue
+			}
+			b.Run(program.name+"/"+backend.name, func(b *testing.B) {
+				function, constants, numGlobals, err := compileProgram(program.source, backend.register)
+				if err != nil {
+					b.Fatalf("compile err = %v", err)
+				}
+				Output = io.Discard
+				b.ReportAllocs()
+				b.ResetTimer()
+				var steps uint64
+				for i := 0; i < b.N; i++ {
+					vm := NewFromFunction(function, constants, numGlobals)
+					err = vm.Run()
+					if err != nil {
+						b.Fatalf("Run() err = %v", err)
+					}
+					steps += vm.Steps
+				}
+				b.ReportMetric(float64(steps)/b.Elapsed().Seconds(), "ops/s")
+			})
+		}
+	}
+}